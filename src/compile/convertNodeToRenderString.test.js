@@ -7,8 +7,8 @@ import { stopTemplateParserServer } from "./templateParserServer.js";
 import { resolveRelativePath } from "../utils/resolveRelativePath.js";
 
 describe("convertNodeToRenderString", () => {
-  after(() => {
-    stopTemplateParserServer();
+  after(async () => {
+    await stopTemplateParserServer();
   });
 
   test("handles a simple component template as expected", async () => {
@@ -6,8 +6,8 @@ import { parseTemplate } from "./parseTemplate.js";
 import { stopTemplateParserServer } from "./templateParserServer.js";
 
 describe("parseTemplate", () => {
-  after(() => {
-    stopTemplateParserServer();
+  after(async () => {
+    await stopTemplateParserServer();
   });
 
   test("should parse a simple component file as expected", async () => {
@@ -28,10 +28,21 @@ import { startTemplateParserServer } from "./templateParserServer.js";
  * @typedef {TmphElementNode| TmphTextNode} TmphNode
  */
 
+/**
+ * @typedef TmphDiagnostic
+ * @property {number} l - Line number
+ * @property {number} c - Column number
+ * @property {string} code
+ * @property {"info" | "warning" | "error"} severity
+ * @property {string} message
+ * @property {string} [path]
+ */
+
 /**
  * @typedef TemplateDataAST
  * @property {string} src - Path to the parsed template file
  * @property {TmphNode[]} nodes - The root nodes of the template
+ * @property {TmphDiagnostic[]} diagnostics - Problems the parser found in the template
  */
 
 /**
@@ -53,15 +64,44 @@ export async function parseTemplate(filePath) {
   return fetch(requestURL).then(async (res) => {
     if (!res.ok) {
       return res.text().then((responseText) => {
+        let errorMessage = responseText;
+        try {
+          errorMessage = JSON.parse(responseText).error.message;
+        } catch {
+          // The response wasn't a JSON error body, so use the raw text
+        }
         throw new Error(
-          `Failed to parse template "${filePath}": ${responseText}`
+          `Failed to parse template "${filePath}" (${res.status}): ${errorMessage}`
         );
       });
     }
 
-    return res.json().then((nodes) => ({
-      src: filePath,
-      nodes,
-    }));
+    return res.json().then((entries) => {
+      // If parsing failed partway through the response, the last entry is the error
+      const lastEntry = entries[entries.length - 1];
+      if (lastEntry && lastEntry.error) {
+        throw new Error(
+          `Failed to parse template "${filePath}" (${lastEntry.error.status}): ${lastEntry.error.message}`
+        );
+      }
+
+      /** @type {TemplateDataAST} */
+      const templateData = {
+        src: filePath,
+        nodes: [],
+        diagnostics: [],
+      };
+
+      // Diagnostic records are mixed in with the root nodes in the order they were found
+      for (const entry of entries) {
+        if (entry.diagnostic) {
+          templateData.diagnostics.push(entry.diagnostic);
+        } else {
+          templateData.nodes.push(entry);
+        }
+      }
+
+      return templateData;
+    });
   });
 }
@@ -18,8 +18,8 @@ describe("parseTemplate", () => {
     await startTemplateParserServer();
   });
 
-  after(() => {
-    stopTemplateParserServer();
+  after(async () => {
+    await stopTemplateParserServer();
   });
 
   test("should parse a simple component file as expected", async () => {
@@ -1,4 +1,6 @@
 import { spawn } from "node:child_process";
+import { existsSync } from "node:fs";
+import path from "node:path";
 import { resolveRelativePath } from "../../utils/resolveRelativePath.js";
 
 const parserBinaryPath = resolveRelativePath(
@@ -14,20 +16,113 @@ let parserProcessServerOrigin = null;
 /** @type {Promise<void> | null} */
 let startingParserPromise = null;
 
-export async function startTemplateParserServer() {
+/**
+ * The version of the protocol between this client and the parser binary.
+ * Binaries which speak a different version are refused rather than having
+ * their output misparsed.
+ */
+const EXPECTED_PROTOCOL_VERSION = 2;
+
+/**
+ * @typedef {Object} TemplateParserHandshake
+ * @property {number} protocolVersion
+ * @property {string} parserVersion
+ * @property {"tcp" | "unix" | "stdio"} transport
+ * @property {string} address
+ * @property {string[]} formats
+ * @property {string[]} features
+ */
+
+/**
+ * Parses and validates the handshake line the parser writes to stdout once
+ * it's ready
+ *
+ * @param {string} handshakeLine
+ * @returns {TemplateParserHandshake}
+ */
+function parseTemplateParserHandshake(handshakeLine) {
+  /** @type {TemplateParserHandshake} */
+  let handshake;
+  try {
+    handshake = JSON.parse(handshakeLine);
+  } catch (err) {
+    throw new Error(
+      `Template parser binary at ${parserBinaryPath} wrote an invalid handshake: ${handshakeLine}`,
+      { cause: err }
+    );
+  }
+
+  if (handshake?.protocolVersion !== EXPECTED_PROTOCOL_VERSION) {
+    throw new Error(
+      `Template parser binary at ${parserBinaryPath} speaks protocol version ${handshake?.protocolVersion}, but version ${EXPECTED_PROTOCOL_VERSION} is required; rebuild the parser binary`
+    );
+  }
+  if (handshake.transport !== "tcp" || !handshake.address) {
+    throw new Error(
+      `Template parser binary at ${parserBinaryPath} isn't serving over HTTP`
+    );
+  }
+
+  return handshake;
+}
+
+/**
+ * Finds the root of the project which is being compiled: the closest directory
+ * to the working directory which has a package.json, or the working directory
+ * itself if there isn't one
+ */
+function findProjectRoot() {
+  let directory = process.cwd();
+  while (!existsSync(path.join(directory, "package.json"))) {
+    const parentDirectory = path.dirname(directory);
+    if (parentDirectory === directory) {
+      return process.cwd();
+    }
+    directory = parentDirectory;
+  }
+  return directory;
+}
+
+/**
+ * @param {Object} [options]
+ * @param {string[]} [options.templateRoots] Directories which the parser is
+ *    allowed to read templates from; defaults to the project root
+ */
+export async function startTemplateParserServer({
+  templateRoots = [findProjectRoot()],
+} = {}) {
   if (!parserProcess) {
     if (startingParserPromise) {
       await startingParserPromise;
     } else {
       startingParserPromise = new Promise((resolve, reject) => {
-        parserProcess = spawn(parserBinaryPath);
+        parserProcess = spawn(parserBinaryPath, [
+          // Make sure the parser exits if this process dies without stopping it
+          "-exit-on-stdin-close",
+          // The parser only reads templates inside of these directories
+          ...templateRoots.flatMap((templateRoot) => ["-root", templateRoot]),
+        ]);
         parserProcess?.addListener("error", (err) => reject(err));
+        /** @type {string} */
+        let handshakeLine = "";
         parserProcess?.stdout.on(
           "data",
           /** @param {ArrayBuffer} message */
           async (message) => {
-            parserProcessServerOrigin = message.toString();
+            // The parser writes a single JSON line describing itself once it's ready
+            handshakeLine += message.toString();
+            const newlineIndex = handshakeLine.indexOf("\n");
+            if (newlineIndex === -1) {
+              return;
+            }
+            parserProcess?.stdout.removeAllListeners("data");
+
             try {
+              const handshake = parseTemplateParserHandshake(
+                handshakeLine.slice(0, newlineIndex)
+              );
+              parserProcessServerOrigin = handshake.address;
+
               const healthResponse = await fetch(
                 new URL("/health", parserProcessServerOrigin)
               );
@@ -36,7 +131,6 @@ export async function startTemplateParserServer() {
                 throw new Error("Template parser server failed health check");
               }
             } catch (err) {
-              parserProcessServerOrigin = null;
               reject(
                 new Error(
                   `Template parser server failed to start at ${parserProcessServerOrigin}`,
@@ -45,6 +139,8 @@ export async function startTemplateParserServer() {
                   }
                 )
               );
+              parserProcessServerOrigin = null;
+              return;
             }
 
             resolve(undefined);
@@ -60,6 +156,7 @@ export async function startTemplateParserServer() {
         await startingParserPromise;
       } catch (e) {
         console.error("Template parser server failed to start", e);
+        parserProcess?.kill();
         parserProcess = null;
         parserProcessServerOrigin = null;
       }
@@ -75,10 +172,49 @@ export function getTemplateParserServerOrigin() {
   return parserProcessServerOrigin;
 }
 
-export function stopTemplateParserServer() {
-  if (parserProcess) {
-    parserProcess.kill();
-    parserProcess = null;
-    parserProcessServerOrigin = null;
+/**
+ * How long to wait for the parser to finish in-flight requests and exit
+ * before killing it
+ */
+const PARSER_SHUTDOWN_TIMEOUT_MS = 5000;
+
+export async function stopTemplateParserServer() {
+  const stoppingParserProcess = parserProcess;
+  const stoppingParserProcessServerOrigin = parserProcessServerOrigin;
+  parserProcess = null;
+  parserProcessServerOrigin = null;
+
+  if (!stoppingParserProcess || stoppingParserProcess.exitCode !== null) {
+    return;
+  }
+
+  const exitPromise = new Promise((resolve) =>
+    stoppingParserProcess.once("exit", resolve)
+  );
+
+  try {
+    if (!stoppingParserProcessServerOrigin) {
+      throw new Error("Template parser server never started");
+    }
+    // Ask the parser to shut down gracefully so in-flight parses can finish
+    await fetch(new URL("/shutdown", stoppingParserProcessServerOrigin), {
+      method: "POST",
+    });
+  } catch (e) {
+    stoppingParserProcess.kill();
+    return;
   }
+
+  /** @type {ReturnType<typeof setTimeout> | undefined} */
+  let killTimeout;
+  await Promise.race([
+    exitPromise,
+    new Promise((resolve) => {
+      killTimeout = setTimeout(() => {
+        stoppingParserProcess.kill();
+        resolve(undefined);
+      }, PARSER_SHUTDOWN_TIMEOUT_MS);
+    }),
+  ]);
+  clearTimeout(killTimeout);
 }
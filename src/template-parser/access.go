@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The extensions templates are allowed to have unless the server is started with other ones
+var DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS = []string{".tmph.html"}
+
+// The rules for which files the server is allowed to read; nil if any file can be read.
+// The check methods can be called on a nil policy and allow everything.
+var templatePathPolicy *pathPolicy
+
+// Restricts reads to templates inside a set of root directories so that anything which can reach the server can't
+// use it to read arbitrary files
+type pathPolicy struct {
+	// Absolute paths of the allowed root directories with any symlinks resolved
+	roots []string
+	// The extensions files must have to be read; any extension is allowed if this is empty
+	extensions []string
+}
+
+// An error for a path which the server isn't allowed to read
+type PathNotAllowedError struct {
+	Path   string
+	Reason string
+}
+
+func (err *PathNotAllowedError) Error() string {
+	return "access to '" + err.Path + "' is not allowed: " + err.Reason
+}
+
+func newPathPolicy(roots []string, extensions []string) (*pathPolicy, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("at least one allowed root directory is required")
+	}
+
+	policy := &pathPolicy{extensions: extensions}
+
+	for _, root := range roots {
+		absoluteRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+
+		// Resolve symlinks up front so resolved template paths can be compared against the roots directly
+		resolvedRoot, err := filepath.EvalSymlinks(absoluteRoot)
+		if err != nil {
+			return nil, err
+		}
+
+		if fileInfo, err := os.Stat(resolvedRoot); err != nil {
+			return nil, err
+		} else if !fileInfo.IsDir() {
+			return nil, errors.New("allowed root '" + root + "' is not a directory")
+		}
+
+		policy.roots = append(policy.roots, resolvedRoot)
+	}
+
+	return policy, nil
+}
+
+// Gets whether a path is inside any of the allowed roots
+func (policy *pathPolicy) isInsideRoots(absolutePath string) bool {
+	for _, root := range policy.roots {
+		relativePath, err := filepath.Rel(root, absolutePath)
+		if err != nil {
+			continue
+		}
+		if relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *pathPolicy) hasAllowedExtension(filePath string) bool {
+	if len(policy.extensions) == 0 {
+		return true
+	}
+
+	fileName := filepath.Base(filePath)
+	for _, extension := range policy.extensions {
+		if strings.HasSuffix(fileName, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that a path is inside one of the allowed roots once all symlinks have been resolved.
+// Returns a *PathNotAllowedError if it isn't, or the error from resolving it if it can't be resolved, ie because it
+// doesn't exist.
+func (policy *pathPolicy) checkPath(path string) (resolvedPath string, err error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Paths which are outside the roots before resolving symlinks are rejected before touching the filesystem so the
+	// error doesn't reveal whether they exist
+	if !policy.isInsideRoots(absolutePath) {
+		return "", &PathNotAllowedError{Path: path, Reason: "it is outside of the allowed root directories"}
+	}
+
+	resolvedPath, err = filepath.EvalSymlinks(absolutePath)
+	if err != nil {
+		return "", err
+	}
+
+	if !policy.isInsideRoots(resolvedPath) {
+		return "", &PathNotAllowedError{Path: path, Reason: "it resolves to a path outside of the allowed root directories"}
+	}
+
+	return resolvedPath, nil
+}
+
+// Checks that a template file can be read. Both the path and the file it resolves to must have an allowed extension
+// so a symlink can't be used to read another kind of file.
+// Returns the path with its symlinks resolved, which is what should be opened; opening the original path would follow
+// its symlinks again, so a link swapped after the check could point anywhere.
+func (policy *pathPolicy) CheckFile(templateFilePath string) (resolvedFilePath string, err error) {
+	if policy == nil {
+		return templateFilePath, nil
+	}
+
+	if !policy.hasAllowedExtension(templateFilePath) {
+		return "", &PathNotAllowedError{Path: templateFilePath, Reason: "it doesn't have an allowed template extension"}
+	}
+
+	resolvedFilePath, err = policy.checkPath(templateFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	if !policy.hasAllowedExtension(resolvedFilePath) {
+		return "", &PathNotAllowedError{Path: templateFilePath, Reason: "it resolves to a file without an allowed template extension"}
+	}
+
+	return resolvedFilePath, nil
+}
+
+// Checks that a directory can be searched for templates
+func (policy *pathPolicy) CheckDir(dir string) error {
+	if policy == nil {
+		return nil
+	}
+
+	_, err := policy.checkPath(dir)
+	return err
+}
+
+// Gets whether an error is a *PathNotAllowedError
+func isPathNotAllowed(err error) bool {
+	var pathNotAllowedErr *PathNotAllowedError
+	return errors.As(err, &pathNotAllowedErr)
+}
+
+// Checks that every path a batch names explicitly is allowed. Templates found by searching the batch's directory
+// are checked as they're found instead, since those can't be known up front.
+// Only returns *PathNotAllowedErrors; other errors, ie for missing templates, are left to be reported when the batch
+// is parsed.
+func (policy *pathPolicy) CheckBatch(batch *ParseBatch) error {
+	if policy == nil {
+		return nil
+	}
+
+	if batch.Dir != "" {
+		if err := policy.CheckDir(batch.Dir); isPathNotAllowed(err) {
+			return err
+		}
+	}
+
+	for _, templateFilePath := range batch.Paths {
+		if _, err := policy.CheckFile(templateFilePath); isPathNotAllowed(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sets up an allowed root directory containing a template, next to a directory of secrets which should never be readable
+func setUpPathPolicyTest(t *testing.T) (root string, secretsDir string) {
+	t.Helper()
+
+	baseDir := t.TempDir()
+	root = filepath.Join(baseDir, "templates")
+	secretsDir = filepath.Join(baseDir, "secrets")
+
+	for _, dir := range []string{root, filepath.Join(root, "components"), secretsDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for filePath, content := range map[string]string{
+		filepath.Join(root, "index.tmph.html"):              "<p>Hello</p>",
+		filepath.Join(root, "components", "List.tmph.html"): "<ul></ul>",
+		filepath.Join(root, "config.json"):                  "{}",
+		filepath.Join(secretsDir, "secret.tmph.html"):       "<p>secret</p>",
+		filepath.Join(secretsDir, "passwords.txt"):          "hunter2",
+	} {
+		if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, target := range map[string]string{
+		// Links with template extensions which point outside of the root
+		filepath.Join(root, "linked-secret.tmph.html"):    filepath.Join(secretsDir, "secret.tmph.html"),
+		filepath.Join(root, "linked-passwords.tmph.html"): filepath.Join(secretsDir, "passwords.txt"),
+		filepath.Join(root, "linked-secrets"):             secretsDir,
+		// A link inside the root which points to a file without a template extension
+		filepath.Join(root, "linked-config.tmph.html"): filepath.Join(root, "config.json"),
+		// A link inside the root which points to another template inside the root
+		filepath.Join(root, "linked-list.tmph.html"): filepath.Join(root, "components", "List.tmph.html"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skip("symlinks aren't supported:", err)
+		}
+	}
+
+	return root, secretsDir
+}
+
+func TestPathPolicyCheckFile(t *testing.T) {
+	root, secretsDir := setUpPathPolicyTest(t)
+
+	policy, err := newPathPolicy([]string{root}, DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowedPaths := []string{
+		filepath.Join(root, "index.tmph.html"),
+		filepath.Join(root, "components", "List.tmph.html"),
+		filepath.Join(root, "components", "..", "index.tmph.html"),
+		filepath.Join(root, "linked-list.tmph.html"),
+	}
+	for _, allowedPath := range allowedPaths {
+		if _, err := policy.CheckFile(allowedPath); err != nil {
+			t.Errorf("expected '%s' to be allowed, got error: %v", allowedPath, err)
+		}
+	}
+
+	notAllowedPaths := []string{
+		// Traversal out of the root
+		filepath.Join(root, "..", "secrets", "secret.tmph.html"),
+		filepath.Join(root, "components", "..", "..", "secrets", "secret.tmph.html"),
+		root + "/../secrets/secret.tmph.html",
+		// Absolute paths outside of the root
+		filepath.Join(secretsDir, "secret.tmph.html"),
+		"/etc/passwd",
+		// Symlinks which resolve outside of the root
+		filepath.Join(root, "linked-secret.tmph.html"),
+		filepath.Join(root, "linked-passwords.tmph.html"),
+		filepath.Join(root, "linked-secrets", "secret.tmph.html"),
+		// Files without a template extension, directly or through a symlink
+		filepath.Join(root, "config.json"),
+		filepath.Join(root, "linked-config.tmph.html"),
+		// A sibling directory whose name starts with the root's name
+		root + "-other/index.tmph.html",
+	}
+	for _, notAllowedPath := range notAllowedPaths {
+		if _, err := policy.CheckFile(notAllowedPath); !isPathNotAllowed(err) {
+			t.Errorf("expected '%s' not to be allowed, got error: %v", notAllowedPath, err)
+		}
+	}
+
+	// Missing files inside the root aren't forbidden; they fail later with a not found error
+	missingPath := filepath.Join(root, "missing.tmph.html")
+	if _, err := policy.CheckFile(missingPath); err == nil || isPathNotAllowed(err) || !os.IsNotExist(err) {
+		t.Errorf("expected '%s' to be reported as not existing, got error: %v", missingPath, err)
+	}
+}
+
+func TestPathPolicyRelativePaths(t *testing.T) {
+	root, _ := setUpPathPolicyTest(t)
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(root, "components")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(workingDir) })
+
+	policy, err := newPathPolicy([]string{"."}, DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := policy.CheckFile("List.tmph.html"); err != nil {
+		t.Errorf("expected a relative path inside the root to be allowed, got error: %v", err)
+	}
+	for _, notAllowedPath := range []string{"../index.tmph.html", "../../secrets/secret.tmph.html"} {
+		if _, err := policy.CheckFile(notAllowedPath); !isPathNotAllowed(err) {
+			t.Errorf("expected '%s' not to be allowed, got error: %v", notAllowedPath, err)
+		}
+	}
+}
+
+func TestPathPolicyAnyExtension(t *testing.T) {
+	root, _ := setUpPathPolicyTest(t)
+
+	policy, err := newPathPolicy([]string{root}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := policy.CheckFile(filepath.Join(root, "config.json")); err != nil {
+		t.Errorf("expected any extension to be allowed, got error: %v", err)
+	}
+	if _, err := policy.CheckFile(filepath.Join(root, "linked-passwords.tmph.html")); !isPathNotAllowed(err) {
+		t.Errorf("expected a symlink outside of the root not to be allowed, got error: %v", err)
+	}
+}
+
+func TestPathPolicyBatch(t *testing.T) {
+	root, secretsDir := setUpPathPolicyTest(t)
+
+	policy, err := newPathPolicy([]string{root}, DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, batch := range []*ParseBatch{
+		{Dir: secretsDir},
+		{Dir: filepath.Join(root, "..")},
+		{Dir: filepath.Join(root, "linked-secrets")},
+		{Paths: []string{filepath.Join(root, "index.tmph.html"), filepath.Join(root, "..", "secrets", "secret.tmph.html")}},
+	} {
+		if err := policy.CheckBatch(batch); !isPathNotAllowed(err) {
+			t.Errorf("expected batch %+v not to be allowed, got error: %v", batch, err)
+		}
+	}
+
+	// Templates found by searching the root skip symlinks which lead outside of it
+	previousPolicy := templatePathPolicy
+	templatePathPolicy = policy
+	t.Cleanup(func() { templatePathPolicy = previousPolicy })
+
+	batch := &ParseBatch{Dir: root}
+	if err := policy.CheckBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	templateFilePaths, err := batch.ResolvePaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPaths := map[string]bool{
+		filepath.Join(root, "components", "List.tmph.html"): true,
+		filepath.Join(root, "index.tmph.html"):              true,
+		filepath.Join(root, "linked-list.tmph.html"):        true,
+	}
+	if len(templateFilePaths) != len(expectedPaths) {
+		t.Fatalf("expected %d templates, got %v", len(expectedPaths), templateFilePaths)
+	}
+	for _, templateFilePath := range templateFilePaths {
+		if !expectedPaths[templateFilePath] {
+			t.Errorf("unexpected template '%s'", templateFilePath)
+		}
+	}
+}
+
+func TestParseEndpointForbidsPathTraversal(t *testing.T) {
+	root, secretsDir := setUpPathPolicyTest(t)
+
+	policy, err := newPathPolicy([]string{root}, DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousPolicy, previousCache := templatePathPolicy, templateParseCache
+	templatePathPolicy, templateParseCache = policy, nil
+	t.Cleanup(func() { templatePathPolicy, templateParseCache = previousPolicy, previousCache })
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, newParserServer(mux, time.Second, 0))
+
+	var request = func(endpoint string, query url.Values) *httptest.ResponseRecorder {
+		responseRecorder := httptest.NewRecorder()
+		mux.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil))
+		return responseRecorder
+	}
+
+	if response := request("/parse", url.Values{"path": {filepath.Join(root, "index.tmph.html")}}); response.Code != http.StatusOK {
+		t.Fatalf("expected a template inside the root to be parsed, got status %d: %s", response.Code, response.Body.String())
+	}
+
+	for _, forbiddenRequest := range []struct {
+		endpoint string
+		query    url.Values
+	}{
+		{"/parse", url.Values{"path": {filepath.Join(root, "..", "secrets", "secret.tmph.html")}}},
+		{"/parse", url.Values{"path": {filepath.Join(root, "linked-passwords.tmph.html")}}},
+		{"/parse", url.Values{"path": {"/etc/passwd"}}},
+		{"/parse", url.Values{"path": {filepath.Join(root, "linked-secret.tmph.html")}, "diff": {"true"}}},
+		{"/parse-batch", url.Values{"dir": {secretsDir}}},
+		{"/parse-batch", url.Values{"path": {filepath.Join(root, "index.tmph.html"), filepath.Join(secretsDir, "secret.tmph.html")}}},
+		{"/watch", url.Values{"dir": {filepath.Join(root, "..")}}},
+	} {
+		response := request(forbiddenRequest.endpoint, forbiddenRequest.query)
+		if response.Code != http.StatusForbidden {
+			t.Errorf("expected %s?%s to be forbidden, got status %d: %s", forbiddenRequest.endpoint, forbiddenRequest.query.Encode(), response.Code, response.Body.String())
+			continue
+		}
+
+		var errorResponse ErrorResponse
+		if err := json.Unmarshal(response.Body.Bytes(), &errorResponse); err != nil {
+			t.Errorf("expected a JSON error body, got '%s': %v", response.Body.String(), err)
+		} else if errorResponse.Error.Status != http.StatusForbidden || errorResponse.Error.Message == "" {
+			t.Errorf("unexpected error body: %s", response.Body.String())
+		}
+	}
+}
+
+func TestSwappedSymlinkIsNotRead(t *testing.T) {
+	root, secretsDir := setUpPathPolicyTest(t)
+
+	policy, err := newPathPolicy([]string{root}, DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cache := range []*parseCache{nil, newParseCache(DEFAULT_PARSE_CACHE_MEMORY_LIMIT)} {
+		linkPath := filepath.Join(root, "swapped.tmph.html")
+		os.Remove(linkPath)
+		if err := os.Symlink(filepath.Join(root, "components", "List.tmph.html"), linkPath); err != nil {
+			t.Fatal(err)
+		}
+
+		resolvedFilePath, err := policy.CheckFile(linkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Point the link outside of the root after it has been checked
+		if err := os.Remove(linkPath); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(secretsDir, "secret.tmph.html"), linkPath); err != nil {
+			t.Fatal(err)
+		}
+
+		previousCache := templateParseCache
+		templateParseCache = cache
+		responseBuffer := &bufferedResponseWriter{}
+		var responseWriter http.ResponseWriter = responseBuffer
+		err = parseTemplateFileCached(context.Background(), linkPath, resolvedFilePath, ParseOptions{OutputFormat: OF_TREE, Limits: DEFAULT_PARSE_LIMITS}, "", &responseWriter)
+		templateParseCache = previousCache
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body := responseBuffer.body.String(); strings.Contains(body, "secret") || !strings.Contains(body, `"ul"`) {
+			t.Errorf("expected the checked template to be parsed rather than the link's new target (cache %v), got: %s", cache != nil, body)
+		}
+	}
+
+	// Watching with diffs parses changed templates after the scan which found them, so a link swapped in between has
+	// to be caught when it's parsed
+	previousPolicy := templatePathPolicy
+	templatePathPolicy = policy
+	t.Cleanup(func() { templatePathPolicy = previousPolicy })
+
+	linkPath := filepath.Join(root, "swapped.tmph.html")
+	os.Remove(linkPath)
+	if err := os.Symlink(filepath.Join(root, "components", "List.tmph.html"), linkPath); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var swappedEvent *WatchEvent
+	err = watchTemplates(ctx, &ParseBatch{Dir: root}, ParseOptions{OutputFormat: OF_TREE, Limits: DEFAULT_PARSE_LIMITS}, WatchOptions{PollInterval: 10 * time.Millisecond, Diff: true}, func(event *WatchEvent) error {
+		switch {
+		case event.Event == WE_READY:
+			// Change both templates so they're parsed in the same poll, in path order
+			for _, templateFilePath := range []string{filepath.Join(root, "index.tmph.html"), filepath.Join(root, "components", "List.tmph.html")} {
+				if err := os.WriteFile(templateFilePath, []byte("<ul><li>changed</li></ul>"), 0o644); err != nil {
+					return err
+				}
+			}
+		case event.Event == WE_CHANGE && event.Path == filepath.Join(root, "index.tmph.html"):
+			// The swapped link has already been found by this poll's scan, but hasn't been parsed yet
+			if err := os.Remove(linkPath); err != nil {
+				return err
+			}
+			return os.Symlink(filepath.Join(secretsDir, "secret.tmph.html"), linkPath)
+		case event.Path == linkPath:
+			swappedEvent = event
+			cancel()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if swappedEvent == nil {
+		t.Fatal("expected an event for the swapped link")
+	}
+	if eventJSON, _ := json.Marshal(swappedEvent); strings.Contains(string(eventJSON), "secret") || swappedEvent.Error == "" {
+		t.Errorf("expected the swapped link not to be read, got: %s", eventJSON)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+type BatchResultFormat int
+
+const (
+	BRF_NDJSON BatchResultFormat = iota // one JSON result per line, written as soon as each template has been parsed
+	BRF_JSON                            // a single JSON object mapping each template's path to its result, with an "error" member if the batch failed partway through
+)
+
+// The templates which should be parsed as part of a batch
+type ParseBatch struct {
+	// Paths of individual templates to parse
+	Paths []string
+	// A directory to search for templates to parse
+	Dir string
+	// Glob patterns for the templates to parse in Dir, relative to Dir; defaults to DEFAULT_BATCH_INCLUDE_GLOB
+	Include []string
+	// Glob patterns for files and directories in Dir which should be skipped, relative to Dir
+	Exclude []string
+	// The maximum number of templates to parse at the same time; defaults to the number of CPUs
+	Concurrency  int
+	ResultFormat BatchResultFormat
+}
+
+const DEFAULT_BATCH_INCLUDE_GLOB = "**/*.tmph.html"
+
+// The result of parsing a single template in a batch
+type BatchResult struct {
+	Path string `json:"path"`
+	// The template's parsed root nodes and diagnostic records; this is the same JSON array which /parse returns
+	Nodes json.RawMessage `json:"nodes,omitempty"`
+	// Set if the template couldn't be parsed
+	Error string `json:"error,omitempty"`
+}
+
+// Gets the paths of all templates in the batch
+func (batch *ParseBatch) ResolvePaths() ([]string, error) {
+	templateFilePaths := append([]string{}, batch.Paths...)
+
+	if batch.Dir == "" {
+		return templateFilePaths, nil
+	}
+
+	include := batch.Include
+	if len(include) == 0 {
+		include = []string{DEFAULT_BATCH_INCLUDE_GLOB}
+	}
+
+	var matchesAny = func(patterns []string, relativePath string) bool {
+		for _, pattern := range patterns {
+			if matchGlob(pattern, relativePath) {
+				return true
+			}
+		}
+		return false
+	}
+
+	err := filepath.WalkDir(batch.Dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(batch.Dir, filePath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		if entry.IsDir() {
+			if relativePath != "." && matchesAny(batch.Exclude, relativePath) {
+				// Don't bother searching excluded directories
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if matchesAny(include, relativePath) && !matchesAny(batch.Exclude, relativePath) {
+			if _, err := templatePathPolicy.CheckFile(filePath); err != nil {
+				// Skip files the server isn't allowed to read, ie symlinks to files outside of the allowed roots
+				return nil
+			}
+			templateFilePaths = append(templateFilePaths, filePath)
+		}
+		return nil
+	})
+
+	return templateFilePaths, err
+}
+
+// An in-memory response writer for parsing templates outside of a request
+type bufferedResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {}
+
+// Everything is already in memory, so there's nothing to flush
+func (w *bufferedResponseWriter) Flush() {}
+
+// Parses a single template in a batch. Errors, including panics, are recorded on the result so they don't affect the
+// rest of the batch.
+func parseBatchTemplate(ctx context.Context, templateFilePath string, options ParseOptions) *BatchResult {
+	return parseBatchTemplateWith(templateFilePath, func(responseWriter *http.ResponseWriter) error {
+		// Checked again right before parsing so the file which is read is the one that was checked
+		resolvedFilePath, err := templatePathPolicy.CheckFile(templateFilePath)
+		if err != nil {
+			return err
+		}
+		return parseTemplateFileCached(ctx, templateFilePath, resolvedFilePath, options, "", responseWriter)
+	})
+}
+
+// Records the output of a function which parses a template in a batch result
+func parseBatchTemplateWith(templateFilePath string, parse func(responseWriter *http.ResponseWriter) error) (result *BatchResult) {
+	result = &BatchResult{Path: templateFilePath}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result.Nodes = nil
+			result.Error = fmt.Sprint("tempeh template parser panicked: ", recovered)
+		}
+	}()
+
+	responseBuffer := &bufferedResponseWriter{}
+	var responseWriter http.ResponseWriter = responseBuffer
+	if err := parse(&responseWriter); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Nodes = responseBuffer.body.Bytes()
+	return result
+}
+
+// Parses every template in a batch using a bounded pool of workers. onResult is called with each template's result as soon
+// as it has been parsed; it is never called concurrently. Returns an error if the batch's templates couldn't be found or
+// onResult returned an error, but not if individual templates failed to parse. If the context is done, the templates
+// which are still being parsed stop and the context's error is returned.
+func parseTemplateBatch(ctx context.Context, batch *ParseBatch, options ParseOptions, onResult func(result *BatchResult) error) error {
+	if options.OutputFormat != OF_TREE {
+		// Each result's nodes are embedded as a single JSON value, which the event stream isn't
+		return errors.New("batches can only be parsed with the tree output format")
+	}
+
+	templateFilePaths, err := batch.ResolvePaths()
+	if err != nil {
+		return err
+	}
+
+	concurrency := batch.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	concurrency = min(concurrency, len(templateFilePaths))
+
+	templateFilePathsToParse := make(chan string)
+	results := make(chan *BatchResult)
+	// Cancelled if we stop early so the workers stop parsing and don't get stuck trying to send results nobody is receiving
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for templateFilePath := range templateFilePathsToParse {
+				select {
+				case results <- parseBatchTemplate(ctx, templateFilePath, options):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(templateFilePathsToParse)
+		for _, templateFilePath := range templateFilePaths {
+			select {
+			case templateFilePathsToParse <- templateFilePath:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	for result := range results {
+		if err = ctx.Err(); err != nil {
+			// The result may only be an error from the parse being cancelled
+			return err
+		}
+		if err = onResult(result); err != nil {
+			return err
+		}
+	}
+
+	// The workers stop without sending any more results once the context is done, so the results can run out before
+	// the batch is finished
+	return ctx.Err()
+}
+
+// Parses a batch of templates and streams the results to the response in the batch's result format
+func writeTemplateBatch(ctx context.Context, batch *ParseBatch, options ParseOptions, responseWriter *http.ResponseWriter) error {
+	stream := &responseStream{
+		responseWriter:     *responseWriter,
+		responseController: http.NewResponseController(*responseWriter),
+	}
+
+	if batch.ResultFormat == BRF_NDJSON {
+		stream.SetContentType("application/x-ndjson")
+
+		err := parseTemplateBatch(ctx, batch, options, func(result *BatchResult) error {
+			if err := stream.BufferJSON(result); err != nil {
+				return err
+			}
+			stream.buf.WriteByte('\n')
+			return stream.Flush()
+		})
+		if err != nil && stream.hasFlushed {
+			// End the results with an error line so the client can tell that some are missing
+			stream.buf.Reset()
+			if stream.BufferJSON(&ErrorResponse{Error: newErrorResponseDetail(err)}) == nil {
+				stream.buf.WriteByte('\n')
+				stream.Flush()
+			}
+		}
+		return err
+	}
+
+	stream.SetContentType("application/json")
+	// The opening brace isn't flushed until the first result is written so an error response can still be sent if the
+	// batch's templates can't be found
+	stream.buf.WriteByte('{')
+
+	// Track whether we should add a comma before writing the next result to keep the JSON object valid
+	shouldAddComma := false
+
+	err := parseTemplateBatch(ctx, batch, options, func(result *BatchResult) error {
+		if shouldAddComma {
+			stream.buf.WriteByte(',')
+		} else {
+			shouldAddComma = true
+		}
+		if err := stream.BufferJSON(result.Path); err != nil {
+			return err
+		}
+		stream.buf.WriteByte(':')
+		if err := stream.BufferJSON(result); err != nil {
+			return err
+		}
+		return stream.Flush()
+	})
+	if err != nil {
+		if stream.hasFlushed {
+			// End the object with an error member so the client can tell that some results are missing. At least one
+			// result has been flushed, so the member needs a comma before it.
+			stream.buf.Reset()
+			stream.buf.WriteString(`,"error":`)
+			if stream.BufferJSON(newErrorResponseDetail(err)) == nil {
+				stream.buf.WriteByte('}')
+				stream.Flush()
+			}
+		}
+		return err
+	}
+
+	stream.buf.WriteByte('}')
+	return stream.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Cancels a request's context as soon as anything is written to the response, like a batch which is cancelled
+// partway through streaming its results
+type cancellingResponseWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w *cancellingResponseWriter) Write(b []byte) (int, error) {
+	defer w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestCancelledJSONBatchEndsWithError(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "template"+strconv.Itoa(i)+".tmph.html"), []byte("<p>Template "+strconv.Itoa(i)+"</p>"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	responseRecorder := httptest.NewRecorder()
+	var responseWriter http.ResponseWriter = &cancellingResponseWriter{ResponseRecorder: responseRecorder, cancel: cancel}
+
+	batch := &ParseBatch{Dir: dir, Concurrency: 1, ResultFormat: BRF_JSON}
+	err := writeTemplateBatch(ctx, batch, ParseOptions{OutputFormat: OF_TREE, Limits: DEFAULT_PARSE_LIMITS}, &responseWriter)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the batch to stop with a cancellation error, got: %v", err)
+	}
+
+	// The object has to stay valid JSON so the client can read the error
+	var results map[string]json.RawMessage
+	if err := json.Unmarshal(responseRecorder.Body.Bytes(), &results); err != nil {
+		t.Fatalf("expected a complete JSON object, got '%s': %v", responseRecorder.Body.String(), err)
+	}
+
+	var errorDetail ErrorResponseDetail
+	if err := json.Unmarshal(results["error"], &errorDetail); err != nil || errorDetail.Message == "" {
+		t.Fatalf("expected the object to end with an error member, got '%s'", responseRecorder.Body.String())
+	}
+	if resultCount := len(results) - 1; resultCount == 0 || resultCount == 10 {
+		t.Errorf("expected the batch to stop partway through, got %d results", resultCount)
+	}
+}
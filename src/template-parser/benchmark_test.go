@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The synthetic template is built by repeating the fixture and example templates until it is at least this large
+const SYNTHETIC_TEMPLATE_SIZE = 5 * 1024 * 1024
+
+type benchmarkTemplate struct {
+	name   string
+	source []byte
+}
+
+// Loads the test fixture and example templates, plus a large synthetic template made up of all of them
+func loadBenchmarkTemplates(b *testing.B) []benchmarkTemplate {
+	b.Helper()
+
+	var templateFilePaths []string
+	for _, pattern := range []string{
+		"../../test/fixtures/*.tmph.html",
+		"../../examples/*.tmph.html",
+		"../../examples/*/*.tmph.html",
+		"../../examples/*/*/*.tmph.html",
+		"../../examples/*/*/*/*.tmph.html",
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			b.Fatal(err)
+		}
+		templateFilePaths = append(templateFilePaths, matches...)
+	}
+
+	if len(templateFilePaths) == 0 {
+		b.Fatal("no templates found to benchmark")
+	}
+
+	templates := make([]benchmarkTemplate, 0, len(templateFilePaths)+1)
+	var syntheticTemplate bytes.Buffer
+
+	for _, templateFilePath := range templateFilePaths {
+		source, err := os.ReadFile(templateFilePath)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		name, _ := filepath.Rel("../..", templateFilePath)
+		templates = append(templates, benchmarkTemplate{name: filepath.ToSlash(name), source: source})
+	}
+
+	for syntheticTemplate.Len() < SYNTHETIC_TEMPLATE_SIZE {
+		for _, template := range templates {
+			syntheticTemplate.Write(template.source)
+		}
+	}
+
+	return append(templates, benchmarkTemplate{name: "synthetic-5MB", source: syntheticTemplate.Bytes()})
+}
+
+func BenchmarkLexer(b *testing.B) {
+	for _, template := range loadBenchmarkTemplates(b) {
+		b.Run(template.name, func(b *testing.B) {
+			b.SetBytes(int64(len(template.source)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				lexer := NewLexer(context.Background(), NewTemplateSource(bytes.NewReader(template.source)), LexerOptions{})
+				for {
+					token := lexer.NextToken()
+					if token.tokenType == LT_EOF {
+						break
+					} else if token.tokenType == LT_ERROR {
+						b.Fatal(lexer.TokenValue(&token))
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParser(b *testing.B) {
+	for _, template := range loadBenchmarkTemplates(b) {
+		b.Run(template.name, func(b *testing.B) {
+			b.SetBytes(int64(len(template.source)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				var responseWriter http.ResponseWriter = httptest.NewRecorder()
+				// Parsing errors like mismatched closing tags are expected in some templates; we only care about how long it takes
+				parseTemplate(context.Background(), bytes.NewReader(template.source), template.name, ParseOptions{}, &responseWriter)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default maximum size of all cached parse results combined
+const DEFAULT_PARSE_CACHE_MEMORY_LIMIT = 64 * 1024 * 1024
+
+// Rough per-entry overhead for the entry struct, list element and map slot so lots of tiny templates still count toward the limit
+const PARSE_CACHE_ENTRY_OVERHEAD = 256
+
+// The cache used by the parse endpoints; nil if caching is disabled
+var templateParseCache *parseCache
+
+// The maximum number of ETags of timed out responses which are remembered
+const MAX_TIMED_OUT_ETAG_COUNT = 1024
+
+// ETags of responses which were cut short by the parse timeout. How long a parse takes depends on how busy the server
+// is, so clients with one of these responses are never told that they're up to date, and get a fresh parse instead.
+var timedOutParseETags = newETagSet(MAX_TIMED_OUT_ETAG_COUNT)
+
+// A cached response for a template file parsed with a specific set of options
+type parseCacheEntry struct {
+	key              string
+	absoluteFilePath string
+	// The path the template was requested with, which is used in its diagnostics
+	templateFilePath string
+	modTime          time.Time
+	size             int64
+	contentHash      string
+	etag             string
+	contentType      string
+	body             []byte
+}
+
+func (entry *parseCacheEntry) memorySize() int64 {
+	return int64(len(entry.body)+len(entry.key)+len(entry.templateFilePath)) + PARSE_CACHE_ENTRY_OVERHEAD
+}
+
+type ParseCacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+	Entries     int   `json:"entries"`
+	MemoryUsed  int64 `json:"memoryUsed"`
+	MemoryLimit int64 `json:"memoryLimit"`
+}
+
+// An LRU cache of parse responses keyed by the template's absolute path and parse options.
+// Entries are validated against the file's modification time and size, and then its content hash if those changed.
+type parseCache struct {
+	mutex       sync.Mutex
+	memoryLimit int64
+	memoryUsed  int64
+	// Most recently used entries are at the front
+	entries      *list.List
+	entriesByKey map[string]*list.Element
+	hits         int64
+	misses       int64
+	evictions    int64
+}
+
+func newParseCache(memoryLimit int64) *parseCache {
+	return &parseCache{
+		memoryLimit:  memoryLimit,
+		entries:      list.New(),
+		entriesByKey: make(map[string]*list.Element),
+	}
+}
+
+func getParseCacheKey(absoluteFilePath string, options ParseOptions) string {
+	return fmt.Sprintf("%s\x00%+v", absoluteFilePath, options)
+}
+
+// Gets an entity tag for a parse response. Parsing is deterministic, so the same content parsed with the same options
+// from the same path always produces the same response.
+func getParseETag(templateFilePath string, contentHash string, options ParseOptions) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%+v", templateFilePath, contentHash, options)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func getContentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// Gets a cached entry if its file hasn't been modified since it was cached
+func (c *parseCache) get(key string, templateFilePath string, fileInfo os.FileInfo) *parseCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entriesByKey[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*parseCacheEntry)
+	if entry.templateFilePath != templateFilePath || !entry.modTime.Equal(fileInfo.ModTime()) || entry.size != fileInfo.Size() {
+		return nil
+	}
+
+	c.entries.MoveToFront(element)
+	c.hits++
+	return entry
+}
+
+// Gets a cached entry if it was parsed from the same content, ie if the file was touched without being changed.
+// The entry's modification time is updated so the next lookup can skip reading the file.
+func (c *parseCache) getByContentHash(key string, templateFilePath string, fileInfo os.FileInfo, contentHash string) *parseCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entriesByKey[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+
+	entry := element.Value.(*parseCacheEntry)
+	if entry.templateFilePath != templateFilePath || entry.contentHash != contentHash {
+		c.misses++
+		return nil
+	}
+
+	entry.modTime = fileInfo.ModTime()
+	entry.size = fileInfo.Size()
+	c.entries.MoveToFront(element)
+	c.hits++
+	return entry
+}
+
+func (c *parseCache) put(entry *parseCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entriesByKey[entry.key]; ok {
+		c.removeElement(element)
+	}
+
+	entrySize := entry.memorySize()
+	if entrySize > c.memoryLimit {
+		// The entry would evict everything else and still not fit
+		return
+	}
+
+	for c.memoryUsed+entrySize > c.memoryLimit {
+		c.removeElement(c.entries.Back())
+		c.evictions++
+	}
+
+	c.entriesByKey[entry.key] = c.entries.PushFront(entry)
+	c.memoryUsed += entrySize
+}
+
+func (c *parseCache) removeElement(element *list.Element) {
+	entry := c.entries.Remove(element).(*parseCacheEntry)
+	delete(c.entriesByKey, entry.key)
+	c.memoryUsed -= entry.memorySize()
+}
+
+// Removes all cached entries for a template file, or every entry if the path is empty.
+// Returns the number of entries removed.
+func (c *parseCache) Invalidate(templateFilePath string) (int, error) {
+	absoluteFilePath := ""
+	if templateFilePath != "" {
+		var err error
+		if absoluteFilePath, err = filepath.Abs(templateFilePath); err != nil {
+			return 0, err
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	removedCount := 0
+	for element := c.entries.Front(); element != nil; {
+		nextElement := element.Next()
+		entry := element.Value.(*parseCacheEntry)
+		if absoluteFilePath == "" || entry.absoluteFilePath == absoluteFilePath {
+			c.removeElement(element)
+			removedCount++
+		}
+		element = nextElement
+	}
+
+	return removedCount, nil
+}
+
+func (c *parseCache) Stats() ParseCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return ParseCacheStats{
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Entries:     c.entries.Len(),
+		MemoryUsed:  c.memoryUsed,
+		MemoryLimit: c.memoryLimit,
+	}
+}
+
+// Writes to a response while keeping a copy of everything written so it can be cached
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Checks whether an If-None-Match header matches an entity tag. The header can be "*" or a comma-separated list of
+// tags, which are compared weakly as If-None-Match requires.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range parseETagList(ifNoneMatch) {
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits an If-None-Match header into its entity tags, with any weak validator prefixes removed
+func parseETagList(ifNoneMatch string) []string {
+	var etags []string
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/"); candidate != "" {
+			etags = append(etags, candidate)
+		}
+	}
+	return etags
+}
+
+// A set of ETags which forgets all of them once it gets too big; forgetting an ETag early only means a client may keep
+// a response which is missing some of the template until the template changes
+type etagSet struct {
+	mutex    sync.Mutex
+	maxCount int
+	etags    map[string]bool
+}
+
+func newETagSet(maxCount int) *etagSet {
+	return &etagSet{maxCount: maxCount, etags: make(map[string]bool)}
+}
+
+func (s *etagSet) Add(etag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.etags) >= s.maxCount {
+		s.etags = make(map[string]bool)
+	}
+	s.etags[etag] = true
+}
+
+func (s *etagSet) Remove(etag string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.etags, etag)
+}
+
+func (s *etagSet) Has(etag string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.etags[etag]
+}
+
+// Records whether a parse response was complete so it is only cached and kept as a diff base if it was. Returns false
+// if the parse stopped at one of its limits.
+func recordParseCompleteness(etag string, diagnostics []*Diagnostic) bool {
+	limitDiagnostic := getParseLimitDiagnostic(diagnostics)
+	if limitDiagnostic != nil && limitDiagnostic.Code == DC_PARSE_TIMEOUT {
+		timedOutParseETags.Add(etag)
+	} else {
+		timedOutParseETags.Remove(etag)
+	}
+	return limitDiagnostic == nil
+}
+
+// Whether the client already has the complete response with an ETag, in which case a 304 Not Modified response can be sent
+func isUpToDate(ifNoneMatch string, etag string) bool {
+	return etagMatches(ifNoneMatch, etag) && !timedOutParseETags.Has(etag)
+}
+
+// Writes a cached response, or a 304 Not Modified response if the client already has it
+func writeCachedParseResponse(entry *parseCacheEntry, ifNoneMatch string, responseWriter http.ResponseWriter) {
+	responseWriter.Header().Set("ETag", entry.etag)
+	if etagMatches(ifNoneMatch, entry.etag) {
+		responseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", entry.contentType)
+	responseWriter.Write(entry.body)
+}
+
+// Parses a template file, using the in-memory and on-disk caches if they're enabled. ifNoneMatch is the request's
+// If-None-Match header, if any; if it matches the response's ETag, a 304 Not Modified response is written instead of
+// the parsed template.
+// The file is read from resolvedFilePath, the path returned by the path policy's check, while the cache is keyed by
+// templateFilePath.
+func parseTemplateFileCached(ctx context.Context, templateFilePath string, resolvedFilePath string, options ParseOptions, ifNoneMatch string, responseWriter *http.ResponseWriter) error {
+	cache := templateParseCache
+	// Parse results on disk are stored as trees, so they can't be used for the event stream
+	diskCache := templateDiskCache
+	if options.OutputFormat != OF_TREE {
+		diskCache = nil
+	}
+
+	if cache == nil && diskCache == nil {
+		return parseTemplateFile(ctx, templateFilePath, resolvedFilePath, options, responseWriter)
+	}
+
+	absoluteFilePath, err := filepath.Abs(templateFilePath)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(resolvedFilePath)
+	if err != nil {
+		return err
+	}
+
+	if options.Limits.MaxInputSize > 0 && fileInfo.Size() > options.Limits.MaxInputSize {
+		// Only part of the template will be parsed, so stream it instead of reading it all into memory to cache it
+		return parseTemplateFile(ctx, templateFilePath, resolvedFilePath, options, responseWriter)
+	}
+
+	if cache != nil && fileInfo.Size() > cache.memoryLimit {
+		// Too big to cache, so don't bother reading it all into memory
+		if diskCache == nil {
+			return parseTemplateFile(ctx, templateFilePath, resolvedFilePath, options, responseWriter)
+		}
+		cache = nil
+	}
+
+	key := getParseCacheKey(absoluteFilePath, options)
+
+	if cache != nil {
+		if entry := cache.get(key, templateFilePath, fileInfo); entry != nil {
+			writeCachedParseResponse(entry, ifNoneMatch, *responseWriter)
+			return nil
+		}
+	}
+
+	content, err := os.ReadFile(resolvedFilePath)
+	if err != nil {
+		return err
+	}
+	contentHash := getContentHash(content)
+
+	if cache != nil {
+		if entry := cache.getByContentHash(key, templateFilePath, fileInfo, contentHash); entry != nil {
+			writeCachedParseResponse(entry, ifNoneMatch, *responseWriter)
+			return nil
+		}
+	}
+
+	etag := getParseETag(templateFilePath, contentHash, options)
+	(*responseWriter).Header().Set("ETag", etag)
+	if isUpToDate(ifNoneMatch, etag) {
+		// The client already has the response for this exact content, so there's no need to parse it again
+		(*responseWriter).WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	recordingWriter := &recordingResponseWriter{ResponseWriter: *responseWriter}
+	var templateResponseWriter http.ResponseWriter = recordingWriter
+
+	// Set if the template was parsed rather than read from the disk cache
+	var diagnostics []*Diagnostic
+	if diskCache != nil {
+		diskCacheKey := getDiskCacheKey(templateFilePath, contentHash, options)
+		if result := diskCache.Get(diskCacheKey); result != nil {
+			err = writeParseResult(result, &templateResponseWriter)
+		} else {
+			var result *ParseResult
+			if result, err = parseTemplateResult(ctx, bytes.NewReader(content), templateFilePath, options, &templateResponseWriter); err == nil {
+				diagnostics = result.Diagnostics()
+				if recordParseCompleteness(etag, diagnostics) {
+					diskCache.Put(diskCacheKey, result)
+				}
+			}
+		}
+	} else {
+		output := &diagnosticCollectingOutput{parseOutput: newParseOutput(options.OutputFormat, &templateResponseWriter)}
+		err = parseTemplateToOutput(ctx, bytes.NewReader(content), templateFilePath, options, output)
+		diagnostics = output.diagnostics
+	}
+	if err != nil {
+		return err
+	}
+
+	if cache != nil && recordParseCompleteness(etag, diagnostics) {
+		cache.put(&parseCacheEntry{
+			key:              key,
+			absoluteFilePath: absoluteFilePath,
+			templateFilePath: templateFilePath,
+			modTime:          fileInfo.ModTime(),
+			size:             fileInfo.Size(),
+			contentHash:      contentHash,
+			etag:             etag,
+			contentType:      recordingWriter.Header().Get("Content-Type"),
+			body:             recordingWriter.body.Bytes(),
+		})
+	}
+
+	return nil
+}
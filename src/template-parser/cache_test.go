@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimedOutParseIsNotCached(t *testing.T) {
+	templateFilePath := filepath.Join(t.TempDir(), "slow.tmph.html")
+	if err := os.WriteFile(templateFilePath, []byte("<div>"+strings.Repeat("<p class=\"item\">Some text</p>\n", 10_000)+"</div>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testDiskCache, err := newDiskCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousCache, previousDiskCache, previousLimits := templateParseCache, templateDiskCache, templateParseLimits
+	t.Cleanup(func() {
+		templateParseCache, templateDiskCache, templateParseLimits = previousCache, previousDiskCache, previousLimits
+	})
+	// Small enough that every parse times out
+	templateParseLimits.Timeout = time.Nanosecond
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, newParserServer(mux, time.Second, 0))
+
+	var request = func(query url.Values, ifNoneMatch string) *httptest.ResponseRecorder {
+		httpRequest := httptest.NewRequest(http.MethodGet, "/parse?"+query.Encode(), nil)
+		if ifNoneMatch != "" {
+			httpRequest.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		responseRecorder := httptest.NewRecorder()
+		mux.ServeHTTP(responseRecorder, httpRequest)
+		return responseRecorder
+	}
+
+	for _, testCase := range []struct {
+		name      string
+		cache     *parseCache
+		diskCache *diskCache
+		query     url.Values
+	}{
+		{"memory cache", newParseCache(DEFAULT_PARSE_CACHE_MEMORY_LIMIT), nil, url.Values{"path": {templateFilePath}}},
+		{"disk cache", nil, testDiskCache, url.Values{"path": {templateFilePath}}},
+		{"diff", nil, nil, url.Values{"path": {templateFilePath}, "diff": {"true"}}},
+	} {
+		templateParseCache, templateDiskCache = testCase.cache, testCase.diskCache
+
+		firstResponse := request(testCase.query, "")
+		etag := firstResponse.Header().Get("ETag")
+		if firstResponse.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: expected the first request to be parsed with an ETag, got status %d: %s", testCase.name, firstResponse.Code, firstResponse.Body.String())
+		}
+		if !bytes.Contains(firstResponse.Body.Bytes(), []byte(`"code":"`+DC_PARSE_TIMEOUT+`"`)) {
+			t.Fatalf("%s: expected the first request to time out, got: %.200s", testCase.name, firstResponse.Body.String())
+		}
+
+		// The client has the timed out response, so the second request has to parse the template again rather than
+		// telling the client it's up to date or diffing against the truncated result
+		secondResponse := request(testCase.query, etag)
+		if secondResponse.Code != http.StatusOK {
+			t.Errorf("%s: expected the second request to be parsed again, got status %d", testCase.name, secondResponse.Code)
+		}
+		if testCase.query.Has("diff") {
+			var diffResponse ParseDiffResponse
+			if err := json.Unmarshal(secondResponse.Body.Bytes(), &diffResponse); err != nil {
+				t.Fatal(err)
+			}
+			if diffResponse.Base != "" || diffResponse.Edits != nil {
+				t.Errorf("%s: expected a full tree instead of edits from the timed out result, got base %s", testCase.name, diffResponse.Base)
+			}
+		}
+
+		if testCase.cache != nil {
+			if stats := testCase.cache.Stats(); stats.Entries != 0 || stats.Hits != 0 {
+				t.Errorf("%s: expected the timed out result not to be cached, got %+v", testCase.name, stats)
+			}
+		}
+		if testCase.diskCache != nil && testCase.diskCache.hits.Load() != 0 {
+			t.Errorf("%s: expected the timed out result not to be read from the disk cache", testCase.name)
+		}
+	}
+}
+
+func TestDiskCacheRoundTrip(t *testing.T) {
+	testDiskCache, err := newDiskCache(t.TempDir(), time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid byte at the very start of the file has a byte offset of 0, which has to survive the round trip, while
+	// the other diagnostics have no byte offset at all
+	source := "\xFF<div a a>\n<p>text</p></div></span>"
+	var writeResponse = func(result *ParseResult) string {
+		responseRecorder := httptest.NewRecorder()
+		var responseWriter http.ResponseWriter = responseRecorder
+		if err := writeParseResult(result, &responseWriter); err != nil {
+			t.Fatal(err)
+		}
+		return responseRecorder.Body.String()
+	}
+
+	var responseWriter http.ResponseWriter = httptest.NewRecorder()
+	parseResult, err := parseTemplateResult(context.Background(), strings.NewReader(source), "test.tmph.html", ParseOptions{}, &responseWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := parseResult.Diagnostics(); len(diagnostics) == 0 || diagnostics[0].ByteOffset == nil || *diagnostics[0].ByteOffset != 0 {
+		t.Fatalf("expected the first diagnostic to be at byte offset 0, got %+v", diagnostics)
+	}
+
+	testDiskCache.Put("test", parseResult)
+	cachedResult := testDiskCache.Get("test")
+	if cachedResult == nil {
+		t.Fatal("expected the parse result to be read from the disk cache")
+	}
+
+	if expected, got := writeResponse(parseResult), writeResponse(cachedResult); got != expected {
+		t.Errorf("expected the cached result to be written the same way as the fresh one\n%s\ngot\n%s", expected, got)
+	}
+}
@@ -1,15 +1,6 @@
 package main
 
-var lineBreakChars = map[rune]bool{
-	'\n': true,
-	'\r': true,
-	'\f': true,
-}
-
-func isLineBreak(char rune) bool {
-	_, isLineBreakChar := lineBreakChars[char]
-	return isLineBreakChar
-}
+import "strings"
 
 var whiteSpaceChars = map[rune]bool{
 	' ':  true,
@@ -91,13 +82,17 @@ func isLegalTagNameChar(char rune) bool {
 	return isLetter(char) || isNumber(char) || isPCENChar(char)
 }
 
-// Attribute names are pretty flexible, but can't contain an equals sign, whitespace, quotes, or tag ending characters
-func isLegalAttributeNameChar(char rune) bool {
-	return char != '=' && !isWhiteSpace(char) && !isEndOfTagChar(char) && !isAttributeValueQuoteChar(char)
+var illegalUnquotedAttributeValueChars = map[rune]bool{
+	'"':  true,
+	'\'': true,
+	'<':  true,
+	'=':  true,
+	'`':  true,
 }
 
-func isLegalUnquotedAttributeValueChar(char rune) bool {
-	return !isWhiteSpace(char) && !isAttributeValueQuoteChar(char) && !isEndOfTagChar(char) && char != '<'
+// Unquoted attribute values may contain these characters, but they are a parse error per the HTML spec
+func isIllegalUnquotedAttributeValueChar(char rune) bool {
+	return illegalUnquotedAttributeValueChars[char] || false
 }
 
 var scriptQuoteChars = map[rune]bool{
@@ -123,12 +118,38 @@ func isStyleQuoteChar(char rune) bool {
 var rawTextContentTagNames = map[string]bool{
 	"script":   true,
 	"style":    true,
-	"textarea": true,
+	"xmp":      true,
+	"iframe":   true,
+	"noembed":  true,
+	"noframes": true,
+	"noscript": true,
 }
 
 // Child content of these elements are parsed as raw text instead of HTML
 func isRawTextContentElementTagName(tagName string) bool {
-	return rawTextContentTagNames[tagName] || false
+	isRawTextContentTagName, _ := lookupLowerCaseName(rawTextContentTagNames, tagName)
+	return isRawTextContentTagName
+}
+
+var escapableRawTextContentTagNames = map[string]bool{
+	"textarea": true,
+	"title":    true,
+}
+
+// Child content of these elements are parsed as RCDATA; raw text which can contain character references
+func isEscapableRawTextContentElementTagName(tagName string) bool {
+	isEscapableRawTextContentTagName, _ := lookupLowerCaseName(escapableRawTextContentTagNames, tagName)
+	return isEscapableRawTextContentTagName
+}
+
+// Everything following a <plaintext> opening tag is raw text; the element can't be closed
+func isPlaintextElementTagName(tagName string) bool {
+	return strings.EqualFold(tagName, "plaintext")
+}
+
+// Per the HTML spec, an "appropriate" end tag name in raw text content must be followed by whitespace, '/', or '>'
+func isEndTagNameTerminatorChar(char rune) bool {
+	return isWhiteSpace(char) || isEndOfTagChar(char)
 }
 
 var voidTagNames = map[string]bool{
@@ -151,3 +172,34 @@ var voidTagNames = map[string]bool{
 func isVoidTag(tagName string) bool {
 	return voidTagNames[tagName] || false
 }
+
+// Looks up a name in a map with lower-case keys without allocating a lower-cased copy of the name
+func lookupLowerCaseName[V any](names map[string]V, name string) (value V, ok bool) {
+	if value, ok = names[name]; ok {
+		return value, ok
+	}
+
+	var lowerCaseName [32]byte
+	if len(name) > len(lowerCaseName) {
+		value, ok = names[strings.ToLower(name)]
+		return value, ok
+	}
+
+	hasUpperCaseChar := false
+	for i := 0; i < len(name); i++ {
+		char := name[i]
+		if char >= 'A' && char <= 'Z' {
+			char += 'a' - 'A'
+			hasUpperCaseChar = true
+		}
+		lowerCaseName[i] = char
+	}
+
+	if !hasUpperCaseChar {
+		// We already looked up the name as-is
+		return value, false
+	}
+
+	value, ok = names[string(lowerCaseName[:len(name)])]
+	return value, ok
+}
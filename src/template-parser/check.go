@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type CheckReportFormat int
+
+const (
+	CRF_HUMAN  CheckReportFormat = iota // each diagnostic with a frame of the source around it
+	CRF_JSON                            // a single CheckReport object
+	CRF_SARIF                           // a SARIF 2.1.0 log for code scanning tools
+	CRF_GITHUB                          // GitHub Actions workflow commands which annotate the diagnostics in pull requests
+)
+
+// The number of lines before a diagnostic's line which are shown in its code frame
+const CHECK_CODE_FRAME_CONTEXT_LINES = 2
+
+const SARIF_VERSION = "2.1.0"
+const SARIF_SCHEMA_URI = "https://json.schemastore.org/sarif-2.1.0.json"
+
+// The results of checking every template under a directory
+type CheckReport struct {
+	TemplateCount int           `json:"templateCount"`
+	Diagnostics   []*Diagnostic `json:"diagnostics"`
+	// Templates which couldn't be read
+	Failures     []*BatchResult `json:"failures,omitempty"`
+	ErrorCount   int            `json:"errorCount"`
+	WarningCount int            `json:"warningCount"`
+	InfoCount    int            `json:"infoCount"`
+}
+
+func (report *CheckReport) addDiagnostic(diagnostic *Diagnostic) {
+	report.Diagnostics = append(report.Diagnostics, diagnostic)
+	switch diagnostic.Severity {
+	case DS_INFO:
+		report.InfoCount++
+	case DS_WARNING:
+		report.WarningCount++
+	default:
+		report.ErrorCount++
+	}
+}
+
+// A response writer which throws away everything written to it, for templates which are only parsed for their diagnostics
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return io.Discard.Write(b)
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
+
+func (w *discardResponseWriter) Flush() {}
+
+// Parses a template and gets all of the diagnostics found in it. A template which can't be parsed at all is reported
+// with a DC_PARSE_ERROR diagnostic; only templates which couldn't be read return an error.
+func checkTemplate(ctx context.Context, templateFilePath string, options ParseOptions) ([]*Diagnostic, error) {
+	// Only the diagnostics are needed, so the parsed template is streamed as events and thrown away rather than being
+	// held in memory
+	var responseWriter http.ResponseWriter = &discardResponseWriter{}
+	output := &diagnosticCollectingOutput{parseOutput: newParseOutput(OF_EVENTS, &responseWriter)}
+
+	err := parseTemplateFileToOutput(ctx, templateFilePath, options, output)
+
+	var templateErr *TemplateError
+	if errors.As(err, &templateErr) {
+		output.diagnostics = append(output.diagnostics, &Diagnostic{
+			Code:     DC_PARSE_ERROR,
+			Severity: DS_ERROR,
+			Message:  templateErr.Message,
+			Path:     templateErr.Path,
+			Line:     templateErr.Line,
+			Col:      templateErr.Col,
+		})
+		err = nil
+	}
+
+	return output.diagnostics, err
+}
+
+// Parses every template under a directory and checks them for problems, then reports them in the chosen format.
+// Exits with EC_DIAGNOSTICS if any diagnostics are at or above the -fail-on severity.
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	setCommandUsage(flags, "check [flags] [root]")
+
+	query := url.Values{}
+	batch := &ParseBatch{}
+	format := flags.String("format", "human", "report format: 'human', 'json', 'sarif' or 'github'")
+	failOn := flags.String("fail-on", "error", "lowest severity which makes the check fail: 'info', 'warning', 'error' or 'none'")
+	flags.Func("include", "glob pattern for the templates to check, relative to the root; can be given more than once (default '"+DEFAULT_BATCH_INCLUDE_GLOB+"')", func(pattern string) error {
+		batch.Include = append(batch.Include, pattern)
+		return validateGlob(pattern)
+	})
+	flags.Func("exclude", "glob pattern for files and directories under the root to skip; can be given more than once", func(pattern string) error {
+		batch.Exclude = append(batch.Exclude, pattern)
+		return validateGlob(pattern)
+	})
+	addLexerOptionFlags(flags, query)
+	addParseLimitFlags(flags)
+	flags.Parse(args)
+
+	options, err := parseOptionsFromQuery(query)
+	if err != nil {
+		return usageError(flags, err.Error())
+	}
+
+	var reportFormat CheckReportFormat
+	switch *format {
+	case "human":
+		reportFormat = CRF_HUMAN
+	case "json":
+		reportFormat = CRF_JSON
+	case "sarif":
+		reportFormat = CRF_SARIF
+		if options.LexerOptions.ColumnUnit == CU_BYTES {
+			return usageError(flags, "the sarif format can't report columns in bytes; use 'runes' or 'utf16' columns")
+		}
+	case "github":
+		reportFormat = CRF_GITHUB
+	default:
+		return usageError(flags, "invalid format '"+*format+"'; expected 'human', 'json', 'sarif' or 'github'")
+	}
+
+	// Diagnostics are never severe enough to fail the check if this is nil
+	var failOnSeverity *DiagnosticSeverity
+	if *failOn != "none" {
+		severity, err := parseDiagnosticSeverity(*failOn)
+		if err != nil {
+			return usageError(flags, "invalid -fail-on severity '"+*failOn+"'; expected 'info', 'warning', 'error' or 'none'")
+		}
+		failOnSeverity = &severity
+	}
+
+	switch flags.NArg() {
+	case 0:
+		batch.Dir = "."
+	case 1:
+		batch.Dir = flags.Arg(0)
+	default:
+		return usageError(flags, "expected a single root directory")
+	}
+
+	templateFilePaths, err := batch.ResolvePaths()
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return EC_FAILURE
+	}
+
+	report := &CheckReport{TemplateCount: len(templateFilePaths), Diagnostics: []*Diagnostic{}}
+	for _, templateFilePath := range templateFilePaths {
+		// Report paths relative to the working directory, which is usually the repository's root in CI
+		templateFilePath, _ = getWorkingDirRelativePath(templateFilePath)
+
+		diagnostics, err := checkTemplate(context.Background(), templateFilePath, options)
+		if err != nil {
+			report.Failures = append(report.Failures, &BatchResult{Path: templateFilePath, Error: err.Error()})
+			continue
+		}
+		for _, diagnostic := range diagnostics {
+			report.addDiagnostic(diagnostic)
+		}
+	}
+
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+
+	switch reportFormat {
+	case CRF_HUMAN:
+		writeHumanCheckReport(stdout, report, options.LexerOptions.ColumnUnit)
+	case CRF_JSON:
+		json.NewEncoder(stdout).Encode(report)
+	case CRF_SARIF:
+		sarifLog := newSarifLog(report, options.LexerOptions.ColumnUnit)
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(sarifLog)
+	case CRF_GITHUB:
+		writeGitHubCheckReport(stdout, report)
+	}
+
+	return getCheckExitCode(report, failOnSeverity)
+}
+
+// Gets the exit code for a check; templates which couldn't be read fail the check regardless of the -fail-on severity
+func getCheckExitCode(report *CheckReport, failOnSeverity *DiagnosticSeverity) int {
+	if len(report.Failures) > 0 {
+		return EC_FAILURE
+	}
+	if failOnSeverity != nil {
+		for _, diagnostic := range report.Diagnostics {
+			if diagnostic.Severity >= *failOnSeverity {
+				return EC_DIAGNOSTICS
+			}
+		}
+	}
+	return EC_OK
+}
+
+// Writes each diagnostic with a frame of the source lines leading up to it and a caret under its column, ie
+//
+//	src/index.tmph.html:3:8: warning: duplicate attribute 'a' on <p> (duplicate-attribute)
+//	  2 |   Some text
+//	  3 |   <p a a>hi</p>
+//	    |        ^
+//
+// followed by a summary of how many problems were found.
+func writeHumanCheckReport(writer io.Writer, report *CheckReport, columnUnit ColumnUnit) {
+	// Diagnostics are grouped by template, so only the current template's source needs to be kept
+	var sourcePath string
+	var sourceLines []string
+
+	for _, diagnostic := range report.Diagnostics {
+		if diagnostic.Path != sourcePath {
+			sourcePath = diagnostic.Path
+			sourceLines = readSourceLines(sourcePath)
+		}
+
+		io.WriteString(writer, formatDiagnosticLine(diagnostic)+"\n")
+		writeCodeFrame(writer, sourceLines, diagnostic.Line, diagnostic.Col, columnUnit)
+		io.WriteString(writer, "\n")
+	}
+
+	for _, failure := range report.Failures {
+		io.WriteString(writer, failure.Path+": "+failure.Error+"\n")
+	}
+	if len(report.Failures) > 0 {
+		io.WriteString(writer, "\n")
+	}
+
+	summary := "Checked " + pluralize(report.TemplateCount, "template", "templates") + ": " +
+		pluralize(report.ErrorCount, "error", "errors") + ", " +
+		pluralize(report.WarningCount, "warning", "warnings") + ", " +
+		strconv.Itoa(report.InfoCount) + " info"
+	if len(report.Failures) > 0 {
+		summary += "; " + pluralize(len(report.Failures), "template", "templates") + " couldn't be read"
+	}
+	io.WriteString(writer, summary+"\n")
+}
+
+func pluralize(count int, singular string, plural string) string {
+	if count == 1 {
+		return "1 " + singular
+	}
+	return strconv.Itoa(count) + " " + plural
+}
+
+// Reads a template's lines for code frames, with line endings normalized the same way the lexer does.
+// Returns nil if the template can't be read.
+func readSourceLines(templateFilePath string) []string {
+	source, err := os.ReadFile(templateFilePath)
+	if err != nil {
+		return nil
+	}
+	normalizedSource := strings.TrimPrefix(string(source), "\uFEFF")
+	normalizedSource = strings.ReplaceAll(normalizedSource, "\r\n", "\n")
+	normalizedSource = strings.ReplaceAll(normalizedSource, "\r", "\n")
+	return strings.Split(normalizedSource, "\n")
+}
+
+// Writes the source lines up to a diagnostic's line with a caret under its column. Nothing is written if the line
+// isn't in the source or isn't valid UTF-8, ie because the template is in another encoding.
+func writeCodeFrame(writer io.Writer, sourceLines []string, line int, col int, columnUnit ColumnUnit) {
+	if line < 1 || line > len(sourceLines) || !utf8.ValidString(sourceLines[line-1]) {
+		return
+	}
+
+	gutterWidth := len(strconv.Itoa(line))
+	var writeGutter = func(lineNumber string) {
+		io.WriteString(writer, "  "+strings.Repeat(" ", gutterWidth-len(lineNumber))+lineNumber+" | ")
+	}
+
+	for lineNumber := max(1, line-CHECK_CODE_FRAME_CONTEXT_LINES); lineNumber <= line; lineNumber++ {
+		writeGutter(strconv.Itoa(lineNumber))
+		io.WriteString(writer, strings.TrimRight(sourceLines[lineNumber-1], " \t")+"\n")
+	}
+
+	// Keep any tabs before the column so the caret lines up with the source
+	sourceLine := sourceLines[line-1]
+	caretIndent := strings.Map(func(char rune) rune {
+		if char == '\t' {
+			return '\t'
+		}
+		return ' '
+	}, sourceLine[:getColumnByteOffset(sourceLine, col, columnUnit)])
+
+	writeGutter("")
+	io.WriteString(writer, caretIndent+"^\n")
+}
+
+// Gets the byte offset of a 1-based column in a line, counting columns in the given unit
+func getColumnByteOffset(line string, col int, columnUnit ColumnUnit) int {
+	column := 1
+	for offset, char := range line {
+		if column >= col {
+			return offset
+		}
+		switch columnUnit {
+		case CU_BYTES:
+			column += utf8.RuneLen(char)
+		case CU_UTF16:
+			if char >= 0x10000 {
+				column += 2
+			} else {
+				column++
+			}
+		default:
+			column++
+		}
+	}
+	return len(line)
+}
+
+var gitHubAnnotationMessageEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+var gitHubAnnotationPropertyEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C")
+
+// Writes each diagnostic as a GitHub Actions workflow command, ie
+//
+//	::warning file=src/index.tmph.html,line=3,col=8,title=duplicate-attribute::duplicate attribute 'a' on <p>
+//
+// https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions
+func writeGitHubCheckReport(writer io.Writer, report *CheckReport) {
+	for _, diagnostic := range report.Diagnostics {
+		command := "error"
+		switch diagnostic.Severity {
+		case DS_INFO:
+			command = "notice"
+		case DS_WARNING:
+			command = "warning"
+		}
+
+		io.WriteString(writer, "::"+command+
+			" file="+gitHubAnnotationPropertyEscaper.Replace(filepath.ToSlash(diagnostic.Path))+
+			",line="+strconv.Itoa(diagnostic.Line)+
+			",col="+strconv.Itoa(diagnostic.Col)+
+			",title="+gitHubAnnotationPropertyEscaper.Replace(diagnostic.Code)+
+			"::"+gitHubAnnotationMessageEscaper.Replace(diagnostic.Message)+"\n")
+	}
+
+	for _, failure := range report.Failures {
+		io.WriteString(writer, "::error file="+gitHubAnnotationPropertyEscaper.Replace(filepath.ToSlash(failure.Path))+
+			"::"+gitHubAnnotationMessageEscaper.Replace(failure.Error)+"\n")
+	}
+}
+
+// A SARIF 2.1.0 log with the subset of properties the check command reports
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type SarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []SarifRun `json:"runs"`
+}
+
+type SarifRun struct {
+	Tool        SarifTool         `json:"tool"`
+	Invocations []SarifInvocation `json:"invocations"`
+	// The unit of the results' columns; either "unicodeCodePoints" or "utf16CodeUnits"
+	ColumnKind string        `json:"columnKind"`
+	Results    []SarifResult `json:"results"`
+}
+
+type SarifTool struct {
+	Driver SarifToolComponent `json:"driver"`
+}
+
+type SarifToolComponent struct {
+	Name           string                     `json:"name"`
+	Version        string                     `json:"version"`
+	InformationURI string                     `json:"informationUri"`
+	Rules          []SarifReportingDescriptor `json:"rules"`
+}
+
+// Describes one of the diagnostic codes
+type SarifReportingDescriptor struct {
+	ID string `json:"id"`
+}
+
+type SarifInvocation struct {
+	ExecutionSuccessful bool `json:"executionSuccessful"`
+	// Templates which couldn't be read
+	ToolExecutionNotifications []SarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type SarifNotification struct {
+	Level     string          `json:"level"`
+	Message   SarifMessage    `json:"message"`
+	Locations []SarifLocation `json:"locations"`
+}
+
+type SarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   SarifMessage    `json:"message"`
+	Locations []SarifLocation `json:"locations"`
+}
+
+type SarifMessage struct {
+	Text string `json:"text"`
+}
+
+type SarifLocation struct {
+	PhysicalLocation SarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type SarifPhysicalLocation struct {
+	ArtifactLocation SarifArtifactLocation `json:"artifactLocation"`
+	Region           *SarifRegion          `json:"region,omitempty"`
+}
+
+type SarifArtifactLocation struct {
+	URI string `json:"uri"`
+	// Set for paths relative to the directory the check was run in
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+type SarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+func newSarifLog(report *CheckReport, columnUnit ColumnUnit) *SarifLog {
+	run := SarifRun{
+		Tool: SarifTool{Driver: SarifToolComponent{
+			Name:           "tempeh-template-parser",
+			Version:        PARSER_VERSION,
+			InformationURI: "https://github.com/gyanreyer/tempeh",
+			Rules:          []SarifReportingDescriptor{},
+		}},
+		Invocations: []SarifInvocation{{ExecutionSuccessful: len(report.Failures) == 0}},
+		ColumnKind:  "unicodeCodePoints",
+		Results:     []SarifResult{},
+	}
+	if columnUnit == CU_UTF16 {
+		run.ColumnKind = "utf16CodeUnits"
+	}
+
+	ruleIndexes := make(map[string]int)
+	for _, diagnostic := range report.Diagnostics {
+		ruleIndex, ok := ruleIndexes[diagnostic.Code]
+		if !ok {
+			ruleIndex = len(run.Tool.Driver.Rules)
+			ruleIndexes[diagnostic.Code] = ruleIndex
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, SarifReportingDescriptor{ID: diagnostic.Code})
+		}
+
+		level := "error"
+		switch diagnostic.Severity {
+		case DS_INFO:
+			level = "note"
+		case DS_WARNING:
+			level = "warning"
+		}
+
+		location := newSarifLocation(diagnostic.Path)
+		if diagnostic.Line >= 1 {
+			location.PhysicalLocation.Region = &SarifRegion{StartLine: diagnostic.Line, StartColumn: max(diagnostic.Col, 0)}
+		}
+
+		run.Results = append(run.Results, SarifResult{
+			RuleID:    diagnostic.Code,
+			RuleIndex: ruleIndex,
+			Level:     level,
+			Message:   SarifMessage{Text: diagnostic.Message},
+			Locations: []SarifLocation{location},
+		})
+	}
+
+	for _, failure := range report.Failures {
+		run.Invocations[0].ToolExecutionNotifications = append(run.Invocations[0].ToolExecutionNotifications, SarifNotification{
+			Level:     "error",
+			Message:   SarifMessage{Text: failure.Error},
+			Locations: []SarifLocation{newSarifLocation(failure.Path)},
+		})
+	}
+
+	return &SarifLog{Schema: SARIF_SCHEMA_URI, Version: SARIF_VERSION, Runs: []SarifRun{run}}
+}
+
+// Gets the location of a template; paths relative to the working directory are given relative to %SRCROOT% so code
+// scanning tools can match them to files in the repository
+func newSarifLocation(templateFilePath string) SarifLocation {
+	var artifactLocation SarifArtifactLocation
+	if filepath.IsAbs(templateFilePath) {
+		artifactLocation.URI = (&url.URL{Scheme: "file", Path: filepath.ToSlash(templateFilePath)}).String()
+	} else {
+		artifactLocation.URI = (&url.URL{Path: filepath.ToSlash(templateFilePath)}).String()
+		artifactLocation.URIBaseID = "%SRCROOT%"
+	}
+	return SarifLocation{PhysicalLocation: SarifPhysicalLocation{ArtifactLocation: artifactLocation}}
+}
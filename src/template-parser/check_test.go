@@ -0,0 +1,332 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetColumnByteOffset(t *testing.T) {
+	// 'é' is 2 bytes and 1 UTF-16 code unit; '😀' is 4 bytes and 2 UTF-16 code units
+	line := "aé😀b"
+	for _, testCase := range []struct {
+		name       string
+		columnUnit ColumnUnit
+		col        int
+		expected   int
+	}{
+		{"runes: first column", CU_RUNES, 1, 0},
+		{"runes: after a multi-byte character", CU_RUNES, 3, 3},
+		{"runes: after an astral character", CU_RUNES, 4, 7},
+		{"runes: end of the line", CU_RUNES, 5, 8},
+		{"runes: past the end of the line", CU_RUNES, 20, 8},
+		{"bytes: first column", CU_BYTES, 1, 0},
+		{"bytes: after a multi-byte character", CU_BYTES, 4, 3},
+		{"bytes: inside of a multi-byte character", CU_BYTES, 3, 3},
+		{"bytes: after an astral character", CU_BYTES, 8, 7},
+		{"bytes: inside of an astral character", CU_BYTES, 5, 7},
+		{"utf16: after a multi-byte character", CU_UTF16, 3, 3},
+		{"utf16: after an astral character", CU_UTF16, 5, 7},
+		{"utf16: between an astral character's surrogates", CU_UTF16, 4, 7},
+		{"utf16: end of the line", CU_UTF16, 6, 8},
+		{"column 0", CU_RUNES, 0, 0},
+	} {
+		if offset := getColumnByteOffset(line, testCase.col, testCase.columnUnit); offset != testCase.expected {
+			t.Errorf("%s: expected column %d to be at byte %d, got %d", testCase.name, testCase.col, testCase.expected, offset)
+		}
+	}
+}
+
+func TestWriteCodeFrame(t *testing.T) {
+	for _, testCase := range []struct {
+		name        string
+		sourceLines []string
+		line        int
+		col         int
+		columnUnit  ColumnUnit
+		expected    string
+	}{
+		{
+			name:        "context lines before the diagnostic's line",
+			sourceLines: []string{"<div>", "  <p>", "    <a a a>", "  </p>", "</div>"},
+			line:        3,
+			col:         10,
+			expected:    "  1 | <div>\n  2 |   <p>\n  3 |     <a a a>\n    |          ^\n",
+		},
+		{
+			name:        "file shorter than the context",
+			sourceLines: []string{"<a a a>"},
+			line:        1,
+			col:         6,
+			expected:    "  1 | <a a a>\n    |      ^\n",
+		},
+		{
+			name:        "line numbers are right aligned",
+			sourceLines: strings.Split(strings.Repeat("<p></p>\n", 9)+"<a a a>", "\n"),
+			line:        10,
+			col:         6,
+			expected:    "   8 | <p></p>\n   9 | <p></p>\n  10 | <a a a>\n     |      ^\n",
+		},
+		{
+			name:        "tabs before the column are kept",
+			sourceLines: []string{"<div>", "\t\t<a a a>"},
+			line:        2,
+			col:         7,
+			expected:    "  1 | <div>\n  2 | \t\t<a a a>\n    | \t\t    ^\n",
+		},
+		{
+			name:        "trailing whitespace is trimmed",
+			sourceLines: []string{"<p> \t", "<a a a>"},
+			line:        2,
+			col:         6,
+			expected:    "  1 | <p>\n  2 | <a a a>\n    |      ^\n",
+		},
+		{
+			name:        "columns in utf-16 code units",
+			sourceLines: []string{"😀<a a a>"},
+			line:        1,
+			col:         8,
+			columnUnit:  CU_UTF16,
+			expected:    "  1 | 😀<a a a>\n    |       ^\n",
+		},
+		{
+			name:        "line past the end of the file",
+			sourceLines: []string{"<p></p>"},
+			line:        2,
+			col:         1,
+		},
+		{
+			name:        "source which couldn't be read",
+			sourceLines: nil,
+			line:        1,
+			col:         1,
+		},
+		{
+			name:        "line which isn't valid utf-8",
+			sourceLines: []string{"<p>\xFF</p>"},
+			line:        1,
+			col:         4,
+		},
+	} {
+		var writer strings.Builder
+		writeCodeFrame(&writer, testCase.sourceLines, testCase.line, testCase.col, testCase.columnUnit)
+		if writer.String() != testCase.expected {
+			t.Errorf("%s: expected code frame\n%q\ngot\n%q", testCase.name, testCase.expected, writer.String())
+		}
+	}
+}
+
+func TestGitHubCheckReport(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		report   *CheckReport
+		expected string
+	}{
+		{
+			name: "severities",
+			report: &CheckReport{Diagnostics: []*Diagnostic{
+				{Code: "a", Severity: DS_INFO, Message: "info", Path: "a.tmph.html", Line: 1, Col: 2},
+				{Code: "b", Severity: DS_WARNING, Message: "warning", Path: "a.tmph.html", Line: 3, Col: 4},
+				{Code: "c", Severity: DS_ERROR, Message: "error", Path: "a.tmph.html", Line: 5, Col: 6},
+			}},
+			expected: "::notice file=a.tmph.html,line=1,col=2,title=a::info\n" +
+				"::warning file=a.tmph.html,line=3,col=4,title=b::warning\n" +
+				"::error file=a.tmph.html,line=5,col=6,title=c::error\n",
+		},
+		{
+			name: "properties escape '%', ':', ',' and newlines",
+			report: &CheckReport{Diagnostics: []*Diagnostic{
+				{Code: "a:b,c", Severity: DS_ERROR, Message: "m", Path: "100%,a:b\nc\r.tmph.html", Line: 1, Col: 1},
+			}},
+			expected: "::error file=100%25%2Ca%3Ab%0Ac%0D.tmph.html,line=1,col=1,title=a%3Ab%2Cc::m\n",
+		},
+		{
+			name: "messages only escape '%' and newlines",
+			report: &CheckReport{Diagnostics: []*Diagnostic{
+				{Code: "a", Severity: DS_WARNING, Message: "100% sure: a, b\r\nc", Path: "a.tmph.html", Line: 1, Col: 1},
+			}},
+			expected: "::warning file=a.tmph.html,line=1,col=1,title=a::100%25 sure: a, b%0D%0Ac\n",
+		},
+		{
+			name: "templates which couldn't be read",
+			report: &CheckReport{Failures: []*BatchResult{
+				{Path: "a,b.tmph.html", Error: "open a,b.tmph.html: no such file or directory"},
+			}},
+			expected: "::error file=a%2Cb.tmph.html::open a,b.tmph.html: no such file or directory\n",
+		},
+	} {
+		var writer strings.Builder
+		writeGitHubCheckReport(&writer, testCase.report)
+		if writer.String() != testCase.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", testCase.name, testCase.expected, writer.String())
+		}
+	}
+}
+
+func TestSarifLog(t *testing.T) {
+	absolutePath := filepath.Join(t.TempDir(), "b.tmph.html")
+	report := &CheckReport{
+		Diagnostics: []*Diagnostic{
+			{Code: DC_DUPLICATE_ATTRIBUTE, Severity: DS_WARNING, Message: "a", Path: "src/a b.tmph.html", Line: 1, Col: 2},
+			{Code: DC_UNCLOSED_ELEMENT, Severity: DS_ERROR, Message: "b", Path: absolutePath, Line: 3, Col: 4},
+			{Code: DC_DUPLICATE_ATTRIBUTE, Severity: DS_INFO, Message: "c", Path: "src/a b.tmph.html", Line: 5, Col: 6},
+			{Code: DC_PARSE_ERROR, Severity: DS_ERROR, Message: "d", Path: "src/a b.tmph.html", Line: 0, Col: 0},
+		},
+		Failures: []*BatchResult{{Path: "c.tmph.html", Error: "e"}},
+	}
+
+	for _, testCase := range []struct {
+		columnUnit         ColumnUnit
+		expectedColumnKind string
+	}{
+		{CU_RUNES, "unicodeCodePoints"},
+		{CU_UTF16, "utf16CodeUnits"},
+	} {
+		sarifLog := newSarifLog(report, testCase.columnUnit)
+		if len(sarifLog.Runs) != 1 {
+			t.Fatalf("expected a single run, got %d", len(sarifLog.Runs))
+		}
+		run := sarifLog.Runs[0]
+
+		if run.ColumnKind != testCase.expectedColumnKind {
+			t.Errorf("unit %d: expected columnKind %s, got %s", testCase.columnUnit, testCase.expectedColumnKind, run.ColumnKind)
+		}
+
+		// Each code is a rule which results refer to by its index
+		expectedRules := []SarifReportingDescriptor{{ID: DC_DUPLICATE_ATTRIBUTE}, {ID: DC_UNCLOSED_ELEMENT}, {ID: DC_PARSE_ERROR}}
+		if !reflect.DeepEqual(run.Tool.Driver.Rules, expectedRules) {
+			t.Errorf("unit %d: expected rules %v, got %v", testCase.columnUnit, expectedRules, run.Tool.Driver.Rules)
+		}
+		var ruleIndexes, levels []string
+		for _, result := range run.Results {
+			ruleIndexes = append(ruleIndexes, result.RuleID+"@"+run.Tool.Driver.Rules[result.RuleIndex].ID)
+			levels = append(levels, result.Level)
+		}
+		if expected := []string{
+			DC_DUPLICATE_ATTRIBUTE + "@" + DC_DUPLICATE_ATTRIBUTE,
+			DC_UNCLOSED_ELEMENT + "@" + DC_UNCLOSED_ELEMENT,
+			DC_DUPLICATE_ATTRIBUTE + "@" + DC_DUPLICATE_ATTRIBUTE,
+			DC_PARSE_ERROR + "@" + DC_PARSE_ERROR,
+		}; !reflect.DeepEqual(ruleIndexes, expected) {
+			t.Errorf("unit %d: expected each result's ruleIndex to point to its rule, got %v", testCase.columnUnit, ruleIndexes)
+		}
+		if expected := []string{"warning", "error", "note", "error"}; !reflect.DeepEqual(levels, expected) {
+			t.Errorf("unit %d: expected levels %v, got %v", testCase.columnUnit, expected, levels)
+		}
+
+		// Relative paths are relative to the source root, while absolute paths are file URIs
+		relativeLocation := run.Results[0].Locations[0].PhysicalLocation
+		if relativeLocation.ArtifactLocation != (SarifArtifactLocation{URI: "src/a%20b.tmph.html", URIBaseID: "%SRCROOT%"}) {
+			t.Errorf("unit %d: expected a location relative to %%SRCROOT%%, got %+v", testCase.columnUnit, relativeLocation.ArtifactLocation)
+		}
+		if relativeLocation.Region == nil || *relativeLocation.Region != (SarifRegion{StartLine: 1, StartColumn: 2}) {
+			t.Errorf("unit %d: expected a region at 1:2, got %+v", testCase.columnUnit, relativeLocation.Region)
+		}
+		absoluteLocation := run.Results[1].Locations[0].PhysicalLocation
+		if expectedURI := "file://" + filepath.ToSlash(absolutePath); absoluteLocation.ArtifactLocation != (SarifArtifactLocation{URI: expectedURI}) {
+			t.Errorf("unit %d: expected a file URI without a uriBaseId, got %+v", testCase.columnUnit, absoluteLocation.ArtifactLocation)
+		}
+		if region := run.Results[3].Locations[0].PhysicalLocation.Region; region != nil {
+			t.Errorf("unit %d: expected no region for a diagnostic without a position, got %+v", testCase.columnUnit, region)
+		}
+
+		invocation := run.Invocations[0]
+		if invocation.ExecutionSuccessful || len(invocation.ToolExecutionNotifications) != 1 || invocation.ToolExecutionNotifications[0].Locations[0].PhysicalLocation.ArtifactLocation.URIBaseID != "%SRCROOT%" {
+			t.Errorf("unit %d: expected the template which couldn't be read to be reported as a notification, got %+v", testCase.columnUnit, invocation)
+		}
+	}
+}
+
+func TestGetCheckExitCode(t *testing.T) {
+	warningReport := &CheckReport{Diagnostics: []*Diagnostic{{Code: "a", Severity: DS_INFO}, {Code: "b", Severity: DS_WARNING}}}
+	failureReport := &CheckReport{Failures: []*BatchResult{{Path: "a.tmph.html", Error: "a"}}}
+
+	for _, testCase := range []struct {
+		name     string
+		report   *CheckReport
+		failOn   string
+		expected int
+	}{
+		{"no diagnostics", &CheckReport{}, "info", EC_OK},
+		{"diagnostics below the threshold", warningReport, "error", EC_OK},
+		{"diagnostics at the threshold", warningReport, "warning", EC_DIAGNOSTICS},
+		{"diagnostics above the threshold", warningReport, "info", EC_DIAGNOSTICS},
+		{"diagnostics with no threshold", warningReport, "none", EC_OK},
+		{"templates which couldn't be read", failureReport, "error", EC_FAILURE},
+		{"templates which couldn't be read with no threshold", failureReport, "none", EC_FAILURE},
+	} {
+		var failOnSeverity *DiagnosticSeverity
+		if testCase.failOn != "none" {
+			severity, err := parseDiagnosticSeverity(testCase.failOn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failOnSeverity = &severity
+		}
+
+		if exitCode := getCheckExitCode(testCase.report, failOnSeverity); exitCode != testCase.expected {
+			t.Errorf("%s: expected exit code %d, got %d", testCase.name, testCase.expected, exitCode)
+		}
+	}
+}
+
+// Replaces stdout and stderr with a file for the rest of the test so commands' reports don't clutter its output
+func captureCommandOutput(t *testing.T) *os.File {
+	outputFile, err := os.Create(filepath.Join(t.TempDir(), "output.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousStdout, previousStderr := os.Stdout, os.Stderr
+	t.Cleanup(func() {
+		os.Stdout, os.Stderr = previousStdout, previousStderr
+		outputFile.Close()
+	})
+	os.Stdout, os.Stderr = outputFile, outputFile
+
+	return outputFile
+}
+
+func TestCheckCommandExitCodes(t *testing.T) {
+	var writeTemplates = func(templates map[string]string) string {
+		dir := t.TempDir()
+		for name, source := range templates {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	cleanDir := writeTemplates(map[string]string{"a.tmph.html": "<p>a</p>"})
+	warningDir := writeTemplates(map[string]string{"a.tmph.html": "<p>a</p>", "b.tmph.html": "<p b b>b</p>"})
+	errorDir := writeTemplates(map[string]string{"a.tmph.html": "<p>a"})
+	failureDir := writeTemplates(map[string]string{"a.tmph.html": "<p>a</p>"})
+	if err := os.Symlink(filepath.Join(failureDir, "missing.tmph.html"), filepath.Join(failureDir, "b.tmph.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	captureCommandOutput(t)
+
+	for _, testCase := range []struct {
+		name     string
+		args     []string
+		expected int
+	}{
+		{"clean templates", []string{cleanDir}, EC_OK},
+		{"warnings fail at -fail-on warning", []string{"-fail-on", "warning", warningDir}, EC_DIAGNOSTICS},
+		{"warnings pass by default", []string{warningDir}, EC_OK},
+		{"errors fail by default", []string{errorDir}, EC_DIAGNOSTICS},
+		{"errors pass at -fail-on none", []string{"-fail-on", "none", errorDir}, EC_OK},
+		{"templates which couldn't be read fail at -fail-on none", []string{"-fail-on", "none", failureDir}, EC_FAILURE},
+		{"invalid -fail-on severity", []string{"-fail-on", "fatal", cleanDir}, EC_USAGE},
+		{"more than one root", []string{cleanDir, errorDir}, EC_USAGE},
+	} {
+		for _, format := range []string{"human", "json", "sarif", "github"} {
+			if exitCode := runCheckCommand(append([]string{"-format", format}, testCase.args...)); exitCode != testCase.expected {
+				t.Errorf("%s (format %s): expected exit code %d, got %d", testCase.name, format, testCase.expected, exitCode)
+			}
+		}
+	}
+}
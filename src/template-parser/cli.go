@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Exit codes for the commands. Serving exits with EC_OK once the server has shut down.
+const (
+	EC_OK          = 0 // every template was parsed without any diagnostics
+	EC_DIAGNOSTICS = 1 // every template was parsed, but at least one had diagnostics
+	EC_USAGE       = 2 // the command or its flags were invalid
+	EC_FAILURE     = 3 // a template couldn't be read or parsed at all
+)
+
+// Text in the human-readable tree is cut off after this many characters so each node fits on a line
+const AST_TREE_MAX_TEXT_LENGTH = 60
+
+func writeUsage(writer io.Writer) {
+	programName := filepath.Base(os.Args[0])
+	io.WriteString(writer, `Usage: `+programName+` <command> [flags] [arguments]
+
+Commands:
+  serve             serve parse requests over HTTP or JSON-RPC; this is the default if no command is given
+  parse <paths...>  parse templates and write them as JSON; paths can be globs like "src/**/*.tmph.html"
+  tokens <path>     print the tokens the lexer reads from a template
+  ast <path>        print a template's parsed tree as indented JSON, or as a human-readable tree with -tree
+  check [root]      check every template under a directory for problems and report them for people or CI
+  help              print this message
+
+Run "`+programName+` <command> -h" to see a command's flags.
+
+Exit codes:
+  0  no diagnostics were found
+  1  diagnostics were found; for check, only diagnostics at or above its -fail-on severity count
+  2  the command was used incorrectly
+  3  a template couldn't be read or parsed
+`)
+}
+
+func setCommandUsage(flags *flag.FlagSet, usage string) {
+	flags.Usage = func() {
+		io.WriteString(flags.Output(), "Usage: "+filepath.Base(os.Args[0])+" "+usage+"\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+}
+
+// Reports a problem with a command's arguments and returns the usage exit code
+func usageError(flags *flag.FlagSet, message string) int {
+	io.WriteString(flags.Output(), message+"\n\n")
+	flags.Usage()
+	return EC_USAGE
+}
+
+// Adds flags for the limits which apply to every parse
+func addParseLimitFlags(flags *flag.FlagSet) {
+	flags.Int64Var(&templateParseLimits.MaxInputSize, "max-input-size", DEFAULT_PARSE_LIMITS.MaxInputSize, "maximum number of bytes of a template to parse; 0 disables the limit")
+	flags.IntVar(&templateParseLimits.MaxNestingDepth, "max-nesting-depth", DEFAULT_PARSE_LIMITS.MaxNestingDepth, "maximum number of elements which can be nested inside of each other; 0 disables the limit")
+	flags.IntVar(&templateParseLimits.MaxAttributeCount, "max-attribute-count", DEFAULT_PARSE_LIMITS.MaxAttributeCount, "maximum number of attributes on a single element; 0 disables the limit")
+	flags.IntVar(&templateParseLimits.MaxAttributeLength, "max-attribute-length", DEFAULT_PARSE_LIMITS.MaxAttributeLength, "maximum number of bytes in a single attribute name or value; 0 disables the limit")
+	flags.IntVar(&templateParseLimits.MaxTextLength, "max-text-length", DEFAULT_PARSE_LIMITS.MaxTextLength, "maximum number of bytes in a single run of text; 0 disables the limit")
+	flags.IntVar(&templateParseLimits.MaxNodeCount, "max-node-count", DEFAULT_PARSE_LIMITS.MaxNodeCount, "maximum number of element and text nodes in a template; 0 disables the limit")
+	flags.DurationVar(&templateParseLimits.Timeout, "parse-timeout", DEFAULT_PARSE_LIMITS.Timeout, "maximum amount of time a single template can take to parse; 0 disables the limit")
+}
+
+// Adds a flag which sets one of the parse endpoint's query parameters so the commands can share its option parsing
+func addQueryFlag(flags *flag.FlagSet, query url.Values, name string, queryParam string, usage string) {
+	flags.Func(name, usage, func(value string) error {
+		query.Set(queryParam, value)
+		return nil
+	})
+}
+
+// Adds flags for the lexer options; read them with parseLexerOptionsFromQuery once the flags have been parsed
+func addLexerOptionFlags(flags *flag.FlagSet, query url.Values) {
+	addQueryFlag(flags, query, "raw-text", "rawText", "how to find the end of raw text elements like <script>: 'lenient' or 'strict' (default 'lenient')")
+	addQueryFlag(flags, query, "columns", "columns", "unit to count columns in: 'runes', 'bytes' or 'utf16' (default 'runes')")
+	flags.BoolFunc("backslash-escapes", "allow backslashes to escape quotes inside of quoted attribute values", func(value string) error {
+		query.Set("backslashEscapes", value)
+		return nil
+	})
+	addQueryFlag(flags, query, "text-chunk-size", "textChunkSize", "split runs of text longer than this many bytes into chunks; 0 never splits text (default 0)")
+}
+
+// Adds flags for the parse options; read them with parseOptionsFromQuery once the flags have been parsed
+func addParseOptionFlags(flags *flag.FlagSet, query url.Values) {
+	addLexerOptionFlags(flags, query)
+	addQueryFlag(flags, query, "whitespace", "whitespace", "what to do with whitespace-only text: 'preserve', 'drop' or 'collapse' (default 'preserve')")
+}
+
+// Formats a diagnostic as a single line for the terminal, ie "index.tmph.html:3:5: warning: <p> has a duplicate 'class' attribute (duplicate-attribute)"
+func formatDiagnosticLine(diagnostic *Diagnostic) string {
+	return diagnostic.Path + ":" + strconv.Itoa(diagnostic.Line) + ":" + strconv.Itoa(diagnostic.Col) + ": " + diagnostic.Severity.String() + ": " + diagnostic.Message + " (" + diagnostic.Code + ")"
+}
+
+// Gets the exit code for a template which was parsed with the given diagnostics
+func getDiagnosticsExitCode(diagnostics []*Diagnostic) int {
+	if len(diagnostics) > 0 {
+		return EC_DIAGNOSTICS
+	}
+	return EC_OK
+}
+
+// Finds the templates for a command's arguments, which are either paths or glob patterns like "src/**/*.tmph.html".
+// Patterns are matched by searching from the longest leading directory without any glob characters.
+func resolveTemplateArgs(args []string) ([]string, error) {
+	var templateFilePaths []string
+	isResolved := make(map[string]bool)
+
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			// Cleaned the same way as the paths patterns match so a file is only included once
+			templateFilePath := filepath.Clean(arg)
+			if !isResolved[templateFilePath] {
+				isResolved[templateFilePath] = true
+				templateFilePaths = append(templateFilePaths, templateFilePath)
+			}
+			continue
+		}
+
+		segments := strings.Split(filepath.ToSlash(arg), "/")
+		patternStart := 0
+		for patternStart < len(segments) && !strings.ContainsAny(segments[patternStart], "*?[") {
+			patternStart++
+		}
+
+		dir := strings.Join(segments[:patternStart], "/")
+		if dir == "" && patternStart > 0 {
+			// The pattern is an absolute path with a glob in its first segment
+			dir = "/"
+		} else if dir == "" {
+			dir = "."
+		}
+
+		pattern := strings.Join(segments[patternStart:], "/")
+		if err := validateGlob(pattern); err != nil {
+			return nil, errors.New("invalid glob pattern '" + arg + "'")
+		}
+
+		batch := &ParseBatch{Dir: filepath.FromSlash(dir), Include: []string{pattern}}
+		matchingPaths, err := batch.ResolvePaths()
+		if err != nil {
+			return nil, err
+		}
+		for _, matchingPath := range matchingPaths {
+			if !isResolved[matchingPath] {
+				isResolved[matchingPath] = true
+				templateFilePaths = append(templateFilePaths, matchingPath)
+			}
+		}
+	}
+
+	return templateFilePaths, nil
+}
+
+// Gets a template's path relative to the working directory. Returns false if the template isn't inside of the
+// working directory, in which case its absolute path is returned instead.
+func getWorkingDirRelativePath(templateFilePath string) (string, bool) {
+	absolutePath, err := filepath.Abs(templateFilePath)
+	if err != nil {
+		return templateFilePath, !filepath.IsAbs(templateFilePath)
+	}
+	if workingDir, err := os.Getwd(); err == nil {
+		if relativePath, err := filepath.Rel(workingDir, absolutePath); err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return relativePath, true
+		}
+	}
+	return absolutePath, false
+}
+
+// Gets where a template's output goes in an output directory. Outputs mirror the templates' paths relative to the
+// working directory; templates outside of it keep their whole path.
+func getOutputPath(outDir string, templateFilePath string, extension string) string {
+	relativePath, _ := getWorkingDirRelativePath(templateFilePath)
+	relativePath = strings.TrimPrefix(relativePath, filepath.VolumeName(relativePath))
+	return filepath.Join(outDir, relativePath) + extension
+}
+
+// Parses templates and writes them as JSON, either to stdout as one line per template or to a file per template in an
+// output directory
+func runParseCommand(args []string) int {
+	flags := flag.NewFlagSet("parse", flag.ExitOnError)
+	setCommandUsage(flags, "parse [flags] <paths or globs...>")
+
+	query := url.Values{}
+	addQueryFlag(flags, query, "format", "format", "output format: 'tree' or 'events'; events can only be written to an output directory (default 'tree')")
+	addParseOptionFlags(flags, query)
+	addParseLimitFlags(flags)
+	outDir := flags.String("out", "", "directory to write each template's output to, as <path>.json for trees or <path>.ndjson for events; if this isn't set, results are written to stdout as newline-delimited JSON like /parse-batch")
+	flags.Parse(args)
+
+	options, err := parseOptionsFromQuery(query)
+	if err != nil {
+		return usageError(flags, err.Error())
+	}
+	if flags.NArg() == 0 {
+		return usageError(flags, "no templates to parse")
+	}
+	if options.OutputFormat == OF_EVENTS && *outDir == "" {
+		return usageError(flags, "the events format can only be written to an output directory with -out")
+	}
+
+	templateFilePaths, err := resolveTemplateArgs(flags.Args())
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return EC_FAILURE
+	}
+
+	outputExtension := ".json"
+	if options.OutputFormat == OF_EVENTS {
+		outputExtension = ".ndjson"
+	}
+
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+
+	exitCode := EC_OK
+	for _, templateFilePath := range templateFilePaths {
+		responseBuffer := &bufferedResponseWriter{}
+		var responseWriter http.ResponseWriter = responseBuffer
+		output := &diagnosticCollectingOutput{parseOutput: newParseOutput(options.OutputFormat, &responseWriter)}
+
+		err := parseTemplateFileToOutput(context.Background(), templateFilePath, options, output)
+		if err == nil && *outDir != "" {
+			outputPath := getOutputPath(*outDir, templateFilePath, outputExtension)
+			if err = os.MkdirAll(filepath.Dir(outputPath), 0o755); err == nil {
+				err = os.WriteFile(outputPath, responseBuffer.body.Bytes(), 0o644)
+			}
+		} else if *outDir == "" {
+			result := &BatchResult{Path: templateFilePath}
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Nodes = responseBuffer.body.Bytes()
+			}
+			resultJSON, _ := json.Marshal(result)
+			stdout.Write(append(resultJSON, '\n'))
+		}
+
+		if err != nil {
+			os.Stderr.WriteString(templateFilePath + ": " + err.Error() + "\n")
+			exitCode = max(exitCode, EC_FAILURE)
+			continue
+		}
+
+		for _, diagnostic := range output.diagnostics {
+			os.Stderr.WriteString(formatDiagnosticLine(diagnostic) + "\n")
+		}
+		exitCode = max(exitCode, getDiagnosticsExitCode(output.diagnostics))
+	}
+
+	return exitCode
+}
+
+// Prints each token the lexer reads from a template on its own line
+func runTokensCommand(args []string) int {
+	flags := flag.NewFlagSet("tokens", flag.ExitOnError)
+	setCommandUsage(flags, "tokens [flags] <path>")
+
+	query := url.Values{}
+	addLexerOptionFlags(flags, query)
+	addParseLimitFlags(flags)
+	flags.Parse(args)
+
+	lexerOptions, err := parseLexerOptionsFromQuery(query)
+	if err != nil {
+		return usageError(flags, err.Error())
+	}
+	if flags.NArg() != 1 {
+		return usageError(flags, "expected the path of a single template")
+	}
+	templateFilePath := flags.Arg(0)
+
+	file, err := os.Open(templateFilePath)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return EC_FAILURE
+	}
+	defer file.Close()
+
+	limits := templateParseLimits
+	lexer := NewLexer(context.Background(), NewTemplateSource(newInputSizeLimitReader(file, limits.MaxInputSize)), limits.ApplyToLexerOptions(lexerOptions))
+
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+
+	exitCode := EC_OK
+	for {
+		token := lexer.NextToken()
+		stdout.WriteString(lexer.FormatToken(&token) + "\n")
+
+		switch token.tokenType {
+		case LT_DIAGNOSTIC:
+			exitCode = max(exitCode, EC_DIAGNOSTICS)
+		case LT_ERROR:
+			return EC_FAILURE
+		case LT_EOF:
+			return exitCode
+		}
+	}
+}
+
+// Prints a template's parsed tree, either as indented JSON or as a human-readable tree
+func runASTCommand(args []string) int {
+	flags := flag.NewFlagSet("ast", flag.ExitOnError)
+	setCommandUsage(flags, "ast [flags] <path>")
+
+	query := url.Values{}
+	isTree := flags.Bool("tree", false, "print a human-readable tree instead of JSON")
+	addParseOptionFlags(flags, query)
+	addParseLimitFlags(flags)
+	flags.Parse(args)
+
+	options, err := parseOptionsFromQuery(query)
+	if err != nil {
+		return usageError(flags, err.Error())
+	}
+	if flags.NArg() != 1 {
+		return usageError(flags, "expected the path of a single template")
+	}
+	templateFilePath := flags.Arg(0)
+
+	responseBuffer := &bufferedResponseWriter{}
+	var responseWriter http.ResponseWriter = responseBuffer
+	result, err := parseTemplateFileResult(context.Background(), templateFilePath, templateFilePath, options, &responseWriter)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		return EC_FAILURE
+	}
+
+	stdout := bufio.NewWriter(os.Stdout)
+	defer stdout.Flush()
+
+	if *isTree {
+		writeASTTree(stdout, result)
+	} else {
+		var indentedJSON bytes.Buffer
+		json.Indent(&indentedJSON, responseBuffer.body.Bytes(), "", "  ")
+		indentedJSON.WriteByte('\n')
+		indentedJSON.WriteTo(stdout)
+	}
+
+	var diagnostics []*Diagnostic
+	for _, entry := range result.Entries {
+		if entry.Diagnostic != nil {
+			diagnostics = append(diagnostics, entry.Diagnostic)
+		}
+	}
+	return getDiagnosticsExitCode(diagnostics)
+}
+
+// Writes a parsed template as a tree with one node per line, ie
+//
+//	div class="list" (1:1)
+//	├─ "Some text" (1:18)
+//	└─ p (2:3)
+//	   └─ "More text" (2:6)
+//
+// Diagnostics are written between the root nodes in the order they were found.
+func writeASTTree(writer io.Writer, result *ParseResult) {
+	var writeNode func(node *Node, linePrefix string, childPrefix string)
+	writeNode = func(node *Node, linePrefix string, childPrefix string) {
+		io.WriteString(writer, linePrefix+formatASTNode(node)+"\n")
+		for i, child := range node.Children {
+			if i == len(node.Children)-1 {
+				writeNode(child, childPrefix+"└─ ", childPrefix+"   ")
+			} else {
+				writeNode(child, childPrefix+"├─ ", childPrefix+"│  ")
+			}
+		}
+	}
+
+	for _, entry := range result.Entries {
+		if entry.Diagnostic != nil {
+			diagnostic := entry.Diagnostic
+			io.WriteString(writer, "! "+diagnostic.Severity.String()+" "+diagnostic.Code+": "+diagnostic.Message+" ("+strconv.Itoa(diagnostic.Line)+":"+strconv.Itoa(diagnostic.Col)+")\n")
+		} else {
+			writeNode(entry.Node, "", "")
+		}
+	}
+}
+
+// Formats a single node for the human-readable tree
+func formatASTNode(node *Node) string {
+	position := " (" + strconv.Itoa(node.Line) + ":" + strconv.Itoa(node.Col) + ")"
+
+	if node.TagName == "" {
+		text := node.TextContent
+		isTruncated := node.Continues
+		if utf8.RuneCountInString(text) > AST_TREE_MAX_TEXT_LENGTH {
+			text = string([]rune(text)[:AST_TREE_MAX_TEXT_LENGTH])
+			isTruncated = true
+		}
+		formattedText := strconv.Quote(text)
+		if isTruncated {
+			formattedText += "..."
+		}
+		return formattedText + position
+	}
+
+	formattedElement := node.TagName
+	if node.Namespace != "" && node.Namespace != NS_HTML {
+		formattedElement += " [" + string(node.Namespace) + "]"
+	}
+	for _, attribute := range node.Attributes {
+		formattedElement += " " + attribute.Name
+		if attribute.Value != "" {
+			formattedElement += "=" + strconv.Quote(attribute.Value)
+		}
+	}
+	return formattedElement + position
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Changes the working directory for the rest of the test
+func changeWorkingDir(t *testing.T, dir string) {
+	previousWorkingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(previousWorkingDir)
+	})
+}
+
+func TestResolveTemplateArgs(t *testing.T) {
+	root := t.TempDir()
+	for _, templatePath := range []string{"a.tmph.html", "src/b.tmph.html", "src/nested/c.tmph.html", "src/d.txt", "lib/e.tmph.html"} {
+		filePath := filepath.Join(root, filepath.FromSlash(templatePath))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte("<p></p>"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changeWorkingDir(t, root)
+
+	for _, testCase := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "paths are kept whether or not they exist",
+			args:     []string{"src/b.tmph.html", "missing.tmph.html"},
+			expected: []string{"src/b.tmph.html", "missing.tmph.html"},
+		},
+		{
+			name:     "glob in a directory",
+			args:     []string{"src/*.tmph.html"},
+			expected: []string{"src/b.tmph.html"},
+		},
+		{
+			name:     "recursive glob",
+			args:     []string{"src/**/*.tmph.html"},
+			expected: []string{"src/b.tmph.html", "src/nested/c.tmph.html"},
+		},
+		{
+			name:     "glob in the first segment",
+			args:     []string{"*/b.tmph.html"},
+			expected: []string{"src/b.tmph.html"},
+		},
+		{
+			name:     "absolute pattern",
+			args:     []string{filepath.Join(root, "src", "**", "*.tmph.html")},
+			expected: []string{filepath.Join(root, "src", "b.tmph.html"), filepath.Join(root, "src", "nested", "c.tmph.html")},
+		},
+		{
+			name:     "the same file from several arguments is only included once",
+			args:     []string{"./src/b.tmph.html", "src/*.tmph.html", "./src/**/*.tmph.html", "**/c.tmph.html"},
+			expected: []string{"src/b.tmph.html", "src/nested/c.tmph.html"},
+		},
+	} {
+		for i, expectedPath := range testCase.expected {
+			testCase.expected[i] = filepath.FromSlash(expectedPath)
+		}
+
+		templateFilePaths, err := resolveTemplateArgs(testCase.args)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+		} else if !reflect.DeepEqual(templateFilePaths, testCase.expected) {
+			t.Errorf("%s: expected %v, got %v", testCase.name, testCase.expected, templateFilePaths)
+		}
+	}
+
+	if _, err := resolveTemplateArgs([]string{"src/[.tmph.html"}); err == nil {
+		t.Error("expected an invalid glob pattern to be an error")
+	}
+}
+
+func TestGetOutputPath(t *testing.T) {
+	workingDir := t.TempDir()
+	outsidePath := filepath.Join(t.TempDir(), "outside.tmph.html")
+	changeWorkingDir(t, workingDir)
+
+	// Templates outside of the working directory keep their whole path without its volume, so the output still ends up
+	// inside of the output directory
+	outsidePathWithoutVolume := strings.TrimPrefix(outsidePath, filepath.VolumeName(outsidePath))
+	siblingPath := filepath.Join(filepath.Dir(workingDir), "sibling", "a.tmph.html")
+	siblingPathWithoutVolume := strings.TrimPrefix(siblingPath, filepath.VolumeName(siblingPath))
+
+	for _, testCase := range []struct {
+		name             string
+		templateFilePath string
+		expected         string
+	}{
+		{"relative path", filepath.Join("src", "a.tmph.html"), filepath.Join("out", "src", "a.tmph.html.json")},
+		{"absolute path inside of the working directory", filepath.Join(workingDir, "src", "a.tmph.html"), filepath.Join("out", "src", "a.tmph.html.json")},
+		{"absolute path outside of the working directory", outsidePath, filepath.Join("out", outsidePathWithoutVolume+".json")},
+		{"relative path outside of the working directory", filepath.Join("..", "sibling", "a.tmph.html"), filepath.Join("out", siblingPathWithoutVolume+".json")},
+	} {
+		outputPath := getOutputPath("out", testCase.templateFilePath, ".json")
+		if outputPath != testCase.expected {
+			t.Errorf("%s: expected %s, got %s", testCase.name, testCase.expected, outputPath)
+		}
+		if !strings.HasPrefix(outputPath, "out"+string(filepath.Separator)) {
+			t.Errorf("%s: expected %s to be inside of the output directory", testCase.name, outputPath)
+		}
+	}
+}
+
+func TestTokensAndASTCommandExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	for name, source := range map[string]string{
+		"clean.tmph.html":       "<p class=\"a\">text</p>",
+		"diagnostics.tmph.html": "<p a a>text</p>",
+		"fatal.tmph.html":       "<div></p></div>",
+		"large.tmph.html":       "<p>" + strings.Repeat("a", 100) + "</p>",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var templatePath = func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	previousLimits := templateParseLimits
+	t.Cleanup(func() {
+		templateParseLimits = previousLimits
+	})
+	captureCommandOutput(t)
+
+	for _, testCase := range []struct {
+		name           string
+		args           []string
+		expectedTokens int
+		expectedAST    int
+	}{
+		{name: "template without diagnostics", args: []string{templatePath("clean.tmph.html")}, expectedTokens: EC_OK, expectedAST: EC_OK},
+		{name: "template with diagnostics", args: []string{templatePath("diagnostics.tmph.html")}, expectedTokens: EC_DIAGNOSTICS, expectedAST: EC_DIAGNOSTICS},
+		// The lexer doesn't know about elements, so only the parser fails on the stray closing tag
+		{name: "template which can't be parsed", args: []string{templatePath("fatal.tmph.html")}, expectedTokens: EC_OK, expectedAST: EC_FAILURE},
+		{name: "template which can't be read", args: []string{templatePath("missing.tmph.html")}, expectedTokens: EC_FAILURE, expectedAST: EC_FAILURE},
+		{name: "template past the input size limit", args: []string{"-max-input-size", "10", templatePath("large.tmph.html")}, expectedTokens: EC_DIAGNOSTICS, expectedAST: EC_DIAGNOSTICS},
+		{name: "no template", args: []string{}, expectedTokens: EC_USAGE, expectedAST: EC_USAGE},
+		{name: "more than one template", args: []string{templatePath("clean.tmph.html"), templatePath("clean.tmph.html")}, expectedTokens: EC_USAGE, expectedAST: EC_USAGE},
+	} {
+		// The limit flags write to the global limits, so each command starts from the defaults
+		templateParseLimits = previousLimits
+		if exitCode := runTokensCommand(testCase.args); exitCode != testCase.expectedTokens {
+			t.Errorf("%s: expected tokens to exit with %d, got %d", testCase.name, testCase.expectedTokens, exitCode)
+		}
+		for _, extraArgs := range [][]string{{}, {"-tree"}} {
+			templateParseLimits = previousLimits
+			if exitCode := runASTCommand(append(extraArgs, testCase.args...)); exitCode != testCase.expectedAST {
+				t.Errorf("%s: expected ast %v to exit with %d, got %d", testCase.name, extraArgs, testCase.expectedAST, exitCode)
+			}
+		}
+	}
+}
+
+func TestFormatASTNode(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		node     *Node
+		expected string
+	}{
+		{
+			name:     "text",
+			node:     &Node{TextContent: "Some \"text\"\n", Line: 1, Col: 2},
+			expected: `"Some \"text\"\n" (1:2)`,
+		},
+		{
+			name:     "text at the length limit isn't truncated",
+			node:     &Node{TextContent: strings.Repeat("a", AST_TREE_MAX_TEXT_LENGTH), Line: 1, Col: 1},
+			expected: `"` + strings.Repeat("a", AST_TREE_MAX_TEXT_LENGTH) + `" (1:1)`,
+		},
+		{
+			name:     "text past the length limit is truncated",
+			node:     &Node{TextContent: strings.Repeat("a", AST_TREE_MAX_TEXT_LENGTH+1), Line: 1, Col: 1},
+			expected: `"` + strings.Repeat("a", AST_TREE_MAX_TEXT_LENGTH) + `"... (1:1)`,
+		},
+		{
+			name:     "text is truncated by characters rather than bytes",
+			node:     &Node{TextContent: strings.Repeat("é", AST_TREE_MAX_TEXT_LENGTH) + "😀", Line: 1, Col: 1},
+			expected: `"` + strings.Repeat("é", AST_TREE_MAX_TEXT_LENGTH) + `"... (1:1)`,
+		},
+		{
+			name:     "text which continues in the next chunk",
+			node:     &Node{TextContent: "abc", Continues: true, Line: 1, Col: 1},
+			expected: `"abc"... (1:1)`,
+		},
+		{
+			name:     "html element",
+			node:     &Node{TagName: "div", Namespace: NS_HTML, Attributes: []*Attribute{{Name: "class", Value: "a \"b\""}, {Name: "hidden"}}, Line: 3, Col: 4},
+			expected: `div class="a \"b\"" hidden (3:4)`,
+		},
+		{
+			name:     "foreign element",
+			node:     &Node{TagName: "svg", Namespace: NS_SVG, Attributes: []*Attribute{{Name: "viewBox", Value: "0 0 1 1"}}, Line: 1, Col: 1},
+			expected: `svg [svg] viewBox="0 0 1 1" (1:1)`,
+		},
+	} {
+		if formattedNode := formatASTNode(testCase.node); formattedNode != testCase.expected {
+			t.Errorf("%s: expected %s, got %s", testCase.name, testCase.expected, formattedNode)
+		}
+	}
+}
@@ -5,13 +5,17 @@ import "errors"
 type Attribute struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
-	Line  int    `json:"l"`
-	Col   int    `json:"c"`
+	// The value with backslash escapes resolved; only set if backslash escapes are enabled and the value contains escapes
+	UnescapedValue string `json:"unescapedValue,omitempty"`
+	Line           int    `json:"l"`
+	Col            int    `json:"c"`
 }
 
 type Node struct {
 	TagName     string       `json:"tagName,omitempty"`
+	Namespace   Namespace    `json:"ns,omitempty"`
 	TextContent string       `json:"textContent,omitempty"`
+	Continues   bool         `json:"continues,omitempty"` // Set if the text was split into chunks and continues in the next text node
 	Attributes  []*Attribute `json:"attributes,omitempty"`
 	Children    []*Node      `json:"children,omitempty"`
 	Parent      *Node        `json:"-"` // This field is not serialized
@@ -33,22 +37,33 @@ func (n *Node) AddAttribute(name string, line, col int) {
 	})
 }
 
-func (n *Node) UpdateLatestAttributeValue(attrValue string) error {
+func (n *Node) UpdateLatestAttributeValue(attrValue string, unescapedAttrValue string) error {
 	attrCount := len(n.Attributes)
 	if attrCount == 0 {
 		return errors.New("no attributes found to set value '" + attrValue + "' on")
 	}
 
-	n.Attributes[attrCount-1].Value = attrValue
+	latestAttribute := n.Attributes[attrCount-1]
+	latestAttribute.Value = attrValue
+	if unescapedAttrValue != attrValue {
+		latestAttribute.UnescapedValue = unescapedAttrValue
+	}
 	return nil
 }
 
-func CreateElementNode(tagName string, line, col int) *Node {
+// Diagnostics are written to the parsed output alongside root nodes, wrapped in a record
+// so they can be distinguished from nodes
+type DiagnosticRecord struct {
+	Diagnostic *Diagnostic `json:"diagnostic"`
+}
+
+func CreateElementNode(tagName string, namespace Namespace, line, col int) *Node {
 	return &Node{
-		Line:     line,
-		Col:      col,
-		TagName:  tagName,
-		Children: []*Node{},
+		Line:      line,
+		Col:       col,
+		TagName:   tagName,
+		Namespace: namespace,
+		Children:  []*Node{},
 	}
 }
 
@@ -0,0 +1,89 @@
+package main
+
+import "errors"
+
+type DiagnosticSeverity int
+
+const (
+	DS_INFO    DiagnosticSeverity = iota // informational; the template is fine
+	DS_WARNING                           // recoverable problem; the template may not behave as intended
+	DS_ERROR                             // the template is malformed
+)
+
+func (s DiagnosticSeverity) String() string {
+	switch s {
+	case DS_INFO:
+		return "info"
+	case DS_WARNING:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+func (s DiagnosticSeverity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func parseDiagnosticSeverity(severity string) (DiagnosticSeverity, error) {
+	switch severity {
+	case "info":
+		return DS_INFO, nil
+	case "warning":
+		return DS_WARNING, nil
+	case "error":
+		return DS_ERROR, nil
+	default:
+		return DS_ERROR, errors.New("invalid severity '" + severity + "'; expected 'info', 'warning' or 'error'")
+	}
+}
+
+// Diagnostic codes; where possible, these match the parse error names from the HTML spec
+// https://html.spec.whatwg.org/multipage/parsing.html#parse-errors
+const (
+	DC_CDATA_IN_HTML_CONTENT                            = "cdata-in-html-content"
+	DC_DUPLICATE_ATTRIBUTE                              = "duplicate-attribute"
+	DC_EOF_IN_TAG                                       = "eof-in-tag"
+	DC_INVALID_BYTE_SEQUENCE                            = "invalid-byte-sequence"
+	DC_MISSING_ATTRIBUTE_VALUE                          = "missing-attribute-value"
+	DC_MISSING_WHITESPACE_BETWEEN_ATTRIBUTES            = "missing-whitespace-between-attributes"
+	DC_UNEXPECTED_CHARACTER_IN_ATTRIBUTE_NAME           = "unexpected-character-in-attribute-name"
+	DC_UNEXPECTED_CHARACTER_IN_UNQUOTED_ATTRIBUTE_VALUE = "unexpected-character-in-unquoted-attribute-value"
+	DC_UNEXPECTED_EQUALS_SIGN_BEFORE_ATTRIBUTE_NAME     = "unexpected-equals-sign-before-attribute-name"
+	DC_UNEXPECTED_SOLIDUS_IN_TAG                        = "unexpected-solidus-in-tag"
+	DC_UNSUPPORTED_ENCODING                             = "unsupported-encoding"
+)
+
+// Diagnostic codes for templates which hit one of the parse limits; these aren't from the HTML spec
+const (
+	DC_ATTRIBUTE_TOO_LONG  = "attribute-too-long"
+	DC_INPUT_TOO_LARGE     = "input-too-large"
+	DC_NESTING_TOO_DEEP    = "nesting-too-deep"
+	DC_PARSE_TIMEOUT       = "parse-timeout"
+	DC_TEXT_TOO_LONG       = "text-too-long"
+	DC_TOO_MANY_ATTRIBUTES = "too-many-attributes"
+	DC_TOO_MANY_NODES      = "too-many-nodes"
+)
+
+// Diagnostic codes for problems found while building the tree; the HTML spec recovers from these without naming them
+const (
+	DC_MISNESTED_CLOSING_TAG  = "misnested-closing-tag"
+	DC_UNCLOSED_ELEMENT       = "unclosed-element"
+	DC_UNEXPECTED_CLOSING_TAG = "unexpected-closing-tag"
+)
+
+// Diagnostic code the check command reports for templates which couldn't be parsed at all; the endpoints respond with
+// an error instead
+const DC_PARSE_ERROR = "parse-error"
+
+type Diagnostic struct {
+	Code     string             `json:"code"`
+	Severity DiagnosticSeverity `json:"severity"`
+	Message  string             `json:"message"`
+	// The path of the template the diagnostic was found in; this is a virtual path for templates which weren't read from a file
+	Path string `json:"path,omitempty"`
+	Line int    `json:"l"`
+	Col  int    `json:"c"`
+	// The byte offset in the file where the problem was found; only set for diagnostics about the file's raw bytes
+	ByteOffset *int `json:"byteOffset,omitempty"`
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	NE_INSERT    = "insert"
+	NE_REMOVE    = "remove"
+	NE_MOVE      = "move"
+	NE_TEXT      = "text"
+	NE_ATTRIBUTE = "attribute"
+)
+
+// The position of a node in a parsed template: the index of its root node, followed by the index of each node
+// in its parent's children on the way down to it
+type NodePath []int
+
+// A single edit in an edit script which turns one parsed template into another.
+// Edits are applied in order, and each edit's paths refer to the tree as it is after the edits before it were applied.
+type NodeEdit struct {
+	Op   string   `json:"op"`
+	Path NodePath `json:"path"`
+	// The node's path before it was moved; for move edits, Path is where the node ends up once it has been removed from
+	// its old position
+	From NodePath `json:"from,omitempty"`
+	// The inserted node, including its children
+	Node *Node `json:"node,omitempty"`
+	// The text node's new content
+	TextContent *string `json:"textContent,omitempty"`
+	// The name of the changed attribute
+	Name string `json:"name,omitempty"`
+	// The attribute's new value, or nil if the attribute was removed
+	Attribute *Attribute `json:"attribute,omitempty"`
+}
+
+// Produces an edit script which turns the root nodes of one parse result into those of another.
+// Diagnostics and node positions are not compared, since every edit shifts the positions of everything after it.
+func diffParseResults(oldResult *ParseResult, newResult *ParseResult) []NodeEdit {
+	return diffNodes(oldResult.RootNodes(), newResult.RootNodes())
+}
+
+// Produces an edit script which turns one list of root nodes into another
+func diffNodes(oldNodes []*Node, newNodes []*Node) []NodeEdit {
+	differ := &nodeDiffer{nodeHashes: make(map[*Node]uint64)}
+	differ.diffChildren(NodePath{}, oldNodes, newNodes)
+	return differ.edits
+}
+
+func (result *ParseResult) RootNodes() []*Node {
+	if result == nil {
+		return nil
+	}
+
+	nodes := make([]*Node, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		if entry.Node != nil {
+			nodes = append(nodes, entry.Node)
+		}
+	}
+	return nodes
+}
+
+type nodeDiffer struct {
+	edits []NodeEdit
+	// Hashes of each node's content and descendants, so identical subtrees can be found without comparing them in full
+	nodeHashes map[*Node]uint64
+}
+
+func (d *nodeDiffer) hashNode(node *Node) uint64 {
+	if hash, ok := d.nodeHashes[node]; ok {
+		return hash
+	}
+
+	hasher := fnv.New64a()
+	writeString := func(s string) {
+		// Prefix each string with its length so different splits of the same content don't collide
+		binary.Write(hasher, binary.LittleEndian, uint32(len(s)))
+		hasher.Write([]byte(s))
+	}
+
+	writeString(getNodeKind(node))
+	writeString(node.TextContent)
+	for _, attribute := range node.Attributes {
+		writeString(attribute.Name)
+		writeString(attribute.Value)
+		writeString(attribute.UnescapedValue)
+	}
+	for _, child := range node.Children {
+		binary.Write(hasher, binary.LittleEndian, d.hashNode(child))
+	}
+
+	hash := hasher.Sum64()
+	d.nodeHashes[node] = hash
+	return hash
+}
+
+// Nodes can only be updated in place by a diff if they're the same kind; otherwise they're removed and re-inserted
+func getNodeKind(node *Node) string {
+	if node.TagName == "" {
+		if node.Continues {
+			return "#text-continues"
+		}
+		return "#text"
+	}
+	return string(node.Namespace) + ":" + node.TagName
+}
+
+func (d *nodeDiffer) nodesAreEqual(oldNode *Node, newNode *Node) bool {
+	// Hashes can collide, so confirm with a full comparison
+	return d.hashNode(oldNode) == d.hashNode(newNode) && nodesAreEqual(oldNode, newNode)
+}
+
+func nodesAreEqual(oldNode *Node, newNode *Node) bool {
+	if getNodeKind(oldNode) != getNodeKind(newNode) || oldNode.TextContent != newNode.TextContent ||
+		len(oldNode.Attributes) != len(newNode.Attributes) || len(oldNode.Children) != len(newNode.Children) {
+		return false
+	}
+
+	for i, oldAttribute := range oldNode.Attributes {
+		newAttribute := newNode.Attributes[i]
+		if oldAttribute.Name != newAttribute.Name || oldAttribute.Value != newAttribute.Value || oldAttribute.UnescapedValue != newAttribute.UnescapedValue {
+			return false
+		}
+	}
+
+	for i, oldChild := range oldNode.Children {
+		if !nodesAreEqual(oldChild, newNode.Children[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func childPath(parentPath NodePath, index int) NodePath {
+	path := make(NodePath, len(parentPath)+1)
+	copy(path, parentPath)
+	path[len(parentPath)] = index
+	return path
+}
+
+func (d *nodeDiffer) diffChildren(parentPath NodePath, oldChildren []*Node, newChildren []*Node) {
+	// The index of the old child matched to each new child, or -1 if the new child has to be inserted
+	matchedOldIndices := make([]int, len(newChildren))
+	isOldChildMatched := make([]bool, len(oldChildren))
+
+	// First match children which are completely unchanged, wherever they are, so they can be moved instead of rebuilt
+	oldIndicesByHash := make(map[uint64][]int)
+	for oldIndex, oldChild := range oldChildren {
+		hash := d.hashNode(oldChild)
+		oldIndicesByHash[hash] = append(oldIndicesByHash[hash], oldIndex)
+	}
+	for newIndex, newChild := range newChildren {
+		matchedOldIndices[newIndex] = -1
+		candidates := oldIndicesByHash[d.hashNode(newChild)]
+		for i, oldIndex := range candidates {
+			if d.nodesAreEqual(oldChildren[oldIndex], newChild) {
+				matchedOldIndices[newIndex] = oldIndex
+				isOldChildMatched[oldIndex] = true
+				oldIndicesByHash[d.hashNode(newChild)] = append(candidates[:i:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Then match the remaining children of the same kind in order so they can be updated in place
+	unmatchedOldIndicesByKind := make(map[string][]int)
+	for oldIndex, oldChild := range oldChildren {
+		if !isOldChildMatched[oldIndex] {
+			kind := getNodeKind(oldChild)
+			unmatchedOldIndicesByKind[kind] = append(unmatchedOldIndicesByKind[kind], oldIndex)
+		}
+	}
+	for newIndex, newChild := range newChildren {
+		if matchedOldIndices[newIndex] != -1 {
+			continue
+		}
+		kind := getNodeKind(newChild)
+		if candidates := unmatchedOldIndicesByKind[kind]; len(candidates) > 0 {
+			matchedOldIndices[newIndex] = candidates[0]
+			isOldChildMatched[candidates[0]] = true
+			unmatchedOldIndicesByKind[kind] = candidates[1:]
+		}
+	}
+
+	// The old children which are currently in the tree, in order, as edits are applied
+	currentOldIndices := make([]int, 0, len(oldChildren))
+
+	// Remove unmatched children from the end first so the earlier children's paths don't change
+	for oldIndex := len(oldChildren) - 1; oldIndex >= 0; oldIndex-- {
+		if !isOldChildMatched[oldIndex] {
+			d.edits = append(d.edits, NodeEdit{Op: NE_REMOVE, Path: childPath(parentPath, oldIndex)})
+		}
+	}
+	for oldIndex := range oldChildren {
+		if isOldChildMatched[oldIndex] {
+			currentOldIndices = append(currentOldIndices, oldIndex)
+		}
+	}
+
+	// Children in the longest run which is already in the right order stay put; everything else moves around them
+	isStationary := findLongestIncreasingSubsequence(matchedOldIndices)
+
+	// The current position of each matched old child is looked up by scanning, which is fine for the number of children
+	// an element typically has
+	indexOf := func(oldIndex int) int {
+		for i, currentOldIndex := range currentOldIndices {
+			if currentOldIndex == oldIndex {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// Place each new child right after the new child before it. Stationary children are already in the right order
+	// relative to each other, so once every other child has been placed the children are all in order.
+	previousPosition := -1
+	for newIndex, newChild := range newChildren {
+		oldIndex := matchedOldIndices[newIndex]
+
+		if oldIndex == -1 {
+			position := previousPosition + 1
+			currentOldIndices = insertAt(currentOldIndices, position, -1-newIndex)
+			d.edits = append(d.edits, NodeEdit{Op: NE_INSERT, Path: childPath(parentPath, position), Node: newChild})
+			previousPosition = position
+			continue
+		}
+
+		currentPosition := indexOf(oldIndex)
+		if isStationary[newIndex] {
+			previousPosition = currentPosition
+			continue
+		}
+
+		currentOldIndices = append(currentOldIndices[:currentPosition], currentOldIndices[currentPosition+1:]...)
+		position := previousPosition + 1
+		if currentPosition < position {
+			// Removing the child shifted everything after it back by one
+			position--
+		}
+		currentOldIndices = insertAt(currentOldIndices, position, oldIndex)
+		if position != currentPosition {
+			d.edits = append(d.edits, NodeEdit{Op: NE_MOVE, From: childPath(parentPath, currentPosition), Path: childPath(parentPath, position)})
+		}
+		previousPosition = position
+	}
+
+	// Every child is now in its final position, so update the matched children in place
+	for newIndex, newChild := range newChildren {
+		if oldIndex := matchedOldIndices[newIndex]; oldIndex != -1 {
+			d.diffNode(childPath(parentPath, newIndex), oldChildren[oldIndex], newChild)
+		}
+	}
+}
+
+// Updates a node in place; the nodes must be the same kind
+func (d *nodeDiffer) diffNode(path NodePath, oldNode *Node, newNode *Node) {
+	if d.nodesAreEqual(oldNode, newNode) {
+		return
+	}
+
+	if newNode.TagName == "" {
+		textContent := newNode.TextContent
+		d.edits = append(d.edits, NodeEdit{Op: NE_TEXT, Path: path, TextContent: &textContent})
+		return
+	}
+
+	// Duplicate attributes are ignored in favor of the first one, which is the one browsers keep
+	oldAttributesByName := make(map[string]*Attribute, len(oldNode.Attributes))
+	for _, attribute := range oldNode.Attributes {
+		if _, ok := oldAttributesByName[attribute.Name]; !ok {
+			oldAttributesByName[attribute.Name] = attribute
+		}
+	}
+	newAttributeNames := make(map[string]bool, len(newNode.Attributes))
+
+	for _, newAttribute := range newNode.Attributes {
+		if newAttributeNames[newAttribute.Name] {
+			continue
+		}
+		newAttributeNames[newAttribute.Name] = true
+
+		oldAttribute, ok := oldAttributesByName[newAttribute.Name]
+		if !ok || oldAttribute.Value != newAttribute.Value || oldAttribute.UnescapedValue != newAttribute.UnescapedValue {
+			d.edits = append(d.edits, NodeEdit{Op: NE_ATTRIBUTE, Path: path, Name: newAttribute.Name, Attribute: newAttribute})
+		}
+	}
+
+	for _, oldAttribute := range oldNode.Attributes {
+		if !newAttributeNames[oldAttribute.Name] {
+			newAttributeNames[oldAttribute.Name] = true
+			d.edits = append(d.edits, NodeEdit{Op: NE_ATTRIBUTE, Path: path, Name: oldAttribute.Name})
+		}
+	}
+
+	d.diffChildren(path, oldNode.Children, newNode.Children)
+}
+
+func insertAt(values []int, index int, value int) []int {
+	values = append(values, 0)
+	copy(values[index+1:], values[index:])
+	values[index] = value
+	return values
+}
+
+// Finds the longest strictly increasing subsequence of the non-negative values in a list; negative values are skipped.
+// Returns whether each value is part of the subsequence.
+func findLongestIncreasingSubsequence(values []int) []bool {
+	// The index of the last value of the best subsequence found so far of each length
+	var tailIndices []int
+	previousIndices := make([]int, len(values))
+
+	for i, value := range values {
+		previousIndices[i] = -1
+		if value < 0 {
+			continue
+		}
+
+		length := sort.Search(len(tailIndices), func(j int) bool {
+			return values[tailIndices[j]] >= value
+		})
+		if length > 0 {
+			previousIndices[i] = tailIndices[length-1]
+		}
+		if length == len(tailIndices) {
+			tailIndices = append(tailIndices, i)
+		} else {
+			tailIndices[length] = i
+		}
+	}
+
+	isInSubsequence := make([]bool, len(values))
+	if len(tailIndices) > 0 {
+		for i := tailIndices[len(tailIndices)-1]; i != -1; i = previousIndices[i] {
+			isInSubsequence[i] = true
+		}
+	}
+	return isInSubsequence
+}
+
+// The maximum number of parse results kept to diff against for parse requests
+const MAX_DIFF_BASE_COUNT = 256
+
+// Recent parse results from parse requests with diffs, keyed by their ETags so a client's next request can be diffed
+// against the result it already has
+var templateDiffBases = newDiffBaseStore(MAX_DIFF_BASE_COUNT)
+
+type diffBase struct {
+	etag   string
+	result *ParseResult
+}
+
+// A small LRU store of parse results by ETag
+type diffBaseStore struct {
+	mutex       sync.Mutex
+	maxCount    int
+	bases       *list.List
+	basesByETag map[string]*list.Element
+}
+
+func newDiffBaseStore(maxCount int) *diffBaseStore {
+	return &diffBaseStore{
+		maxCount:    maxCount,
+		bases:       list.New(),
+		basesByETag: make(map[string]*list.Element),
+	}
+}
+
+func (s *diffBaseStore) get(etag string) *ParseResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.basesByETag[etag]
+	if !ok {
+		return nil
+	}
+	s.bases.MoveToFront(element)
+	return element.Value.(*diffBase).result
+}
+
+func (s *diffBaseStore) put(etag string, result *ParseResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.basesByETag[etag]; ok {
+		s.bases.MoveToFront(element)
+		return
+	}
+
+	s.basesByETag[etag] = s.bases.PushFront(&diffBase{etag: etag, result: result})
+	for s.bases.Len() > s.maxCount {
+		oldestBase := s.bases.Remove(s.bases.Back()).(*diffBase)
+		delete(s.basesByETag, oldestBase.etag)
+	}
+}
+
+// The response to a parse request with diffs
+type ParseDiffResponse struct {
+	// The parsed root nodes and diagnostic records, as they would be returned without diffs
+	Nodes json.RawMessage `json:"nodes"`
+	// The ETag of this result, which is also sent in the ETag header
+	ETag string `json:"etag"`
+	// The ETag of the previous result which the edits apply to
+	Base string `json:"base,omitempty"`
+	// The edits from the previous result to this one, or null if the client's previous result is unknown, ie if this is
+	// the first request or the previous result is too old, in which case the nodes have to be used instead
+	Edits []NodeEdit `json:"edits"`
+}
+
+// Parses a template and writes it to the response along with the edits from the previous result the client has,
+// which is identified by the request's If-None-Match header. If the client's previous result is the same as the new one,
+// a 304 Not Modified response is written instead.
+func writeTemplateDiff(ctx context.Context, content []byte, templateFilePath string, options ParseOptions, ifNoneMatch string, responseWriter *http.ResponseWriter) error {
+	etag := getParseETag(templateFilePath, getContentHash(content), options)
+	(*responseWriter).Header().Set("ETag", etag)
+	if isUpToDate(ifNoneMatch, etag) {
+		(*responseWriter).WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	responseBuffer := &bufferedResponseWriter{}
+	var bufferedWriter http.ResponseWriter = responseBuffer
+	result, err := parseTemplateResult(ctx, bytes.NewReader(content), templateFilePath, options, &bufferedWriter)
+	if err != nil {
+		return err
+	}
+
+	response := &ParseDiffResponse{Nodes: responseBuffer.body.Bytes(), ETag: etag}
+	for _, baseETag := range parseETagList(ifNoneMatch) {
+		if baseResult := templateDiffBases.get(baseETag); baseResult != nil {
+			response.Base = baseETag
+			response.Edits = diffParseResults(baseResult, result)
+			if response.Edits == nil {
+				response.Edits = []NodeEdit{}
+			}
+			break
+		}
+	}
+	if recordParseCompleteness(etag, result.Diagnostics()) {
+		templateDiffBases.put(etag, result)
+	}
+
+	stream := &responseStream{
+		responseWriter:     *responseWriter,
+		responseController: http.NewResponseController(*responseWriter),
+	}
+	stream.SetContentType("application/json")
+	if err := stream.BufferJSON(response); err != nil {
+		return err
+	}
+	return stream.Flush()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cloneNode(node *Node) *Node {
+	clone := *node
+	clone.Attributes = make([]*Attribute, len(node.Attributes))
+	for i, attribute := range node.Attributes {
+		attributeClone := *attribute
+		clone.Attributes[i] = &attributeClone
+	}
+	clone.Children = make([]*Node, len(node.Children))
+	for i, child := range node.Children {
+		clone.Children[i] = cloneNode(child)
+	}
+	return &clone
+}
+
+// Applies an edit script to a copy of a list of root nodes the way a client would
+func applyNodeEdits(t *testing.T, nodes []*Node, edits []NodeEdit) []*Node {
+	t.Helper()
+
+	roots := make([]*Node, len(nodes))
+	for i, node := range nodes {
+		roots[i] = cloneNode(node)
+	}
+
+	// Gets the list of children which the last index of a path refers to
+	var getSiblings = func(path NodePath) *[]*Node {
+		siblings := &roots
+		for _, index := range path[:len(path)-1] {
+			siblings = &(*siblings)[index].Children
+		}
+		return siblings
+	}
+	var insert = func(siblings *[]*Node, index int, node *Node) {
+		*siblings = append(*siblings, nil)
+		copy((*siblings)[index+1:], (*siblings)[index:])
+		(*siblings)[index] = node
+	}
+	var remove = func(siblings *[]*Node, index int) *Node {
+		node := (*siblings)[index]
+		*siblings = append((*siblings)[:index], (*siblings)[index+1:]...)
+		return node
+	}
+
+	for _, edit := range edits {
+		siblings := getSiblings(edit.Path)
+		index := edit.Path[len(edit.Path)-1]
+
+		switch edit.Op {
+		case NE_INSERT:
+			insert(siblings, index, cloneNode(edit.Node))
+		case NE_REMOVE:
+			remove(siblings, index)
+		case NE_MOVE:
+			node := remove(getSiblings(edit.From), edit.From[len(edit.From)-1])
+			insert(siblings, index, node)
+		case NE_TEXT:
+			(*siblings)[index].TextContent = *edit.TextContent
+		case NE_ATTRIBUTE:
+			node := (*siblings)[index]
+			attributes := node.Attributes[:0]
+			isReplaced := false
+			for _, attribute := range node.Attributes {
+				if attribute.Name != edit.Name {
+					attributes = append(attributes, attribute)
+				} else if edit.Attribute != nil && !isReplaced {
+					attributes = append(attributes, edit.Attribute)
+					isReplaced = true
+				}
+			}
+			if edit.Attribute != nil && !isReplaced {
+				attributes = append(attributes, edit.Attribute)
+			}
+			node.Attributes = attributes
+		default:
+			t.Fatalf("unknown edit op '%s'", edit.Op)
+		}
+	}
+
+	return roots
+}
+
+// Sorts every node's attributes by name, since attribute edits don't keep the attributes' order
+func sortAttributes(nodes []*Node) {
+	for _, node := range nodes {
+		sort.SliceStable(node.Attributes, func(i, j int) bool { return node.Attributes[i].Name < node.Attributes[j].Name })
+		sortAttributes(node.Children)
+	}
+}
+
+func assertNodesAreEqual(t *testing.T, name string, expectedNodes []*Node, nodes []*Node) {
+	t.Helper()
+
+	sortAttributes(expectedNodes)
+	sortAttributes(nodes)
+	isEqual := len(expectedNodes) == len(nodes)
+	for i := 0; isEqual && i < len(nodes); i++ {
+		isEqual = nodesAreEqual(expectedNodes[i], nodes[i])
+	}
+	if !isEqual {
+		expectedJSON, _ := json.Marshal(expectedNodes)
+		nodesJSON, _ := json.Marshal(nodes)
+		t.Errorf("%s: expected the edits to produce\n%s\ngot\n%s", name, expectedJSON, nodesJSON)
+	}
+}
+
+func parseNodesForDiff(t *testing.T, source string) []*Node {
+	t.Helper()
+
+	responseBuffer := &bufferedResponseWriter{}
+	var responseWriter http.ResponseWriter = responseBuffer
+	options := ParseOptions{OutputFormat: OF_TREE, Limits: DEFAULT_PARSE_LIMITS}
+	result, err := parseTemplateResult(context.Background(), strings.NewReader(source), "diff.tmph.html", options, &responseWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.RootNodes()
+}
+
+func TestDiffNodes(t *testing.T) {
+	for _, testCase := range []struct {
+		name      string
+		oldSource string
+		newSource string
+		// The ops of the expected edits, in order
+		ops []string
+	}{
+		{
+			name:      "unchanged",
+			oldSource: `<p class="a">Hello</p><ul><li>1</li></ul>`,
+			newSource: `<p class="a">Hello</p><ul><li>1</li></ul>`,
+			ops:       nil,
+		},
+		{
+			name:      "insert at the start, middle and end",
+			oldSource: `<ul><li>b</li><li>d</li></ul>`,
+			newSource: `<ul><li>a</li><li>b</li><li>c</li><li>d</li><li>e</li></ul>`,
+			ops:       []string{NE_INSERT, NE_INSERT, NE_INSERT},
+		},
+		{
+			name:      "insert a root node",
+			oldSource: `<p>a</p>`,
+			newSource: `<h1>Title</h1><p>a</p>`,
+			ops:       []string{NE_INSERT},
+		},
+		{
+			name:      "remove",
+			oldSource: `<ul><li>a</li><li>b</li><li>c</li><li>d</li></ul>`,
+			newSource: `<ul><li>b</li><li>d</li></ul>`,
+			ops:       []string{NE_REMOVE, NE_REMOVE},
+		},
+		{
+			name:      "remove everything",
+			oldSource: `<p>a</p><p>b</p>`,
+			newSource: ``,
+			ops:       []string{NE_REMOVE, NE_REMOVE},
+		},
+		{
+			name:      "move one node to the front",
+			oldSource: `<a>1</a><b>2</b><i>3</i>`,
+			newSource: `<i>3</i><a>1</a><b>2</b>`,
+			ops:       []string{NE_MOVE},
+		},
+		{
+			name:      "move one node to the back",
+			oldSource: `<a>1</a><b>2</b><i>3</i>`,
+			newSource: `<b>2</b><i>3</i><a>1</a>`,
+			ops:       []string{NE_MOVE},
+		},
+		{
+			name:      "reverse",
+			oldSource: `<ul><li>1</li><li>2</li><li>3</li><li>4</li><li>5</li></ul>`,
+			newSource: `<ul><li>5</li><li>4</li><li>3</li><li>2</li><li>1</li></ul>`,
+			ops:       []string{NE_MOVE, NE_MOVE, NE_MOVE, NE_MOVE},
+		},
+		{
+			name:      "reorder with a node which is updated in place",
+			oldSource: `<ul><li>1</li><li>2</li><li>3</li><li>4</li></ul>`,
+			newSource: `<ul><li>4</li><li>new</li><li>1</li><li>3</li></ul>`,
+			ops:       []string{NE_MOVE, NE_MOVE, NE_TEXT},
+		},
+		{
+			name:      "reorder with inserts and removes",
+			oldSource: `<a>1</a><b>2</b><i>3</i><s>4</s>`,
+			newSource: `<s>4</s><u>new</u><a>1</a><i>3</i>`,
+			ops:       []string{NE_REMOVE, NE_MOVE, NE_INSERT},
+		},
+		{
+			name:      "text",
+			oldSource: `<p>Hello</p>`,
+			newSource: `<p>Goodbye</p>`,
+			ops:       []string{NE_TEXT},
+		},
+		{
+			name:      "attributes are added, changed and removed",
+			oldSource: `<div id="a" class="b" hidden></div>`,
+			newSource: `<div class="c" id="a" title="d"></div>`,
+			ops:       []string{NE_ATTRIBUTE, NE_ATTRIBUTE, NE_ATTRIBUTE},
+		},
+		{
+			name:      "a node of another kind is replaced",
+			oldSource: `<div>a</div>`,
+			newSource: `<span>a</span>`,
+			ops:       []string{NE_REMOVE, NE_INSERT},
+		},
+		{
+			name:      "edits inside of a moved node",
+			oldSource: `<section><h2>A</h2><p x="1">a</p></section><section><h2>B</h2></section>`,
+			newSource: `<section><h2>B</h2></section><section><h2>A</h2><p x="2">a!</p></section>`,
+			ops:       []string{NE_MOVE, NE_ATTRIBUTE, NE_TEXT},
+		},
+		{
+			name:      "nested changes",
+			oldSource: `<main><nav><a href="/">Home</a></nav><article><p>1</p><p>2</p></article></main>`,
+			newSource: `<main><article><p>2</p><p>1</p><p>3</p></article><nav><a href="/home">Home</a><a href="/about">About</a></nav></main>`,
+			ops:       []string{NE_MOVE, NE_MOVE, NE_INSERT, NE_INSERT, NE_ATTRIBUTE},
+		},
+	} {
+		oldNodes := parseNodesForDiff(t, testCase.oldSource)
+		newNodes := parseNodesForDiff(t, testCase.newSource)
+
+		edits := diffNodes(oldNodes, newNodes)
+		ops := []string(nil)
+		for _, edit := range edits {
+			ops = append(ops, edit.Op)
+		}
+		if !reflect.DeepEqual(ops, testCase.ops) {
+			t.Errorf("%s: expected edits %v, got %v", testCase.name, testCase.ops, ops)
+		}
+
+		assertNodesAreEqual(t, testCase.name, newNodes, applyNodeEdits(t, oldNodes, edits))
+	}
+}
+
+func TestParseEndpointDiff(t *testing.T) {
+	templateFilePath := filepath.Join(t.TempDir(), "diff.tmph.html")
+
+	previousDiffBases := templateDiffBases
+	templateDiffBases = newDiffBaseStore(MAX_DIFF_BASE_COUNT)
+	t.Cleanup(func() { templateDiffBases = previousDiffBases })
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, newParserServer(mux, time.Second, 0))
+
+	var requestDiff = func(source string, ifNoneMatch string) *ParseDiffResponse {
+		t.Helper()
+
+		if err := os.WriteFile(templateFilePath, []byte(source), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest(http.MethodGet, "/parse?"+url.Values{"path": {templateFilePath}, "diff": {"true"}}.Encode(), nil)
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		responseRecorder := httptest.NewRecorder()
+		mux.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", responseRecorder.Code, responseRecorder.Body.String())
+		}
+
+		var response ParseDiffResponse
+		if err := json.Unmarshal(responseRecorder.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if etag := responseRecorder.Header().Get("ETag"); etag == "" || etag != response.ETag {
+			t.Fatalf("expected the ETag header to match the response's ETag '%s', got '%s'", response.ETag, etag)
+		}
+		return &response
+	}
+	var decodeNodes = func(response *ParseDiffResponse) []*Node {
+		t.Helper()
+
+		var nodes []*Node
+		if err := json.Unmarshal(response.Nodes, &nodes); err != nil {
+			t.Fatal(err)
+		}
+		return nodes
+	}
+
+	firstResponse := requestDiff(`<ul><li>1</li><li>2</li></ul>`, "")
+	if firstResponse.Base != "" || firstResponse.Edits != nil {
+		t.Errorf("expected the first response to have no edits, got base %s and %d edits", firstResponse.Base, len(firstResponse.Edits))
+	}
+
+	// The client sends the ETag of the result it has, so the edits from it can be applied to get the new result
+	secondResponse := requestDiff(`<ul><li>2</li><li>1</li><li class="new">3</li></ul>`, firstResponse.ETag)
+	if secondResponse.Base != firstResponse.ETag || len(secondResponse.Edits) == 0 {
+		t.Fatalf("expected edits from '%s', got base '%s' and %d edits", firstResponse.ETag, secondResponse.Base, len(secondResponse.Edits))
+	}
+	assertNodesAreEqual(t, "edits from the previous response", decodeNodes(secondResponse), applyNodeEdits(t, decodeNodes(firstResponse), secondResponse.Edits))
+
+	// If the client's ETag isn't a known result, the full tree is the only way to get the new result
+	thirdResponse := requestDiff(`<ul><li>3</li></ul>`, `"unknown", W/"also-unknown"`)
+	if thirdResponse.Base != "" || thirdResponse.Edits != nil {
+		t.Errorf("expected a full tree for an unknown ETag, got base '%s' and %d edits", thirdResponse.Base, len(thirdResponse.Edits))
+	}
+	if nodes := decodeNodes(thirdResponse); len(nodes) != 1 || len(nodes[0].Children) != 1 || nodes[0].Children[0].Children[0].TextContent != "3" {
+		t.Errorf("expected the full tree of the new template, got %s", thirdResponse.Nodes)
+	}
+}
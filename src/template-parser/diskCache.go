@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_DISK_CACHE_MAX_AGE = 30 * 24 * time.Hour
+const DEFAULT_DISK_CACHE_MAX_SIZE = 256 * 1024 * 1024
+
+// Garbage collection runs on startup and then again after this many entries have been written
+const DISK_CACHE_WRITES_PER_GC = 256
+
+const DISK_CACHE_FILE_EXTENSION = ".gob"
+
+// Included in every key and bumped whenever the gob encoding of entries changes, so entries written in an older format
+// are never read
+const DISK_CACHE_ENTRY_VERSION = 2
+
+// The on-disk cache used by the parse endpoints; nil if no cache directory was provided
+var templateDiskCache *diskCache
+
+// A persistent cache of parse results, stored as one gob file per entry.
+// Entries are only read when they are requested, so a large cache doesn't slow down startup.
+type diskCache struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+
+	writesSinceGC atomic.Int64
+	hits          atomic.Int64
+	misses        atomic.Int64
+	// Held while garbage collection is running so only one collection runs at a time
+	gcMutex sync.Mutex
+}
+
+// The gob encoding of a parse result entry. Node can't be encoded directly because of its Parent field, which
+// makes the tree cyclic.
+type diskCacheEntry struct {
+	Node       *diskCacheNode
+	Diagnostic *diskCacheDiagnostic
+}
+
+// The gob encoding of a diagnostic. Gob leaves out zero values, including those pointed to by pointer fields, so a
+// ByteOffset of 0 would otherwise be read back as nil.
+type diskCacheDiagnostic struct {
+	Code          string
+	Severity      DiagnosticSeverity
+	Message       string
+	Path          string
+	Line          int
+	Col           int
+	ByteOffset    int
+	HasByteOffset bool
+}
+
+type diskCacheNode struct {
+	TagName     string
+	Namespace   Namespace
+	TextContent string
+	Continues   bool
+	Attributes  []*Attribute
+	Children    []*diskCacheNode
+	Line        int
+	Col         int
+}
+
+func newDiskCache(dir string, maxAge time.Duration, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	cache := &diskCache{
+		dir:     dir,
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}
+
+	// Clean up anything which went stale while the parser wasn't running without holding up startup
+	go cache.CollectGarbage()
+
+	return cache, nil
+}
+
+// Gets the key for a parse result. Entries are keyed by the content they were parsed from rather than the file path
+// so moving or reverting a file doesn't require parsing it again, but the path is included since it appears in diagnostics.
+func getDiskCacheKey(templateFilePath string, contentHash string, options ParseOptions) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%+v", PARSER_VERSION, DISK_CACHE_ENTRY_VERSION, contentHash, templateFilePath, options)))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *diskCache) getEntryPath(key string) string {
+	// Spread entries across subdirectories so no single directory gets too big
+	return filepath.Join(c.dir, key[:2], key+DISK_CACHE_FILE_EXTENSION)
+}
+
+// Reads a cached parse result, or returns nil if there isn't one
+func (c *diskCache) Get(key string) *ParseResult {
+	entryPath := c.getEntryPath(key)
+
+	entryFile, err := os.Open(entryPath)
+	if err != nil {
+		c.misses.Add(1)
+		return nil
+	}
+	defer entryFile.Close()
+
+	var entries []diskCacheEntry
+	if err := gob.NewDecoder(entryFile).Decode(&entries); err != nil {
+		// The entry is corrupt, ie if the parser was stopped partway through writing it
+		os.Remove(entryPath)
+		c.misses.Add(1)
+		return nil
+	}
+	c.hits.Add(1)
+
+	// Record that the entry was used so garbage collection keeps it around
+	now := time.Now()
+	os.Chtimes(entryPath, now, now)
+
+	result := &ParseResult{Entries: make([]ParseResultEntry, len(entries))}
+	for i, entry := range entries {
+		result.Entries[i] = ParseResultEntry{
+			Node:       entry.Node.toNode(nil),
+			Diagnostic: entry.Diagnostic.toDiagnostic(),
+		}
+	}
+	return result
+}
+
+// Writes a parse result to the cache. Failures are ignored since the cache is only an optimization.
+func (c *diskCache) Put(key string, result *ParseResult) {
+	entries := make([]diskCacheEntry, len(result.Entries))
+	for i, entry := range result.Entries {
+		entries[i] = diskCacheEntry{
+			Node:       newDiskCacheNode(entry.Node),
+			Diagnostic: newDiskCacheDiagnostic(entry.Diagnostic),
+		}
+	}
+
+	entryPath := c.getEntryPath(key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		return
+	}
+
+	// Write to a temporary file first so other requests never read a partially written entry
+	tempFile, err := os.CreateTemp(filepath.Dir(entryPath), key+".*.tmp")
+	if err != nil {
+		return
+	}
+
+	err = gob.NewEncoder(tempFile).Encode(entries)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), entryPath)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return
+	}
+
+	if c.writesSinceGC.Add(1) >= DISK_CACHE_WRITES_PER_GC {
+		c.writesSinceGC.Store(0)
+		go c.CollectGarbage()
+	}
+}
+
+// Removes entries which haven't been used within the max age, and then the least recently used entries until the
+// cache is within its max size
+func (c *diskCache) CollectGarbage() {
+	if !c.gcMutex.TryLock() {
+		// Another collection is already running
+		return
+	}
+	defer c.gcMutex.Unlock()
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var cachedFiles []cachedFile
+	var totalSize int64
+	oldestModTime := time.Now().Add(-c.maxAge)
+
+	filepath.WalkDir(c.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		isEntry := strings.HasSuffix(filePath, DISK_CACHE_FILE_EXTENSION)
+		if !isEntry && fileInfo.ModTime().Before(time.Now().Add(-time.Hour)) {
+			// Clean up temporary files left behind by writes that never finished
+			os.Remove(filePath)
+			return nil
+		}
+
+		if isEntry && c.maxAge > 0 && fileInfo.ModTime().Before(oldestModTime) {
+			os.Remove(filePath)
+			return nil
+		}
+
+		cachedFiles = append(cachedFiles, cachedFile{path: filePath, size: fileInfo.Size(), modTime: fileInfo.ModTime()})
+		totalSize += fileInfo.Size()
+		return nil
+	})
+
+	if c.maxSize <= 0 || totalSize <= c.maxSize {
+		return
+	}
+
+	sort.Slice(cachedFiles, func(i, j int) bool {
+		return cachedFiles[i].modTime.Before(cachedFiles[j].modTime)
+	})
+
+	for _, cachedFile := range cachedFiles {
+		if totalSize <= c.maxSize {
+			break
+		}
+		if os.Remove(cachedFile.path) == nil {
+			totalSize -= cachedFile.size
+		}
+	}
+}
+
+func newDiskCacheNode(node *Node) *diskCacheNode {
+	if node == nil {
+		return nil
+	}
+
+	cacheNode := &diskCacheNode{
+		TagName:     node.TagName,
+		Namespace:   node.Namespace,
+		TextContent: node.TextContent,
+		Continues:   node.Continues,
+		Attributes:  node.Attributes,
+		Line:        node.Line,
+		Col:         node.Col,
+	}
+
+	if node.Children != nil {
+		cacheNode.Children = make([]*diskCacheNode, len(node.Children))
+		for i, child := range node.Children {
+			cacheNode.Children[i] = newDiskCacheNode(child)
+		}
+	}
+
+	return cacheNode
+}
+
+func (cacheNode *diskCacheNode) toNode(parent *Node) *Node {
+	if cacheNode == nil {
+		return nil
+	}
+
+	node := &Node{
+		TagName:     cacheNode.TagName,
+		Namespace:   cacheNode.Namespace,
+		TextContent: cacheNode.TextContent,
+		Continues:   cacheNode.Continues,
+		Attributes:  cacheNode.Attributes,
+		Parent:      parent,
+		Line:        cacheNode.Line,
+		Col:         cacheNode.Col,
+	}
+
+	if cacheNode.TagName != "" {
+		// Elements always have a non-nil children slice so they serialize the same way as freshly parsed ones
+		node.Children = make([]*Node, len(cacheNode.Children))
+		for i, child := range cacheNode.Children {
+			node.Children[i] = child.toNode(node)
+		}
+	}
+
+	return node
+}
+
+func newDiskCacheDiagnostic(diagnostic *Diagnostic) *diskCacheDiagnostic {
+	if diagnostic == nil {
+		return nil
+	}
+
+	cacheDiagnostic := &diskCacheDiagnostic{
+		Code:     diagnostic.Code,
+		Severity: diagnostic.Severity,
+		Message:  diagnostic.Message,
+		Path:     diagnostic.Path,
+		Line:     diagnostic.Line,
+		Col:      diagnostic.Col,
+	}
+	if diagnostic.ByteOffset != nil {
+		cacheDiagnostic.ByteOffset = *diagnostic.ByteOffset
+		cacheDiagnostic.HasByteOffset = true
+	}
+
+	return cacheDiagnostic
+}
+
+func (cacheDiagnostic *diskCacheDiagnostic) toDiagnostic() *Diagnostic {
+	if cacheDiagnostic == nil {
+		return nil
+	}
+
+	diagnostic := &Diagnostic{
+		Code:     cacheDiagnostic.Code,
+		Severity: cacheDiagnostic.Severity,
+		Message:  cacheDiagnostic.Message,
+		Path:     cacheDiagnostic.Path,
+		Line:     cacheDiagnostic.Line,
+		Col:      cacheDiagnostic.Col,
+	}
+	if cacheDiagnostic.HasByteOffset {
+		byteOffset := cacheDiagnostic.ByteOffset
+		diagnostic.ByteOffset = &byteOffset
+	}
+
+	return diagnostic
+}
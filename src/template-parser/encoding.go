@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	ENCODING_UTF8        = "utf-8"
+	ENCODING_UTF16LE     = "utf-16le"
+	ENCODING_UTF16BE     = "utf-16be"
+	ENCODING_WINDOWS1252 = "windows-1252"
+	ENCODING_ISO885915   = "iso-8859-15"
+)
+
+// Per the HTML spec, a <meta charset> declaration must be within the first 1024 bytes of the file
+const META_CHARSET_PRESCAN_BYTE_COUNT = 1024
+
+// Transcoders write this byte in place of invalid sequences; it can never appear in valid UTF-8, so the lexer
+// will read it as an invalid sequence and report it
+const INVALID_SEQUENCE_MARKER_BYTE = 0xFF
+
+// Maps encoding labels to the encodings we support, following https://encoding.spec.whatwg.org/#names-and-labels
+var encodingLabels = map[string]string{
+	"unicode-1-1-utf-8": ENCODING_UTF8,
+	"unicode11utf8":     ENCODING_UTF8,
+	"unicode20utf8":     ENCODING_UTF8,
+	"utf-8":             ENCODING_UTF8,
+	"utf8":              ENCODING_UTF8,
+	"x-unicode20utf8":   ENCODING_UTF8,
+	"unicodefffe":       ENCODING_UTF16BE,
+	"utf-16be":          ENCODING_UTF16BE,
+	"csunicode":         ENCODING_UTF16LE,
+	"iso-10646-ucs-2":   ENCODING_UTF16LE,
+	"ucs-2":             ENCODING_UTF16LE,
+	"unicode":           ENCODING_UTF16LE,
+	"unicodefeff":       ENCODING_UTF16LE,
+	"utf-16":            ENCODING_UTF16LE,
+	"utf-16le":          ENCODING_UTF16LE,
+	"ansi_x3.4-1968":    ENCODING_WINDOWS1252,
+	"ascii":             ENCODING_WINDOWS1252,
+	"cp1252":            ENCODING_WINDOWS1252,
+	"cp819":             ENCODING_WINDOWS1252,
+	"csisolatin1":       ENCODING_WINDOWS1252,
+	"ibm819":            ENCODING_WINDOWS1252,
+	"iso-8859-1":        ENCODING_WINDOWS1252,
+	"iso-ir-100":        ENCODING_WINDOWS1252,
+	"iso8859-1":         ENCODING_WINDOWS1252,
+	"iso88591":          ENCODING_WINDOWS1252,
+	"iso_8859-1":        ENCODING_WINDOWS1252,
+	"iso_8859-1:1987":   ENCODING_WINDOWS1252,
+	"l1":                ENCODING_WINDOWS1252,
+	"latin1":            ENCODING_WINDOWS1252,
+	"us-ascii":          ENCODING_WINDOWS1252,
+	"windows-1252":      ENCODING_WINDOWS1252,
+	"x-cp1252":          ENCODING_WINDOWS1252,
+	"csisolatin9":       ENCODING_ISO885915,
+	"iso-8859-15":       ENCODING_ISO885915,
+	"iso8859-15":        ENCODING_ISO885915,
+	"iso885915":         ENCODING_ISO885915,
+	"iso_8859-15":       ENCODING_ISO885915,
+	"l9":                ENCODING_ISO885915,
+}
+
+// A template file's contents, decoded to UTF-8 so the lexer can read it
+type TemplateSource struct {
+	reader *bufio.Reader
+	// The encoding which the file was detected to be in
+	Encoding string
+	// The number of bytes taken up by a byte order mark at the start of the file, if there was one
+	bomLength int
+	// Byte offsets in the original file of invalid sequences which a transcoder replaced with INVALID_SEQUENCE_MARKER_BYTE;
+	// the lexer consumes these in order as it encounters the markers
+	invalidSequenceOffsets []int
+	// Problems encountered while detecting the encoding
+	diagnostics []*Diagnostic
+}
+
+// Detects the encoding of the file from its byte order mark or a <meta charset> declaration and sets up a reader
+// which will decode the file's contents to UTF-8.
+func NewTemplateSource(reader io.Reader) *TemplateSource {
+	source := &TemplateSource{
+		Encoding: ENCODING_UTF8,
+	}
+
+	bufferedReader := bufio.NewReader(reader)
+	// Peek will return fewer bytes and an error if the file is shorter than the prescan length; that's fine
+	prescanBytes, _ := bufferedReader.Peek(META_CHARSET_PRESCAN_BYTE_COUNT)
+
+	if bytes.HasPrefix(prescanBytes, []byte{0xEF, 0xBB, 0xBF}) {
+		source.bomLength = 3
+	} else if bytes.HasPrefix(prescanBytes, []byte{0xFE, 0xFF}) {
+		source.Encoding = ENCODING_UTF16BE
+		source.bomLength = 2
+	} else if bytes.HasPrefix(prescanBytes, []byte{0xFF, 0xFE}) {
+		source.Encoding = ENCODING_UTF16LE
+		source.bomLength = 2
+	} else if bytes.HasPrefix(prescanBytes, []byte{'<', 0}) {
+		// UTF-16 file without a byte order mark; templates will generally start with an ASCII '<' character
+		source.Encoding = ENCODING_UTF16LE
+	} else if bytes.HasPrefix(prescanBytes, []byte{0, '<'}) {
+		source.Encoding = ENCODING_UTF16BE
+	} else if label, line, col := findMetaCharsetLabel(prescanBytes); label != "" {
+		if encoding, isSupported := encodingLabels[strings.ToLower(label)]; !isSupported {
+			source.diagnostics = append(source.diagnostics, &Diagnostic{
+				Code:     DC_UNSUPPORTED_ENCODING,
+				Severity: DS_WARNING,
+				Message:  "unsupported encoding '" + label + "' declared in <meta> tag; falling back to utf-8",
+				Line:     line,
+				Col:      col,
+			})
+		} else if encoding == ENCODING_UTF16LE || encoding == ENCODING_UTF16BE {
+			// Per the HTML spec, a UTF-16 <meta> declaration must be wrong since we were able to read it as ASCII
+			source.Encoding = ENCODING_UTF8
+		} else {
+			source.Encoding = encoding
+		}
+	}
+
+	bufferedReader.Discard(source.bomLength)
+
+	switch source.Encoding {
+	case ENCODING_UTF16LE:
+		source.reader = bufio.NewReader(&utf16Transcoder{source: source, reader: bufferedReader, byteOrder: binary.LittleEndian, offset: source.bomLength})
+	case ENCODING_UTF16BE:
+		source.reader = bufio.NewReader(&utf16Transcoder{source: source, reader: bufferedReader, byteOrder: binary.BigEndian, offset: source.bomLength})
+	case ENCODING_WINDOWS1252:
+		source.reader = bufio.NewReader(&singleByteTranscoder{reader: bufferedReader, highCharacters: &windows1252HighCharacters})
+	case ENCODING_ISO885915:
+		source.reader = bufio.NewReader(&singleByteTranscoder{reader: bufferedReader, highCharacters: &iso885915HighCharacters})
+	default:
+		source.reader = bufferedReader
+	}
+
+	return source
+}
+
+// Gets the byte offset in the original file of an invalid sequence which the lexer encountered at the given
+// offset in the decoded UTF-8 content
+func (s *TemplateSource) GetInvalidSequenceOffset(decodedOffset int) int {
+	if len(s.invalidSequenceOffsets) > 0 {
+		offset := s.invalidSequenceOffsets[0]
+		s.invalidSequenceOffsets = s.invalidSequenceOffsets[1:]
+		return offset
+	}
+
+	// UTF-8 content isn't transcoded, so the decoded offset matches the original file aside from the BOM
+	return s.bomLength + decodedOffset
+}
+
+var htmlCommentRegex = regexp.MustCompile(`(?s)<!--.*?-->`)
+var metaCharsetRegex = regexp.MustCompile(`(?i)<meta[\s/][^>]*?charset\s*=\s*["']?\s*([^\s"';/>]+)`)
+
+// Searches for a <meta charset="..."> or <meta http-equiv="Content-Type" content="...; charset=..."> declaration.
+// Returns the declared encoding label and its position, or an empty string if there is no declaration.
+func findMetaCharsetLabel(prescanBytes []byte) (label string, line int, col int) {
+	// Blank out comments so we don't pick up commented out <meta> tags, but keep the byte offsets intact
+	prescanBytes = htmlCommentRegex.ReplaceAllFunc(prescanBytes, func(comment []byte) []byte {
+		return bytes.Repeat([]byte{' '}, len(comment))
+	})
+
+	match := metaCharsetRegex.FindSubmatchIndex(prescanBytes)
+	if match == nil {
+		return "", 0, 0
+	}
+
+	precedingBytes := prescanBytes[:match[2]]
+	line = bytes.Count(precedingBytes, []byte{'\n'}) + 1
+	col = utf8.RuneCount(precedingBytes[bytes.LastIndexByte(precedingBytes, '\n')+1:]) + 1
+
+	return string(prescanBytes[match[2]:match[3]]), line, col
+}
+
+// Decodes UTF-16 content to UTF-8
+type utf16Transcoder struct {
+	source    *TemplateSource
+	reader    *bufio.Reader
+	byteOrder binary.ByteOrder
+	// The offset in the original file of the next code unit
+	offset int
+	// Decoded UTF-8 bytes which haven't been read yet
+	pending []byte
+	// A code unit which was read ahead while looking for a low surrogate
+	nextCodeUnit *uint16
+}
+
+// Reads the next 2-byte code unit. isTruncated will be true if the file ended in the middle of the code unit.
+func (t *utf16Transcoder) readCodeUnit() (codeUnit uint16, isTruncated bool, err error) {
+	if t.nextCodeUnit != nil {
+		codeUnit = *t.nextCodeUnit
+		t.nextCodeUnit = nil
+		return codeUnit, false, nil
+	}
+
+	var codeUnitBytes [2]byte
+	if _, err = io.ReadFull(t.reader, codeUnitBytes[:]); err == io.ErrUnexpectedEOF {
+		return 0, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	return t.byteOrder.Uint16(codeUnitBytes[:]), false, nil
+}
+
+func (t *utf16Transcoder) writeInvalidSequence(byteCount int) {
+	t.source.invalidSequenceOffsets = append(t.source.invalidSequenceOffsets, t.offset)
+	t.pending = append(t.pending, INVALID_SEQUENCE_MARKER_BYTE)
+	t.offset += byteCount
+}
+
+func (t *utf16Transcoder) Read(p []byte) (int, error) {
+	for len(t.pending) < len(p) {
+		codeUnit, isTruncated, err := t.readCodeUnit()
+		if err != nil {
+			if len(t.pending) > 0 {
+				break
+			}
+			return 0, err
+		}
+
+		if isTruncated {
+			// The file ended in the middle of a code unit
+			t.writeInvalidSequence(1)
+			continue
+		}
+
+		r := rune(codeUnit)
+
+		if !utf16.IsSurrogate(r) {
+			t.pending = utf8.AppendRune(t.pending, r)
+			t.offset += 2
+			continue
+		}
+
+		// Surrogates must come in high/low pairs
+		if r >= 0xDC00 {
+			// Unpaired low surrogate
+			t.writeInvalidSequence(2)
+			continue
+		}
+
+		nextCodeUnit, isNextTruncated, err := t.readCodeUnit()
+		if err != nil || isNextTruncated {
+			// The file ended after a high surrogate
+			t.writeInvalidSequence(2)
+			if isNextTruncated {
+				t.writeInvalidSequence(1)
+			}
+			continue
+		}
+
+		if decodedRune := utf16.DecodeRune(r, rune(nextCodeUnit)); decodedRune != utf8.RuneError {
+			t.pending = utf8.AppendRune(t.pending, decodedRune)
+			t.offset += 4
+		} else {
+			// Unpaired high surrogate; the next code unit will be processed on its own
+			t.writeInvalidSequence(2)
+			t.nextCodeUnit = &nextCodeUnit
+		}
+	}
+
+	readByteCount := copy(p, t.pending)
+	t.pending = t.pending[readByteCount:]
+	return readByteCount, nil
+}
+
+// Decodes content in single-byte legacy encodings where 0x00-0x7F match ASCII
+type singleByteTranscoder struct {
+	reader *bufio.Reader
+	// Code points for bytes 0x80-0xFF
+	highCharacters *[128]rune
+	pending        []byte
+}
+
+func (t *singleByteTranscoder) Read(p []byte) (int, error) {
+	for len(t.pending) < len(p) {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			if len(t.pending) > 0 {
+				break
+			}
+			return 0, err
+		}
+
+		if b < 0x80 {
+			t.pending = append(t.pending, b)
+		} else {
+			t.pending = utf8.AppendRune(t.pending, t.highCharacters[b-0x80])
+		}
+	}
+
+	readByteCount := copy(p, t.pending)
+	t.pending = t.pending[readByteCount:]
+	return readByteCount, nil
+}
+
+// Builds a table of code points for bytes 0x80-0xFF in an ISO-8859-like encoding, where bytes map to the
+// matching code point unless overridden
+func makeHighCharacterTable(overrides map[byte]rune) [128]rune {
+	var table [128]rune
+	for i := range table {
+		table[i] = rune(0x80 + i)
+	}
+	for b, r := range overrides {
+		table[b-0x80] = r
+	}
+	return table
+}
+
+// https://encoding.spec.whatwg.org/index-windows-1252.txt
+var windows1252HighCharacters = makeHighCharacterTable(map[byte]rune{
+	0x80: 0x20AC, 0x82: 0x201A, 0x83: 0x0192, 0x84: 0x201E, 0x85: 0x2026, 0x86: 0x2020, 0x87: 0x2021,
+	0x88: 0x02C6, 0x89: 0x2030, 0x8A: 0x0160, 0x8B: 0x2039, 0x8C: 0x0152, 0x8E: 0x017D,
+	0x91: 0x2018, 0x92: 0x2019, 0x93: 0x201C, 0x94: 0x201D, 0x95: 0x2022, 0x96: 0x2013, 0x97: 0x2014,
+	0x98: 0x02DC, 0x99: 0x2122, 0x9A: 0x0161, 0x9B: 0x203A, 0x9C: 0x0153, 0x9E: 0x017E, 0x9F: 0x0178,
+})
+
+// https://encoding.spec.whatwg.org/index-iso-8859-15.txt
+var iso885915HighCharacters = makeHighCharacterTable(map[byte]rune{
+	0xA4: 0x20AC, 0xA6: 0x0160, 0xA8: 0x0161, 0xB4: 0x017D, 0xB8: 0x017E, 0xBC: 0x0152, 0xBD: 0x0153, 0xBE: 0x0178,
+})
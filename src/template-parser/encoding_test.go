@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Encodes a string's UTF-16 code units, followed by any extra code units, with an optional byte order mark
+func encodeUTF16(byteOrder binary.AppendByteOrder, hasBOM bool, text string, extraCodeUnits ...uint16) []byte {
+	codeUnits := utf16.Encode([]rune(text))
+	if hasBOM {
+		codeUnits = append([]uint16{0xFEFF}, codeUnits...)
+	}
+	codeUnits = append(codeUnits, extraCodeUnits...)
+
+	encoded := make([]byte, 0, 2*len(codeUnits))
+	for _, codeUnit := range codeUnits {
+		encoded = byteOrder.AppendUint16(encoded, codeUnit)
+	}
+	return encoded
+}
+
+func TestTemplateSourceEncodings(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		source           []byte
+		expectedEncoding string
+		expectedContent  string
+		// The code and position of each diagnostic reported while detecting the encoding
+		expectedDiagnostics []string
+	}{
+		{
+			name:             "utf-8 without a byte order mark",
+			source:           []byte("<p>café</p>"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  "<p>café</p>",
+		},
+		{
+			name:             "utf-8 byte order mark",
+			source:           []byte("\xEF\xBB\xBF<p>café</p>"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  "<p>café</p>",
+		},
+		{
+			name:             "utf-16le byte order mark",
+			source:           encodeUTF16(binary.LittleEndian, true, "<p>café 😀</p>"),
+			expectedEncoding: ENCODING_UTF16LE,
+			expectedContent:  "<p>café 😀</p>",
+		},
+		{
+			name:             "utf-16be byte order mark",
+			source:           encodeUTF16(binary.BigEndian, true, "<p>café 😀</p>"),
+			expectedEncoding: ENCODING_UTF16BE,
+			expectedContent:  "<p>café 😀</p>",
+		},
+		{
+			name:             "utf-16le without a byte order mark",
+			source:           encodeUTF16(binary.LittleEndian, false, "<p>€</p>"),
+			expectedEncoding: ENCODING_UTF16LE,
+			expectedContent:  "<p>€</p>",
+		},
+		{
+			name:             "utf-16be without a byte order mark",
+			source:           encodeUTF16(binary.BigEndian, false, "<p>€</p>"),
+			expectedEncoding: ENCODING_UTF16BE,
+			expectedContent:  "<p>€</p>",
+		},
+		{
+			name:             "byte order mark takes precedence over <meta charset>",
+			source:           []byte("\xEF\xBB\xBF<meta charset=\"windows-1252\">\xE2\x82\xAC"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  "<meta charset=\"windows-1252\">€",
+		},
+		{
+			name:             "windows-1252 <meta charset>",
+			source:           []byte("<meta charset=\"windows-1252\"><p>\x80 \x93caf\xE9\x94 \x81</p>"),
+			expectedEncoding: ENCODING_WINDOWS1252,
+			expectedContent:  "<meta charset=\"windows-1252\"><p>€ “café” \u0081</p>",
+		},
+		{
+			name:             "latin1 label maps to windows-1252",
+			source:           []byte("<META CHARSET=Latin1><p>\x99</p>"),
+			expectedEncoding: ENCODING_WINDOWS1252,
+			expectedContent:  "<META CHARSET=Latin1><p>™</p>",
+		},
+		{
+			name:             "iso-8859-15 <meta http-equiv>",
+			source:           []byte("<meta http-equiv=\"Content-Type\" content=\"text/html; charset=iso-8859-15\"><p>\xA4 \xBD \xE9 \x80</p>"),
+			expectedEncoding: ENCODING_ISO885915,
+			expectedContent:  "<meta http-equiv=\"Content-Type\" content=\"text/html; charset=iso-8859-15\"><p>€ œ é \u0080</p>",
+		},
+		{
+			name:             "<meta charset> inside of a comment is ignored",
+			source:           []byte("<!-- <meta charset=\"windows-1252\"> --><p>café</p>"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  "<!-- <meta charset=\"windows-1252\"> --><p>café</p>",
+		},
+		{
+			name:             "<meta charset> past the prescan is ignored",
+			source:           []byte(strings.Repeat(" ", META_CHARSET_PRESCAN_BYTE_COUNT) + "<meta charset=\"windows-1252\">"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  strings.Repeat(" ", META_CHARSET_PRESCAN_BYTE_COUNT) + "<meta charset=\"windows-1252\">",
+		},
+		{
+			name:             "utf-16 <meta charset> is read as utf-8",
+			source:           []byte("<meta charset=\"utf-16\"><p>café</p>"),
+			expectedEncoding: ENCODING_UTF8,
+			expectedContent:  "<meta charset=\"utf-16\"><p>café</p>",
+		},
+		{
+			name:                "unsupported <meta charset>",
+			source:              []byte("<html>\n  <meta charset=\"shift_jis\">"),
+			expectedEncoding:    ENCODING_UTF8,
+			expectedContent:     "<html>\n  <meta charset=\"shift_jis\">",
+			expectedDiagnostics: []string{"2:18 " + DC_UNSUPPORTED_ENCODING},
+		},
+	} {
+		source := NewTemplateSource(strings.NewReader(string(testCase.source)))
+		if source.Encoding != testCase.expectedEncoding {
+			t.Errorf("%s: expected encoding %s, got %s", testCase.name, testCase.expectedEncoding, source.Encoding)
+		}
+
+		content, err := io.ReadAll(source.reader)
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+		} else if string(content) != testCase.expectedContent {
+			t.Errorf("%s: expected content %q, got %q", testCase.name, testCase.expectedContent, content)
+		}
+
+		var diagnostics []string
+		for _, diagnostic := range source.diagnostics {
+			diagnostics = append(diagnostics, strconv.Itoa(diagnostic.Line)+":"+strconv.Itoa(diagnostic.Col)+" "+diagnostic.Code)
+		}
+		if !reflect.DeepEqual(diagnostics, testCase.expectedDiagnostics) {
+			t.Errorf("%s: expected diagnostics %v, got %v", testCase.name, testCase.expectedDiagnostics, diagnostics)
+		}
+	}
+}
+
+func TestInvalidByteSequenceOffsets(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		source []byte
+		// The position and byte offset of each invalid byte sequence diagnostic
+		expectedDiagnostics []string
+	}{
+		{
+			name:                "invalid utf-8",
+			source:              []byte("<p>a\xFFb\n\xC3</p>"),
+			expectedDiagnostics: []string{"1:5 @4", "2:1 @7"},
+		},
+		{
+			name:                "invalid utf-8 after a byte order mark",
+			source:              []byte("\xEF\xBB\xBF<p>\xFF</p>"),
+			expectedDiagnostics: []string{"1:4 @6"},
+		},
+		{
+			name:                "unpaired low surrogate",
+			source:              encodeUTF16(binary.LittleEndian, true, "<p>a", 0xDC00, 'b'),
+			expectedDiagnostics: []string{"1:5 @10"},
+		},
+		{
+			name:                "unpaired high surrogate followed by a character",
+			source:              encodeUTF16(binary.BigEndian, true, "<p>😀", 0xD83D, '!'),
+			expectedDiagnostics: []string{"1:5 @12"},
+		},
+		{
+			name:                "two unpaired high surrogates",
+			source:              encodeUTF16(binary.LittleEndian, false, "<p>", 0xD83D, 0xD83D, 'x'),
+			expectedDiagnostics: []string{"1:4 @6", "1:5 @8"},
+		},
+		{
+			name:                "high surrogate at the end of the file",
+			source:              encodeUTF16(binary.LittleEndian, true, "<p>\n", 0xD83D),
+			expectedDiagnostics: []string{"2:1 @10"},
+		},
+		{
+			name:                "file ends in the middle of a code unit",
+			source:              append(encodeUTF16(binary.LittleEndian, true, "<p>ab"), 'c'),
+			expectedDiagnostics: []string{"1:6 @12"},
+		},
+		{
+			name:                "file ends in the middle of a code unit after a high surrogate",
+			source:              append(encodeUTF16(binary.BigEndian, true, "<p>", 0xD83D), 0xDE),
+			expectedDiagnostics: []string{"1:4 @8", "1:5 @10"},
+		},
+	} {
+		lexer := NewLexer(context.Background(), NewTemplateSource(strings.NewReader(string(testCase.source))), LexerOptions{})
+		var diagnostics []string
+		for token := lexer.NextToken(); token.tokenType != LT_EOF && token.tokenType != LT_ERROR; token = lexer.NextToken() {
+			if token.tokenType == LT_DIAGNOSTIC && token.diagnostic.Code == DC_INVALID_BYTE_SEQUENCE {
+				diagnostics = append(diagnostics, strconv.Itoa(token.line)+":"+strconv.Itoa(token.column)+" @"+strconv.Itoa(*token.diagnostic.ByteOffset))
+			}
+		}
+		if !reflect.DeepEqual(diagnostics, testCase.expectedDiagnostics) {
+			t.Errorf("%s: expected invalid byte sequences %v, got %v", testCase.name, testCase.expectedDiagnostics, diagnostics)
+		}
+	}
+}
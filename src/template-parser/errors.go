@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// A fatal error which stopped a template from being parsed
+type TemplateError struct {
+	Path    string
+	Line    int
+	Col     int
+	Message string
+}
+
+func (err *TemplateError) Error() string {
+	return err.Path + ":" + strconv.Itoa(err.Line) + ":" + strconv.Itoa(err.Col) + " - tempeh template parser encountered fatal error: '" + err.Message + "'"
+}
+
+// An error which should be sent with a specific status code, ie for invalid query parameters
+type statusError struct {
+	statusCode int
+	err        error
+}
+
+func (err *statusError) Error() string {
+	return err.err.Error()
+}
+
+func (err *statusError) Unwrap() error {
+	return err.err
+}
+
+func withStatusCode(statusCode int, err error) error {
+	return &statusError{statusCode: statusCode, err: err}
+}
+
+// Gets the status code of the error response for an error
+func getErrorStatusCode(err error) int {
+	var statusErr *statusError
+	var templateErr *TemplateError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.statusCode
+	case isPathNotAllowed(err), errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.As(err, &templateErr), errors.Is(err, syscall.EISDIR):
+		// The file exists but can't be parsed as a template
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// The JSON body of an error response. This is also the last record of a streamed response which failed partway through
+// so clients can tell that the response is incomplete.
+type ErrorResponse struct {
+	Error *ErrorResponseDetail `json:"error"`
+}
+
+type ErrorResponseDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func newErrorResponseDetail(err error) *ErrorResponseDetail {
+	return &ErrorResponseDetail{Status: getErrorStatusCode(err), Message: err.Error()}
+}
+
+// Writes an error response with a JSON body describing the error
+func writeErrorResponse(responseWriter http.ResponseWriter, err error) {
+	detail := newErrorResponseDetail(err)
+	// The response isn't the parsed template anymore, so it shouldn't be cached as one
+	responseWriter.Header().Del("ETag")
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(detail.Status)
+	json.NewEncoder(responseWriter).Encode(&ErrorResponse{Error: detail})
+}
@@ -0,0 +1,217 @@
+package main
+
+import "strings"
+
+type Namespace string
+
+const (
+	NS_HTML   Namespace = "html"
+	NS_SVG    Namespace = "svg"
+	NS_MATHML Namespace = "mathml"
+)
+
+// An element which is open while the lexer is inside of foreign content. We need to track these
+// so we know which namespace each new element belongs to and when we have exited foreign content.
+type openForeignContentElement struct {
+	tagName                string
+	namespace              Namespace
+	isHTMLIntegrationPoint bool
+}
+
+// SVG tag names are case-sensitive; these are the tag names which need their casing adjusted
+// per https://html.spec.whatwg.org/multipage/parsing.html#parsing-main-inforeign
+var svgTagNameAdjustments = map[string]string{
+	"altglyph":            "altGlyph",
+	"altglyphdef":         "altGlyphDef",
+	"altglyphitem":        "altGlyphItem",
+	"animatecolor":        "animateColor",
+	"animatemotion":       "animateMotion",
+	"animatetransform":    "animateTransform",
+	"clippath":            "clipPath",
+	"feblend":             "feBlend",
+	"fecolormatrix":       "feColorMatrix",
+	"fecomponenttransfer": "feComponentTransfer",
+	"fecomposite":         "feComposite",
+	"feconvolvematrix":    "feConvolveMatrix",
+	"fediffuselighting":   "feDiffuseLighting",
+	"fedisplacementmap":   "feDisplacementMap",
+	"fedistantlight":      "feDistantLight",
+	"fedropshadow":        "feDropShadow",
+	"feflood":             "feFlood",
+	"fefunca":             "feFuncA",
+	"fefuncb":             "feFuncB",
+	"fefuncg":             "feFuncG",
+	"fefuncr":             "feFuncR",
+	"fegaussianblur":      "feGaussianBlur",
+	"feimage":             "feImage",
+	"femerge":             "feMerge",
+	"femergenode":         "feMergeNode",
+	"femorphology":        "feMorphology",
+	"feoffset":            "feOffset",
+	"fepointlight":        "fePointLight",
+	"fespecularlighting":  "feSpecularLighting",
+	"fespotlight":         "feSpotLight",
+	"fetile":              "feTile",
+	"feturbulence":        "feTurbulence",
+	"foreignobject":       "foreignObject",
+	"glyphref":            "glyphRef",
+	"lineargradient":      "linearGradient",
+	"radialgradient":      "radialGradient",
+	"textpath":            "textPath",
+}
+
+// SVG attribute names which need their casing adjusted
+// per https://html.spec.whatwg.org/multipage/parsing.html#adjust-svg-attributes
+var svgAttributeNameAdjustments = map[string]string{
+	"attributename":       "attributeName",
+	"attributetype":       "attributeType",
+	"basefrequency":       "baseFrequency",
+	"baseprofile":         "baseProfile",
+	"calcmode":            "calcMode",
+	"clippathunits":       "clipPathUnits",
+	"diffuseconstant":     "diffuseConstant",
+	"edgemode":            "edgeMode",
+	"filterunits":         "filterUnits",
+	"glyphref":            "glyphRef",
+	"gradienttransform":   "gradientTransform",
+	"gradientunits":       "gradientUnits",
+	"kernelmatrix":        "kernelMatrix",
+	"kernelunitlength":    "kernelUnitLength",
+	"keypoints":           "keyPoints",
+	"keysplines":          "keySplines",
+	"keytimes":            "keyTimes",
+	"lengthadjust":        "lengthAdjust",
+	"limitingconeangle":   "limitingConeAngle",
+	"markerheight":        "markerHeight",
+	"markerunits":         "markerUnits",
+	"markerwidth":         "markerWidth",
+	"maskcontentunits":    "maskContentUnits",
+	"maskunits":           "maskUnits",
+	"numoctaves":          "numOctaves",
+	"pathlength":          "pathLength",
+	"patterncontentunits": "patternContentUnits",
+	"patterntransform":    "patternTransform",
+	"patternunits":        "patternUnits",
+	"pointsatx":           "pointsAtX",
+	"pointsaty":           "pointsAtY",
+	"pointsatz":           "pointsAtZ",
+	"preservealpha":       "preserveAlpha",
+	"preserveaspectratio": "preserveAspectRatio",
+	"primitiveunits":      "primitiveUnits",
+	"refx":                "refX",
+	"refy":                "refY",
+	"repeatcount":         "repeatCount",
+	"repeatdur":           "repeatDur",
+	"requiredextensions":  "requiredExtensions",
+	"requiredfeatures":    "requiredFeatures",
+	"specularconstant":    "specularConstant",
+	"specularexponent":    "specularExponent",
+	"spreadmethod":        "spreadMethod",
+	"startoffset":         "startOffset",
+	"stddeviation":        "stdDeviation",
+	"stitchtiles":         "stitchTiles",
+	"surfacescale":        "surfaceScale",
+	"systemlanguage":      "systemLanguage",
+	"tablevalues":         "tableValues",
+	"targetx":             "targetX",
+	"targety":             "targetY",
+	"textlength":          "textLength",
+	"viewbox":             "viewBox",
+	"viewtarget":          "viewTarget",
+	"xchannelselector":    "xChannelSelector",
+	"ychannelselector":    "yChannelSelector",
+	"zoomandpan":          "zoomAndPan",
+}
+
+// MathML attribute names which need their casing adjusted
+// per https://html.spec.whatwg.org/multipage/parsing.html#adjust-mathml-attributes
+var mathMLAttributeNameAdjustments = map[string]string{
+	"definitionurl": "definitionURL",
+}
+
+func adjustForeignTagName(tagName string, namespace Namespace) string {
+	if namespace == NS_SVG {
+		if adjustedTagName, ok := lookupLowerCaseName(svgTagNameAdjustments, tagName); ok {
+			return adjustedTagName
+		}
+	}
+	return tagName
+}
+
+func adjustForeignAttributeName(attrName string, namespace Namespace) string {
+	var adjustments map[string]string
+	switch namespace {
+	case NS_SVG:
+		adjustments = svgAttributeNameAdjustments
+	case NS_MATHML:
+		adjustments = mathMLAttributeNameAdjustments
+	default:
+		return attrName
+	}
+
+	if adjustedAttrName, ok := lookupLowerCaseName(adjustments, attrName); ok {
+		return adjustedAttrName
+	}
+	return attrName
+}
+
+var mathMLTextIntegrationPointTagNames = map[string]bool{
+	"mi":    true,
+	"mo":    true,
+	"mn":    true,
+	"ms":    true,
+	"mtext": true,
+}
+
+// The children of MathML text integration points are parsed with HTML rules, except for <mglyph> and <malignmark>
+func isMathMLTextIntegrationPoint(element *openForeignContentElement) bool {
+	if element.namespace != NS_MATHML {
+		return false
+	}
+	isTextIntegrationPoint, _ := lookupLowerCaseName(mathMLTextIntegrationPointTagNames, element.tagName)
+	return isTextIntegrationPoint
+}
+
+// The children of HTML integration points are parsed as HTML; these are <foreignObject>, <desc> and <title> in SVG
+// and <annotation-xml> in MathML if it has an HTML encoding attribute
+func isHTMLIntegrationPoint(tagName string, namespace Namespace, encoding string) bool {
+	switch namespace {
+	case NS_SVG:
+		return tagName == "foreignObject" || tagName == "desc" || tagName == "title"
+	case NS_MATHML:
+		return strings.EqualFold(tagName, "annotation-xml") && (strings.EqualFold(encoding, "text/html") || strings.EqualFold(encoding, "application/xhtml+xml"))
+	}
+	return false
+}
+
+// CDATA sections are only allowed in foreign content. The children of integration points are parsed as HTML, where
+// they're bogus comments instead.
+func allowsCDATASections(currentElement *openForeignContentElement) bool {
+	return currentElement != nil &&
+		currentElement.namespace != NS_HTML &&
+		!currentElement.isHTMLIntegrationPoint &&
+		!isMathMLTextIntegrationPoint(currentElement)
+}
+
+// Determines the namespace for a new element with the given tag name based on the current open element, if
+// we are inside of foreign content.
+func getNamespaceForTagName(tagName string, currentElement *openForeignContentElement) Namespace {
+	if currentElement == nil ||
+		currentElement.namespace == NS_HTML ||
+		currentElement.isHTMLIntegrationPoint ||
+		(isMathMLTextIntegrationPoint(currentElement) && !strings.EqualFold(tagName, "mglyph") && !strings.EqualFold(tagName, "malignmark")) {
+		// Use HTML rules; <svg> and <math> tags are the only ways to enter foreign content
+		if strings.EqualFold(tagName, "svg") {
+			return NS_SVG
+		} else if strings.EqualFold(tagName, "math") {
+			return NS_MATHML
+		}
+		return NS_HTML
+	}
+
+	if currentElement.namespace == NS_MATHML && strings.EqualFold(currentElement.tagName, "annotation-xml") && strings.EqualFold(tagName, "svg") {
+		return NS_SVG
+	}
+
+	return currentElement.namespace
+}
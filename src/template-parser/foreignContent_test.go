@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForeignContentTokens(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:   "svg tag and attribute names have their casing adjusted",
+			source: `<svg viewbox="0 0 1 1"><CLIPPATH id="a"/><lineargradient></LINEARGRADIENT></svg>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "svg" ns=svg`,
+				`1:6 ATTRIBUTENAME "viewBox"`,
+				`1:15 ATTRIBUTEVALUE "0 0 1 1"`,
+				`1:25 OPENINGTAGNAME "clipPath" ns=svg`,
+				`1:34 ATTRIBUTENAME "id"`,
+				`1:38 ATTRIBUTEVALUE "a"`,
+				`1:42 SELFCLOSINGTAGEND`,
+				`1:43 OPENINGTAGNAME "linearGradient" ns=svg`,
+				`1:60 CLOSINGTAGNAME "linearGradient"`,
+				`1:77 CLOSINGTAGNAME "svg"`,
+			},
+		},
+		{
+			name:   "self-closing foreign elements and content after foreign content",
+			source: `<svg><circle/>x</svg><p>y</p>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "svg" ns=svg`,
+				`1:7 OPENINGTAGNAME "circle" ns=svg`,
+				`1:15 SELFCLOSINGTAGEND`,
+				`1:15 TEXTCONTENT "x"`,
+				`1:18 CLOSINGTAGNAME "svg"`,
+				`1:23 OPENINGTAGNAME "p"`,
+				`1:25 TEXTCONTENT "y"`,
+				`1:28 CLOSINGTAGNAME "p"`,
+			},
+		},
+		{
+			name:   "<foreignObject> switches back to html",
+			source: `<svg><foreignObject><div viewbox="a"><br><svg><g/></svg></div></foreignObject><g></g></svg>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "svg" ns=svg`,
+				`1:7 OPENINGTAGNAME "foreignObject" ns=svg`,
+				`1:22 OPENINGTAGNAME "div"`,
+				`1:26 ATTRIBUTENAME "viewbox"`,
+				`1:35 ATTRIBUTEVALUE "a"`,
+				`1:39 OPENINGTAGNAME "br"`,
+				`1:42 SELFCLOSINGTAGEND`,
+				`1:43 OPENINGTAGNAME "svg" ns=svg`,
+				`1:48 OPENINGTAGNAME "g" ns=svg`,
+				`1:51 SELFCLOSINGTAGEND`,
+				`1:53 CLOSINGTAGNAME "svg"`,
+				`1:59 CLOSINGTAGNAME "div"`,
+				`1:65 CLOSINGTAGNAME "foreignObject"`,
+				`1:80 OPENINGTAGNAME "g" ns=svg`,
+				`1:84 CLOSINGTAGNAME "g"`,
+				`1:88 CLOSINGTAGNAME "svg"`,
+			},
+		},
+		{
+			name:   "svg <desc> and <title> are html integration points",
+			source: `<svg><desc><circle></circle></desc><title><em></em></title></svg>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "svg" ns=svg`,
+				`1:7 OPENINGTAGNAME "desc" ns=svg`,
+				`1:13 OPENINGTAGNAME "circle"`,
+				`1:22 CLOSINGTAGNAME "circle"`,
+				`1:31 CLOSINGTAGNAME "desc"`,
+				`1:37 OPENINGTAGNAME "title" ns=svg`,
+				`1:44 OPENINGTAGNAME "em"`,
+				`1:49 CLOSINGTAGNAME "em"`,
+				`1:54 CLOSINGTAGNAME "title"`,
+				`1:62 CLOSINGTAGNAME "svg"`,
+			},
+		},
+		{
+			name:   "mathml integration points",
+			source: `<math definitionurl="x"><mi><mglyph/><b>y</b></mi><annotation-xml encoding="text/html"><p></p></annotation-xml><annotation-xml><svg></svg></annotation-xml></math>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "math" ns=mathml`,
+				`1:7 ATTRIBUTENAME "definitionURL"`,
+				`1:22 ATTRIBUTEVALUE "x"`,
+				`1:26 OPENINGTAGNAME "mi" ns=mathml`,
+				`1:30 OPENINGTAGNAME "mglyph" ns=mathml`,
+				`1:38 SELFCLOSINGTAGEND`,
+				`1:39 OPENINGTAGNAME "b"`,
+				`1:41 TEXTCONTENT "y"`,
+				`1:44 CLOSINGTAGNAME "b"`,
+				`1:48 CLOSINGTAGNAME "mi"`,
+				`1:52 OPENINGTAGNAME "annotation-xml" ns=mathml`,
+				`1:67 ATTRIBUTENAME "encoding"`,
+				`1:77 ATTRIBUTEVALUE "text/html"`,
+				`1:89 OPENINGTAGNAME "p"`,
+				`1:93 CLOSINGTAGNAME "p"`,
+				`1:97 CLOSINGTAGNAME "annotation-xml"`,
+				`1:113 OPENINGTAGNAME "annotation-xml" ns=mathml`,
+				`1:129 OPENINGTAGNAME "svg" ns=svg`,
+				`1:135 CLOSINGTAGNAME "svg"`,
+				`1:141 CLOSINGTAGNAME "annotation-xml"`,
+				`1:158 CLOSINGTAGNAME "math"`,
+			},
+		},
+	} {
+		if tokens := lexTemplate(testCase.source, LexerOptions{}); !reflect.DeepEqual(tokens, testCase.expected) {
+			t.Errorf("%s: expected tokens\n%s\ngot\n%s", testCase.name, strings.Join(testCase.expected, "\n"), strings.Join(tokens, "\n"))
+		}
+	}
+}
+
+func TestForeignContentNodeNamespaces(t *testing.T) {
+	source := `<div><svg><foreignObject><p></p></foreignObject><circle/></svg><math><mi></mi></math></div>`
+	var responseWriter http.ResponseWriter = httptest.NewRecorder()
+	result, err := parseTemplateResult(context.Background(), strings.NewReader(source), "test.tmph.html", ParseOptions{}, &responseWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var elements []string
+	var collectElements func(nodes []*Node)
+	collectElements = func(nodes []*Node) {
+		for _, node := range nodes {
+			if node.TagName != "" {
+				elements = append(elements, node.TagName+":"+string(node.Namespace))
+			}
+			collectElements(node.Children)
+		}
+	}
+	collectElements(result.RootNodes())
+
+	expected := []string{"div:html", "svg:svg", "foreignObject:svg", "p:html", "circle:svg", "math:mathml", "mi:mathml"}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("expected elements %v, got %v", expected, elements)
+	}
+}
+
+func TestCDATASections(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:     "svg",
+			source:   `<svg><![CDATA[a<b>&amp;]]></svg>`,
+			expected: []string{`1:2 OPENINGTAGNAME "svg" ns=svg`, `1:15 TEXTCONTENT "a<b>&amp;"`, `1:29 CLOSINGTAGNAME "svg"`},
+		},
+		{
+			name:     "mathml which isn't an integration point",
+			source:   `<math><mrow><![CDATA[x]]></mrow></math>`,
+			expected: []string{`1:2 OPENINGTAGNAME "math" ns=mathml`, `1:8 OPENINGTAGNAME "mrow" ns=mathml`, `1:22 TEXTCONTENT "x"`, `1:28 CLOSINGTAGNAME "mrow"`, `1:35 CLOSINGTAGNAME "math"`},
+		},
+		{
+			name:   "html content",
+			source: `<p><![CDATA[a>b]]></p>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "p"`,
+				`1:4 DIAGNOSTIC warning cdata-in-html-content: CDATA section in HTML content is parsed as a comment which ends at the first '>'`,
+				`1:15 TEXTCONTENT "b]]>"`,
+				`1:21 CLOSINGTAGNAME "p"`,
+			},
+		},
+		{
+			name:   "svg html integration point",
+			source: `<svg><foreignObject><![CDATA[a]]></foreignObject></svg>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "svg" ns=svg`,
+				`1:7 OPENINGTAGNAME "foreignObject" ns=svg`,
+				`1:21 DIAGNOSTIC warning cdata-in-html-content: CDATA section in HTML content is parsed as a comment which ends at the first '>'`,
+				`1:36 CLOSINGTAGNAME "foreignObject"`,
+				`1:52 CLOSINGTAGNAME "svg"`,
+			},
+		},
+		{
+			name:   "mathml html integration point",
+			source: `<math><annotation-xml encoding="text/html"><![CDATA[a]]></annotation-xml></math>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "math" ns=mathml`,
+				`1:8 OPENINGTAGNAME "annotation-xml" ns=mathml`,
+				`1:23 ATTRIBUTENAME "encoding"`,
+				`1:33 ATTRIBUTEVALUE "text/html"`,
+				`1:44 DIAGNOSTIC warning cdata-in-html-content: CDATA section in HTML content is parsed as a comment which ends at the first '>'`,
+				`1:59 CLOSINGTAGNAME "annotation-xml"`,
+				`1:76 CLOSINGTAGNAME "math"`,
+			},
+		},
+		{
+			name:   "mathml text integration point",
+			source: `<math><mi><![CDATA[x]]></mi></math>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "math" ns=mathml`,
+				`1:8 OPENINGTAGNAME "mi" ns=mathml`,
+				`1:11 DIAGNOSTIC warning cdata-in-html-content: CDATA section in HTML content is parsed as a comment which ends at the first '>'`,
+				`1:26 CLOSINGTAGNAME "mi"`,
+				`1:31 CLOSINGTAGNAME "math"`,
+			},
+		},
+		{
+			name:     "annotation-xml without an html encoding isn't an integration point",
+			source:   `<math><annotation-xml><![CDATA[x]]></annotation-xml></math>`,
+			expected: []string{`1:2 OPENINGTAGNAME "math" ns=mathml`, `1:8 OPENINGTAGNAME "annotation-xml" ns=mathml`, `1:32 TEXTCONTENT "x"`, `1:38 CLOSINGTAGNAME "annotation-xml"`, `1:55 CLOSINGTAGNAME "math"`},
+		},
+		{
+			name:     "svg inside of an integration point",
+			source:   `<svg><foreignObject><svg><![CDATA[a]]></svg></foreignObject></svg>`,
+			expected: []string{`1:2 OPENINGTAGNAME "svg" ns=svg`, `1:7 OPENINGTAGNAME "foreignObject" ns=svg`, `1:22 OPENINGTAGNAME "svg" ns=svg`, `1:35 TEXTCONTENT "a"`, `1:41 CLOSINGTAGNAME "svg"`, `1:47 CLOSINGTAGNAME "foreignObject"`, `1:63 CLOSINGTAGNAME "svg"`},
+		},
+	} {
+		if tokens := lexTemplate(testCase.source, LexerOptions{}); !reflect.DeepEqual(tokens, testCase.expected) {
+			t.Errorf("%s: expected tokens\n%s\ngot\n%s", testCase.name, strings.Join(testCase.expected, "\n"), strings.Join(tokens, "\n"))
+		}
+	}
+}
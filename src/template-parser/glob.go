@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Matches a slash-separated path against a glob pattern. Patterns support the same syntax as path.Match,
+// plus "**" segments which match any number of path segments, including none.
+// For example, "**/*.tmph.html" matches "index.tmph.html" and "components/List.tmph.html".
+func matchGlob(pattern string, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(patternSegments []string, nameSegments []string) bool {
+	for len(patternSegments) > 0 {
+		patternSegment := patternSegments[0]
+
+		if patternSegment == "**" {
+			// Try matching the rest of the pattern against every possible remainder of the path
+			for i := 0; i <= len(nameSegments); i++ {
+				if matchGlobSegments(patternSegments[1:], nameSegments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(nameSegments) == 0 {
+			return false
+		}
+
+		if isMatch, err := path.Match(patternSegment, nameSegments[0]); err != nil || !isMatch {
+			return false
+		}
+
+		patternSegments = patternSegments[1:]
+		nameSegments = nameSegments[1:]
+	}
+
+	return len(nameSegments) == 0
+}
+
+// Checks that a glob pattern is well-formed so bad patterns can be reported up front instead of silently matching nothing
+func validateGlob(pattern string) error {
+	for _, patternSegment := range strings.Split(pattern, "/") {
+		if patternSegment == "**" {
+			continue
+		}
+		if _, err := path.Match(patternSegment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Tracks whether a handler has started its response, after which an error response can no longer be sent
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	hasStarted bool
+}
+
+func (w *trackingResponseWriter) WriteHeader(statusCode int) {
+	w.hasStarted = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *trackingResponseWriter) Write(b []byte) (int, error) {
+	w.hasStarted = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flushing sends the response's headers, so it starts the response as well
+func (w *trackingResponseWriter) FlushError() error {
+	w.hasStarted = true
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Adapts a handler which returns an error. If the handler fails before starting its response, an error response is
+// sent with the error's status code; if it fails partway through, it is responsible for ending the response with an
+// error record itself.
+func handleWithErrors(handler func(responseWriter http.ResponseWriter, request *http.Request) error) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		trackingWriter := &trackingResponseWriter{ResponseWriter: responseWriter}
+		if err := handler(trackingWriter, request); err != nil && !trackingWriter.hasStarted {
+			writeErrorResponse(trackingWriter, err)
+		}
+	}
+}
+
+// Gets the error for a posted template whose body couldn't be read; bodies over the size limit get a 413
+func getPostedTemplateReadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return withStatusCode(http.StatusRequestEntityTooLarge, errors.New("request body is larger than the limit of "+strconv.FormatInt(maxBytesErr.Limit, 10)+" bytes"))
+	}
+	return withStatusCode(http.StatusBadRequest, err)
+}
+
+// Gets the error for a request whose method the endpoint doesn't support
+func methodNotAllowed(responseWriter http.ResponseWriter, request *http.Request, allowedMethods string) error {
+	responseWriter.Header().Set("Allow", allowedMethods)
+	return withStatusCode(http.StatusMethodNotAllowed, errors.New("method "+request.Method+" is not allowed; expected one of "+allowedMethods))
+}
+
+// Registers the parser's endpoints. Every transport serves these same handlers.
+func registerHandlers(mux *http.ServeMux, server *parserServer) {
+	// Every endpoint records request metrics
+	var handle = func(endpoint string, handler http.HandlerFunc) {
+		mux.HandleFunc(endpoint, server.instrumentHandler(endpoint, handler))
+	}
+
+	handle("/health", func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Write([]byte("OK"))
+	})
+
+	handle("/version", func(responseWriter http.ResponseWriter, request *http.Request) {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(responseWriter).Encode(&server.info)
+	})
+
+	handle("/metrics", func(responseWriter http.ResponseWriter, request *http.Request) {
+		var buf bytes.Buffer
+		templateParserMetrics.Write(&buf, server)
+		responseWriter.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+		buf.WriteTo(responseWriter)
+	})
+
+	handle("/parse", handleWithErrors(func(responseWriter http.ResponseWriter, request *http.Request) error {
+		query := request.URL.Query()
+
+		options, err := parseOptionsFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		shouldDiff, err := parseDiffFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		switch request.Method {
+		case http.MethodGet:
+			templateFilePath := query.Get("path")
+			resolvedFilePath, err := templatePathPolicy.CheckFile(templateFilePath)
+			if err != nil {
+				return err
+			}
+			if shouldDiff {
+				content, err := readTemplateFile(resolvedFilePath, options.Limits)
+				if err != nil {
+					return err
+				}
+				return writeTemplateDiff(request.Context(), content, templateFilePath, options, request.Header.Get("If-None-Match"), &responseWriter)
+			}
+			return parseTemplateFileCached(request.Context(), templateFilePath, resolvedFilePath, options, request.Header.Get("If-None-Match"), &responseWriter)
+		case http.MethodPost:
+			// Parse the template source from the request body instead of a file, ie for unsaved editor buffers
+			if maxInputSize := options.Limits.MaxInputSize; maxInputSize > 0 {
+				// Leave room for JSON bodies, where the source is escaped
+				request.Body = http.MaxBytesReader(responseWriter, request.Body, 2*maxInputSize+MAX_POSTED_TEMPLATE_JSON_OVERHEAD)
+			}
+			templateReader, virtualPath, err := readPostedTemplate(request)
+			if err != nil {
+				return getPostedTemplateReadError(err)
+			}
+			if shouldDiff {
+				content, err := io.ReadAll(templateReader)
+				if err != nil {
+					return getPostedTemplateReadError(err)
+				}
+				return writeTemplateDiff(request.Context(), content, virtualPath, options, request.Header.Get("If-None-Match"), &responseWriter)
+			}
+			return parseTemplate(request.Context(), templateReader, virtualPath, options, &responseWriter)
+		default:
+			return methodNotAllowed(responseWriter, request, "GET, POST")
+		}
+	}))
+
+	handle("/parse-batch", handleWithErrors(func(responseWriter http.ResponseWriter, request *http.Request) error {
+		query := request.URL.Query()
+
+		options, err := parseOptionsFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		batch, err := parseBatchFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		if err = templatePathPolicy.CheckBatch(batch); err != nil {
+			return err
+		}
+
+		return writeTemplateBatch(request.Context(), batch, options, &responseWriter)
+	}))
+
+	handle("/watch", handleWithErrors(func(responseWriter http.ResponseWriter, request *http.Request) error {
+		query := request.URL.Query()
+
+		options, err := parseOptionsFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		batch, watchOptions, err := parseWatchFromQuery(query)
+		if err != nil {
+			return withStatusCode(http.StatusBadRequest, err)
+		}
+
+		if err = templatePathPolicy.CheckBatch(batch); err != nil {
+			return err
+		}
+
+		// Watching never ends on its own, so end it when the server shuts down instead of holding up shutdown
+		request, cancel := server.WithShutdownContext(request)
+		defer cancel()
+
+		return writeTemplateWatchEvents(request, batch, options, watchOptions, &responseWriter)
+	}))
+
+	handle("/cache", handleWithErrors(func(responseWriter http.ResponseWriter, request *http.Request) error {
+		if templateParseCache == nil {
+			return withStatusCode(http.StatusNotFound, errors.New("the parse cache is disabled"))
+		}
+
+		var response any
+		switch request.Method {
+		case http.MethodGet:
+			response = templateParseCache.Stats()
+		case http.MethodDelete:
+			// Invalidate the entries for a single template if a path is given, or the whole cache otherwise
+			invalidatedCount, err := templateParseCache.Invalidate(request.URL.Query().Get("path"))
+			if err != nil {
+				return withStatusCode(http.StatusBadRequest, err)
+			}
+			response = map[string]int{"invalidated": invalidatedCount}
+		default:
+			return methodNotAllowed(responseWriter, request, "GET, DELETE")
+		}
+
+		responseWriter.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(responseWriter).Encode(response)
+	}))
+
+	handle("/shutdown", handleWithErrors(func(responseWriter http.ResponseWriter, request *http.Request) error {
+		if request.Method != http.MethodPost {
+			return methodNotAllowed(responseWriter, request, "POST")
+		}
+
+		// Shutdown waits for in-flight requests, including this one, so it has to happen after the response is sent
+		responseWriter.WriteHeader(http.StatusAccepted)
+		go server.Shutdown()
+		return nil
+	}))
+}
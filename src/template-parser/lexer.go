@@ -1,8 +1,14 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"html"
 	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type LexerTokenType int
@@ -16,100 +22,750 @@ const (
 	LT_ATTRIBUTEVALUE                          // element attribute value
 	LT_SELFCLOSINGTAGEND                       // end of a self-closing tag; '/>'
 	LT_CLOSINGTAGNAME                          // element closing tag name
+	LT_DIAGNOSTIC                              // non-fatal problem with the template
 )
 
+type LexerTokenFlags uint8
+
+const (
+	TF_DECODE_CHARACTER_REFERENCES LexerTokenFlags = 1 << iota // the value is RCDATA content whose character references should be decoded
+	TF_RESOLVE_BACKSLASH_ESCAPES                               // the value is a quoted attribute value containing backslash escapes
+	TF_SINGLE_QUOTED                                           // the value is an attribute value wrapped in single quotes
+	TF_CONTINUED                                               // the text content is a chunk of a larger run of text which continues in the next LT_TEXTCONTENT token
+)
+
+// Tokens don't hold a copy of their value; instead, they point to the range of the source which the value
+// was lexed from so we don't need to allocate anything while lexing. Use Lexer.TokenValue to get the value.
 type LexerToken struct {
-	tokenType  LexerTokenType
-	tokenValue string
-	line       int
-	column     int
-}
-
-// func (lt *LexerToken) String() string {
-// 	var typeString string
-// 	switch lt.tokenType {
-// 	case LT_EOF:
-// 		typeString = "EOF"
-// 	case LT_ERROR:
-// 		typeString = "ERROR"
-// 	case LT_TEXTCONTENT:
-// 		typeString = "TEXTCONTENT"
-// 	case LT_OPENINGTAGNAME:
-// 		typeString = "OPENINGTAGNAME"
-// 	case LT_ATTRIBUTENAME:
-// 		typeString = "ATTRIBUTENAME"
-// 	case LT_ATTRIBUTEVALUE:
-// 		typeString = "ATTRIBUTEVALUE"
-// 	case LT_SELFCLOSINGTAGEND:
-// 		typeString = "SELFCLOSINGTAGEND"
-// 	case LT_CLOSINGTAGNAME:
-// 		typeString = "CLOSINGTAGNAME"
-// 	}
-// 	return fmt.Sprintf("Type %s: '%s'\n", typeString, lt.tokenValue)
-// }
+	tokenType LexerTokenType
+	// The byte offsets of the start and end of the token's value in the decoded UTF-8 content
+	start int
+	end   int
+	// Tag names, attribute names and error messages don't map directly to a range of the source, so their
+	// value is stored on the token instead
+	value    string
+	hasValue bool
+	flags    LexerTokenFlags
+	line     int
+	column   int
+	// The namespace of the element; only set for LT_OPENINGTAGNAME tokens
+	namespace Namespace
+	// Only set for LT_DIAGNOSTIC tokens
+	diagnostic *Diagnostic
+}
+
+func (tokenType LexerTokenType) String() string {
+	switch tokenType {
+	case LT_EOF:
+		return "EOF"
+	case LT_ERROR:
+		return "ERROR"
+	case LT_TEXTCONTENT:
+		return "TEXTCONTENT"
+	case LT_OPENINGTAGNAME:
+		return "OPENINGTAGNAME"
+	case LT_ATTRIBUTENAME:
+		return "ATTRIBUTENAME"
+	case LT_ATTRIBUTEVALUE:
+		return "ATTRIBUTEVALUE"
+	case LT_SELFCLOSINGTAGEND:
+		return "SELFCLOSINGTAGEND"
+	case LT_CLOSINGTAGNAME:
+		return "CLOSINGTAGNAME"
+	case LT_DIAGNOSTIC:
+		return "DIAGNOSTIC"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type RawTextMode int
+
+const (
+	RTM_LENIENT RawTextMode = iota // track quoted strings in script and style content so closing tags inside of strings are ignored
+	RTM_STRICT                     // follow the HTML5 raw text, RCDATA, and script data states
+)
+
+type ColumnUnit int
+
+const (
+	CU_RUNES ColumnUnit = iota // count columns in unicode code points
+	CU_BYTES                   // count columns in UTF-8 bytes
+	CU_UTF16                   // count columns in UTF-16 code units, which is what editors like VS Code and source maps use
+)
+
+type LexerOptions struct {
+	RawTextMode RawTextMode
+	ColumnUnit  ColumnUnit
+	// Whether a backslash can escape a quote character inside of a quoted attribute value; this is not standard HTML
+	AttributeBackslashEscapes bool
+	// If greater than 0, runs of text content longer than this many bytes are emitted as a series of chunks so a huge
+	// text run never needs to be held in memory all at once
+	TextChunkSize int
+	// If greater than 0, lexing stops with a diagnostic once a tag has more than this many attributes
+	MaxAttributeCount int
+	// If greater than 0, lexing stops with a diagnostic once an attribute name or value is longer than this many bytes
+	MaxAttributeLength int
+	// If greater than 0, lexing stops with a diagnostic once a run of text is longer than this many bytes
+	MaxTextLength int
+}
+
+// The initial size of the window of source bytes held by the lexer; the window grows if a single token doesn't fit in it
+const LEXER_WINDOW_SIZE = 8 * 1024
+
+// The maximum number of characters which can be unread in a row
+const MAX_UNREAD_CHAR_COUNT = 8
+
+// The maximum number of distinct tag and attribute names a lexer will reuse strings for
+const MAX_INTERNED_NAME_COUNT = 1024
+
+// Character references in RCDATA are never split across text chunks; the longest named character reference is 33 bytes
+const MAX_CHARACTER_REFERENCE_LENGTH = 33
+
+// A character which has been read, along with the position it was read from so it can be unread
+type lexerChar struct {
+	char rune
+	// The byte size of the character in the decoded UTF-8 content; a "\r\n" line ending counts as one character
+	size   int
+	line   int
+	column int
+	offset int
+}
 
 type Lexer struct {
-	reader      *bufio.Reader
-	line        int
-	column      int
-	tokens      chan *LexerToken
-	lastTagName string
-}
-
-func NewLexer(reader *bufio.Reader) *Lexer {
-	return &Lexer{
-		reader: reader,
-		line:   1,
-		column: 1,
-		tokens: make(chan *LexerToken),
+	// Lexing stops with an error at the next read from the source once the context is done
+	ctx     context.Context
+	source  *TemplateSource
+	reader  io.Reader
+	options LexerOptions
+	// A sliding window over the decoded UTF-8 content. Bytes at the start of the window are discarded once no token
+	// or unreadable character refers to them anymore.
+	window []byte
+	// The byte offset of the first byte in the window
+	windowStart int
+	// The error which stopped us from reading more of the source; usually io.EOF
+	readErr error
+	line    int
+	column  int
+	// The byte offset of the next character in the decoded UTF-8 content
+	offset int
+	// The byte offset and position where the token currently being lexed starts
+	tokenStart  int
+	tokenLine   int
+	tokenColumn int
+	// The furthest byte offset which has been read so far; characters before this offset may be read again after being unread
+	furthestOffset int
+	// Ring buffer of the most recently read characters so they can be unread
+	readChars     [MAX_UNREAD_CHAR_COUNT]lexerChar
+	readCharIndex int
+	readCharCount int
+	state         StateFn
+	// Tokens which have been emitted by the current state func but not returned by NextToken yet
+	tokens         []LexerToken
+	nextTokenIndex int
+	// Strings for tag and attribute names which have already been encountered so repeated names don't need to be allocated again
+	internedNames    map[string]string
+	lastTagName      string
+	lastTagNamespace Namespace
+	// The value of the last tag's "encoding" attribute; determines whether a MathML <annotation-xml> element is an HTML integration point
+	lastTagEncoding   string
+	lastAttributeName string
+	// Names of the attributes on the last tag so far; used to detect duplicates
+	lastTagAttributeNames []string
+	// Stack of elements which are open while inside of SVG or MathML foreign content; empty while in plain HTML
+	openForeignContentElements []*openForeignContentElement
+	// The state of the raw text element currently being lexed, which needs to be kept between text chunks
+	rawContentStart       int
+	rawContentQuoteChar   rune
+	rawContentBackslashes int
+	scriptDataState       scriptDataState
+	// The byte offset where the run of text currently being lexed starts; a run can span multiple text chunks
+	textRunStart int
+	// Whether the last text token was a chunk which the next text token continues
+	isContinuingTextRun bool
+}
+
+func NewLexer(ctx context.Context, source *TemplateSource, options LexerOptions) *Lexer {
+	l := &Lexer{
+		ctx:           ctx,
+		source:        source,
+		reader:        source.reader,
+		options:       options,
+		window:        make([]byte, 0, LEXER_WINDOW_SIZE),
+		line:          1,
+		column:        1,
+		state:         LexTextContent,
+		tokens:        make([]LexerToken, 0, 8),
+		internedNames: make(map[string]string),
 		// Track the last tag name; necessary context to determine how an element's content should
 		// processed since script and style tags have raw content
-		lastTagName: "",
+		lastTagName:      "",
+		lastTagNamespace: NS_HTML,
+	}
+
+	// Report any problems encountered while detecting the source's encoding
+	for _, diagnostic := range source.diagnostics {
+		l.EmitToken(LexerToken{
+			tokenType:  LT_DIAGNOSTIC,
+			line:       diagnostic.Line,
+			column:     diagnostic.Col,
+			diagnostic: diagnostic,
+		})
+	}
+
+	return l
+}
+
+// Returns the next token, running the lexer's state funcs until one is emitted.
+// The token's value must be read with TokenValue before NextToken is called again, since the source bytes it refers to
+// may be discarded after that.
+func (l *Lexer) NextToken() LexerToken {
+	for l.nextTokenIndex >= len(l.tokens) {
+		if l.state == nil {
+			// The lexer is done; keep reporting the end of the file
+			return LexerToken{tokenType: LT_EOF, hasValue: true, line: l.line, column: l.column}
+		}
+
+		l.tokens = l.tokens[:0]
+		l.nextTokenIndex = 0
+		l.state = l.state(l)
+	}
+
+	token := l.tokens[l.nextTokenIndex]
+	l.nextTokenIndex++
+	return token
+}
+
+// Formats a token as a single line for debugging, ie `1:2 OPENINGTAGNAME "div"`. Like TokenValue, this must be called
+// before NextToken is called again.
+func (l *Lexer) FormatToken(token *LexerToken) string {
+	formattedToken := strconv.Itoa(token.line) + ":" + strconv.Itoa(token.column) + " " + token.tokenType.String()
+
+	switch token.tokenType {
+	case LT_EOF, LT_SELFCLOSINGTAGEND:
+		return formattedToken
+	case LT_DIAGNOSTIC:
+		return formattedToken + " " + token.diagnostic.Severity.String() + " " + token.diagnostic.Code + ": " + token.diagnostic.Message
+	}
+
+	formattedToken += " " + strconv.Quote(l.TokenValue(token))
+	if token.tokenType == LT_OPENINGTAGNAME && token.namespace != NS_HTML {
+		formattedToken += " ns=" + string(token.namespace)
+	}
+	if token.flags&TF_CONTINUED != 0 {
+		formattedToken += " continued"
+	}
+	return formattedToken
+}
+
+// Builds the string value of a token. Newlines are normalized and character references are decoded if necessary.
+func (l *Lexer) TokenValue(token *LexerToken) string {
+	if token.hasValue {
+		return token.value
+	}
+
+	rawValue := l.SourceBytes(token.start, token.end)
+
+	var value string
+	if hasCarriageReturn(rawValue) {
+		value = normalizeLineEndings(rawValue)
+	} else {
+		value = string(rawValue)
 	}
+
+	if token.flags&TF_DECODE_CHARACTER_REFERENCES != 0 {
+		value = html.UnescapeString(value)
+	}
+	return value
 }
 
-func (l *Lexer) Emit(tokenType LexerTokenType, tokenValue string, line int, column int) {
-	l.tokens <- &LexerToken{
-		tokenType:  tokenType,
-		tokenValue: tokenValue,
-		line:       line,
-		column:     column,
+// Returns an attribute value with backslash escapes resolved, or the value as-is if it doesn't have any
+func (l *Lexer) TokenUnescapedValue(token *LexerToken, value string) string {
+	if token.flags&TF_RESOLVE_BACKSLASH_ESCAPES == 0 {
+		return value
+	}
+
+	quoteChar := '"'
+	if token.flags&TF_SINGLE_QUOTED != 0 {
+		quoteChar = '\''
 	}
+	return unescapeAttributeValue(value, quoteChar)
 }
 
-func (l *Lexer) ReadRune() (r rune, err error) {
-	r, _, err = l.reader.ReadRune()
-	if err == nil {
-		if isLineBreak(r) {
-			l.line++
-			l.column = 1
+func hasCarriageReturn(rawValue []byte) bool {
+	for _, b := range rawValue {
+		if b == '\r' {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts "\r\n" and lone "\r" line endings to "\n" per the HTML spec
+func normalizeLineEndings(rawValue []byte) string {
+	normalizedValue := make([]byte, 0, len(rawValue))
+	for i := 0; i < len(rawValue); i++ {
+		if rawValue[i] == '\r' {
+			normalizedValue = append(normalizedValue, '\n')
+			if i+1 < len(rawValue) && rawValue[i+1] == '\n' {
+				i++
+			}
 		} else {
-			l.column++
+			normalizedValue = append(normalizedValue, rawValue[i])
 		}
 	}
+	return string(normalizedValue)
+}
 
-	return r, err
+// Returns the bytes of the decoded source between two offsets. The offsets must still be inside of the window.
+func (l *Lexer) SourceBytes(start int, end int) []byte {
+	return l.window[start-l.windowStart : end-l.windowStart]
 }
 
-func (l *Lexer) UnreadRune() (err error) {
-	err = l.reader.UnreadRune()
-	if l.column == 1 {
-		l.line--
+// Returns a string for a tag or attribute name, reusing the string from a previous occurrence of the name if possible
+func (l *Lexer) InternName(name []byte) string {
+	if internedName, ok := l.internedNames[string(name)]; ok {
+		return internedName
+	}
+
+	internedName := string(name)
+	if len(l.internedNames) < MAX_INTERNED_NAME_COUNT {
+		l.internedNames[internedName] = internedName
+	}
+	return internedName
+}
+
+// Returns the earliest byte offset which still needs to be kept in the window
+func (l *Lexer) GetRetainedOffset() int {
+	retainedOffset := min(l.tokenStart, l.offset)
+
+	if l.readCharCount > 0 {
+		oldestReadChar := l.readChars[(l.readCharIndex-l.readCharCount+MAX_UNREAD_CHAR_COUNT)%MAX_UNREAD_CHAR_COUNT]
+		retainedOffset = min(retainedOffset, oldestReadChar.offset)
+	}
+
+	for i := l.nextTokenIndex; i < len(l.tokens); i++ {
+		if token := &l.tokens[i]; !token.hasValue && token.tokenType != LT_DIAGNOSTIC {
+			retainedOffset = min(retainedOffset, token.start)
+		}
+	}
+
+	return retainedOffset
+}
+
+// Reads more of the source into the window, discarding bytes which are no longer needed or growing the window
+// if it is full
+func (l *Lexer) FillWindow() {
+	if err := l.ctx.Err(); err != nil {
+		// Stop reading as soon as the lexer is cancelled; the state funcs will emit the error as if reading had failed
+		// and stop, so nothing more is read from the source
+		l.readErr = err
+		return
+	}
+
+	if len(l.window) == cap(l.window) {
+		if discardCount := l.GetRetainedOffset() - l.windowStart; discardCount > 0 {
+			retainedCount := copy(l.window, l.window[discardCount:])
+			l.window = l.window[:retainedCount]
+			l.windowStart += discardCount
+		}
+
+		if cap(l.window)-len(l.window) < cap(l.window)/4 {
+			// Most of the window is taken up by bytes we still need, so make room for more
+			grownWindow := make([]byte, len(l.window), cap(l.window)*2)
+			copy(grownWindow, l.window)
+			l.window = grownWindow
+		}
+	}
+
+	readCount, err := l.reader.Read(l.window[len(l.window):cap(l.window)])
+	l.window = l.window[:len(l.window)+readCount]
+	if err != nil {
+		l.readErr = err
+	}
+}
+
+// Reads from the source until the window contains everything up to the given offset or there is nothing left to read
+func (l *Lexer) FillWindowUntil(offset int) {
+	for l.windowStart+len(l.window) < offset && l.readErr == nil {
+		l.FillWindow()
+	}
+}
+
+// Returns the byte at the given distance past the lexer's position without reading it
+func (l *Lexer) PeekByte(distance int) (b byte, ok bool) {
+	l.FillWindowUntil(l.offset + distance + 1)
+
+	windowIndex := l.offset + distance - l.windowStart
+	if windowIndex >= len(l.window) {
+		return 0, false
+	}
+	return l.window[windowIndex], true
+}
+
+// Whether the upcoming bytes match the given prefix exactly
+func (l *Lexer) HasPrefix(prefix string) bool {
+	end := l.offset + len(prefix)
+	l.FillWindowUntil(end)
+
+	if end > l.windowStart+len(l.window) {
+		return false
+	}
+	return string(l.SourceBytes(l.offset, end)) == prefix
+}
+
+// Whether the bytes between minStart and end end with the given suffix
+func (l *Lexer) HasSuffix(end int, suffix string, minStart int) bool {
+	start := end - len(suffix)
+	if start < minStart {
+		return false
+	}
+	return string(l.SourceBytes(start, end)) == suffix
+}
+
+// Counts how many backslashes directly precede the given offset, stopping at minStart
+func (l *Lexer) CountPrecedingBackslashes(end int, minStart int) int {
+	backslashCount := 0
+	for offset := end - 1; offset >= minStart && l.window[offset-l.windowStart] == '\\'; offset-- {
+		backslashCount++
+	}
+	return backslashCount
+}
+
+// Reads a number of characters which we already know are there because we peeked at them
+func (l *Lexer) SkipChars(charCount int) {
+	for i := 0; i < charCount; i++ {
+		l.ReadChar()
+	}
+}
+
+// Marks the start of a new token at the lexer's current position. Returns the position to report for the token.
+func (l *Lexer) StartToken() (line int, column int) {
+	l.tokenStart = l.offset
+	l.tokenLine = l.line
+	l.tokenColumn = l.column
+	return l.line, l.column
+}
+
+// Marks the start of a new text token. The token starts a new run of text unless the previous token was a chunk of the
+// same run.
+func (l *Lexer) StartTextToken() {
+	l.StartToken()
+	if !l.isContinuingTextRun {
+		l.textRunStart = l.tokenStart
+	}
+	l.isContinuingTextRun = false
+}
+
+// Emits LT_TEXTCONTENT token for the text between the start of the current token and the end offset
+func (l *Lexer) EmitTextContent(end int, flags LexerTokenFlags) {
+	l.EmitToken(LexerToken{
+		tokenType: LT_TEXTCONTENT,
+		start:     l.tokenStart,
+		end:       end,
+		flags:     flags,
+		line:      l.tokenLine,
+		column:    l.tokenColumn,
+	})
+}
+
+// If text chunking is enabled and the text content read so far has reached the chunk size, emits it as a chunk which is
+// continued by the next text token. nextChar is the character which was just read at charOffset; it is unread so it can
+// start the next chunk. Returns whether a chunk was emitted, in which case the state func should return so the chunk can
+// be consumed before lexing the rest of the text.
+func (l *Lexer) EmitTextChunkIfFull(nextChar rune, charOffset int, flags LexerTokenFlags) bool {
+	if l.options.TextChunkSize <= 0 || charOffset-l.tokenStart < l.options.TextChunkSize || !l.IsTextChunkBoundary(nextChar, charOffset, flags) {
+		return false
+	}
+
+	l.EmitTextContent(charOffset, flags|TF_CONTINUED)
+	l.isContinuingTextRun = true
+	// This can't fail since we just read the character
+	l.UnreadChar()
+	return true
+}
+
+// Text is only split into chunks between two letters, digits or non-ASCII characters. This guarantees that whitespace runs,
+// tags, comment markers and backslash escapes never straddle two chunks, so each chunk can be processed on its own.
+func (l *Lexer) IsTextChunkBoundary(nextChar rune, charOffset int, flags LexerTokenFlags) bool {
+	if charOffset == l.tokenStart || !isTextChunkBoundaryChar(nextChar) || !isTextChunkBoundaryChar(rune(l.window[charOffset-1-l.windowStart])) {
+		return false
+	}
+
+	if flags&TF_DECODE_CHARACTER_REFERENCES != 0 {
+		// Make sure we aren't splitting a character reference
+		for offset := max(charOffset-MAX_CHARACTER_REFERENCE_LENGTH, l.tokenStart); offset < charOffset; offset++ {
+			if l.window[offset-l.windowStart] == '&' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Checks a character or the last byte of one; any byte of a multi-byte UTF-8 character is >= utf8.RuneSelf
+func isTextChunkBoundaryChar(char rune) bool {
+	return char >= utf8.RuneSelf || isLetter(char) || isNumber(char)
+}
+
+func (l *Lexer) EmitToken(token LexerToken) {
+	l.tokens = append(l.tokens, token)
+}
+
+// Emits a token whose value is the source between the start and end offsets
+func (l *Lexer) Emit(tokenType LexerTokenType, start int, end int, line int, column int) {
+	l.EmitToken(LexerToken{
+		tokenType: tokenType,
+		start:     start,
+		end:       end,
+		line:      line,
+		column:    column,
+	})
+}
+
+// Emits a token with a value which doesn't come directly from the source
+func (l *Lexer) EmitValue(tokenType LexerTokenType, value string, line int, column int) {
+	l.EmitToken(LexerToken{
+		tokenType: tokenType,
+		value:     value,
+		hasValue:  true,
+		line:      line,
+		column:    column,
+	})
+}
+
+func (l *Lexer) EmitAttributeValue(start int, end int, flags LexerTokenFlags, line int, column int) {
+	l.EmitToken(LexerToken{
+		tokenType: LT_ATTRIBUTEVALUE,
+		start:     start,
+		end:       end,
+		flags:     flags,
+		line:      line,
+		column:    column,
+	})
+	if strings.EqualFold(l.lastAttributeName, "encoding") {
+		l.lastTagEncoding = string(l.SourceBytes(start, end))
+	}
+}
+
+// Returns the most recently opened element which hasn't been closed yet if we are inside of foreign content
+func (l *Lexer) GetCurrentForeignContentElement() *openForeignContentElement {
+	openElementCount := len(l.openForeignContentElements)
+	if openElementCount == 0 {
+		return nil
+	}
+	return l.openForeignContentElements[openElementCount-1]
+}
+
+// Whether the current element is an SVG or MathML element whose content is lexed with foreign content rules, meaning
+// CDATA sections are allowed
+func (l *Lexer) IsCDATAAllowed() bool {
+	return allowsCDATASections(l.GetCurrentForeignContentElement())
+}
+
+// Pushes the last opened tag onto the stack of open foreign content elements if it is a foreign element
+// or we are already inside of foreign content.
+func (l *Lexer) PushOpenElement() {
+	if l.lastTagNamespace == NS_HTML && len(l.openForeignContentElements) == 0 {
+		// No need to track elements while in plain HTML
+		return
+	}
+
+	l.openForeignContentElements = append(l.openForeignContentElements, &openForeignContentElement{
+		tagName:                l.lastTagName,
+		namespace:              l.lastTagNamespace,
+		isHTMLIntegrationPoint: isHTMLIntegrationPoint(l.lastTagName, l.lastTagNamespace, l.lastTagEncoding),
+	})
+}
+
+// Pops the open foreign content element matching the closing tag name off of the stack, along with any unclosed elements opened after it.
+// Returns the closing tag name adjusted to match the casing of the opening tag name.
+func (l *Lexer) PopOpenElement(closingTagName string) string {
+	for i := len(l.openForeignContentElements) - 1; i >= 0; i-- {
+		openElement := l.openForeignContentElements[i]
+		if strings.EqualFold(openElement.tagName, closingTagName) {
+			l.openForeignContentElements = l.openForeignContentElements[:i]
+			return openElement.tagName
+		}
+	}
+
+	return closingTagName
+}
+
+func (l *Lexer) EmitDiagnostic(code string, severity DiagnosticSeverity, message string, line int, column int) {
+	l.EmitToken(LexerToken{
+		tokenType: LT_DIAGNOSTIC,
+		line:      line,
+		column:    column,
+		diagnostic: &Diagnostic{
+			Code:     code,
+			Severity: severity,
+			Message:  message,
+			Line:     line,
+			Col:      column,
+		},
+	})
+}
+
+// Emits LT_EOF token if the end of the file was reached, or LT_ERROR token otherwise.
+// Hitting a parse limit is reported as a diagnostic followed by LT_EOF token so everything lexed so far is kept.
+func (l *Lexer) EmitReadError(err error) {
+	var limitErr *ParseLimitError
+	if err == io.EOF {
+		l.EmitValue(LT_EOF, "", l.line, l.column)
+	} else if errors.As(err, &limitErr) {
+		l.EmitDiagnostic(limitErr.Code, DS_ERROR, limitErr.Message, l.line, l.column)
+		l.EmitValue(LT_EOF, "", l.line, l.column)
+	} else {
+		l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+	}
+}
+
+// Like EmitReadError, but also reports an unterminated tag if the end of the file was reached
+func (l *Lexer) EmitTagReadError(err error) {
+	if err == io.EOF {
+		l.EmitDiagnostic(DC_EOF_IN_TAG, DS_ERROR, "unexpected end of file inside of <"+l.lastTagName+"> tag", l.line, l.column)
+	}
+	l.EmitReadError(err)
+}
+
+// Reads the next character and advances the lexer's position.
+// "\r\n" and lone "\r" line endings are normalized to "\n" per the HTML spec.
+func (l *Lexer) ReadChar() (r rune, err error) {
+	if l.windowStart+len(l.window)-l.offset < utf8.UTFMax {
+		// Make sure the window holds a full character, plus the "\n" following a "\r"
+		l.FillWindowUntil(l.offset + utf8.UTFMax)
+	}
+
+	windowIndex := l.offset - l.windowStart
+	if windowIndex >= len(l.window) {
+		return 0, l.readErr
+	}
+
+	char := lexerChar{
+		char:   rune(l.window[windowIndex]),
+		size:   1,
+		line:   l.line,
+		column: l.column,
+		offset: l.offset,
+	}
+
+	if char.char >= utf8.RuneSelf {
+		char.char, char.size = utf8.DecodeRune(l.window[windowIndex:])
+		if char.char == utf8.RuneError && char.size == 1 && char.offset >= l.furthestOffset {
+			// DecodeRune returns a replacement character with a size of 1 for invalid UTF-8 sequences.
+			// Only report each invalid sequence once, even if it is unread and read again.
+			sourceOffset := l.source.GetInvalidSequenceOffset(char.offset)
+			l.EmitToken(LexerToken{
+				tokenType: LT_DIAGNOSTIC,
+				line:      l.line,
+				column:    l.column,
+				diagnostic: &Diagnostic{
+					Code:       DC_INVALID_BYTE_SEQUENCE,
+					Severity:   DS_ERROR,
+					Message:    "invalid " + l.source.Encoding + " byte sequence at byte offset " + strconv.Itoa(sourceOffset) + "; replaced with U+FFFD",
+					Line:       l.line,
+					Col:        l.column,
+					ByteOffset: &sourceOffset,
+				},
+			})
+		}
+	} else if char.char == '\r' {
+		char.char = '\n'
+		if windowIndex+1 < len(l.window) && l.window[windowIndex+1] == '\n' {
+			// Consume the "\n" in a "\r\n" line ending so the pair is treated as a single line break
+			char.size = 2
+		}
+	}
+
+	l.readChars[l.readCharIndex] = char
+	l.readCharIndex = (l.readCharIndex + 1) % MAX_UNREAD_CHAR_COUNT
+	if l.readCharCount < MAX_UNREAD_CHAR_COUNT {
+		l.readCharCount++
+	}
+
+	l.offset = char.offset + char.size
+	l.furthestOffset = max(l.furthestOffset, l.offset)
+	if char.char == '\n' {
+		l.line = char.line + 1
+		l.column = 1
 	} else {
-		l.column--
+		l.column = char.column + l.GetColumnWidth(char)
+	}
+
+	return char.char, nil
+}
+
+// Reads the next character of a run of text, or returns a text too long error if the run has reached the maximum length
+func (l *Lexer) ReadTextChar() (r rune, err error) {
+	if l.options.MaxTextLength > 0 && l.offset-l.textRunStart >= l.options.MaxTextLength {
+		return 0, newTextTooLongError(l.options.MaxTextLength)
+	}
+	return l.ReadChar()
+}
+
+// Reads the next character of an attribute name or value, or returns an attribute too long error if the current token
+// has reached the maximum length
+func (l *Lexer) ReadAttributeChar() (r rune, err error) {
+	if l.options.MaxAttributeLength > 0 && l.offset-l.tokenStart >= l.options.MaxAttributeLength {
+		return 0, newAttributeTooLongError(l.options.MaxAttributeLength)
+	}
+	return l.ReadChar()
+}
+
+// Moves the lexer back to the position of the last character read so it will be read again
+func (l *Lexer) UnreadChar() (err error) {
+	if l.readCharCount == 0 {
+		return errors.New("no character to unread")
 	}
 
-	return err
+	l.readCharIndex = (l.readCharIndex - 1 + MAX_UNREAD_CHAR_COUNT) % MAX_UNREAD_CHAR_COUNT
+	l.readCharCount--
+	char := l.readChars[l.readCharIndex]
+
+	l.line = char.line
+	l.column = char.column
+	l.offset = char.offset
+
+	return nil
 }
 
-func (l *Lexer) Run() {
-	for state := LexTextContent; state != nil; {
-		state = state(l)
+// Gets the number of columns a character takes up in the unit the lexer was configured to report columns in
+func (l *Lexer) GetColumnWidth(char lexerChar) int {
+	switch l.options.ColumnUnit {
+	case CU_BYTES:
+		return char.size
+	case CU_UTF16:
+		if char.char >= 0x10000 {
+			// Characters outside of the Basic Multilingual Plane take up a surrogate pair in UTF-16
+			return 2
+		}
 	}
+	return 1
 }
 
-func (l *Lexer) NextToken() *LexerToken {
-	return <-l.tokens
+// Attempts to read the given characters case-insensitively, followed by a character which satisfies isTerminatorChar.
+// Returns whether the characters matched.
+// The first mismatched character or the terminator character is unread so it can be processed by the caller.
+func (l *Lexer) ReadMatchingChars(expectedChars string, isTerminatorChar func(rune) bool) (didMatch bool, err error) {
+	for _, expectedChar := range expectedChars {
+		nextChar, err := l.ReadChar()
+		if err != nil {
+			return false, err
+		}
+
+		if unicode.ToLower(nextChar) != unicode.ToLower(expectedChar) {
+			return false, l.UnreadChar()
+		}
+	}
+
+	nextChar, err := l.ReadChar()
+	if err != nil {
+		return false, err
+	}
+
+	return isTerminatorChar(nextChar), l.UnreadChar()
 }
 
 // StateFn represents the state of the scanner as a function that returns the next state.
@@ -118,105 +774,99 @@ type StateFn func(*Lexer) StateFn
 // Reads raw text content until an opening or closing tag is encountered.
 // Emits LT_TEXTCONTENT token.
 func LexTextContent(l *Lexer) StateFn {
-	textContentRunes := make([]rune, 0)
-
-	startLine := l.line
-	startCol := l.column
-
-	var emitTextContent = func() {
-		l.Emit(LT_TEXTCONTENT, string(textContentRunes), startLine, startCol)
-	}
+	l.StartTextToken()
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadTextChar()
 		if err != nil {
-			emitTextContent()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitTextContent(charOffset, 0)
+			l.EmitReadError(err)
 			return nil
 		}
 
-		if isLegalLeadingTagNameChar(nextChar) {
-			textContentLength := len(textContentRunes)
+		if nextChar != '<' {
+			if l.EmitTextChunkIfFull(nextChar, charOffset, 0) {
+				return LexTextContent
+			}
+			continue
+		}
 
-			if textContentLength > 0 && textContentRunes[textContentLength-1] == '<' {
-				// Slice off the '<' character that was appended to the text content since that's part of the tag
-				textContentRunes = textContentRunes[:textContentLength-1]
-				emitTextContent()
-				// Unread so the next state func can read the first character of the tag name
-				if err = l.UnreadRune(); err != nil {
-					l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-					return nil
-				}
-				return LexOpeningTagName
-			} else if textContentLength >= 2 && textContentRunes[textContentLength-2] == '<' && textContentRunes[textContentLength-1] == '/' {
-				// Slice off the "</" characters that were appended to the text content since that's part of the closing tag
-				textContentRunes = textContentRunes[:textContentLength-2]
-				emitTextContent()
-				// Unread so the next state func can start with the first letter of the tag name
-				if err = l.UnreadRune(); err != nil {
-					l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-					return nil
-				}
+		// Look at what follows the '<' to see if it starts a tag; otherwise it's just part of the text
+		nextByte, ok := l.PeekByte(0)
+		if !ok {
+			continue
+		}
+
+		if isLegalLeadingTagNameChar(rune(nextByte)) {
+			l.EmitTextContent(charOffset, 0)
+			return LexOpeningTagName
+		} else if nextByte == '/' {
+			if afterSlashByte, ok := l.PeekByte(1); ok && isLegalLeadingTagNameChar(rune(afterSlashByte)) {
+				l.EmitTextContent(charOffset, 0)
+				// Skip the '/' so the next state func can start with the first letter of the tag name
+				l.SkipChars(1)
 				return LexClosingTagName
 			}
-		} else if nextChar == '-' {
-			textContentLength := len(textContentRunes)
-			// See if previous chars match "<!-"
-			if textContentLength >= 3 && textContentRunes[textContentLength-3] == '<' && textContentRunes[textContentLength-2] == '!' && textContentRunes[textContentLength-1] == '-' {
-				// Slice off the "<!-" characters that were appended to the text content since that's part of the comment
-				textContentRunes = textContentRunes[:textContentLength-3]
-				emitTextContent()
-				// Unread so the next state func can start with the first character of the comment
-				if err = l.UnreadRune(); err != nil {
-					l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-					return nil
-				}
+		} else if nextByte == '!' {
+			if l.HasPrefix("!--") {
+				l.EmitTextContent(charOffset, 0)
+				l.SkipChars(3)
 				return LexCommentTag
+			} else if l.HasPrefix("![CDATA[") {
+				l.EmitTextContent(charOffset, 0)
+				if l.IsCDATAAllowed() {
+					l.SkipChars(8)
+					return LexCDATASection
+				}
+				// CDATA sections are only allowed in foreign content; elsewhere they're bogus comments
+				l.EmitDiagnostic(DC_CDATA_IN_HTML_CONTENT, DS_WARNING, "CDATA section in HTML content is parsed as a comment which ends at the first '>'", l.line, l.column-1)
+				l.SkipChars(1)
+				return LexBogusComment
 			}
 		}
-
-		textContentRunes = append(textContentRunes, nextChar)
 	}
 }
 
-// The first character from ReadRune will be the first character of the tag name following the '<' character.
+// The first character from ReadChar will be the first character of the tag name following the '<' character.
 // Reads until the first illegal tag name character; usually whitespace or '>'.
 // Emits LT_OPENINGTAGNAME token.
 func LexOpeningTagName(l *Lexer) StateFn {
-	tagNameRunes := make([]rune, 0)
-
-	startLine := l.line
-	startCol := l.column
-
-	var emitTagName = func() {
-		tagName := string(tagNameRunes)
-		l.Emit(LT_OPENINGTAGNAME, tagName, startLine, startCol)
+	startLine, startCol := l.StartToken()
+
+	var emitTagName = func(end int) {
+		tagName := l.InternName(l.SourceBytes(l.tokenStart, end))
+		namespace := getNamespaceForTagName(tagName, l.GetCurrentForeignContentElement())
+		tagName = adjustForeignTagName(tagName, namespace)
+
+		l.EmitToken(LexerToken{
+			tokenType: LT_OPENINGTAGNAME,
+			value:     tagName,
+			hasValue:  true,
+			line:      startLine,
+			column:    startCol,
+			namespace: namespace,
+		})
 		l.lastTagName = tagName
+		l.lastTagNamespace = namespace
+		l.lastTagEncoding = ""
+		l.lastTagAttributeNames = l.lastTagAttributeNames[:0]
 	}
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadChar()
 		if err != nil {
-			emitTagName()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			emitTagName(charOffset)
+			l.EmitReadError(err)
 			return nil
 		}
 
-		if isLegalTagNameChar(nextChar) {
-			tagNameRunes = append(tagNameRunes, nextChar)
-		} else {
-			emitTagName()
+		if !isLegalTagNameChar(nextChar) {
+			emitTagName(charOffset)
 			// Unread so the next state func can read the character which caused this state to end
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
+			if err = l.UnreadChar(); err != nil {
+				l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
 				return nil
 			}
 			return LexOpeningTagContents
@@ -224,21 +874,16 @@ func LexOpeningTagName(l *Lexer) StateFn {
 	}
 }
 
-// The first character from ReadRune will be the first character which terminated the opening tag's name; usually whitespace or '>'.
-// Reads until the end of the opening tag and emits LT_SELFCLOSINGTAGEND token if the tag is self-closing, but will divert
-// to lex attribute names if a legal attribute name character is encountered.
+// The first character from ReadChar will be the first character which terminated the opening tag's name or the previous attribute;
+// usually whitespace or '>'.
+// Skips whitespace until the end of the opening tag or the start of the next attribute name.
+// This corresponds to the "before attribute name" state in the HTML spec.
 func LexOpeningTagContents(l *Lexer) StateFn {
-	var prevChar *rune
-
 	for {
-		nextChar, err := l.ReadRune()
+		nextChar, err := l.ReadChar()
 		if err != nil {
-			l.Emit(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+			l.EmitTagReadError(err)
 			return nil
 		}
 
@@ -246,314 +891,485 @@ func LexOpeningTagContents(l *Lexer) StateFn {
 			// Skip whitespace
 			continue
 		} else if nextChar == '>' {
-			// End of opening tag
-			if (prevChar != nil && *prevChar == '/') || isVoidTag(l.lastTagName) {
-				// Self-closing tag or void tag which is implicitly self-closing per HTML spec
-				l.Emit(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
-			} else if isRawTextContentElementTagName(l.lastTagName) {
-				return LexRawElementContent
-			}
-			// Go back to lexing text content; if a self closing tag, that will be the content after this tag, otherwise it
-			// will be the content inside the tag
-			return LexTextContent
-		} else if isLegalAttributeNameChar(nextChar) {
-			// Unread so the first character of the attribute name can be read by the next state func
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-				return nil
-			}
-			// Attribute name
-			return LexOpeningTagAttributeName
+			return l.EndOpeningTag(false)
+		} else if nextChar == '/' {
+			return LexOpeningTagSelfClosingEnd
+		}
+
+		if nextChar == '=' {
+			// The '=' will be treated as the first character of the attribute name
+			l.EmitDiagnostic(DC_UNEXPECTED_EQUALS_SIGN_BEFORE_ATTRIBUTE_NAME, DS_WARNING, "unexpected '=' before attribute name", l.line, l.column)
 		}
 
-		prevChar = &nextChar
+		// Unread so the first character of the attribute name can be read by the next state func
+		if err = l.UnreadChar(); err != nil {
+			l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+			return nil
+		}
+		return LexOpeningTagAttributeName
+	}
+}
+
+// The previous character was a '/' inside of an opening tag.
+// If the next character is '>', the tag is self-closing; otherwise, the '/' is ignored and we continue lexing the tag contents.
+func LexOpeningTagSelfClosingEnd(l *Lexer) StateFn {
+	nextChar, err := l.ReadChar()
+	if err != nil {
+		l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+		l.EmitTagReadError(err)
+		return nil
+	}
+
+	if nextChar == '>' {
+		return l.EndOpeningTag(true)
+	}
+
+	l.EmitDiagnostic(DC_UNEXPECTED_SOLIDUS_IN_TAG, DS_WARNING, "unexpected '/' in tag", l.line, l.column)
+
+	// Unread so the next state func can read the character following the '/'
+	if err = l.UnreadChar(); err != nil {
+		l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+		return nil
+	}
+	return LexOpeningTagContents
+}
+
+// Called once the closing '>' of an opening tag has been read. Emits LT_SELFCLOSINGTAGEND token if the tag is self-closing
+// and returns the state func which should lex the element's content.
+func (l *Lexer) EndOpeningTag(hasSelfClosingSlash bool) StateFn {
+	isHTMLElement := l.lastTagNamespace == NS_HTML
+	if hasSelfClosingSlash || (isHTMLElement && isVoidTag(l.lastTagName)) {
+		// Self-closing tag or void tag which is implicitly self-closing per HTML spec.
+		// Void tags only exist in HTML; foreign elements can only be self-closed with '/>'
+		l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+		// Go back to lexing text content following the self-closing tag
+		return LexTextContent
+	}
+
+	l.PushOpenElement()
+
+	// Foreign elements never have raw text content
+	if isHTMLElement {
+		if isPlaintextElementTagName(l.lastTagName) {
+			return LexPlaintextContent
+		} else if isRawTextContentElementTagName(l.lastTagName) || isEscapableRawTextContentElementTagName(l.lastTagName) {
+			return LexRawElementContent
+		}
 	}
+
+	// Go back to lexing text content inside of the element
+	return LexTextContent
 }
 
-// The first character from ReadRune will be the first character of the attribute name.
-// Reads until the first illegal attribute name character; usually '=' for an attribute with a value or whitespace for a boolean attribute.
+// The first character from ReadChar will be the first character of the attribute name.
+// Reads until whitespace, '/', '>' or '='.
 // Emits LT_ATTRIBUTENAME token.
 func LexOpeningTagAttributeName(l *Lexer) StateFn {
-	attrNameRunes := make([]rune, 0)
+	if l.options.MaxAttributeCount > 0 && len(l.lastTagAttributeNames) >= l.options.MaxAttributeCount {
+		l.EmitReadError(newTooManyAttributesError(l.options.MaxAttributeCount, l.lastTagName))
+		return nil
+	}
+
+	startLine, startCol := l.StartToken()
+
+	var emitAttrName = func(end int) {
+		attrName := adjustForeignAttributeName(l.InternName(l.SourceBytes(l.tokenStart, end)), l.lastTagNamespace)
 
-	startLine := l.line
-	startCol := l.column
+		for _, existingAttrName := range l.lastTagAttributeNames {
+			if strings.EqualFold(existingAttrName, attrName) {
+				l.EmitDiagnostic(DC_DUPLICATE_ATTRIBUTE, DS_WARNING, "duplicate attribute '"+attrName+"' on <"+l.lastTagName+">", startLine, startCol)
+				break
+			}
+		}
+		l.lastTagAttributeNames = append(l.lastTagAttributeNames, attrName)
 
-	var emitAttrName = func() {
-		l.Emit(LT_ATTRIBUTENAME, string(attrNameRunes), startLine, startCol)
+		l.EmitValue(LT_ATTRIBUTENAME, attrName, startLine, startCol)
+		l.lastAttributeName = attrName
 	}
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadAttributeChar()
 		if err != nil {
-			emitAttrName()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			emitAttrName(charOffset)
+			l.EmitTagReadError(err)
 			return nil
 		}
 
-		if nextChar == '=' {
-			if nextChar, err = l.ReadRune(); err != nil {
-				emitAttrName()
-				if err == io.EOF {
-					l.Emit(LT_EOF, "", l.line, l.column)
-				} else {
-					l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-				}
-				return nil
-			}
-
-			emitAttrName()
+		if isWhiteSpace(nextChar) || nextChar == '/' || nextChar == '>' {
+			emitAttrName(charOffset)
 
-			// Unread so the next state func can read the first character following the =
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
+			// Unread so the next state func can read the character which caused this state to end
+			if err = l.UnreadChar(); err != nil {
+				l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
 				return nil
 			}
+			return LexOpeningTagAfterAttributeName
+		} else if nextChar == '=' && charOffset > l.tokenStart {
+			emitAttrName(charOffset)
+			return LexOpeningTagBeforeAttributeValue
+		} else if nextChar == '"' || nextChar == '\'' || nextChar == '<' {
+			l.EmitDiagnostic(DC_UNEXPECTED_CHARACTER_IN_ATTRIBUTE_NAME, DS_WARNING, "unexpected character '"+string(nextChar)+"' in attribute name", l.line, l.column)
+		}
+	}
+}
 
-			if isAttributeValueQuoteChar(nextChar) {
-				return LexOpeningTagQuotedAttributeValue
-			} else if isLegalUnquotedAttributeValueChar(nextChar) {
-				return LexOpeningTagUnquotedAttributeValue
-			} else {
-				return LexOpeningTagContents
-			}
-		} else if !isLegalAttributeNameChar(nextChar) {
-			emitAttrName()
+// The first character from ReadChar will be the character which terminated the attribute name.
+// Skips whitespace to determine whether the attribute has a value following an '='.
+func LexOpeningTagAfterAttributeName(l *Lexer) StateFn {
+	for {
+		nextChar, err := l.ReadChar()
+		if err != nil {
+			l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+			l.EmitTagReadError(err)
+			return nil
+		}
 
-			// Unread so the next state func can read the character which caused this state to end
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-				return nil
-			}
-			return LexOpeningTagContents
+		if isWhiteSpace(nextChar) {
+			continue
+		} else if nextChar == '/' {
+			return LexOpeningTagSelfClosingEnd
+		} else if nextChar == '=' {
+			return LexOpeningTagBeforeAttributeValue
+		} else if nextChar == '>' {
+			return l.EndOpeningTag(false)
 		}
 
-		attrNameRunes = append(attrNameRunes, nextChar)
+		// This is the start of a new attribute name; unread so the next state func can read its first character
+		if err = l.UnreadChar(); err != nil {
+			l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+			return nil
+		}
+		return LexOpeningTagAttributeName
 	}
 }
 
-// The first character from ReadRune will be the opening quote character of the quoted attribute value.
-// Reads until the first instance of an unescaped matching quote character.
-// Emits LT_ATTRIBUTEVALUE token.
-func LexOpeningTagQuotedAttributeValue(l *Lexer) StateFn {
-	openingQuoteChar, err := l.ReadRune()
+// The previous character was the '=' following an attribute name.
+// Skips whitespace until the start of the attribute value.
+func LexOpeningTagBeforeAttributeValue(l *Lexer) StateFn {
+	for {
+		nextChar, err := l.ReadChar()
+		if err != nil {
+			l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+			l.EmitTagReadError(err)
+			return nil
+		}
 
-	attrValueRunes := make([]rune, 0)
+		if isWhiteSpace(nextChar) {
+			continue
+		} else if nextChar == '>' {
+			l.EmitDiagnostic(DC_MISSING_ATTRIBUTE_VALUE, DS_WARNING, "missing value for attribute '"+l.lastAttributeName+"'", l.line, l.column)
+			return l.EndOpeningTag(false)
+		}
 
-	startLine := l.line
-	startCol := l.column
+		// Unread so the next state func can read the first character of the attribute value
+		if err = l.UnreadChar(); err != nil {
+			l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+			return nil
+		}
 
-	var emitAttrValue = func() {
-		l.Emit(LT_ATTRIBUTEVALUE, string(attrValueRunes), startLine, startCol)
+		if isAttributeValueQuoteChar(nextChar) {
+			return LexOpeningTagQuotedAttributeValue
+		}
+		return LexOpeningTagUnquotedAttributeValue
 	}
+}
 
+// The first character from ReadChar will be the opening quote character of the quoted attribute value.
+// Reads until the first instance of a matching quote character, or of an unescaped matching quote character
+// if backslash escapes are enabled.
+// Emits LT_ATTRIBUTEVALUE token.
+func LexOpeningTagQuotedAttributeValue(l *Lexer) StateFn {
+	openingQuoteChar, err := l.ReadChar()
 	if err != nil {
-		emitAttrValue()
-		if err == io.EOF {
-			l.Emit(LT_EOF, "", l.line, l.column)
-		} else {
-			l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-		}
+		l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+		l.EmitTagReadError(err)
+		return nil
+	}
+
+	startLine, startCol := l.StartToken()
+
+	var flags LexerTokenFlags
+	if openingQuoteChar == '\'' {
+		flags |= TF_SINGLE_QUOTED
 	}
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadAttributeChar()
 		if err != nil {
-			emitAttrValue()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitAttributeValue(l.tokenStart, charOffset, flags, startLine, startCol)
+			l.EmitTagReadError(err)
 			return nil
 		}
 
 		if nextChar == openingQuoteChar {
-			escapeCharCount := 0
-
-			for i := len(attrValueRunes) - 1; i >= 0; i-- {
-				if attrValueRunes[i] == '\\' {
-					escapeCharCount++
-				} else {
-					// Break on the first non-escape character
-					break
-				}
+			// If backslash escapes are enabled, the quote character only ends the attribute value if it is preceded by
+			// an even number of backslashes
+			if !l.options.AttributeBackslashEscapes || l.CountPrecedingBackslashes(charOffset, l.tokenStart)%2 == 0 {
+				l.EmitAttributeValue(l.tokenStart, charOffset, flags, startLine, startCol)
+				return LexOpeningTagAfterQuotedAttributeValue
 			}
+		}
 
-			if escapeCharCount%2 == 0 {
-				// If the next character is the closing quote character and it isn't escaped, then we have reached the end of the attribute value
-				emitAttrValue()
-				return LexOpeningTagContents
-			}
+		if nextChar == '\\' && l.options.AttributeBackslashEscapes {
+			flags |= TF_RESOLVE_BACKSLASH_ESCAPES
 		}
+	}
+}
 
-		attrValueRunes = append(attrValueRunes, nextChar)
+// Resolves backslash escapes in a quoted attribute value. A backslash only escapes the value's quote character
+// or another backslash; all other backslashes are left as-is.
+func unescapeAttributeValue(attrValue string, quoteChar rune) string {
+	var unescapedValue strings.Builder
+	unescapedValue.Grow(len(attrValue))
+
+	for i := 0; i < len(attrValue); i++ {
+		char := attrValue[i]
+		if char == '\\' && i+1 < len(attrValue) && (rune(attrValue[i+1]) == quoteChar || attrValue[i+1] == '\\') {
+			// Skip the backslash and keep the escaped character
+			i++
+			char = attrValue[i]
+		}
+		unescapedValue.WriteByte(char)
 	}
+
+	return unescapedValue.String()
 }
 
-// At this point, we know that the first character from ReadRune will be the first character of the unquoted attribute value.
-// Reads until the end of the attribute value; an unquoted attribute value is terminated by whitespace or tag characters like '>' or '/'.
-// Emits LT_ATTRIBUTEVALUE token.
-func LexOpeningTagUnquotedAttributeValue(l *Lexer) StateFn {
-	attrValueRunes := make([]rune, 0)
+// The previous character was the closing quote of a quoted attribute value.
+// The attribute value should be followed by whitespace or the end of the tag.
+func LexOpeningTagAfterQuotedAttributeValue(l *Lexer) StateFn {
+	nextChar, err := l.ReadChar()
+	if err != nil {
+		l.EmitValue(LT_SELFCLOSINGTAGEND, "", l.line, l.column)
+		l.EmitTagReadError(err)
+		return nil
+	}
+
+	if isWhiteSpace(nextChar) {
+		return LexOpeningTagContents
+	} else if nextChar == '/' {
+		return LexOpeningTagSelfClosingEnd
+	} else if nextChar == '>' {
+		return l.EndOpeningTag(false)
+	}
 
-	startLine := l.line
-	startCol := l.column
+	l.EmitDiagnostic(DC_MISSING_WHITESPACE_BETWEEN_ATTRIBUTES, DS_WARNING, "missing whitespace between attributes", l.line, l.column)
 
-	var emitAttrValue = func() {
-		l.Emit(LT_ATTRIBUTEVALUE, string(attrValueRunes), startLine, startCol)
+	// Unread so the next state func can read the first character of the next attribute name
+	if err = l.UnreadChar(); err != nil {
+		l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
+		return nil
 	}
+	return LexOpeningTagContents
+}
+
+// At this point, we know that the first character from ReadChar will be the first character of the unquoted attribute value.
+// Reads until the end of the attribute value; an unquoted attribute value is terminated by whitespace or '>'.
+// Emits LT_ATTRIBUTEVALUE token.
+func LexOpeningTagUnquotedAttributeValue(l *Lexer) StateFn {
+	startLine, startCol := l.StartToken()
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadAttributeChar()
 		if err != nil {
-			emitAttrValue()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitAttributeValue(l.tokenStart, charOffset, 0, startLine, startCol)
+			l.EmitTagReadError(err)
 			return nil
 		}
 
-		if !isLegalUnquotedAttributeValueChar(nextChar) {
-			emitAttrValue()
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-				return nil
-			}
+		if isWhiteSpace(nextChar) {
+			l.EmitAttributeValue(l.tokenStart, charOffset, 0, startLine, startCol)
 			return LexOpeningTagContents
+		} else if nextChar == '>' {
+			l.EmitAttributeValue(l.tokenStart, charOffset, 0, startLine, startCol)
+			return l.EndOpeningTag(false)
+		} else if isIllegalUnquotedAttributeValueChar(nextChar) {
+			l.EmitDiagnostic(DC_UNEXPECTED_CHARACTER_IN_UNQUOTED_ATTRIBUTE_VALUE, DS_WARNING, "unexpected character '"+string(nextChar)+"' in unquoted attribute value", l.line, l.column)
 		}
-
-		attrValueRunes = append(attrValueRunes, nextChar)
 	}
 }
 
-// Read the raw contents of a script or style tag until the closing tag is encountered.
+// Script data states used to lex script content in strict mode; see https://html.spec.whatwg.org/multipage/parsing.html#script-data-state
+type scriptDataState int
+
+const (
+	sds_DATA           scriptDataState = iota // default state; a matching closing tag ends the script
+	sds_ESCAPED                               // inside of a "<!--" section; a matching closing tag still ends the script
+	sds_DOUBLE_ESCAPED                        // inside of a "<script" tag nested in an escaped section; closing tags are ignored
+)
+
+// In lenient mode, a closing tag name in raw text only needs to be followed by something which isn't part of a tag name
+// so we aren't fooled by a malformed tag name like `</scriptttt`
+func isLenientEndTagNameTerminatorChar(char rune) bool {
+	return !isLegalTagNameChar(char)
+}
+
+// Read the raw contents of a raw text or RCDATA element like <script>, <style> or <textarea> until the closing tag is encountered.
 // Emits LT_TEXTCONTENT token.
 func LexRawElementContent(l *Lexer) StateFn {
-	rawTextContentRunes := make([]rune, 0)
-	startLine := l.line
-	startCol := l.column
+	l.rawContentStart = l.offset
+	l.rawContentQuoteChar = 0
+	l.rawContentBackslashes = 0
+	l.scriptDataState = sds_DATA
+
+	return LexRawElementContentChunk(l)
+}
+
+// Reads raw element content until the closing tag is encountered or, if text chunking is enabled, the content read so far
+// fills a chunk. State which needs to carry over between chunks is kept on the lexer.
+func LexRawElementContentChunk(l *Lexer) StateFn {
+	l.StartTextToken()
 
 	elementTagName := l.lastTagName
+	isScript := strings.EqualFold(elementTagName, "script")
+	isStyle := strings.EqualFold(elementTagName, "style")
+
+	isStrict := l.options.RawTextMode == RTM_STRICT
+	shouldTrackScriptDataState := isStrict && isScript
 
-	var emitTextContent = func() {
-		l.Emit(LT_TEXTCONTENT, string(rawTextContentRunes), startLine, startCol)
+	// Character references in RCDATA elements like <title> and <textarea> are decoded in both modes; the modes only
+	// differ in how they find the end of script and style content
+	var textContentFlags LexerTokenFlags
+	if isEscapableRawTextContentElementTagName(elementTagName) {
+		textContentFlags = TF_DECODE_CHARACTER_REFERENCES
 	}
 
-	var unterminatedQuoteChar *rune
+	// In strict mode, the closing tag name must be followed by whitespace, '/' or '>' per the HTML spec.
+	isClosingTagNameTerminatorChar := isEndTagNameTerminatorChar
+	if !isStrict {
+		isClosingTagNameTerminatorChar = isLenientEndTagNameTerminatorChar
+	}
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadTextChar()
 		if err != nil {
-			emitTextContent()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitTextContent(charOffset, textContentFlags)
+			l.EmitReadError(err)
 			return nil
 		}
 
-		if unterminatedQuoteChar != nil {
-			if nextChar == *unterminatedQuoteChar {
-				// Count how many backslash escape characters precede the quote character.
-				// If the count is even, the quote character is not escaped and is the closing quote character.
-				// Examples:
-				// "quote: \"" -> '"' is escaped, '"' is not"
-				// "backslash: \\" -> '\' is escaped, '"' is not"
-				// "backslash and quote: \\\"" -> '\' is escaped, '"' is escaped, final '"' is not
-				escapeCharCount := 0
-
-				for i := len(rawTextContentRunes) - 1; i >= 0; i-- {
-					if rawTextContentRunes[i] == '\\' {
-						escapeCharCount++
-					} else {
-						// Break on the first non-escape character
-						break
-					}
-				}
+		if l.EmitTextChunkIfFull(nextChar, charOffset, textContentFlags) {
+			return LexRawElementContentChunk
+		}
 
-				if escapeCharCount%2 == 0 {
-					// The quote character is not escaped, so we can now consider it terminated
-					unterminatedQuoteChar = nil
-				}
+		if l.rawContentQuoteChar != 0 {
+			// Count how many backslash escape characters precede the quote character.
+			// If the count is even, the quote character is not escaped and is the closing quote character.
+			// Examples:
+			// "quote: \"" -> '"' is escaped, '"' is not"
+			// "backslash: \\" -> '\' is escaped, '"' is not"
+			// "backslash and quote: \\\"" -> '\' is escaped, '"' is escaped, final '"' is not
+			if nextChar == l.rawContentQuoteChar && l.rawContentBackslashes%2 == 0 {
+				// The quote character is not escaped, so we can now consider it terminated
+				l.rawContentQuoteChar = 0
 			}
-			rawTextContentRunes = append(rawTextContentRunes, nextChar)
-		} else if (elementTagName == "script" && isScriptQuoteChar(nextChar)) || (elementTagName == "style" && isStyleQuoteChar(nextChar)) {
+		} else if !isStrict && ((isScript && isScriptQuoteChar(nextChar)) || (isStyle && isStyleQuoteChar(nextChar))) {
 			// We've encountered the opening quote character for a string in a script or style tag
-			unterminatedQuoteChar = &nextChar
-			rawTextContentRunes = append(rawTextContentRunes, nextChar)
+			l.rawContentQuoteChar = nextChar
 		} else if nextChar == '<' {
 			// If there is no unterminated quote character, check if we just hit a closing tag
 			closingTagNameLine := l.line
 			closingTagNameCol := l.column
 
-			// check for the chars in </script or </style
-			expectedClosingTagChars := []rune("</" + elementTagName)
-
-			actualChars := make([]rune, 0, len(expectedClosingTagChars))
-			actualChars = append(actualChars, nextChar)
-
-			closingTagNameCharCount := len(expectedClosingTagChars)
-			didMatchClosingTagName := true
-
-			for i := 1; i < closingTagNameCharCount; i++ {
-				if nextChar, err = l.ReadRune(); err != nil {
-					emitTextContent()
-					if err == io.EOF {
-						l.Emit(LT_EOF, "", l.line, l.column)
-					} else {
-						l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-					}
-					return nil
+			didMatchClosingTagName := false
+
+			if nextByte, ok := l.PeekByte(0); ok && nextByte == '/' {
+				// check for the chars in </script or </style
+				l.SkipChars(1)
+				didMatchClosingTagName, err = l.ReadMatchingChars(elementTagName, isClosingTagNameTerminatorChar)
+			} else if shouldTrackScriptDataState && l.scriptDataState == sds_ESCAPED {
+				// A nested "<script" tag inside of an escaped section switches to the double escaped state, where
+				// "</script" no longer closes the element
+				var didMatchOpeningScriptTag bool
+				didMatchOpeningScriptTag, err = l.ReadMatchingChars("script", isEndTagNameTerminatorChar)
+				if didMatchOpeningScriptTag {
+					l.scriptDataState = sds_DOUBLE_ESCAPED
 				}
+			}
 
-				actualChars = append(actualChars, nextChar)
-
-				if nextChar != expectedClosingTagChars[i] {
-					didMatchClosingTagName = false
-					break
-				}
+			if err != nil {
+				// Everything read while looking for the closing tag is part of the text content
+				l.EmitTextContent(l.offset, textContentFlags)
+				l.EmitReadError(err)
+				return nil
 			}
 
 			if didMatchClosingTagName {
-				// We need to read one last character to make sure the tag name is terminated correctly
-				// to be an exact match; we don't want to be fooled by a malformed `</scriptttt` tag name
-				if nextChar, err = l.ReadRune(); err != nil {
-					emitTextContent()
-					if err == io.EOF {
-						l.Emit(LT_EOF, "", l.line, l.column)
-					} else {
-						l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-					}
-					return nil
-				}
-
-				actualChars = append(actualChars, nextChar)
-
-				if !isLegalTagNameChar(nextChar) {
-					emitTextContent()
-					l.Emit(LT_CLOSINGTAGNAME, elementTagName, closingTagNameLine, closingTagNameCol)
-					// Unread so the next state func can read the character which caused this state to end
-					if err = l.UnreadRune(); err != nil {
-						l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-						return nil
-					}
+				if l.scriptDataState == sds_DOUBLE_ESCAPED {
+					// A closing tag in the double escaped state just closes the nested "<script" tag
+					l.scriptDataState = sds_ESCAPED
+				} else {
+					// The "</tagname" characters aren't part of the text content since they're part of the closing tag
+					l.EmitTextContent(charOffset, textContentFlags)
+					l.EmitValue(LT_CLOSINGTAGNAME, l.PopOpenElement(elementTagName), closingTagNameLine, closingTagNameCol)
 					// Finish lexing the closing tag
 					return LexClosingTag
 				}
 			}
+		} else if shouldTrackScriptDataState {
+			if l.scriptDataState == sds_DATA && nextChar == '-' && l.HasSuffix(l.offset, "<!--", l.rawContentStart) {
+				l.scriptDataState = sds_ESCAPED
+			} else if l.scriptDataState != sds_DATA && nextChar == '>' && l.HasSuffix(l.offset, "-->", l.rawContentStart) {
+				l.scriptDataState = sds_DATA
+			}
+		}
 
-			// If we didn't hit on a closing tag match, add all of the characters we read so far to the script content
-			rawTextContentRunes = append(rawTextContentRunes, actualChars...)
+		if nextChar == '\\' {
+			l.rawContentBackslashes++
 		} else {
-			rawTextContentRunes = append(rawTextContentRunes, nextChar)
+			l.rawContentBackslashes = 0
+		}
+	}
+}
+
+// Reads the contents of a <plaintext> element, which consists of everything until the end of the file.
+// Emits LT_TEXTCONTENT token.
+func LexPlaintextContent(l *Lexer) StateFn {
+	l.StartTextToken()
+
+	for {
+		charOffset := l.offset
+		nextChar, err := l.ReadTextChar()
+		if err != nil {
+			l.EmitTextContent(charOffset, 0)
+			l.EmitReadError(err)
+			return nil
+		}
+
+		if l.EmitTextChunkIfFull(nextChar, charOffset, 0) {
+			return LexPlaintextContent
+		}
+	}
+}
+
+// CDATA sections are of the form <![CDATA[ ... ]]> and are only allowed in foreign content.
+// The first character from ReadChar will be the first character of the section's content.
+// Reads until the closing ]]> is encountered.
+// Emits LT_TEXTCONTENT token.
+func LexCDATASection(l *Lexer) StateFn {
+	l.StartTextToken()
+
+	for {
+		charOffset := l.offset
+		nextChar, err := l.ReadTextChar()
+		if err != nil {
+			l.EmitTextContent(charOffset, 0)
+			l.EmitReadError(err)
+			return nil
+		}
+
+		if l.EmitTextChunkIfFull(nextChar, charOffset, 0) {
+			return LexCDATASection
+		}
+
+		if nextChar == '>' && l.HasSuffix(l.offset, "]]>", l.tokenStart) {
+			// Leave off the "]]>" characters since they aren't part of the content
+			l.EmitTextContent(l.offset-3, 0)
+			return LexTextContent
 		}
 	}
 }
@@ -562,64 +1378,79 @@ func LexRawElementContent(l *Lexer) StateFn {
 // Reads until the closing --> is encountered.
 // We don't need to emit a token for comments, just want to skip them
 func LexCommentTag(l *Lexer) StateFn {
-	var prevChar *rune
-	var prevPrevChar *rune
+	// Nothing in the comment needs to be kept, so let the window discard it as we go
+	l.StartToken()
+
+	// The number of '-' characters directly preceding the current character. The second '-' of the opening "<!--"
+	// counts, so "<!--->" is a complete comment.
+	dashCount := 1
 
 	for {
-		nextChar, err := l.ReadRune()
+		nextChar, err := l.ReadChar()
 		if err != nil {
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitReadError(err)
 			return nil
 		}
 
-		if prevPrevChar != nil && prevChar != nil && *prevPrevChar == '-' && *prevChar == '-' && nextChar == '>' {
+		if nextChar == '>' && dashCount >= 2 {
 			// The comment has been terminated with -->
 			return LexTextContent
 		}
 
-		prevPrevChar = prevChar
-		prevChar = &nextChar
+		if nextChar == '-' {
+			dashCount++
+		} else {
+			dashCount = 0
+		}
+		l.tokenStart = l.offset
+	}
+}
+
+// Bogus comments are markup like <![CDATA[ ... ]]> in HTML content which is parsed as a comment. They end at the first '>'.
+// Like regular comments, we don't need to emit a token for them.
+func LexBogusComment(l *Lexer) StateFn {
+	l.StartToken()
+
+	for {
+		nextChar, err := l.ReadChar()
+		if err != nil {
+			l.EmitReadError(err)
+			return nil
+		}
+
+		if nextChar == '>' {
+			return LexTextContent
+		}
+		l.tokenStart = l.offset
 	}
 }
 
 // Reads until the end of the tag name.
 // emits LT_CLOSINGTAGNAME token
 func LexClosingTagName(l *Lexer) StateFn {
-	closingTagNameRunes := make([]rune, 0)
-
-	startLine := l.line
-	startCol := l.column
+	startLine, startCol := l.StartToken()
 
-	var emitClosingTagName = func() {
-		l.Emit(LT_CLOSINGTAGNAME, string(closingTagNameRunes), startLine, startCol)
+	var emitClosingTagName = func(end int) {
+		l.EmitValue(LT_CLOSINGTAGNAME, l.PopOpenElement(l.InternName(l.SourceBytes(l.tokenStart, end))), startLine, startCol)
 	}
 
 	for {
-		nextChar, err := l.ReadRune()
+		charOffset := l.offset
+		nextChar, err := l.ReadChar()
 		if err != nil {
-			emitClosingTagName()
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			emitClosingTagName(charOffset)
+			l.EmitReadError(err)
 			return nil
 		}
 
 		if !isLegalTagNameChar(nextChar) {
-			emitClosingTagName()
-			if err = l.UnreadRune(); err != nil {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
+			emitClosingTagName(charOffset)
+			if err = l.UnreadChar(); err != nil {
+				l.EmitValue(LT_ERROR, err.Error(), l.line, l.column)
 				return nil
 			}
 			return LexClosingTag
 		}
-
-		closingTagNameRunes = append(closingTagNameRunes, nextChar)
 	}
 }
 
@@ -627,14 +1458,12 @@ func LexClosingTagName(l *Lexer) StateFn {
 // This will simply skip until the closing '>' character is found and then revert back to the default state
 // lexing text content.
 func LexClosingTag(l *Lexer) StateFn {
+	l.StartToken()
+
 	for {
-		nextChar, err := l.ReadRune()
+		nextChar, err := l.ReadChar()
 		if err != nil {
-			if err == io.EOF {
-				l.Emit(LT_EOF, "", l.line, l.column)
-			} else {
-				l.Emit(LT_ERROR, err.Error(), l.line, l.column)
-			}
+			l.EmitReadError(err)
 			return nil
 		}
 
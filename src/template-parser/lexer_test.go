@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Lexes a template and formats its tokens with FormatToken, leaving out empty text content and the final EOF
+func lexTemplate(source string, options LexerOptions) []string {
+	lexer := NewLexer(context.Background(), NewTemplateSource(strings.NewReader(source)), options)
+	tokens := []string{}
+	for {
+		token := lexer.NextToken()
+		if token.tokenType == LT_EOF || token.tokenType == LT_ERROR {
+			return tokens
+		}
+		if formattedToken := lexer.FormatToken(&token); !strings.HasSuffix(formattedToken, ` TEXTCONTENT ""`) {
+			tokens = append(tokens, formattedToken)
+		}
+	}
+}
+
+func TestLexAttributes(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:   "quoted, unquoted and valueless attributes",
+			source: `<a b="1" c='2' d=3 e>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:7 ATTRIBUTEVALUE "1"`,
+				`1:10 ATTRIBUTENAME "c"`,
+				`1:13 ATTRIBUTEVALUE "2"`,
+				`1:16 ATTRIBUTENAME "d"`,
+				`1:18 ATTRIBUTEVALUE "3"`,
+				`1:20 ATTRIBUTENAME "e"`,
+			},
+		},
+		{
+			name:   "character references in attribute values are left encoded",
+			source: `<a b="&lt;" c=&amp;>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:7 ATTRIBUTEVALUE "&lt;"`,
+				`1:13 ATTRIBUTENAME "c"`,
+				`1:15 ATTRIBUTEVALUE "&amp;"`,
+			},
+		},
+		{
+			name:   "duplicate attribute",
+			source: `<a b c B>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:6 ATTRIBUTENAME "c"`,
+				`1:8 DIAGNOSTIC warning duplicate-attribute: duplicate attribute 'B' on <a>`,
+				`1:8 ATTRIBUTENAME "B"`,
+			},
+		},
+		{
+			name:   "missing attribute value",
+			source: `<a b=>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:7 DIAGNOSTIC warning missing-attribute-value: missing value for attribute 'b'`,
+			},
+		},
+		{
+			name:   "missing whitespace between attributes",
+			source: `<a b="1"c>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:7 ATTRIBUTEVALUE "1"`,
+				`1:10 DIAGNOSTIC warning missing-whitespace-between-attributes: missing whitespace between attributes`,
+				`1:9 ATTRIBUTENAME "c"`,
+			},
+		},
+		{
+			name:   "unexpected character in attribute name",
+			source: `<a b"c>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:6 DIAGNOSTIC warning unexpected-character-in-attribute-name: unexpected character '"' in attribute name`,
+				`1:4 ATTRIBUTENAME "b\"c"`,
+			},
+		},
+		{
+			name:   "unexpected character in unquoted attribute value",
+			source: `<a b=c"d>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:8 DIAGNOSTIC warning unexpected-character-in-unquoted-attribute-value: unexpected character '"' in unquoted attribute value`,
+				`1:6 ATTRIBUTEVALUE "c\"d"`,
+			},
+		},
+		{
+			name:   "unexpected equals sign before attribute name",
+			source: `<a =b>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:5 DIAGNOSTIC warning unexpected-equals-sign-before-attribute-name: unexpected '=' before attribute name`,
+				`1:4 ATTRIBUTENAME "=b"`,
+			},
+		},
+		{
+			name:   "unexpected solidus in tag",
+			source: `<a / b>`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:6 DIAGNOSTIC warning unexpected-solidus-in-tag: unexpected '/' in tag`,
+				`1:6 ATTRIBUTENAME "b"`,
+			},
+		},
+		{
+			name:   "end of file inside of an attribute value",
+			source: `<a b="1`,
+			expected: []string{
+				`1:2 OPENINGTAGNAME "a"`,
+				`1:4 ATTRIBUTENAME "b"`,
+				`1:7 ATTRIBUTEVALUE "1"`,
+				`1:8 DIAGNOSTIC error eof-in-tag: unexpected end of file inside of <a> tag`,
+			},
+		},
+	} {
+		if tokens := lexTemplate(testCase.source, LexerOptions{}); !reflect.DeepEqual(tokens, testCase.expected) {
+			t.Errorf("%s: expected tokens\n%s\ngot\n%s", testCase.name, strings.Join(testCase.expected, "\n"), strings.Join(tokens, "\n"))
+		}
+	}
+}
+
+func TestReadCharPositions(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		source string
+		// The position of each character before it is read, followed by the position at the end of the file
+		runes []string
+		bytes []string
+		utf16 []string
+	}{
+		{
+			name:   "line endings",
+			source: "a\r\nb\rc\nd",
+			runes:  []string{"1:1", "1:2", "2:1", "2:2", "3:1", "3:2", "4:1", "4:2"},
+			bytes:  []string{"1:1", "1:2", "2:1", "2:2", "3:1", "3:2", "4:1", "4:2"},
+			utf16:  []string{"1:1", "1:2", "2:1", "2:2", "3:1", "3:2", "4:1", "4:2"},
+		},
+		{
+			name:   "consecutive line endings",
+			source: "\r\r\n\n\r",
+			runes:  []string{"1:1", "2:1", "3:1", "4:1", "5:1"},
+			bytes:  []string{"1:1", "2:1", "3:1", "4:1", "5:1"},
+			utf16:  []string{"1:1", "2:1", "3:1", "4:1", "5:1"},
+		},
+		{
+			name:   "multi-byte and astral characters",
+			source: "é😀x",
+			runes:  []string{"1:1", "1:2", "1:3", "1:4"},
+			bytes:  []string{"1:1", "1:3", "1:7", "1:8"},
+			utf16:  []string{"1:1", "1:2", "1:4", "1:5"},
+		},
+		{
+			name:   "astral characters around a line ending",
+			source: "😀\r\n𝄞a",
+			runes:  []string{"1:1", "1:2", "2:1", "2:2", "2:3"},
+			bytes:  []string{"1:1", "1:5", "2:1", "2:5", "2:6"},
+			utf16:  []string{"1:1", "1:3", "2:1", "2:3", "2:4"},
+		},
+	} {
+		for columnUnit, expectedPositions := range map[ColumnUnit][]string{
+			CU_RUNES: testCase.runes,
+			CU_BYTES: testCase.bytes,
+			CU_UTF16: testCase.utf16,
+		} {
+			lexer := NewLexer(context.Background(), NewTemplateSource(strings.NewReader(testCase.source)), LexerOptions{ColumnUnit: columnUnit})
+			var getPosition = func() string {
+				return strconv.Itoa(lexer.line) + ":" + strconv.Itoa(lexer.column)
+			}
+
+			positions := []string{getPosition()}
+			chars := []rune{}
+			for {
+				char, err := lexer.ReadChar()
+				if err != nil {
+					break
+				}
+				chars = append(chars, char)
+				positions = append(positions, getPosition())
+			}
+			if !reflect.DeepEqual(positions, expectedPositions) {
+				t.Errorf("%s (unit %d): expected positions %v, got %v", testCase.name, columnUnit, expectedPositions, positions)
+				continue
+			}
+			if strings.ContainsRune(string(chars), '\r') {
+				t.Errorf("%s (unit %d): expected line endings to be normalized, got %q", testCase.name, columnUnit, string(chars))
+			}
+
+			// Unreading moves back to each character's position, and reading it again moves forward the same way
+			unreadCount := min(len(chars), MAX_UNREAD_CHAR_COUNT)
+			for i := 1; i <= unreadCount; i++ {
+				if err := lexer.UnreadChar(); err != nil {
+					t.Fatal(err)
+				}
+				if position := getPosition(); position != expectedPositions[len(chars)-i] {
+					t.Errorf("%s (unit %d): expected unreading %d characters to move to %s, got %s", testCase.name, columnUnit, i, expectedPositions[len(chars)-i], position)
+				}
+			}
+			for i := len(chars) - unreadCount; i < len(chars); i++ {
+				if char, err := lexer.ReadChar(); err != nil || char != chars[i] {
+					t.Errorf("%s (unit %d): expected to read %q again, got %q (%v)", testCase.name, columnUnit, chars[i], char, err)
+				} else if position := getPosition(); position != expectedPositions[i+1] {
+					t.Errorf("%s (unit %d): expected reading %q again to move to %s, got %s", testCase.name, columnUnit, chars[i], expectedPositions[i+1], position)
+				}
+			}
+		}
+	}
+}
+
+func TestRawTextCharacterReferences(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"<textarea> is decoded", `<textarea>a &amp; &lt;b&gt;</textarea>`, `1:11 TEXTCONTENT "a & <b>"`},
+		{"<title> is decoded", `<title>&copy; 2024 &#x1F600;</title>`, `1:8 TEXTCONTENT "© 2024 😀"`},
+		{"<script> is left encoded", `<script>a &amp;&amp; b</script>`, `1:9 TEXTCONTENT "a &amp;&amp; b"`},
+		{"<style> is left encoded", `<style>a::after { content: "&amp;" }</style>`, `1:8 TEXTCONTENT "a::after { content: \"&amp;\" }"`},
+		{"text content is left encoded", `<p>a &amp; b</p>`, `1:4 TEXTCONTENT "a &amp; b"`},
+	} {
+		for _, rawTextMode := range []RawTextMode{RTM_LENIENT, RTM_STRICT} {
+			tokens := lexTemplate(testCase.source, LexerOptions{RawTextMode: rawTextMode})
+			if !slices.Contains(tokens, testCase.expected) {
+				t.Errorf("%s (mode %d): expected token %s, got\n%s", testCase.name, rawTextMode, testCase.expected, strings.Join(tokens, "\n"))
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+)
+
+// Limits on how much work a single parse can do so a malicious or broken template can't exhaust the server's memory.
+// Hitting a limit stops the parse with a diagnostic; everything parsed up to that point is kept. A limit of 0 disables it.
+type ParseLimits struct {
+	// The maximum number of bytes read from the template source
+	MaxInputSize int64
+	// The maximum number of elements which can be open inside of each other
+	MaxNestingDepth int
+	// The maximum number of attributes on a single element
+	MaxAttributeCount int
+	// The maximum number of bytes in a single attribute name or value
+	MaxAttributeLength int
+	// The maximum number of bytes in a single run of text, including text which is split into chunks
+	MaxTextLength int
+	// The maximum number of element and text nodes in the template
+	MaxNodeCount int
+	// The maximum amount of time a parse can take
+	Timeout time.Duration
+}
+
+var DEFAULT_PARSE_LIMITS = ParseLimits{
+	MaxInputSize:       64 * 1024 * 1024,
+	MaxNestingDepth:    1024,
+	MaxAttributeCount:  1024,
+	MaxAttributeLength: 1024 * 1024,
+	MaxTextLength:      16 * 1024 * 1024,
+	MaxNodeCount:       1_000_000,
+	Timeout:            30 * time.Second,
+}
+
+// Copies the limits which the lexer enforces itself into its options
+func (limits ParseLimits) ApplyToLexerOptions(options LexerOptions) LexerOptions {
+	options.MaxAttributeCount = limits.MaxAttributeCount
+	options.MaxAttributeLength = limits.MaxAttributeLength
+	options.MaxTextLength = limits.MaxTextLength
+	return options
+}
+
+// The limits applied to templates parsed by the server's endpoints and commands
+var templateParseLimits = DEFAULT_PARSE_LIMITS
+
+// How many tokens are parsed between checks of whether the parse has been cancelled or timed out
+const PARSE_CONTEXT_CHECK_INTERVAL = 1024
+
+// An error which stops a parse because it hit one of its limits. It is reported as a diagnostic rather than failing
+// the parse, so its code is a diagnostic code.
+type ParseLimitError struct {
+	Code    string
+	Message string
+}
+
+func (err *ParseLimitError) Error() string {
+	return err.Message
+}
+
+func newInputTooLargeError(maxInputSize int64) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_INPUT_TOO_LARGE,
+		Message: "template is larger than the limit of " + strconv.FormatInt(maxInputSize, 10) + " bytes; parsing stopped",
+	}
+}
+
+func newNestingTooDeepError(maxNestingDepth int) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_NESTING_TOO_DEEP,
+		Message: "elements are nested more than " + strconv.Itoa(maxNestingDepth) + " levels deep; parsing stopped",
+	}
+}
+
+func newTooManyAttributesError(maxAttributeCount int, tagName string) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_TOO_MANY_ATTRIBUTES,
+		Message: "<" + tagName + "> has more than " + strconv.Itoa(maxAttributeCount) + " attributes; parsing stopped",
+	}
+}
+
+func newAttributeTooLongError(maxAttributeLength int) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_ATTRIBUTE_TOO_LONG,
+		Message: "attribute is longer than the limit of " + strconv.Itoa(maxAttributeLength) + " bytes; parsing stopped",
+	}
+}
+
+func newTextTooLongError(maxTextLength int) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_TEXT_TOO_LONG,
+		Message: "text is longer than the limit of " + strconv.Itoa(maxTextLength) + " bytes; parsing stopped",
+	}
+}
+
+func newTooManyNodesError(maxNodeCount int) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_TOO_MANY_NODES,
+		Message: "template has more than " + strconv.Itoa(maxNodeCount) + " nodes; parsing stopped",
+	}
+}
+
+func newParseTimeoutError(timeout time.Duration) *ParseLimitError {
+	return &ParseLimitError{
+		Code:    DC_PARSE_TIMEOUT,
+		Message: "parsing took longer than the limit of " + timeout.String() + "; parsing stopped",
+	}
+}
+
+// Finds the diagnostic for the limit a parse stopped at, or returns nil if the whole template was parsed. Results which
+// stopped at a limit shouldn't be cached or kept as diff bases, since the parse timeout depends on how busy the server
+// is, so the same template could be parsed completely next time.
+func getParseLimitDiagnostic(diagnostics []*Diagnostic) *Diagnostic {
+	for _, diagnostic := range diagnostics {
+		switch diagnostic.Code {
+		case DC_ATTRIBUTE_TOO_LONG, DC_INPUT_TOO_LARGE, DC_NESTING_TOO_DEEP, DC_PARSE_TIMEOUT, DC_TEXT_TOO_LONG, DC_TOO_MANY_ATTRIBUTES, DC_TOO_MANY_NODES:
+			return diagnostic
+		}
+	}
+	return nil
+}
+
+// Reads from a template source until the maximum input size is reached, and then returns an input too large error
+// if there is anything left to read
+type inputSizeLimitReader struct {
+	reader       io.Reader
+	maxInputSize int64
+	remaining    int64
+}
+
+func newInputSizeLimitReader(reader io.Reader, maxInputSize int64) io.Reader {
+	if maxInputSize <= 0 {
+		return reader
+	}
+	return &inputSizeLimitReader{reader: reader, maxInputSize: maxInputSize, remaining: maxInputSize}
+}
+
+func (r *inputSizeLimitReader) Read(p []byte) (int, error) {
+	// Read one byte past the limit so a source which is exactly the maximum size isn't reported as too large
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	readCount, err := r.reader.Read(p)
+	if int64(readCount) > r.remaining {
+		readCount = int(r.remaining)
+		r.remaining = 0
+		return readCount, newInputTooLargeError(r.maxInputSize)
+	}
+
+	r.remaining -= int64(readCount)
+	return readCount, err
+}
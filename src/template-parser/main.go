@@ -1,36 +1,252 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func main() {
-	listener, err := net.Listen("tcp", "localhost:0")
+	// Clients start the server with just flags, so serving is the default if no command is given
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	if err != nil {
-		panic(err)
+	switch command {
+	case "serve":
+		serve(args)
+	case "parse":
+		os.Exit(runParseCommand(args))
+	case "tokens":
+		os.Exit(runTokensCommand(args))
+	case "ast":
+		os.Exit(runASTCommand(args))
+	case "check":
+		os.Exit(runCheckCommand(args))
+	case "help":
+		writeUsage(os.Stdout)
+	default:
+		os.Stderr.WriteString("unknown command '" + command + "'\n\n")
+		writeUsage(os.Stderr)
+		os.Exit(EC_USAGE)
 	}
+}
+
+// Serves parse requests over the transport chosen by the flags until the server shuts down
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	setCommandUsage(flags, "serve [flags]")
 
-	http.HandleFunc("/health", func(responseWriter http.ResponseWriter, request *http.Request) {
-		responseWriter.Write([]byte("OK"))
+	cacheMemoryLimit := flags.Int64("cache-memory-limit", DEFAULT_PARSE_CACHE_MEMORY_LIMIT, "maximum number of bytes of parse results to cache in memory; 0 disables the cache")
+	cacheDir := flags.String("cache-dir", "", "directory to persist parse results in between runs; the on-disk cache is disabled if this isn't set")
+	cacheDirMaxAge := flags.Duration("cache-dir-max-age", DEFAULT_DISK_CACHE_MAX_AGE, "how long parse results in the cache directory are kept after they were last used")
+	cacheDirMaxSize := flags.Int64("cache-dir-max-size", DEFAULT_DISK_CACHE_MAX_SIZE, "maximum number of bytes of parse results to keep in the cache directory")
+	shutdownTimeout := flags.Duration("shutdown-timeout", DEFAULT_SHUTDOWN_TIMEOUT, "how long to wait for in-flight requests to finish when shutting down")
+	idleTimeout := flags.Duration("idle-timeout", 0, "shut down after going this long without any requests; 0 disables the idle timeout")
+	transport := flags.String("transport", "tcp", "how to serve requests: 'tcp' for HTTP on a random localhost port, 'unix' for HTTP on a Unix domain socket, or 'stdio' for newline-delimited JSON-RPC over stdin and stdout")
+	socketPath := flags.String("socket", "", "path of the Unix domain socket to listen on with the 'unix' transport")
+	exitOnStdinClose := flags.Bool("exit-on-stdin-close", false, "shut down when stdin is closed, ie when the parent process exits")
+	enablePprof := flags.Bool("pprof", false, "serve net/http/pprof profiles under /debug/pprof/")
+	enableServerTiming := flags.Bool("server-timing", false, "send a Server-Timing trailer with how long lexing, building the tree and serializing took")
+
+	var allowedRoots []string
+	flags.Func("root", "directory which templates can be read from; may be repeated, and defaults to the current working directory", func(root string) error {
+		allowedRoots = append(allowedRoots, root)
+		return nil
 	})
+	templateExtensions := flags.String("template-extensions", strings.Join(DEFAULT_ALLOWED_TEMPLATE_EXTENSIONS, ","), "comma-separated extensions which files must have to be read; '*' allows any extension")
+	addParseLimitFlags(flags)
+	flags.Parse(args)
 
-	http.HandleFunc("/parse", func(responseWriter http.ResponseWriter, request *http.Request) {
-		err := parseTemplateFile(request.URL.Query().Get("path"), &responseWriter)
+	if len(allowedRoots) == 0 {
+		workingDir, err := os.Getwd()
 		if err != nil {
-			responseWriter.WriteHeader(http.StatusInternalServerError)
-			responseWriter.Write([]byte(err.Error()))
+			panic(err)
 		}
-	})
+		allowedRoots = []string{workingDir}
+	}
+
+	var allowedExtensions []string
+	if *templateExtensions != "*" {
+		for _, extension := range strings.Split(*templateExtensions, ",") {
+			if extension = strings.TrimSpace(extension); extension != "" {
+				allowedExtensions = append(allowedExtensions, extension)
+			}
+		}
+	}
+
+	policy, err := newPathPolicy(allowedRoots, allowedExtensions)
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(EC_USAGE)
+	}
+	templatePathPolicy = policy
+
+	if *cacheMemoryLimit > 0 {
+		templateParseCache = newParseCache(*cacheMemoryLimit)
+	}
+
+	if *cacheDir != "" {
+		if templateDiskCache, err = newDiskCache(*cacheDir, *cacheDirMaxAge, *cacheDirMaxSize); err != nil {
+			panic(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	server := newParserServer(mux, *shutdownTimeout, *idleTimeout)
+	server.isServerTimingEnabled = *enableServerTiming
+	registerHandlers(mux, server)
+	if *enablePprof {
+		registerPprofHandlers(mux)
+	}
+
+	server.ShutdownOnSignal()
+	server.MonitorParentAndIdleTime()
+
+	server.info = ServerInfo{
+		ProtocolVersion: PROTOCOL_VERSION,
+		ParserVersion:   PARSER_VERSION,
+		Transport:       *transport,
+		Formats:         []string{"tree", "events"},
+		Features:        []string{"parse-batch", "watch", "diff", "shutdown", "metrics"},
+	}
+	if templateParseCache != nil {
+		server.info.Features = append(server.info.Features, "memory-cache")
+	}
+	if templateDiskCache != nil {
+		server.info.Features = append(server.info.Features, "disk-cache")
+	}
+	if *idleTimeout > 0 {
+		server.info.Features = append(server.info.Features, "idle-timeout")
+	}
+	if *exitOnStdinClose && *transport != "stdio" {
+		server.info.Features = append(server.info.Features, "exit-on-stdin-close")
+	}
+	if *enablePprof {
+		server.info.Features = append(server.info.Features, "pprof")
+	}
+	if *enableServerTiming {
+		server.info.Features = append(server.info.Features, "server-timing")
+	}
 
-	defer http.Serve(listener, nil)
+	switch *transport {
+	case "tcp":
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			panic(err)
+		}
 
-	port := listener.Addr().(*net.TCPAddr).Port
+		if *exitOnStdinClose {
+			server.ShutdownOnStdinClose()
+		}
+
+		server.info.Address = "http://localhost:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		writeHandshake(&server.info)
+
+		if err := server.Serve(listener); err != nil {
+			panic(err)
+		}
+	case "unix":
+		listener, err := listenOnUnixSocket(*socketPath)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(EC_FAILURE)
+		}
+
+		if *exitOnStdinClose {
+			server.ShutdownOnStdinClose()
+		}
+
+		server.info.Address = *socketPath
+		writeHandshake(&server.info)
+
+		if err := server.Serve(listener); err != nil {
+			panic(err)
+		}
+	case "stdio":
+		// The handshake is the only line on stdout which isn't a JSON-RPC message
+		writeHandshake(&server.info)
+
+		// Stdin carries requests, so closing it already shuts the server down
+		go server.ServeRPC(os.Stdin, os.Stdout)
+		server.Wait()
+	default:
+		os.Stderr.WriteString("invalid transport '" + *transport + "'; expected 'tcp', 'unix' or 'stdio'\n")
+		os.Exit(EC_USAGE)
+	}
+}
+
+// Writes the server's info to stdout as a single JSON line so that the parent process can read it
+// and know that the server is ready to receive requests at its address
+func writeHandshake(info *ServerInfo) {
+	handshakeJSON, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(append(handshakeJSON, '\n'))
+}
+
+// Listens on a Unix domain socket which only the current user can connect to. Sockets are created with the umask's
+// permissions, so the socket is created inside of a private directory and only moved to its path once its permissions
+// have been restricted; otherwise other users could connect before they were changed.
+func listenOnUnixSocket(socketPath string) (net.Listener, error) {
+	if socketPath == "" {
+		return nil, errors.New("the unix transport requires a -socket path")
+	}
+
+	// Clean up a socket left behind by a server which didn't shut down cleanly, but never delete anything else
+	if fileInfo, err := os.Lstat(socketPath); err == nil {
+		if fileInfo.Mode().Type() != fs.ModeSocket {
+			return nil, errors.New("can't listen on '" + socketPath + "' because a file which isn't a socket already exists there")
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The directory has to be next to the socket's path so the socket can be moved there. Its name is kept short since
+	// socket paths have a length limit.
+	privateDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".tp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+
+	privateSocketPath := filepath.Join(privateDir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: privateSocketPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The listener would only remove the socket from its original path, so it is removed from where it was moved instead
+	listener.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(privateSocketPath, 0o600); err == nil {
+		err = os.Rename(privateSocketPath, socketPath)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &unixSocketListener{UnixListener: listener, socketPath: socketPath}, nil
+}
+
+// Removes its socket once it is closed
+type unixSocketListener struct {
+	*net.UnixListener
+	socketPath string
+}
 
-	// Write the server's URL origin to stdout so that the parent process can read it
-	// and know that the server is ready to receive requests at that address
-	os.Stdout.Write([]byte("http://localhost:" + strconv.Itoa(port)))
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.socketPath)
+	return err
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketIsPrivate(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "parser.sock")
+
+	listener, err := listenOnUnixSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileInfo, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.Mode().Type() != os.ModeSocket || fileInfo.Mode().Perm() != 0o600 {
+		t.Errorf("expected a socket which only its owner can use, got mode %v", fileInfo.Mode())
+	}
+
+	connection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("expected to connect to the moved socket: %v", err)
+	}
+	connection.Close()
+
+	// Only the socket should be left behind while listening, and nothing once the listener is closed
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the socket in its directory, got %d entries", len(entries))
+	}
+	listener.Close()
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed once the listener is closed, got: %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the buckets for parse and request durations, in seconds
+var METRICS_DURATION_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// The outcomes parses are counted by
+const (
+	PO_SUCCESS   = "success"
+	PO_ERROR     = "error"
+	PO_CANCELLED = "cancelled"
+)
+
+// A counter which is split up by the values of one or more labels, ie parses by output format and outcome
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mutex sync.Mutex
+	// Keyed by the label values joined with null bytes
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.values[key] += value
+}
+
+func (c *counterVec) Write(buf *bytes.Buffer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	writeMetricHeader(buf, c.name, c.help, "counter")
+	for _, key := range getSortedKeys(c.values) {
+		writeMetricSample(buf, c.name, formatMetricLabels(c.labelNames, strings.Split(key, "\x00")), c.values[key])
+	}
+}
+
+type histogram struct {
+	// The number of observations in each bucket, plus one for observations above the largest bucket
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+}
+
+// A histogram which is split up by the values of one or more labels, ie request durations by endpoint
+type histogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	mutex      sync.Mutex
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labelNames: labelNames, buckets: buckets, histograms: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	labelHistogram := h.histograms[key]
+	if labelHistogram == nil {
+		labelHistogram = &histogram{bucketCounts: make([]uint64, len(h.buckets)+1)}
+		h.histograms[key] = labelHistogram
+	}
+
+	labelHistogram.bucketCounts[sort.SearchFloat64s(h.buckets, value)]++
+	labelHistogram.sum += value
+	labelHistogram.count++
+}
+
+func (h *histogramVec) Write(buf *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+	upperBounds := append(append([]float64{}, h.buckets...), math.Inf(1))
+
+	writeMetricHeader(buf, h.name, h.help, "histogram")
+	for _, key := range getSortedKeys(h.histograms) {
+		labelHistogram := h.histograms[key]
+		labelValues := strings.Split(key, "\x00")
+
+		// Buckets are cumulative, so each one counts every observation up to and including its upper bound
+		var cumulativeCount uint64
+		for i, upperBound := range upperBounds {
+			cumulativeCount += labelHistogram.bucketCounts[i]
+			bucketLabelValues := append(append([]string{}, labelValues...), formatMetricValue(upperBound))
+			writeMetricSample(buf, h.name+"_bucket", formatMetricLabels(bucketLabelNames, bucketLabelValues), float64(cumulativeCount))
+		}
+		labels := formatMetricLabels(h.labelNames, labelValues)
+		writeMetricSample(buf, h.name+"_sum", labels, labelHistogram.sum)
+		writeMetricSample(buf, h.name+"_count", labels, float64(labelHistogram.count))
+	}
+}
+
+func getSortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name string, help string, metricType string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeMetricSample(buf *bytes.Buffer, name string, labels string, value float64) {
+	buf.WriteString(name + labels + " " + formatMetricValue(value) + "\n")
+}
+
+// Writes a metric with a single value which is read when the metrics are requested, ie the number of goroutines
+func writeMetric(buf *bytes.Buffer, name string, help string, metricType string, value float64) {
+	writeMetricHeader(buf, name, help, metricType)
+	writeMetricSample(buf, name, "", value)
+}
+
+var metricLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabels(labelNames []string, labelValues []string) string {
+	if len(labelNames) == 0 {
+		return ""
+	}
+
+	labels := make([]string, len(labelNames))
+	for i, labelName := range labelNames {
+		labels[i] = labelName + `="` + metricLabelValueEscaper.Replace(labelValues[i]) + `"`
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Metrics about the requests and parses the server has handled since it started
+type parserMetrics struct {
+	requests         *counterVec
+	requestDurations *histogramVec
+	parses           *counterVec
+	parseDurations   *histogramVec
+	parsedBytes      atomic.Int64
+	diagnostics      *counterVec
+}
+
+func newParserMetrics() *parserMetrics {
+	return &parserMetrics{
+		requests:         newCounterVec("tempeh_parser_requests_total", "Requests handled by each endpoint, by status code.", "endpoint", "status"),
+		requestDurations: newHistogramVec("tempeh_parser_request_duration_seconds", "How long requests to each endpoint took to handle.", METRICS_DURATION_BUCKETS, "endpoint"),
+		parses:           newCounterVec("tempeh_parser_parses_total", "Templates parsed, by output format and outcome; cached responses aren't counted.", "format", "outcome"),
+		parseDurations:   newHistogramVec("tempeh_parser_parse_duration_seconds", "How long templates took to parse, by output format.", METRICS_DURATION_BUCKETS, "format"),
+		diagnostics:      newCounterVec("tempeh_parser_diagnostics_total", "Diagnostics reported by parses, by diagnostic code and severity.", "code", "severity"),
+	}
+}
+
+// The metrics served from /metrics
+var templateParserMetrics = newParserMetrics()
+
+// Records a finished parse
+func (m *parserMetrics) ObserveParse(format OutputFormat, duration time.Duration, parsedByteCount int64, err error) {
+	formatName := "tree"
+	if format == OF_EVENTS {
+		formatName = "events"
+	}
+
+	outcome := PO_SUCCESS
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		outcome = PO_CANCELLED
+	} else if err != nil {
+		outcome = PO_ERROR
+	}
+
+	m.parses.Add(1, formatName, outcome)
+	m.parseDurations.Observe(duration.Seconds(), formatName)
+	m.parsedBytes.Add(parsedByteCount)
+}
+
+// Writes the metrics in the Prometheus text format, along with the caches' stats and the number of goroutines
+func (m *parserMetrics) Write(buf *bytes.Buffer, server *parserServer) {
+	m.requests.Write(buf)
+	m.requestDurations.Write(buf)
+	m.parses.Write(buf)
+	m.parseDurations.Write(buf)
+	writeMetric(buf, "tempeh_parser_parsed_bytes_total", "Bytes of template source read by parses.", "counter", float64(m.parsedBytes.Load()))
+	m.diagnostics.Write(buf)
+
+	// The caches keep their own stats, so they're read as the metrics are written
+	cacheHits := newCounterVec("tempeh_parser_cache_hits_total", "Parse responses served from each cache.", "cache")
+	cacheMisses := newCounterVec("tempeh_parser_cache_misses_total", "Parse requests which each cache didn't have a response for.", "cache")
+	var memoryCacheStats *ParseCacheStats
+	if cache := templateParseCache; cache != nil {
+		stats := cache.Stats()
+		memoryCacheStats = &stats
+		cacheHits.Add(float64(stats.Hits), "memory")
+		cacheMisses.Add(float64(stats.Misses), "memory")
+	}
+	if diskCache := templateDiskCache; diskCache != nil {
+		cacheHits.Add(float64(diskCache.hits.Load()), "disk")
+		cacheMisses.Add(float64(diskCache.misses.Load()), "disk")
+	}
+	cacheHits.Write(buf)
+	cacheMisses.Write(buf)
+	if memoryCacheStats != nil {
+		writeMetric(buf, "tempeh_parser_cache_evictions_total", "Entries evicted from the in-memory cache to stay within its memory limit.", "counter", float64(memoryCacheStats.Evictions))
+		writeMetric(buf, "tempeh_parser_cache_entries", "Entries in the in-memory cache.", "gauge", float64(memoryCacheStats.Entries))
+		writeMetric(buf, "tempeh_parser_cache_memory_bytes", "Bytes of parse responses held by the in-memory cache.", "gauge", float64(memoryCacheStats.MemoryUsed))
+	}
+
+	writeMetric(buf, "tempeh_parser_active_requests", "Requests which are currently being handled.", "gauge", float64(server.activeRequestCount.Load()))
+	writeMetric(buf, "go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine()))
+}
+
+// Records the status code of a response for the request metrics
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *metricsResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Wraps an endpoint's handler to record request metrics and, if the server has Server-Timing enabled, to send the time
+// spent in each phase of parsing
+func (s *parserServer) instrumentHandler(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		metricsWriter := &metricsResponseWriter{ResponseWriter: responseWriter}
+
+		if s.isServerTimingEnabled {
+			// Parsed templates are streamed, so the timings aren't known until after the headers have been sent
+			timings := &ParseTimings{}
+			request = request.WithContext(withParseTimings(request.Context(), timings))
+			responseWriter.Header().Set("Trailer", "Server-Timing")
+			defer func() {
+				responseWriter.Header().Set("Server-Timing", timings.ServerTiming(time.Since(start)))
+			}()
+		}
+
+		handler(metricsWriter, request)
+
+		statusCode := metricsWriter.statusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+		templateParserMetrics.requests.Add(1, endpoint, strconv.Itoa(statusCode))
+		templateParserMetrics.requestDurations.Observe(time.Since(start).Seconds(), endpoint)
+	}
+}
+
+// Registers the net/http/pprof endpoints. These expose the server's internals, so they're only registered if the
+// server is started with -pprof.
+func registerPprofHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// The time a request spent in each phase of parsing. Parses are interleaved with lexing and streaming the output, so
+// each phase is the total of many short stretches. Batches parse several templates at once, so their phases can add up
+// to more than the request took.
+type ParseTimings struct {
+	// Running the lexer's state funcs to read tokens from the source
+	lex atomic.Int64
+	// Building the tree of nodes from the tokens
+	tree atomic.Int64
+	// Encoding the output and writing it to the response
+	serialize atomic.Int64
+}
+
+type parseTimingsContextKey struct{}
+
+func withParseTimings(ctx context.Context, timings *ParseTimings) context.Context {
+	return context.WithValue(ctx, parseTimingsContextKey{}, timings)
+}
+
+// Gets the timings parses should be recorded in, or nil if they shouldn't be timed
+func getParseTimings(ctx context.Context) *ParseTimings {
+	timings, _ := ctx.Value(parseTimingsContextKey{}).(*ParseTimings)
+	return timings
+}
+
+// Adds a parse's time in each phase; the tree building time is whatever wasn't spent lexing or serializing
+func (t *ParseTimings) Add(total time.Duration, lex time.Duration, serialize time.Duration) {
+	t.lex.Add(int64(lex))
+	t.serialize.Add(int64(serialize))
+	t.tree.Add(int64(max(total-lex-serialize, 0)))
+}
+
+// Formats the timings as a Server-Timing header value, with durations in milliseconds
+func (t *ParseTimings) ServerTiming(total time.Duration) string {
+	var formatDuration = func(nanoseconds int64) string {
+		return strconv.FormatFloat(float64(nanoseconds)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	return "lex;dur=" + formatDuration(t.lex.Load()) +
+		", tree;dur=" + formatDuration(t.tree.Load()) +
+		", serialize;dur=" + formatDuration(t.serialize.Load()) +
+		", total;dur=" + formatDuration(int64(total))
+}
+
+// Records metrics for everything passed to an output and, if timings is set, how long the output took
+type instrumentedOutput struct {
+	parseOutput
+	timings           *ParseTimings
+	serializeDuration time.Duration
+}
+
+// Adds the time since start to the serialization time if the parse is being timed
+func (o *instrumentedOutput) time(start time.Time) {
+	if o.timings != nil {
+		o.serializeDuration += time.Since(start)
+	}
+}
+
+func (o *instrumentedOutput) now() time.Time {
+	if o.timings == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (o *instrumentedOutput) Start() error {
+	defer o.time(o.now())
+	return o.parseOutput.Start()
+}
+
+func (o *instrumentedOutput) OpenElement(node *Node) error {
+	defer o.time(o.now())
+	return o.parseOutput.OpenElement(node)
+}
+
+func (o *instrumentedOutput) Text(node *Node) error {
+	defer o.time(o.now())
+	return o.parseOutput.Text(node)
+}
+
+func (o *instrumentedOutput) CloseElement(node *Node, line int, col int) error {
+	defer o.time(o.now())
+	return o.parseOutput.CloseElement(node, line, col)
+}
+
+func (o *instrumentedOutput) Diagnostic(diagnostic *Diagnostic) error {
+	defer o.time(o.now())
+	templateParserMetrics.diagnostics.Add(1, diagnostic.Code, diagnostic.Severity.String())
+	return o.parseOutput.Diagnostic(diagnostic)
+}
+
+func (o *instrumentedOutput) End() error {
+	defer o.time(o.now())
+	return o.parseOutput.End()
+}
+
+func (o *instrumentedOutput) Abort(err error) {
+	defer o.time(o.now())
+	o.parseOutput.Abort(err)
+}
+
+// Counts the bytes read from a template source
+type countingReader struct {
+	reader    io.Reader
+	readCount int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	readCount, err := r.reader.Read(p)
+	r.readCount += int64(readCount)
+	return readCount, err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type ParseOptions struct {
+	LexerOptions   LexerOptions
+	WhitespaceMode WhitespaceMode
+	OutputFormat   OutputFormat
+	Limits         ParseLimits
+}
+
+// Reads parse options from the query parameters of a parse request.
+// Unset parameters fall back to their default values. The server's parse limits always apply.
+func parseOptionsFromQuery(query url.Values) (ParseOptions, error) {
+	options := ParseOptions{Limits: templateParseLimits}
+
+	var err error
+	if options.LexerOptions, err = parseLexerOptionsFromQuery(query); err != nil {
+		return options, err
+	}
+
+	switch whitespaceMode := query.Get("whitespace"); whitespaceMode {
+	case "", "preserve":
+		options.WhitespaceMode = WM_PRESERVE
+	case "drop":
+		options.WhitespaceMode = WM_DROP
+	case "collapse":
+		options.WhitespaceMode = WM_COLLAPSE
+	default:
+		return options, errors.New("invalid whitespace mode '" + whitespaceMode + "'; expected 'preserve', 'drop' or 'collapse'")
+	}
+
+	switch outputFormat := query.Get("format"); outputFormat {
+	case "", "tree":
+		options.OutputFormat = OF_TREE
+	case "events":
+		options.OutputFormat = OF_EVENTS
+	default:
+		return options, errors.New("invalid format '" + outputFormat + "'; expected 'tree' or 'events'")
+	}
+
+	return options, nil
+}
+
+// Reads lexer options from the query parameters of a parse request.
+// Unset parameters fall back to their default values.
+func parseLexerOptionsFromQuery(query url.Values) (LexerOptions, error) {
+	options := LexerOptions{}
+
+	switch rawTextMode := query.Get("rawText"); rawTextMode {
+	case "", "lenient":
+		options.RawTextMode = RTM_LENIENT
+	case "strict":
+		options.RawTextMode = RTM_STRICT
+	default:
+		return options, errors.New("invalid rawText mode '" + rawTextMode + "'; expected 'lenient' or 'strict'")
+	}
+
+	switch columnUnit := query.Get("columns"); columnUnit {
+	case "", "runes":
+		options.ColumnUnit = CU_RUNES
+	case "bytes":
+		options.ColumnUnit = CU_BYTES
+	case "utf16":
+		options.ColumnUnit = CU_UTF16
+	default:
+		return options, errors.New("invalid columns unit '" + columnUnit + "'; expected 'runes', 'bytes' or 'utf16'")
+	}
+
+	if backslashEscapes := query.Get("backslashEscapes"); backslashEscapes != "" {
+		var err error
+		if options.AttributeBackslashEscapes, err = strconv.ParseBool(backslashEscapes); err != nil {
+			return options, errors.New("invalid backslashEscapes value '" + backslashEscapes + "'; expected a boolean")
+		}
+	}
+
+	if textChunkSize := query.Get("textChunkSize"); textChunkSize != "" {
+		var err error
+		if options.TextChunkSize, err = strconv.Atoi(textChunkSize); err != nil || options.TextChunkSize < 0 {
+			return options, errors.New("invalid textChunkSize value '" + textChunkSize + "'; expected a non-negative number of bytes")
+		}
+	}
+
+	return options, nil
+}
+
+// Reads the templates to parse in a batch from the query parameters of a batch parse request.
+// Paths can be given with any number of "path" parameters and/or a "dir" parameter to search with "include" and "exclude" globs.
+func parseBatchFromQuery(query url.Values) (*ParseBatch, error) {
+	batch := &ParseBatch{
+		Paths:   query["path"],
+		Dir:     query.Get("dir"),
+		Include: query["include"],
+		Exclude: query["exclude"],
+	}
+
+	if len(batch.Paths) == 0 && batch.Dir == "" {
+		return batch, errors.New("no templates to parse; expected at least one 'path' or a 'dir'")
+	}
+
+	for _, pattern := range append(append([]string{}, batch.Include...), batch.Exclude...) {
+		if err := validateGlob(pattern); err != nil {
+			return batch, errors.New("invalid glob pattern '" + pattern + "'")
+		}
+	}
+
+	if concurrency := query.Get("concurrency"); concurrency != "" {
+		var err error
+		if batch.Concurrency, err = strconv.Atoi(concurrency); err != nil || batch.Concurrency < 1 {
+			return batch, errors.New("invalid concurrency value '" + concurrency + "'; expected a positive number")
+		}
+	}
+
+	switch resultFormat := query.Get("output"); resultFormat {
+	case "", "ndjson":
+		batch.ResultFormat = BRF_NDJSON
+	case "json":
+		batch.ResultFormat = BRF_JSON
+	default:
+		return batch, errors.New("invalid output '" + resultFormat + "'; expected 'ndjson' or 'json'")
+	}
+
+	if query.Get("format") == "events" {
+		return batch, errors.New("invalid format 'events'; batches can only be parsed with the 'tree' format")
+	}
+
+	return batch, nil
+}
+
+// Reads the templates to watch and how to watch them from the query parameters of a watch request.
+// Templates are found in the "dir" parameter's directory with the "include" and "exclude" globs.
+func parseWatchFromQuery(query url.Values) (*ParseBatch, WatchOptions, error) {
+	watchOptions := WatchOptions{
+		PollInterval: DEFAULT_WATCH_POLL_INTERVAL,
+		Debounce:     DEFAULT_WATCH_DEBOUNCE,
+	}
+
+	batch := &ParseBatch{
+		Dir:     query.Get("dir"),
+		Include: query["include"],
+		Exclude: query["exclude"],
+	}
+
+	if batch.Dir == "" {
+		return batch, watchOptions, errors.New("no directory to watch; expected a 'dir'")
+	}
+
+	for _, pattern := range append(append([]string{}, batch.Include...), batch.Exclude...) {
+		if err := validateGlob(pattern); err != nil {
+			return batch, watchOptions, errors.New("invalid glob pattern '" + pattern + "'")
+		}
+	}
+
+	if pollInterval := query.Get("interval"); pollInterval != "" {
+		var err error
+		if watchOptions.PollInterval, err = time.ParseDuration(pollInterval); err != nil || watchOptions.PollInterval <= 0 {
+			return batch, watchOptions, errors.New("invalid interval value '" + pollInterval + "'; expected a positive duration like '250ms'")
+		}
+	}
+
+	if debounce := query.Get("debounce"); debounce != "" {
+		var err error
+		if watchOptions.Debounce, err = time.ParseDuration(debounce); err != nil || watchOptions.Debounce < 0 {
+			return batch, watchOptions, errors.New("invalid debounce value '" + debounce + "'; expected a non-negative duration like '100ms'")
+		}
+	}
+
+	var err error
+	if watchOptions.Diff, err = parseDiffFromQuery(query); err != nil {
+		return batch, watchOptions, err
+	}
+
+	if query.Get("format") == "events" {
+		return batch, watchOptions, errors.New("invalid format 'events'; templates can only be watched with the 'tree' format")
+	}
+
+	return batch, watchOptions, nil
+}
+
+// Reads whether a request wants an edit script from the client's previous parse result along with the parsed template
+func parseDiffFromQuery(query url.Values) (bool, error) {
+	diff := query.Get("diff")
+	if diff == "" {
+		return false, nil
+	}
+
+	shouldDiff, err := strconv.ParseBool(diff)
+	if err != nil {
+		return false, errors.New("invalid diff value '" + diff + "'; expected a boolean")
+	}
+	if shouldDiff && query.Get("format") == "events" {
+		return false, errors.New("invalid format 'events'; diffs can only be produced with the 'tree' format")
+	}
+	return shouldDiff, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+type OutputFormat int
+
+const (
+	OF_TREE   OutputFormat = iota // a JSON array of completed root nodes and diagnostic records
+	OF_EVENTS                     // newline-delimited JSON events for each element, text node and diagnostic as they are parsed
+)
+
+// Receives the parsed template as it is parsed and writes it to the response
+type parseOutput interface {
+	Start() error
+	// Called once an element's opening tag has been parsed, including all of its attributes
+	OpenElement(node *Node) error
+	// Called once a text node's content is final and it has been added to the tree
+	Text(node *Node) error
+	// Called when an element is closed by its closing tag, a self-closing tag, a closing tag of one of its ancestors or the end of the file.
+	// The line and column are the position of whatever closed the element.
+	CloseElement(node *Node, line int, col int) error
+	Diagnostic(diagnostic *Diagnostic) error
+	// Called once the whole template has been parsed
+	End() error
+	// Called instead of End if parsing fails. If anything has already been written to the response, it is ended with an
+	// error record so the client can tell that it's incomplete; otherwise nothing is written so the caller can send an
+	// error response instead.
+	Abort(err error)
+}
+
+func newParseOutput(format OutputFormat, responseWriter *http.ResponseWriter) parseOutput {
+	stream := &responseStream{
+		responseWriter:     *responseWriter,
+		responseController: http.NewResponseController(*responseWriter),
+	}
+
+	if format == OF_EVENTS {
+		return &eventsOutput{stream: stream}
+	}
+	return &treeOutput{stream: stream}
+}
+
+// Writes to a response, flushing after each write so the client receives everything as soon as it is written
+type responseStream struct {
+	responseWriter     http.ResponseWriter
+	responseController *http.ResponseController
+	buf                bytes.Buffer
+	// Whether anything has been flushed to the response, after which its status can no longer change
+	hasFlushed bool
+}
+
+func (s *responseStream) SetContentType(contentType string) {
+	s.responseWriter.Header().Set("Content-Type", contentType)
+}
+
+// Writes the buffered content to the response and flushes it
+func (s *responseStream) Flush() error {
+	// Clear the buffer once we're done writing
+	defer s.buf.Reset()
+	s.hasFlushed = true
+
+	if _, err := s.buf.WriteTo(s.responseWriter); err != nil {
+		return err
+	}
+	if err := s.responseController.Flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Buffers a value encoded as JSON so it can be written with Flush
+func (s *responseStream) BufferJSON(value any) error {
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.buf.Write(jsonBytes)
+	return err
+}
+
+// Writes completed root nodes and diagnostic records to the response as entries in a JSON array
+type treeOutput struct {
+	stream *responseStream
+	// Track whether we should add a comma before writing the next entry to the response to keep the JSON array valid
+	shouldAddComma bool
+}
+
+func (o *treeOutput) Start() error {
+	o.stream.SetContentType("application/json")
+	// Buffer an opening bracket to indicate the start of the JSON array. It isn't flushed until the first entry is
+	// written so an error response can still be sent if parsing fails right away, ie because the file can't be read.
+	o.stream.buf.WriteByte('[')
+	return nil
+}
+
+func (o *treeOutput) writeEntry(value any) error {
+	if o.shouldAddComma {
+		o.stream.buf.WriteByte(',')
+	} else {
+		o.shouldAddComma = true
+	}
+	if err := o.stream.BufferJSON(value); err != nil {
+		o.stream.buf.Reset()
+		return err
+	}
+	return o.stream.Flush()
+}
+
+func (o *treeOutput) OpenElement(node *Node) error {
+	// Elements are written once they're complete
+	return nil
+}
+
+func (o *treeOutput) Text(node *Node) error {
+	if node.Parent != nil {
+		// Text inside of an element is written along with its root node
+		return nil
+	}
+	return o.writeEntry(node)
+}
+
+func (o *treeOutput) CloseElement(node *Node, line int, col int) error {
+	if node.Parent != nil {
+		return nil
+	}
+	return o.writeEntry(node)
+}
+
+func (o *treeOutput) Diagnostic(diagnostic *Diagnostic) error {
+	return o.writeEntry(&DiagnosticRecord{Diagnostic: diagnostic})
+}
+
+func (o *treeOutput) End() error {
+	// Write a closing bracket to indicate the end of the JSON array
+	o.stream.buf.WriteByte(']')
+	return o.stream.Flush()
+}
+
+func (o *treeOutput) Abort(err error) {
+	if !o.stream.hasFlushed {
+		o.stream.buf.Reset()
+		return
+	}
+
+	// The error is the last entry in the array
+	if o.writeEntry(&ErrorResponse{Error: newErrorResponseDetail(err)}) == nil {
+		o.End()
+	}
+}
+
+const (
+	PE_OPEN       = "open"
+	PE_TEXT       = "text"
+	PE_CLOSE      = "close"
+	PE_DIAGNOSTIC = "diagnostic"
+	PE_END        = "end"
+	PE_ERROR      = "error" // parsing failed partway through; this is always the last event
+)
+
+// A single event in the event stream output
+type ParseEvent struct {
+	Event       string       `json:"event"`
+	TagName     string       `json:"tagName,omitempty"`
+	Namespace   Namespace    `json:"ns,omitempty"`
+	Attributes  []*Attribute `json:"attributes,omitempty"`
+	TextContent string       `json:"textContent,omitempty"`
+	Continues   bool         `json:"continues,omitempty"`
+	Diagnostic  *Diagnostic  `json:"diagnostic,omitempty"`
+	// Only set for error events
+	Error *ErrorResponseDetail `json:"error,omitempty"`
+	Line  int                  `json:"l,omitempty"`
+	Col   int                  `json:"c,omitempty"`
+}
+
+// Writes each element, text node and diagnostic to the response as a newline-delimited JSON event as soon as it is parsed
+type eventsOutput struct {
+	stream *responseStream
+}
+
+func (o *eventsOutput) writeEvent(event *ParseEvent) error {
+	if err := o.stream.BufferJSON(event); err != nil {
+		o.stream.buf.Reset()
+		return err
+	}
+	o.stream.buf.WriteByte('\n')
+	return o.stream.Flush()
+}
+
+func (o *eventsOutput) Start() error {
+	o.stream.SetContentType("application/x-ndjson")
+	return nil
+}
+
+func (o *eventsOutput) OpenElement(node *Node) error {
+	return o.writeEvent(&ParseEvent{
+		Event:      PE_OPEN,
+		TagName:    node.TagName,
+		Namespace:  node.Namespace,
+		Attributes: node.Attributes,
+		Line:       node.Line,
+		Col:        node.Col,
+	})
+}
+
+func (o *eventsOutput) Text(node *Node) error {
+	return o.writeEvent(&ParseEvent{
+		Event:       PE_TEXT,
+		TextContent: node.TextContent,
+		Continues:   node.Continues,
+		Line:        node.Line,
+		Col:         node.Col,
+	})
+}
+
+func (o *eventsOutput) CloseElement(node *Node, line int, col int) error {
+	return o.writeEvent(&ParseEvent{
+		Event:   PE_CLOSE,
+		TagName: node.TagName,
+		Line:    line,
+		Col:     col,
+	})
+}
+
+func (o *eventsOutput) Diagnostic(diagnostic *Diagnostic) error {
+	return o.writeEvent(&ParseEvent{
+		Event:      PE_DIAGNOSTIC,
+		Diagnostic: diagnostic,
+	})
+}
+
+func (o *eventsOutput) End() error {
+	return o.writeEvent(&ParseEvent{Event: PE_END})
+}
+
+func (o *eventsOutput) Abort(err error) {
+	if !o.stream.hasFlushed {
+		o.stream.buf.Reset()
+		return
+	}
+	o.writeEvent(&ParseEvent{Event: PE_ERROR, Error: newErrorResponseDetail(err)})
+}
+
+// A fully parsed template, in the same order as the tree output
+type ParseResult struct {
+	Entries []ParseResultEntry
+}
+
+// Either a root node or a diagnostic
+type ParseResultEntry struct {
+	Node       *Node
+	Diagnostic *Diagnostic
+}
+
+// Gets the result's diagnostics in the order they were found
+func (result *ParseResult) Diagnostics() []*Diagnostic {
+	var diagnostics []*Diagnostic
+	for _, entry := range result.Entries {
+		if entry.Diagnostic != nil {
+			diagnostics = append(diagnostics, entry.Diagnostic)
+		}
+	}
+	return diagnostics
+}
+
+// Passes everything through to another output while keeping the parsed root nodes and diagnostics as a ParseResult.
+// This relies on the complete tree being kept, so it should only be used with the tree output format.
+type recordingOutput struct {
+	parseOutput
+	result ParseResult
+}
+
+func (o *recordingOutput) Text(node *Node) error {
+	if node.Parent == nil {
+		o.result.Entries = append(o.result.Entries, ParseResultEntry{Node: node})
+	}
+	return o.parseOutput.Text(node)
+}
+
+func (o *recordingOutput) CloseElement(node *Node, line int, col int) error {
+	if node.Parent == nil {
+		o.result.Entries = append(o.result.Entries, ParseResultEntry{Node: node})
+	}
+	return o.parseOutput.CloseElement(node, line, col)
+}
+
+func (o *recordingOutput) Diagnostic(diagnostic *Diagnostic) error {
+	o.result.Entries = append(o.result.Entries, ParseResultEntry{Diagnostic: diagnostic})
+	return o.parseOutput.Diagnostic(diagnostic)
+}
+
+// Collects the diagnostics passed to an output so they can be checked or reported once the parse is done
+type diagnosticCollectingOutput struct {
+	parseOutput
+	diagnostics []*Diagnostic
+}
+
+func (o *diagnosticCollectingOutput) Diagnostic(diagnostic *Diagnostic) error {
+	o.diagnostics = append(o.diagnostics, diagnostic)
+	return o.parseOutput.Diagnostic(diagnostic)
+}
+
+// Writes a previously parsed template to the response in the tree output format
+func writeParseResult(result *ParseResult, responseWriter *http.ResponseWriter) error {
+	output := newParseOutput(OF_TREE, responseWriter)
+
+	if err := output.Start(); err != nil {
+		return err
+	}
+
+	for _, entry := range result.Entries {
+		var err error
+		if entry.Diagnostic != nil {
+			err = output.Diagnostic(entry.Diagnostic)
+		} else if entry.Node.TagName == "" {
+			err = output.Text(entry.Node)
+		} else {
+			err = output.CloseElement(entry.Node, 0, 0)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return output.End()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Records what has been written to the response each time it is flushed
+type flushRecordingResponseWriter struct {
+	bufferedResponseWriter
+	statusCode int
+	flushes    []string
+	flushedLen int
+}
+
+func (w *flushRecordingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+func (w *flushRecordingResponseWriter) Flush() {
+	w.flushes = append(w.flushes, w.body.String()[w.flushedLen:])
+	w.flushedLen = w.body.Len()
+}
+
+func TestEventsOutput(t *testing.T) {
+	mux := http.NewServeMux()
+	registerHandlers(mux, newParserServer(mux, time.Second, 0))
+
+	request := httptest.NewRequest(http.MethodPost, "/parse?format=events&textChunkSize=2", strings.NewReader(`<div class="a" hidden>hi there<br></div></span>`))
+	responseWriter := &flushRecordingResponseWriter{}
+	mux.ServeHTTP(responseWriter, request)
+
+	if responseWriter.statusCode != 0 && responseWriter.statusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", responseWriter.statusCode, responseWriter.body.String())
+	}
+	if contentType := responseWriter.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("expected the content type to be application/x-ndjson, got %s", contentType)
+	}
+
+	expectedEvents := []string{
+		`{"event":"open","tagName":"div","ns":"html","attributes":[{"name":"class","value":"a","l":1,"c":6},{"name":"hidden","value":"","l":1,"c":16}],"l":1,"c":2}`,
+		`{"event":"text","textContent":"hi t","continues":true,"l":1,"c":23}`,
+		`{"event":"text","textContent":"he","continues":true,"l":1,"c":27}`,
+		`{"event":"text","textContent":"re","l":1,"c":29}`,
+		`{"event":"open","tagName":"br","ns":"html","l":1,"c":32}`,
+		`{"event":"close","tagName":"br","l":1,"c":35}`,
+		`{"event":"close","tagName":"div","l":1,"c":37}`,
+		`{"event":"diagnostic","diagnostic":{"code":"unexpected-closing-tag","severity":"error","message":"unexpected closing tag 'span' with no open element to close","path":"\u003crequest body\u003e","l":1,"c":43}}`,
+		`{"event":"end"}`,
+	}
+	// Each event is flushed as soon as it is written, so the client can handle it right away
+	expectedFlushes := make([]string, len(expectedEvents))
+	for i, event := range expectedEvents {
+		expectedFlushes[i] = event + "\n"
+	}
+	if !reflect.DeepEqual(responseWriter.flushes, expectedFlushes) {
+		t.Errorf("expected events\n%s\ngot\n%s", strings.Join(expectedFlushes, ""), strings.Join(responseWriter.flushes, "\n---\n"))
+	}
+}
+
+func TestOutputAbort(t *testing.T) {
+	source := "<div><p>a</span></div>"
+
+	for _, testCase := range []struct {
+		name     string
+		format   OutputFormat
+		expected []string
+	}{
+		{
+			name:   "the event stream ends with an error event",
+			format: OF_EVENTS,
+			expected: []string{
+				`{"event":"open","tagName":"div","ns":"html","l":1,"c":2}` + "\n",
+				`{"event":"open","tagName":"p","ns":"html","l":1,"c":7}` + "\n",
+				`{"event":"text","textContent":"a","l":1,"c":9}` + "\n",
+				`{"event":"error","error":{"status":422,"message":"template.tmph.html:1:12 - tempeh template parser encountered fatal error: 'unexpected closing tag 'span''"}}` + "\n",
+			},
+		},
+		{
+			// Nothing was written before the error, so the caller can still send an error response
+			name:     "the tree output writes nothing",
+			format:   OF_TREE,
+			expected: nil,
+		},
+	} {
+		responseBuffer := &flushRecordingResponseWriter{}
+		var responseWriter http.ResponseWriter = responseBuffer
+		err := parseTemplate(context.Background(), strings.NewReader(source), "template.tmph.html", ParseOptions{OutputFormat: testCase.format, Limits: DEFAULT_PARSE_LIMITS}, &responseWriter)
+		if err == nil {
+			t.Errorf("%s: expected the stray closing tag to be an error", testCase.name)
+		}
+		if !reflect.DeepEqual(responseBuffer.flushes, testCase.expected) {
+			t.Errorf("%s: expected output\n%s\ngot\n%s", testCase.name, strings.Join(testCase.expected, ""), strings.Join(responseBuffer.flushes, "\n---\n"))
+		}
+	}
+}
@@ -1,16 +1,33 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"os"
-	"strconv"
+	"strings"
+	"time"
 )
 
-func parseTemplateFile(templateFilePath string, responseWriter *http.ResponseWriter) error {
+// Parses the template file at resolvedFilePath, the path returned by the path policy's check, and streams it to the
+// response. Diagnostics and errors refer to the template by templateFilePath, the path it was requested by.
+func parseTemplateFile(ctx context.Context, templateFilePath string, resolvedFilePath string, options ParseOptions, responseWriter *http.ResponseWriter) error {
+	file, err := os.Open(resolvedFilePath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	return parseTemplate(ctx, file, templateFilePath, options, responseWriter)
+}
+
+// Parses a template file and passes the parsed template to an output as it is parsed
+func parseTemplateFileToOutput(ctx context.Context, templateFilePath string, options ParseOptions, output parseOutput) error {
 	file, err := os.Open(templateFilePath)
 	if err != nil {
 		return err
@@ -18,63 +35,145 @@ func parseTemplateFile(templateFilePath string, responseWriter *http.ResponseWri
 
 	defer file.Close()
 
-	responseController := http.NewResponseController(*responseWriter)
+	return parseTemplateToOutput(ctx, file, templateFilePath, options, output)
+}
 
-	// Track whether we should add a comma before writing the next node to the response to keep the JSON array valid
-	shouldAddComma := false
+// Parses the template file at resolvedFilePath, streaming it to the response in the tree output format, and returns
+// the parsed result. Like parseTemplateFile, the template is referred to by templateFilePath.
+func parseTemplateFileResult(ctx context.Context, templateFilePath string, resolvedFilePath string, options ParseOptions, responseWriter *http.ResponseWriter) (*ParseResult, error) {
+	file, err := os.Open(resolvedFilePath)
+	if err != nil {
+		return nil, err
+	}
 
-	buf := new(bytes.Buffer)
+	defer file.Close()
 
-	var writeNodeToResponse = func(node *Node) error {
-		// Clear the buffer once we're done writing
-		defer buf.Reset()
+	return parseTemplateResult(ctx, file, templateFilePath, options, responseWriter)
+}
 
-		if shouldAddComma {
-			if _, err := buf.WriteRune(','); err != nil {
-				return err
-			}
-		} else {
-			shouldAddComma = true
-		}
-		var jsonBytes []byte
-		if jsonBytes, err = json.Marshal(node); err != nil {
-			return err
-		}
-		if _, err = buf.Write(jsonBytes); err != nil {
-			return err
-		}
-		if _, err := buf.WriteTo(*responseWriter); err != nil {
-			return err
-		}
-		if err := responseController.Flush(); err != nil {
-			return err
-		}
-		return nil
+// Reads a whole template file into memory. Files larger than the maximum input size are only read one byte past the
+// limit, which is enough for parsing the content to report that the template is too large.
+func readTemplateFile(templateFilePath string, limits ParseLimits) ([]byte, error) {
+	file, err := os.Open(templateFilePath)
+	if err != nil {
+		return nil, err
 	}
 
-	var writeRuneToResponse = func(r rune) error {
-		defer buf.Reset()
+	defer file.Close()
 
-		if _, err := buf.WriteRune(r); err != nil {
-			return err
-		}
-		if _, err := buf.WriteTo(*responseWriter); err != nil {
-			return err
+	if limits.MaxInputSize <= 0 {
+		return io.ReadAll(file)
+	}
+	return io.ReadAll(io.LimitReader(file, limits.MaxInputSize+1))
+}
+
+// The JSON body of a POST /parse request
+type PostedTemplate struct {
+	// A virtual path for the template which is used in diagnostics and error messages; the file doesn't need to exist
+	Path   string `json:"path"`
+	Source string `json:"source"`
+}
+
+// The virtual path used for posted templates if none is provided
+const DEFAULT_POSTED_TEMPLATE_PATH = "<request body>"
+
+// The number of bytes a POST /parse body can have on top of twice the maximum input size, which leaves room for the
+// rest of a JSON body
+const MAX_POSTED_TEMPLATE_JSON_OVERHEAD = 64 * 1024
+
+// Reads the template source from the body of a POST /parse request. The body is either the raw template source or,
+// if the request has a JSON content type, a PostedTemplate. For raw bodies, the virtual path comes from the "path"
+// query parameter.
+func readPostedTemplate(request *http.Request) (templateReader io.Reader, virtualPath string, err error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	virtualPath = request.URL.Query().Get("path")
+
+	if mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type")); mediaType == "application/json" {
+		var postedTemplate PostedTemplate
+		if err = json.Unmarshal(body, &postedTemplate); err != nil {
+			return nil, "", errors.New("invalid JSON request body: " + err.Error())
 		}
-		if err := responseController.Flush(); err != nil {
-			return err
+
+		templateReader = strings.NewReader(postedTemplate.Source)
+		if postedTemplate.Path != "" {
+			virtualPath = postedTemplate.Path
 		}
-		return nil
+	} else {
+		templateReader = bytes.NewReader(body)
+	}
+
+	if virtualPath == "" {
+		virtualPath = DEFAULT_POSTED_TEMPLATE_PATH
 	}
 
-	// Write an opening bracket to indicate the start of the JSON array
-	if err := writeRuneToResponse('['); err != nil {
+	return templateReader, virtualPath, nil
+}
+
+// Parses a template from a reader and streams the parsed template to the response in the requested output format.
+// The template's path is only used in error messages.
+func parseTemplate(ctx context.Context, templateReader io.Reader, templateFilePath string, options ParseOptions, responseWriter *http.ResponseWriter) error {
+	return parseTemplateToOutput(ctx, templateReader, templateFilePath, options, newParseOutput(options.OutputFormat, responseWriter))
+}
+
+// Parses a template from a reader and passes the parsed template to an output as it is parsed. If the context is done
+// before parsing finishes, ie because the client disconnected, parsing stops without reading the rest of the template
+// and the context's error is returned.
+func parseTemplateToOutput(ctx context.Context, templateReader io.Reader, templateFilePath string, options ParseOptions, output parseOutput) (err error) {
+	start := time.Now()
+	sourceReader := &countingReader{reader: templateReader}
+
+	// Only time each phase of the parse if the request is sending Server-Timing
+	timings := getParseTimings(ctx)
+	instrumented := &instrumentedOutput{parseOutput: output, timings: timings}
+	output = instrumented
+	var lexDuration time.Duration
+
+	defer func() {
+		duration := time.Since(start)
+		templateParserMetrics.ObserveParse(options.OutputFormat, duration, sourceReader.readCount, err)
+		if timings != nil {
+			timings.Add(duration, lexDuration, instrumented.serializeDuration)
+		}
+	}()
+
+	if err := output.Start(); err != nil {
 		return err
 	}
 
-	lexer := NewLexer(bufio.NewReader(file))
+	defer func() {
+		if err != nil {
+			output.Abort(err)
+		}
+	}()
+
+	limits := options.Limits
 
-	go lexer.Run()
+	lexerOptions := limits.ApplyToLexerOptions(options.LexerOptions)
+
+	// The parse's own context is also done once the parse timeout is reached, which stops the lexer the same way
+	parseCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		parseCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	lexer := NewLexer(parseCtx, NewTemplateSource(newInputSizeLimitReader(sourceReader, limits.MaxInputSize)), lexerOptions)
+	tokenCount := 0
+
+	var nextToken = lexer.NextToken
+	if timings != nil {
+		nextToken = func() LexerToken {
+			lexStart := time.Now()
+			token := lexer.NextToken()
+			lexDuration += time.Since(lexStart)
+			return token
+		}
+	}
 
 	// Track the current lowest-level leaf element node which we are parsing inside of.
 	// Any new text content or element nodes will be appended to this node.
@@ -82,116 +181,331 @@ func parseTemplateFile(templateFilePath string, responseWriter *http.ResponseWri
 	// If there is no parent node, the leaf node will be appended to the root of the parsed template nodes.
 	var currentOpenLeafElementNode *Node = nil
 
+	// Track the last root node which was written so we know the previous sibling of root-level text nodes
+	var previousRootNode *Node = nil
+
+	// When whitespace is not being preserved, text nodes are held until we know what comes after them
+	// so we can decide whether they should be dropped
+	var pendingTextNode *Node = nil
+
+	// An element whose opening tag is still being parsed; it is passed to the output once all of its attributes are known
+	var pendingOpenElementNode *Node = nil
+
+	// Set from an element's opening tag until the next text, so we know whether the text comes directly after the
+	// opening tag. The lexer emits text before every comment, even if it's empty, so comments in between clear this too.
+	isAfterOpeningTag := false
+
+	// The number of elements which are currently open and the number of nodes parsed so far, which are checked against the limits
+	openElementCount := 0
+	nodeCount := 0
+
+	// The event stream writes nodes as soon as they're parsed, so we don't need to hold on to the whole tree
+	shouldKeepTree := options.OutputFormat != OF_EVENTS
+
+	var addChildNode = func(childNode *Node) {
+		nodeCount++
+
+		if currentOpenLeafElementNode == nil {
+			previousRootNode = childNode
+			return
+		}
+
+		if !shouldKeepTree {
+			// We only need the last child to know the previous sibling of the next text node
+			if childCount := len(currentOpenLeafElementNode.Children); childCount > 0 {
+				currentOpenLeafElementNode.Children[0] = currentOpenLeafElementNode.Children[childCount-1]
+				currentOpenLeafElementNode.Children = currentOpenLeafElementNode.Children[:1]
+			}
+		}
+		currentOpenLeafElementNode.AddChild(childNode)
+	}
+
+	var addTextNode = func(textNode *Node) error {
+		addChildNode(textNode)
+		return output.Text(textNode)
+	}
+
+	// Closes the current element and shifts back up to its parent node
+	var closeCurrentElement = func(line int, col int) error {
+		closedNode := currentOpenLeafElementNode
+		currentOpenLeafElementNode = closedNode.Parent
+		openElementCount--
+		if closedNode.Parent == nil {
+			previousRootNode = closedNode
+		}
+
+		err := output.CloseElement(closedNode, line, col)
+		if !shouldKeepTree {
+			closedNode.Children = nil
+		}
+		return err
+	}
+
+	// Adds the pending text node to the tree if it should be kept. The next sibling is nil if the text node is
+	// at the end of its parent.
+	var flushPendingTextNode = func(nextSibling *Node) error {
+		if pendingTextNode == nil {
+			return nil
+		}
+
+		textNode := pendingTextNode
+		pendingTextNode = nil
+
+		if len(textNode.TextContent) == 0 {
+			// The text node may be empty if its only content was a leading newline which was stripped
+			return nil
+		}
+
+		previousSibling := previousRootNode
+		if currentOpenLeafElementNode != nil {
+			previousSibling = nil
+			if childCount := len(currentOpenLeafElementNode.Children); childCount > 0 {
+				previousSibling = currentOpenLeafElementNode.Children[childCount-1]
+			}
+		}
+
+		if !applyWhitespaceMode(options.WhitespaceMode, textNode, currentOpenLeafElementNode, previousSibling, nextSibling) {
+			return nil
+		}
+
+		return addTextNode(textNode)
+	}
+
+	var reportDiagnostic = func(code string, message string, line int, col int) error {
+		return output.Diagnostic(&Diagnostic{
+			Code:     code,
+			Severity: DS_ERROR,
+			Message:  message,
+			Path:     templateFilePath,
+			Line:     line,
+			Col:      col,
+		})
+	}
+
+	// Finishes the template at the end of the file or wherever parsing stopped, closing any elements which are still open
+	var finish = func(line int, col int) error {
+		if err := flushPendingTextNode(nil); err != nil {
+			return err
+		}
+
+		// If there are unclosed nodes, close them all the way up to the root node
+		for currentOpenLeafElementNode != nil {
+			if err := closeCurrentElement(line, col); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	for {
-		token := lexer.NextToken()
+		token := nextToken()
+		tokenCount++
 
 		var makeParsingError = func(message string) error {
-			return errors.New(templateFilePath + ":" + strconv.Itoa(token.line) + ":" + strconv.Itoa(token.column) + " - tempeh template parser encountered fatal error: '" + message + "'")
+			return &TemplateError{Path: templateFilePath, Line: token.line, Col: token.column, Message: message}
+		}
+
+		if pendingOpenElementNode != nil && token.tokenType != LT_ATTRIBUTENAME && token.tokenType != LT_ATTRIBUTEVALUE && token.tokenType != LT_DIAGNOSTIC {
+			// Anything other than an attribute means the opening tag is complete
+			err = output.OpenElement(pendingOpenElementNode)
+			pendingOpenElementNode = nil
+			if err != nil {
+				return makeParsingError(err.Error())
+			}
 		}
 
 		if token.tokenType == LT_EOF {
-			if currentOpenLeafElementNode != nil {
-				// If there are unclosed nodes, traverse up to the root node and append it to the template data
-				openRootNode := currentOpenLeafElementNode
-				for openRootNode.Parent != nil {
-					openRootNode = openRootNode.Parent
-				}
-				err = writeNodeToResponse(openRootNode)
-				if err != nil {
+			// Flush any trailing text first so it comes before the diagnostics for the elements it's inside of
+			if err = flushPendingTextNode(nil); err != nil {
+				return makeParsingError(err.Error())
+			}
+			for openNode := currentOpenLeafElementNode; openNode != nil; openNode = openNode.Parent {
+				if err = reportDiagnostic(DC_UNCLOSED_ELEMENT, "<"+openNode.TagName+"> is never closed", openNode.Line, openNode.Col); err != nil {
 					return makeParsingError(err.Error())
 				}
 			}
+			if err = finish(token.line, token.column); err != nil {
+				return makeParsingError(err.Error())
+			}
+			break
+		} else if token.tokenType == LT_ERROR && parseCtx.Err() == nil {
+			return makeParsingError(lexer.TokenValue(&token))
+		}
+
+		// Set if the template hits a limit which only the parser can check, in which case parsing stops at this token
+		var limitErr *ParseLimitError
+
+		// The lexer stops with an error once the parse's context is done, but it only checks when it reads more of the
+		// source, so check every so often as well
+		if (token.tokenType == LT_ERROR || tokenCount%PARSE_CONTEXT_CHECK_INTERVAL == 0) && parseCtx.Err() != nil {
+			if err = ctx.Err(); err != nil {
+				// The caller gave up on the parse, ie because the client disconnected, so nobody needs the rest of it
+				return err
+			}
+			limitErr = newParseTimeoutError(limits.Timeout)
+		} else if limits.MaxNodeCount > 0 && nodeCount >= limits.MaxNodeCount && (token.tokenType == LT_TEXTCONTENT || token.tokenType == LT_OPENINGTAGNAME) {
+			limitErr = newTooManyNodesError(limits.MaxNodeCount)
+		} else if limits.MaxNestingDepth > 0 && openElementCount >= limits.MaxNestingDepth && token.tokenType == LT_OPENINGTAGNAME {
+			limitErr = newNestingTooDeepError(limits.MaxNestingDepth)
+		}
+
+		if limitErr != nil {
+			err = output.Diagnostic(&Diagnostic{
+				Code:     limitErr.Code,
+				Severity: DS_ERROR,
+				Message:  limitErr.Message,
+				Path:     templateFilePath,
+				Line:     token.line,
+				Col:      token.column,
+			})
+			if err == nil {
+				err = finish(token.line, token.column)
+			}
+			if err != nil {
+				return makeParsingError(err.Error())
+			}
 			break
-		} else if token.tokenType == LT_ERROR {
-			return makeParsingError(token.tokenValue)
 		}
 
 		switch token.tokenType {
+		case LT_DIAGNOSTIC:
+			token.diagnostic.Path = templateFilePath
+			err = output.Diagnostic(token.diagnostic)
+			if err != nil {
+				return makeParsingError(err.Error())
+			}
 		case LT_TEXTCONTENT:
+			isDirectlyAfterOpeningTag := isAfterOpeningTag
+			isAfterOpeningTag = false
+
+			textContent := lexer.TokenValue(&token)
+
 			// Skip text content if it's empty
-			if len(token.tokenValue) == 0 {
+			if len(textContent) == 0 {
 				break
 			}
 
-			textNode := CreateTextNode(token.tokenValue, token.line, token.column)
+			textNode := CreateTextNode(textContent, token.line, token.column)
+			textNode.Continues = token.flags&TF_CONTINUED != 0
 
-			if currentOpenLeafElementNode != nil {
-				currentOpenLeafElementNode.AddChild(textNode)
-			} else {
-				// Append to the root if there's no parent node
-				err = writeNodeToResponse(textNode)
-				if err != nil {
-					return makeParsingError(err.Error())
+			if isDirectlyAfterOpeningTag {
+				// This is part of how HTML is parsed rather than a whitespace rule, so it applies in every whitespace mode
+				stripLeadingNewline(textNode, currentOpenLeafElementNode)
+			}
+
+			if options.WhitespaceMode != WM_PRESERVE {
+				if pendingTextNode != nil {
+					// Merge adjacent text content, which can happen if it was separated by a comment
+					pendingTextNode.TextContent += textNode.TextContent
+				} else {
+					pendingTextNode = textNode
+				}
+
+				if textNode.Continues {
+					// Chunks are never split inside of a whitespace run, so the whitespace mode can be applied to each
+					// chunk without waiting to see the rest of the text
+					pendingTextNode.Continues = true
+					if err = flushPendingTextNode(nil); err != nil {
+						return makeParsingError(err.Error())
+					}
 				}
+				break
+			}
+
+			if len(textNode.TextContent) == 0 {
+				// The text's only content was a leading newline which was stripped
+				break
+			}
+
+			if err = addTextNode(textNode); err != nil {
+				return makeParsingError(err.Error())
 			}
 		case LT_OPENINGTAGNAME:
-			elementNode := CreateElementNode(token.tokenValue, token.line, token.column)
+			elementNode := CreateElementNode(lexer.TokenValue(&token), token.namespace, token.line, token.column)
 
-			if currentOpenLeafElementNode != nil {
-				currentOpenLeafElementNode.AddChild(elementNode)
+			if err = flushPendingTextNode(elementNode); err != nil {
+				return makeParsingError(err.Error())
 			}
+
+			addChildNode(elementNode)
 			currentOpenLeafElementNode = elementNode
+			openElementCount++
+			pendingOpenElementNode = elementNode
+			isAfterOpeningTag = true
 		case LT_ATTRIBUTENAME:
 			if currentOpenLeafElementNode == nil {
 				break
 			}
-			currentOpenLeafElementNode.AddAttribute(token.tokenValue, token.line, token.column)
+			currentOpenLeafElementNode.AddAttribute(lexer.TokenValue(&token), token.line, token.column)
 		case LT_ATTRIBUTEVALUE:
 			if currentOpenLeafElementNode == nil {
 				break
 			}
 
-			err = currentOpenLeafElementNode.UpdateLatestAttributeValue(token.tokenValue)
+			attrValue := lexer.TokenValue(&token)
+			err = currentOpenLeafElementNode.UpdateLatestAttributeValue(attrValue, lexer.TokenUnescapedValue(&token, attrValue))
 			if err != nil {
 				return makeParsingError(err.Error())
 			}
 		case LT_SELFCLOSINGTAGEND:
+			isAfterOpeningTag = false
 			if currentOpenLeafElementNode == nil {
 				break
 			}
 
-			if currentOpenLeafElementNode.Parent != nil {
-				currentOpenLeafElementNode = currentOpenLeafElementNode.Parent
-			} else {
-				err = writeNodeToResponse(currentOpenLeafElementNode)
-				currentOpenLeafElementNode = nil
-				if err != nil {
-					return makeParsingError(err.Error())
-				}
+			if err = closeCurrentElement(token.line, token.column); err != nil {
+				return makeParsingError(err.Error())
 			}
 		case LT_CLOSINGTAGNAME:
+			isAfterOpeningTag = false
+			if err = flushPendingTextNode(nil); err != nil {
+				return makeParsingError(err.Error())
+			}
+
+			closedTagName := lexer.TokenValue(&token)
+
 			if currentOpenLeafElementNode == nil {
+				// The closing tag is ignored since there's nothing for it to close
+				if err = reportDiagnostic(DC_UNEXPECTED_CLOSING_TAG, "unexpected closing tag '"+closedTagName+"' with no open element to close", token.line, token.column); err != nil {
+					return makeParsingError(err.Error())
+				}
 				break
 			}
 
-			closedTagName := token.tokenValue
-
 			closedNode := currentOpenLeafElementNode
 
 			for closedNode != nil && closedNode.TagName != closedTagName {
-				closedNode = currentOpenLeafElementNode.Parent
+				closedNode = closedNode.Parent
 			}
 
 			if closedNode == nil {
 				return makeParsingError("unexpected closing tag '" + closedTagName + "'")
 			}
 
-			if closedNode.Parent != nil {
-				currentOpenLeafElementNode = closedNode.Parent
-			} else {
-				err = writeNodeToResponse(closedNode)
-				currentOpenLeafElementNode = nil
-				if err != nil {
+			// Close any unclosed elements inside of the closed element along with the element itself
+			for currentOpenLeafElementNode != closedNode.Parent {
+				if currentOpenLeafElementNode != closedNode {
+					if err = reportDiagnostic(DC_MISNESTED_CLOSING_TAG, "<"+currentOpenLeafElementNode.TagName+"> is closed by '"+closedTagName+"' before its own closing tag", token.line, token.column); err != nil {
+						return makeParsingError(err.Error())
+					}
+				}
+				if err = closeCurrentElement(token.line, token.column); err != nil {
 					return makeParsingError(err.Error())
 				}
 			}
 		}
 	}
 
-	// Write a closing bracket to indicate the end of the JSON array
-	if err := writeRuneToResponse(']'); err != nil {
-		return err
-	}
+	return output.End()
+}
 
-	return nil
+// Parses a template from a reader, streaming it to the response in the tree output format, and returns the parsed result
+func parseTemplateResult(ctx context.Context, templateReader io.Reader, templateFilePath string, options ParseOptions, responseWriter *http.ResponseWriter) (*ParseResult, error) {
+	// The result needs the complete tree
+	options.OutputFormat = OF_TREE
+	output := &recordingOutput{parseOutput: newParseOutput(OF_TREE, responseWriter)}
+	if err := parseTemplateToOutput(ctx, templateReader, templateFilePath, options, output); err != nil {
+		return nil, err
+	}
+	return &output.result, nil
 }
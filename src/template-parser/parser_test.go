@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads from a template source and cancels a request's context once a given number of bytes have been read, like a
+// client disconnecting partway through the response
+type disconnectingReader struct {
+	reader       io.Reader
+	disconnectAt int
+	disconnect   context.CancelFunc
+	readCount    int
+}
+
+func (r *disconnectingReader) Read(p []byte) (int, error) {
+	readCount, err := r.reader.Read(p)
+	r.readCount += readCount
+	if r.readCount >= r.disconnectAt {
+		r.disconnect()
+	}
+	return readCount, err
+}
+
+func TestParseStopsWhenClientDisconnects(t *testing.T) {
+	// With the tree output format, a single root element means nothing is written to the response until the whole
+	// template has been parsed, so failing to write can't stop the parse early; only the cancelled context can
+	source := []byte("<div>" + strings.Repeat("<p class=\"item\">Some text &amp; more text</p>\n", 50_000) + "</div>")
+
+	for _, format := range []OutputFormat{OF_TREE, OF_EVENTS} {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader := &disconnectingReader{reader: bytes.NewReader(source), disconnectAt: len(source) / 2, disconnect: cancel}
+
+		responseRecorder := httptest.NewRecorder()
+		var responseWriter http.ResponseWriter = responseRecorder
+		err := parseTemplate(ctx, reader, "large.tmph.html", ParseOptions{OutputFormat: format, Limits: DEFAULT_PARSE_LIMITS}, &responseWriter)
+		cancel()
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("format %d: expected the parse to stop with a cancellation error, got: %v", format, err)
+		}
+		// Nothing is read after the disconnect, so only the rest of the window which was being read can be past it
+		if maxReadCount := reader.disconnectAt + LEXER_WINDOW_SIZE*2; reader.readCount > maxReadCount {
+			t.Errorf("format %d: expected at most %d of %d bytes to be read, but %d were read", format, maxReadCount, len(source), reader.readCount)
+		}
+		if format == OF_EVENTS && bytes.Contains(responseRecorder.Body.Bytes(), []byte(`"event":"`+PE_END+`"`)) {
+			t.Errorf("format %d: expected the cancelled event stream not to end normally", format)
+		}
+	}
+}
+
+func TestTreeBuildingDiagnostics(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		source string
+		// The position and code of each diagnostic, in the order they're reported
+		expectedDiagnostics []string
+	}{
+		{
+			name:   "well-formed template",
+			source: "<div><p>a<br>b</p><svg><path /></svg></div>",
+		},
+		{
+			name:                "closing tag closes an element before its children",
+			source:              "<div><span>hi</div></p>",
+			expectedDiagnostics: []string{"1:16 " + DC_MISNESTED_CLOSING_TAG, "1:22 " + DC_UNEXPECTED_CLOSING_TAG},
+		},
+		{
+			name:                "closing tag with nothing open",
+			source:              "</p><p></p>",
+			expectedDiagnostics: []string{"1:3 " + DC_UNEXPECTED_CLOSING_TAG},
+		},
+		{
+			name:                "elements left open at the end of the file",
+			source:              "<a><b>\n<c>text",
+			expectedDiagnostics: []string{"2:2 " + DC_UNCLOSED_ELEMENT, "1:5 " + DC_UNCLOSED_ELEMENT, "1:2 " + DC_UNCLOSED_ELEMENT},
+		},
+		{
+			name:                "optional closing tags aren't implied",
+			source:              "<ul><li>a<li>b</ul>",
+			expectedDiagnostics: []string{"1:17 " + DC_MISNESTED_CLOSING_TAG, "1:17 " + DC_MISNESTED_CLOSING_TAG},
+		},
+	} {
+		for _, format := range []OutputFormat{OF_TREE, OF_EVENTS} {
+			var responseWriter http.ResponseWriter = httptest.NewRecorder()
+			output := &diagnosticCollectingOutput{parseOutput: newParseOutput(format, &responseWriter)}
+			if err := parseTemplateToOutput(context.Background(), strings.NewReader(testCase.source), "test.tmph.html", ParseOptions{OutputFormat: format}, output); err != nil {
+				t.Errorf("%s (format %d): %v", testCase.name, format, err)
+				continue
+			}
+
+			var diagnostics []string
+			for _, diagnostic := range output.diagnostics {
+				if diagnostic.Severity != DS_ERROR {
+					t.Errorf("%s (format %d): expected %s to be an error, got %s", testCase.name, format, diagnostic.Code, diagnostic.Severity)
+				}
+				diagnostics = append(diagnostics, strconv.Itoa(diagnostic.Line)+":"+strconv.Itoa(diagnostic.Col)+" "+diagnostic.Code)
+			}
+			if !reflect.DeepEqual(diagnostics, testCase.expectedDiagnostics) {
+				t.Errorf("%s (format %d): expected diagnostics %v, got %v", testCase.name, format, testCase.expectedDiagnostics, diagnostics)
+			}
+		}
+	}
+}
+
+func TestPostedTemplateSizeLimit(t *testing.T) {
+	previousLimits, previousDiffBases := templateParseLimits, templateDiffBases
+	t.Cleanup(func() {
+		templateParseLimits, templateDiffBases = previousLimits, previousDiffBases
+	})
+	templateParseLimits.MaxInputSize = 10
+	templateDiffBases = newDiffBaseStore(MAX_DIFF_BASE_COUNT)
+	bodyLimit := 2*templateParseLimits.MaxInputSize + MAX_POSTED_TEMPLATE_JSON_OVERHEAD
+
+	mux := http.NewServeMux()
+	registerHandlers(mux, newParserServer(mux, time.Second, 0))
+
+	for _, query := range []string{"", "?diff=true"} {
+		request := httptest.NewRequest(http.MethodPost, "/parse"+query, strings.NewReader("<p>"+strings.Repeat("a", int(bodyLimit))+"</p>"))
+		responseRecorder := httptest.NewRecorder()
+		mux.ServeHTTP(responseRecorder, request)
+
+		expectedMessage := "request body is larger than the limit of " + strconv.FormatInt(bodyLimit, 10) + " bytes"
+		if responseRecorder.Code != http.StatusRequestEntityTooLarge || !strings.Contains(responseRecorder.Body.String(), expectedMessage) {
+			t.Errorf("'%s': expected status 413 with the limit, got %d: %s", query, responseRecorder.Code, responseRecorder.Body.String())
+		}
+
+		// Bodies under the limit are parsed, even if the template itself is over the input size limit
+		request = httptest.NewRequest(http.MethodPost, "/parse"+query, strings.NewReader("<p>"+strings.Repeat("a", 20)+"</p>"))
+		responseRecorder = httptest.NewRecorder()
+		mux.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != http.StatusOK || !strings.Contains(responseRecorder.Body.String(), DC_INPUT_TOO_LARGE) {
+			t.Errorf("'%s': expected status 200 with an %s diagnostic, got %d: %s", query, DC_INPUT_TOO_LARGE, responseRecorder.Code, responseRecorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The maximum size of a single JSON-RPC request line; large enough for posted templates
+const MAX_RPC_REQUEST_SIZE = 64 * 1024 * 1024
+
+// JSON-RPC error codes for requests which couldn't be handled at all. Errors from the handlers themselves use
+// their HTTP status code as the error code.
+const (
+	RPC_PARSE_ERROR     = -32700
+	RPC_INVALID_REQUEST = -32600
+)
+
+// The method used to cancel an in-flight request
+const RPC_CANCEL_METHOD = "cancel"
+
+// The method of the notifications which carry each line of a streamed response, ie NDJSON or server-sent events
+const RPC_STREAM_METHOD = "stream"
+
+// A JSON-RPC 2.0 request. The method is the path of an HTTP endpoint without its leading slash, ie "parse" for /parse.
+type RPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  *RPCParams      `json:"params,omitempty"`
+}
+
+// The parameters of a JSON-RPC request, which describe the equivalent HTTP request
+type RPCParams struct {
+	// The HTTP method to use; defaults to GET, or POST if there is a body
+	HTTPMethod string `json:"httpMethod,omitempty"`
+	// Query parameters; each value is either a string or an array of strings for repeated parameters
+	Query map[string]any `json:"query,omitempty"`
+	// Request headers, ie If-None-Match or Content-Type
+	Headers map[string]string `json:"headers,omitempty"`
+	// The request body; a string is sent as-is, and anything else is sent as JSON
+	Body json.RawMessage `json:"body,omitempty"`
+	// The id of the request to cancel; only used by the cancel method
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+type RPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// The error response's body, if it was JSON
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type RPCNotification struct {
+	Version string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// A single line of a streamed response
+type RPCStreamParams struct {
+	// The id of the request the line belongs to
+	ID json.RawMessage `json:"id"`
+	// The server-sent event's name; only set for event streams
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// A JSON-RPC connection over a pair of streams
+type rpcTransport struct {
+	server      *parserServer
+	writer      io.Writer
+	writerMutex sync.Mutex
+
+	inFlightMutex sync.Mutex
+	// Cancels each in-flight request, keyed by its id
+	inFlightRequests map[string]context.CancelFunc
+}
+
+// Serves JSON-RPC requests, one per line, from a reader and writes the responses to a writer.
+// Requests are handled concurrently, so responses can arrive in a different order than their requests.
+// The server shuts down once the reader is closed.
+func (s *parserServer) ServeRPC(reader io.Reader, writer io.Writer) {
+	transport := &rpcTransport{
+		server:           s,
+		writer:           writer,
+		inFlightRequests: make(map[string]context.CancelFunc),
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_RPC_REQUEST_SIZE)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var request RPCRequest
+		if err := json.Unmarshal(line, &request); err != nil {
+			transport.writeMessage(&RPCResponse{ID: json.RawMessage("null"), Error: &RPCError{Code: RPC_PARSE_ERROR, Message: err.Error()}})
+			continue
+		}
+
+		if request.Method == RPC_CANCEL_METHOD {
+			if request.Params != nil {
+				transport.cancel(request.Params.ID)
+			}
+			continue
+		}
+
+		// Count the request as in-flight until its response has been written so shutting down doesn't cut it off
+		s.activeRequestCount.Add(1)
+		go transport.handle(&request)
+	}
+
+	if err := scanner.Err(); err != nil {
+		// The rest of the stream can't be read once a line is too long, so tell the client why before shutting down
+		message := "couldn't read request: " + err.Error()
+		if errors.Is(err, bufio.ErrTooLong) {
+			message = "request is larger than the limit of " + strconv.Itoa(MAX_RPC_REQUEST_SIZE) + " bytes"
+			transport.writeMessage(&RPCResponse{ID: json.RawMessage("null"), Error: &RPCError{Code: RPC_INVALID_REQUEST, Message: message}})
+		}
+		os.Stderr.WriteString("stopping the JSON-RPC server: " + message + "\n")
+	}
+
+	// The client has gone away, so there's nobody left to serve
+	s.Shutdown()
+}
+
+func (t *rpcTransport) writeMessage(message any) {
+	switch message := message.(type) {
+	case *RPCResponse:
+		message.Version = "2.0"
+	case *RPCNotification:
+		message.Version = "2.0"
+	}
+
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+
+	t.writerMutex.Lock()
+	defer t.writerMutex.Unlock()
+	t.writer.Write(append(messageJSON, '\n'))
+}
+
+func (t *rpcTransport) cancel(id json.RawMessage) {
+	t.inFlightMutex.Lock()
+	defer t.inFlightMutex.Unlock()
+
+	if cancel, ok := t.inFlightRequests[string(id)]; ok {
+		cancel()
+	}
+}
+
+func (t *rpcTransport) handle(rpcRequest *RPCRequest) {
+	defer t.server.activeRequestCount.Add(-1)
+
+	hasID := len(rpcRequest.ID) > 0 && string(rpcRequest.ID) != "null"
+
+	if rpcRequest.Version != "2.0" || rpcRequest.Method == "" {
+		if hasID {
+			t.writeMessage(&RPCResponse{ID: rpcRequest.ID, Error: &RPCError{Code: RPC_INVALID_REQUEST, Message: "expected a JSON-RPC 2.0 request with a method"}})
+		}
+		return
+	}
+
+	request, err := newRPCHTTPRequest(rpcRequest)
+	if err != nil {
+		if hasID {
+			t.writeMessage(&RPCResponse{ID: rpcRequest.ID, Error: &RPCError{Code: RPC_INVALID_REQUEST, Message: err.Error()}})
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if hasID {
+		t.inFlightMutex.Lock()
+		t.inFlightRequests[string(rpcRequest.ID)] = cancel
+		t.inFlightMutex.Unlock()
+
+		defer func() {
+			t.inFlightMutex.Lock()
+			delete(t.inFlightRequests, string(rpcRequest.ID))
+			t.inFlightMutex.Unlock()
+		}()
+	}
+
+	responseWriter := &rpcResponseWriter{transport: t, id: rpcRequest.ID, header: make(http.Header)}
+	t.server.handler.ServeHTTP(responseWriter, request.WithContext(ctx))
+	responseWriter.Flush()
+
+	if hasID {
+		t.writeMessage(responseWriter.response())
+	}
+}
+
+// Builds the HTTP request equivalent to a JSON-RPC request so it can be handled by the HTTP handlers
+func newRPCHTTPRequest(rpcRequest *RPCRequest) (*http.Request, error) {
+	params := rpcRequest.Params
+	if params == nil {
+		params = &RPCParams{}
+	}
+
+	query := url.Values{}
+	for name, value := range params.Query {
+		switch value := value.(type) {
+		case string:
+			query.Add(name, value)
+		case []any:
+			for _, item := range value {
+				if item, ok := item.(string); ok {
+					query.Add(name, item)
+				}
+			}
+		default:
+			valueJSON, _ := json.Marshal(value)
+			query.Add(name, string(valueJSON))
+		}
+	}
+
+	var body []byte
+	isJSONBody := false
+	if len(params.Body) > 0 {
+		var bodyString string
+		if err := json.Unmarshal(params.Body, &bodyString); err == nil {
+			body = []byte(bodyString)
+		} else {
+			body = params.Body
+			isJSONBody = true
+		}
+	}
+
+	httpMethod := params.HTTPMethod
+	if httpMethod == "" {
+		httpMethod = http.MethodGet
+		if body != nil {
+			httpMethod = http.MethodPost
+		}
+	}
+
+	requestURL := &url.URL{Path: "/" + strings.TrimPrefix(rpcRequest.Method, "/"), RawQuery: query.Encode()}
+	request, err := http.NewRequest(httpMethod, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range params.Headers {
+		request.Header.Set(name, value)
+	}
+	if isJSONBody && request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return request, nil
+}
+
+// Collects a handler's response for a JSON-RPC request. Streamed responses are sent as notifications as each line is
+// flushed; everything else is buffered and sent as the request's result.
+type rpcResponseWriter struct {
+	transport  *rpcTransport
+	id         json.RawMessage
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *rpcResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rpcResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *rpcResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *rpcResponseWriter) mediaType() string {
+	mediaType, _, _ := mime.ParseMediaType(w.header.Get("Content-Type"))
+	return mediaType
+}
+
+// Sends each complete line of a streamed response as a notification
+func (w *rpcResponseWriter) Flush() {
+	mediaType := w.mediaType()
+	isEventStream := mediaType == "text/event-stream"
+	if mediaType != "application/x-ndjson" && !isEventStream {
+		return
+	}
+
+	var eventName string
+	for {
+		line, err := w.body.ReadBytes('\n')
+		if err != nil {
+			// Keep the incomplete line for the next flush
+			w.body.Reset()
+			w.body.Write(line)
+			return
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if isEventStream {
+			// Server-sent events are made up of "event:" and "data:" fields; comments and blank lines are skipped
+			if name, isEventField := bytes.CutPrefix(line, []byte("event: ")); isEventField {
+				eventName = string(name)
+				continue
+			}
+			data, isDataField := bytes.CutPrefix(line, []byte("data: "))
+			if !isDataField {
+				continue
+			}
+			line = data
+		} else if len(line) == 0 {
+			continue
+		}
+
+		w.transport.writeMessage(&RPCNotification{
+			Method: RPC_STREAM_METHOD,
+			Params: &RPCStreamParams{ID: w.id, Event: eventName, Data: append(json.RawMessage{}, line...)},
+		})
+		eventName = ""
+	}
+}
+
+// Gets the JSON-RPC response for the handler's response. Successful JSON responses are returned as JSON, and other
+// bodies as strings.
+func (w *rpcResponseWriter) response() *RPCResponse {
+	statusCode := w.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	bodyBytes := w.body.Bytes()
+	isJSON := w.mediaType() == "application/json" && json.Valid(bodyBytes)
+
+	if statusCode >= 400 {
+		rpcError := &RPCError{Code: statusCode, Message: strings.TrimSpace(string(bodyBytes))}
+		if isJSON {
+			rpcError.Data = bodyBytes
+			rpcError.Message = http.StatusText(statusCode)
+		} else if rpcError.Message == "" {
+			rpcError.Message = http.StatusText(statusCode)
+		}
+		return &RPCResponse{ID: w.id, Error: rpcError}
+	}
+
+	var result any
+	switch {
+	case statusCode == http.StatusNotModified:
+		result = map[string]any{"notModified": true, "etag": w.header.Get("ETag")}
+	case isJSON:
+		result = json.RawMessage(bodyBytes)
+	case len(bodyBytes) > 0:
+		result = string(bodyBytes)
+	default:
+		// Streamed responses have already been sent, so there's nothing left to return
+		result = true
+	}
+	return &RPCResponse{ID: w.id, Result: result}
+}
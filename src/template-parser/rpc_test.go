@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Any message the JSON-RPC server sends; responses have an id, while notifications have a method
+type rpcTestMessage struct {
+	ID     json.RawMessage  `json:"id"`
+	Method string           `json:"method"`
+	Params *RPCStreamParams `json:"params"`
+	Result json.RawMessage  `json:"result"`
+	Error  *RPCError        `json:"error"`
+}
+
+// Starts serving JSON-RPC over a pair of pipes. Returns a writer for requests and a channel of the server's messages,
+// which is closed once the server stops writing.
+func startRPCTestServer(t *testing.T) (io.WriteCloser, <-chan *rpcTestMessage) {
+	mux := http.NewServeMux()
+	server := newParserServer(mux, time.Second, 0)
+	registerHandlers(mux, server)
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	go func() {
+		server.ServeRPC(requestReader, responseWriter)
+		server.Wait()
+		responseWriter.Close()
+	}()
+	t.Cleanup(func() {
+		requestWriter.Close()
+		server.Wait()
+	})
+
+	messages := make(chan *rpcTestMessage)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(responseReader)
+		for scanner.Scan() {
+			var message rpcTestMessage
+			if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+				t.Errorf("expected each line to be a JSON-RPC message, got %q: %v", scanner.Text(), err)
+				continue
+			}
+			messages <- &message
+		}
+	}()
+
+	return requestWriter, messages
+}
+
+// Waits for the next message from the server
+func readRPCTestMessage(t *testing.T, messages <-chan *rpcTestMessage) *rpcTestMessage {
+	t.Helper()
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("expected another message, but the server stopped writing")
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+func TestRPCRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.tmph.html"), []byte("<p>a</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	requestWriter, messages := startRPCTestServer(t)
+	var sendRequest = func(request string) {
+		if _, err := io.WriteString(requestWriter, request+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A request's result is the endpoint's JSON response
+	sendRequest(`{"jsonrpc":"2.0","id":1,"method":"parse","params":{"body":"<p a a>hi</p>"}}`)
+	response := readRPCTestMessage(t, messages)
+	if string(response.ID) != "1" || response.Error != nil {
+		t.Fatalf("expected a successful response to request 1, got %+v", response)
+	}
+	var entries []map[string]any
+	if err := json.Unmarshal(response.Result, &entries); err != nil {
+		t.Fatalf("expected the result to be the parsed tree, got %s: %v", response.Result, err)
+	}
+	if len(entries) != 2 || entries[0]["diagnostic"] == nil || entries[1]["tagName"] != "p" {
+		t.Errorf("expected a diagnostic followed by the <p> element, got %s", response.Result)
+	}
+
+	// Streamed responses are sent as notifications for each line, followed by the response once the stream ends
+	sendRequest(`{"jsonrpc":"2.0","id":"events","method":"parse","params":{"query":{"format":"events"},"body":"<p>hi</p>"}}`)
+	var streamedEvents []string
+	for {
+		message := readRPCTestMessage(t, messages)
+		if message.Method == "" {
+			response = message
+			break
+		}
+		if message.Method != RPC_STREAM_METHOD || string(message.Params.ID) != `"events"` {
+			t.Fatalf("expected stream notifications for the events request, got %+v", message)
+		}
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(message.Params.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		streamedEvents = append(streamedEvents, event.Event)
+	}
+	if len(streamedEvents) == 0 || streamedEvents[len(streamedEvents)-1] != PE_END {
+		t.Errorf("expected the streamed events to end with %s, got %v", PE_END, streamedEvents)
+	}
+	if string(response.ID) != `"events"` || response.Error != nil || string(response.Result) != "true" {
+		t.Errorf("expected the events request to finish without a result once it was streamed, got %+v", response)
+	}
+
+	// Watching never ends on its own, so it has to be cancelled
+	sendRequest(`{"jsonrpc":"2.0","id":3,"method":"watch","params":{"query":{"dir":` + strconv.Quote(filepath.ToSlash(dir)) + `,"interval":"10ms"}}}`)
+	message := readRPCTestMessage(t, messages)
+	if message.Method != RPC_STREAM_METHOD || string(message.Params.ID) != "3" || message.Params.Event != WE_READY {
+		t.Fatalf("expected a %s event for the watch request, got %+v", WE_READY, message)
+	}
+	sendRequest(`{"jsonrpc":"2.0","method":"cancel","params":{"id":3}}`)
+	response = readRPCTestMessage(t, messages)
+	if string(response.ID) != "3" || response.Error != nil {
+		t.Errorf("expected the cancelled watch request to finish, got %+v", response)
+	}
+
+	// Closing the requests shuts the server down
+	requestWriter.Close()
+	for message := range messages {
+		t.Errorf("expected no more messages once the requests were closed, got %+v", message)
+	}
+}
+
+// Reads an endless stream of a single byte
+type repeatingByteReader byte
+
+func (r repeatingByteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestRPCRequestTooLarge(t *testing.T) {
+	outputFile := captureCommandOutput(t)
+
+	mux := http.NewServeMux()
+	server := newParserServer(mux, time.Second, 0)
+	registerHandlers(mux, server)
+
+	var responses bytes.Buffer
+	server.ServeRPC(io.LimitReader(repeatingByteReader('a'), MAX_RPC_REQUEST_SIZE+1), &responses)
+	server.Wait()
+
+	var response rpcTestMessage
+	if err := json.Unmarshal(responses.Bytes(), &response); err != nil {
+		t.Fatalf("expected a single response, got %q: %v", responses.String(), err)
+	}
+	if string(response.ID) != "null" || response.Error == nil || response.Error.Code != RPC_INVALID_REQUEST {
+		t.Errorf("expected an invalid request error, got %s", responses.String())
+	}
+
+	output, err := os.ReadFile(outputFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(output, []byte("request is larger than the limit")) {
+		t.Errorf("expected the reason the server stopped to be logged, got %q", output)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// How often the server checks whether its parent process has exited and whether it has been idle for too long
+const SERVER_MONITOR_INTERVAL = time.Second
+
+// Serves the parser's handlers and shuts down gracefully, letting in-flight requests finish before exiting
+type parserServer struct {
+	// Serves every transport's requests, tracking them so the server can tell when it's idle
+	handler    http.Handler
+	httpServer *http.Server
+	// Describes the server to clients; set once the server knows which address it's listening on
+	info ServerInfo
+	// How long to wait for in-flight requests to finish when shutting down before they're cut off
+	shutdownTimeout time.Duration
+	// How long the server can go without any requests before it shuts itself down; 0 disables the idle timeout
+	idleTimeout time.Duration
+	// Whether responses have a Server-Timing trailer breaking down how long parsing took
+	isServerTimingEnabled bool
+
+	activeRequestCount atomic.Int64
+	// When the last request started or finished, in Unix nanoseconds
+	lastActivityTime atomic.Int64
+
+	shutdownOnce sync.Once
+	// Closed once shutdown has started so long-lived streams like /watch can end
+	shuttingDown chan struct{}
+	// Closed once shutdown has finished
+	done chan struct{}
+}
+
+func newParserServer(handler http.Handler, shutdownTimeout time.Duration, idleTimeout time.Duration) *parserServer {
+	server := &parserServer{
+		shutdownTimeout: shutdownTimeout,
+		idleTimeout:     idleTimeout,
+		shuttingDown:    make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	server.lastActivityTime.Store(time.Now().UnixNano())
+
+	server.handler = http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		server.activeRequestCount.Add(1)
+		server.lastActivityTime.Store(time.Now().UnixNano())
+		defer func() {
+			server.lastActivityTime.Store(time.Now().UnixNano())
+			server.activeRequestCount.Add(-1)
+		}()
+
+		handler.ServeHTTP(responseWriter, request)
+	})
+	server.httpServer = &http.Server{Handler: server.handler}
+
+	return server
+}
+
+// Serves HTTP requests from the listener until the server has shut down
+func (s *parserServer) Serve(listener net.Listener) error {
+	if err := s.httpServer.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	// Serve returns as soon as shutdown starts, so wait for in-flight requests to finish
+	s.Wait()
+	return nil
+}
+
+// Starts shutting down the server. New connections are refused, and in-flight requests get up to the shutdown timeout
+// to finish before they're cut off. Safe to call more than once; only the first call has any effect.
+func (s *parserServer) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shuttingDown)
+
+		go func() {
+			defer close(s.done)
+
+			ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+			defer cancel()
+
+			if err := s.httpServer.Shutdown(ctx); err != nil {
+				// Requests are still running after the timeout, so cut them off
+				s.httpServer.Close()
+				return
+			}
+
+			// Requests from other transports aren't tracked by the HTTP server
+			for s.activeRequestCount.Load() > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}()
+	})
+}
+
+// Waits until the server has shut down
+func (s *parserServer) Wait() {
+	<-s.done
+}
+
+// Gets a channel which is closed once the server has started shutting down
+func (s *parserServer) ShuttingDown() <-chan struct{} {
+	return s.shuttingDown
+}
+
+// Wraps a request so its context is cancelled when the server starts shutting down as well as when the client disconnects.
+// This is for long-lived requests which would otherwise hold up shutdown until the timeout.
+func (s *parserServer) WithShutdownContext(request *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(request.Context())
+	go func() {
+		select {
+		case <-s.shuttingDown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return request.WithContext(ctx), cancel
+}
+
+// Shuts the server down when it receives SIGTERM or SIGINT. A second signal kills the process immediately.
+func (s *parserServer) ShutdownOnSignal() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-ctx.Done()
+		// Restore the default signal behavior so a second signal exits right away
+		stop()
+		s.Shutdown()
+	}()
+}
+
+// Shuts the server down once stdin is closed, which happens when the parent process exits, even if it crashes
+func (s *parserServer) ShutdownOnStdinClose() {
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		s.Shutdown()
+	}()
+}
+
+// Shuts the server down if its parent process exits, or if it has been idle for longer than the idle timeout
+func (s *parserServer) MonitorParentAndIdleTime() {
+	parentPID := os.Getppid()
+
+	go func() {
+		ticker := time.NewTicker(SERVER_MONITOR_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.shuttingDown:
+				return
+			case now := <-ticker.C:
+				// Orphaned processes are adopted by another process, so the parent PID changes when the parent exits
+				if os.Getppid() != parentPID {
+					s.Shutdown()
+					return
+				}
+
+				if s.idleTimeout > 0 && s.activeRequestCount.Load() == 0 &&
+					now.Sub(time.Unix(0, s.lastActivityTime.Load())) >= s.idleTimeout {
+					s.Shutdown()
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Serves the parser's handlers along with /block, which doesn't respond until release is closed. Returns the server
+// and the URL it's listening on.
+func startTestServer(t *testing.T, shutdownTimeout time.Duration, idleTimeout time.Duration) (server *parserServer, url string, blockedRequests <-chan struct{}, release chan struct{}) {
+	mux := http.NewServeMux()
+	server = newParserServer(mux, shutdownTimeout, idleTimeout)
+	registerHandlers(mux, server)
+
+	requests := make(chan struct{}, 10)
+	release = make(chan struct{})
+	mux.HandleFunc("/block", func(responseWriter http.ResponseWriter, request *http.Request) {
+		requests <- struct{}{}
+		<-release
+	})
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-serveErr; err != nil {
+			t.Errorf("expected serving to end without an error, got: %v", err)
+		}
+	})
+
+	return server, "http://" + listener.Addr().String(), requests, release
+}
+
+// Waits for a channel to be closed or receive a value, failing the test if it takes longer than the timeout
+func waitForServerTest(t *testing.T, channel <-chan struct{}, timeout time.Duration, description string) {
+	t.Helper()
+	select {
+	case <-channel:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for " + description)
+	}
+}
+
+// Gets a channel which is closed once the server has shut down
+func getServerDone(server *parserServer) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func TestShutdownEndpoint(t *testing.T) {
+	server, url, _, _ := startTestServer(t, time.Second, 0)
+
+	response, err := http.Get(url + "/shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected with status 405, got %d", response.StatusCode)
+	}
+
+	response, err = http.Post(url+"/shutdown", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("expected status 202, got %d", response.StatusCode)
+	}
+
+	waitForServerTest(t, getServerDone(server), 5*time.Second, "the server to shut down")
+	if _, err := http.Get(url + "/version"); err == nil {
+		t.Error("expected requests to be refused once the server has shut down")
+	}
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	server, url, blockedRequests, release := startTestServer(t, 5*time.Second, 0)
+
+	responseStatus := make(chan int, 1)
+	go func() {
+		response, err := http.Get(url + "/block")
+		if err != nil {
+			responseStatus <- 0
+			return
+		}
+		response.Body.Close()
+		responseStatus <- response.StatusCode
+	}()
+	waitForServerTest(t, blockedRequests, 5*time.Second, "the request to start")
+
+	server.Shutdown()
+	done := getServerDone(server)
+	select {
+	case <-done:
+		t.Fatal("expected shutdown to wait for the in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitForServerTest(t, done, 5*time.Second, "the server to shut down once the request finished")
+	if status := <-responseStatus; status != http.StatusOK {
+		t.Errorf("expected the in-flight request to finish normally, got status %d", status)
+	}
+}
+
+func TestShutdownWaitsForRequestsFromOtherTransports(t *testing.T) {
+	server, _, blockedRequests, release := startTestServer(t, 5*time.Second, 0)
+
+	// Requests over JSON-RPC go through the same handler, but aren't tracked by the HTTP server
+	go server.handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/block", nil))
+	waitForServerTest(t, blockedRequests, 5*time.Second, "the request to start")
+
+	server.Shutdown()
+	done := getServerDone(server)
+	select {
+	case <-done:
+		t.Fatal("expected shutdown to wait for the in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitForServerTest(t, done, 5*time.Second, "the server to shut down once the request finished")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, url, blockedRequests, release := startTestServer(t, 50*time.Millisecond, 0)
+	defer close(release)
+
+	go func() {
+		if response, err := http.Get(url + "/block"); err == nil {
+			response.Body.Close()
+		}
+	}()
+	waitForServerTest(t, blockedRequests, 5*time.Second, "the request to start")
+
+	// The request never finishes, so it's cut off once the shutdown timeout passes
+	server.Shutdown()
+	waitForServerTest(t, getServerDone(server), 5*time.Second, "the server to shut down after the timeout")
+}
+
+func TestWithShutdownContext(t *testing.T) {
+	mux := http.NewServeMux()
+	server := newParserServer(mux, time.Second, 0)
+
+	request, cancel := server.WithShutdownContext(httptest.NewRequest(http.MethodGet, "/watch", nil))
+	defer cancel()
+	select {
+	case <-request.Context().Done():
+		t.Fatal("expected the request's context not to be cancelled before shutdown")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	server.Shutdown()
+	waitForServerTest(t, request.Context().Done(), 5*time.Second, "the request's context to be cancelled by shutdown")
+	server.Wait()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server, url, blockedRequests, release := startTestServer(t, time.Second, 10*time.Millisecond)
+	server.MonitorParentAndIdleTime()
+
+	go func() {
+		if response, err := http.Get(url + "/block"); err == nil {
+			response.Body.Close()
+		}
+	}()
+	waitForServerTest(t, blockedRequests, 5*time.Second, "the request to start")
+
+	// The server isn't idle while a request is running, no matter how long it takes
+	select {
+	case <-server.ShuttingDown():
+		t.Fatal("expected the server not to shut down while a request is running")
+	case <-time.After(SERVER_MONITOR_INTERVAL + SERVER_MONITOR_INTERVAL/2):
+	}
+
+	close(release)
+	waitForServerTest(t, server.ShuttingDown(), 3*SERVER_MONITOR_INTERVAL, "the idle server to shut down")
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	server := newParserServer(http.NewServeMux(), time.Second, 0)
+	server.ShutdownOnSignal()
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		t.Skip("sending signals isn't supported on this platform")
+	}
+	waitForServerTest(t, server.ShuttingDown(), 5*time.Second, "the server to shut down on SIGTERM")
+	server.Wait()
+}
+
+func TestShutdownOnStdinClose(t *testing.T) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousStdin := os.Stdin
+	os.Stdin = stdinReader
+	t.Cleanup(func() {
+		os.Stdin = previousStdin
+		stdinReader.Close()
+	})
+
+	server := newParserServer(http.NewServeMux(), time.Second, 0)
+	server.ShutdownOnStdinClose()
+
+	// Input on stdin is ignored
+	if _, err := io.WriteString(stdinWriter, "input\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-server.ShuttingDown():
+		t.Fatal("expected the server not to shut down while stdin is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stdinWriter.Close()
+	waitForServerTest(t, server.ShuttingDown(), 5*time.Second, "the server to shut down once stdin closed")
+	server.Wait()
+}
+
+// Shutting down more than once has no extra effect
+func TestShutdownIsIdempotent(t *testing.T) {
+	server := newParserServer(http.NewServeMux(), time.Second, 0)
+	for i := 0; i < 3; i++ {
+		server.Shutdown()
+	}
+	waitForServerTest(t, getServerDone(server), 5*time.Second, "the server to shut down")
+}
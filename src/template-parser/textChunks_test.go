@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTextChunkTokens(t *testing.T) {
+	for _, testCase := range []struct {
+		name       string
+		source     string
+		columnUnit ColumnUnit
+		expected   []string
+	}{
+		{
+			name:     "text is split once a chunk reaches the chunk size",
+			source:   "<p>abcdefghij</p>",
+			expected: []string{`1:2 OPENINGTAGNAME "p"`, `1:4 TEXTCONTENT "abcd" continued`, `1:8 TEXTCONTENT "efgh" continued`, `1:12 TEXTCONTENT "ij"`, `1:16 CLOSINGTAGNAME "p"`},
+		},
+		{
+			name:     "whitespace runs are never split",
+			source:   "<p>ab cdefg  hijk</p>",
+			expected: []string{`1:2 OPENINGTAGNAME "p"`, `1:4 TEXTCONTENT "ab c" continued`, `1:8 TEXTCONTENT "defg  h" continued`, `1:15 TEXTCONTENT "ijk"`, `1:20 CLOSINGTAGNAME "p"`},
+		},
+		{
+			name:     "multi-byte characters are never split",
+			source:   "<p>ééééé😀😀x</p>",
+			expected: []string{`1:2 OPENINGTAGNAME "p"`, `1:4 TEXTCONTENT "éé" continued`, `1:6 TEXTCONTENT "éé" continued`, `1:8 TEXTCONTENT "é😀" continued`, `1:10 TEXTCONTENT "😀" continued`, `1:11 TEXTCONTENT "x"`, `1:14 CLOSINGTAGNAME "p"`},
+		},
+		{
+			name:       "chunk positions in utf-16 code units",
+			source:     "<p>ééééé😀😀x</p>",
+			columnUnit: CU_UTF16,
+			expected:   []string{`1:2 OPENINGTAGNAME "p"`, `1:4 TEXTCONTENT "éé" continued`, `1:6 TEXTCONTENT "éé" continued`, `1:8 TEXTCONTENT "é😀" continued`, `1:11 TEXTCONTENT "😀" continued`, `1:13 TEXTCONTENT "x"`, `1:16 CLOSINGTAGNAME "p"`},
+		},
+		{
+			name:     "raw text elements",
+			source:   "<script>abcdefgh</script>",
+			expected: []string{`1:2 OPENINGTAGNAME "script"`, `1:9 TEXTCONTENT "abcd" continued`, `1:13 TEXTCONTENT "efgh"`, `1:18 CLOSINGTAGNAME "script"`},
+		},
+		{
+			name:   "character references in RCDATA are never split",
+			source: "<textarea>aaaa&amp;" + strings.Repeat("b", 33) + "</textarea>",
+			expected: []string{
+				`1:2 OPENINGTAGNAME "textarea"`,
+				`1:11 TEXTCONTENT "aaaa&` + strings.Repeat("b", 29) + `" continued`,
+				`1:49 TEXTCONTENT "bbbb"`,
+				`1:54 CLOSINGTAGNAME "textarea"`,
+			},
+		},
+	} {
+		tokens := lexTemplate(testCase.source, LexerOptions{TextChunkSize: 4, ColumnUnit: testCase.columnUnit})
+		if !reflect.DeepEqual(tokens, testCase.expected) {
+			t.Errorf("%s: expected tokens\n%s\ngot\n%s", testCase.name, strings.Join(testCase.expected, "\n"), strings.Join(tokens, "\n"))
+		}
+	}
+}
+
+// Lexes a template and formats its tokens like lexTemplate, except that text chunks are joined back together into
+// a single token. Also checks that each chunk was split where it's allowed to be.
+func lexJoinedTokens(t *testing.T, name string, source string, options LexerOptions) []string {
+	lexer := NewLexer(context.Background(), NewTemplateSource(strings.NewReader(source)), options)
+	tokens := []string{}
+	textPosition := ""
+	textContent := ""
+	for {
+		token := lexer.NextToken()
+		if token.tokenType == LT_EOF || token.tokenType == LT_ERROR {
+			return tokens
+		}
+		if token.tokenType != LT_TEXTCONTENT {
+			tokens = append(tokens, lexer.FormatToken(&token))
+			continue
+		}
+
+		value := lexer.TokenValue(&token)
+		if textPosition == "" {
+			textPosition = strconv.Itoa(token.line) + ":" + strconv.Itoa(token.column)
+		}
+		textContent += value
+		if token.flags&TF_CONTINUED == 0 {
+			if textContent != "" {
+				tokens = append(tokens, textPosition+" TEXTCONTENT "+strconv.Quote(textContent))
+			}
+			textPosition = ""
+			textContent = ""
+			continue
+		}
+
+		if !utf8.ValidString(value) {
+			t.Errorf("%s (chunk size %d): expected each chunk to be valid UTF-8, got %q", name, options.TextChunkSize, value)
+		}
+		if token.end-token.start < options.TextChunkSize {
+			t.Errorf("%s (chunk size %d): expected continued chunks to be at least the chunk size, got %q", name, options.TextChunkSize, value)
+		}
+		if lastChar, _ := utf8.DecodeLastRuneInString(value); !isTextChunkBoundaryChar(lastChar) {
+			t.Errorf("%s (chunk size %d): expected chunk %q to end with a letter, digit or non-ASCII character", name, options.TextChunkSize, value)
+		}
+	}
+}
+
+func TestTextChunksJoinToUnchunkedText(t *testing.T) {
+	for _, testCase := range []struct {
+		name   string
+		source string
+	}{
+		{"text", "<p>" + strings.Repeat("Some text, with   whitespace\nand punctuation! ", 5) + "</p>"},
+		{"multi-byte characters", "<p>" + strings.Repeat("café 😀😀 日本語テキスト ", 5) + "</p>"},
+		{"line endings", "<p>" + strings.Repeat("abc\r\ndef\rghi\n", 5) + "</p>"},
+		{"comments", "<p>" + strings.Repeat("abc<!-- comment -->def", 5) + "</p>"},
+		{"raw text", "<script>" + strings.Repeat("const a = \"<p>\" + b;\n", 5) + "</script>"},
+		{"RCDATA with character references", "<textarea>" + strings.Repeat("a &amp; b &lt;c&gt; &#x1F600;", 5) + "</textarea>"},
+		{"CDATA", "<svg><![CDATA[" + strings.Repeat("a < b && c ", 5) + "]]></svg>"},
+	} {
+		for _, rawTextMode := range []RawTextMode{RTM_LENIENT, RTM_STRICT} {
+			expected := lexJoinedTokens(t, testCase.name, testCase.source, LexerOptions{RawTextMode: rawTextMode})
+			for chunkSize := 1; chunkSize <= 12; chunkSize++ {
+				tokens := lexJoinedTokens(t, testCase.name, testCase.source, LexerOptions{RawTextMode: rawTextMode, TextChunkSize: chunkSize})
+				if !reflect.DeepEqual(tokens, expected) {
+					t.Errorf("%s (mode %d, chunk size %d): expected chunks to join to\n%s\ngot\n%s", testCase.name, rawTextMode, chunkSize, strings.Join(expected, "\n"), strings.Join(tokens, "\n"))
+				}
+			}
+		}
+	}
+}
+
+// Gets the content of every text run in a parse result in document order, joining text nodes which were split into
+// chunks back together
+func getJoinedTextContents(result *ParseResult) []string {
+	textContents := []string{}
+	isContinuing := false
+	var collectTextContents func(nodes []*Node)
+	collectTextContents = func(nodes []*Node) {
+		for _, node := range nodes {
+			if node.TagName == "" {
+				if isContinuing {
+					textContents[len(textContents)-1] += node.TextContent
+				} else {
+					textContents = append(textContents, node.TextContent)
+				}
+				isContinuing = node.Continues
+			}
+			collectTextContents(node.Children)
+		}
+	}
+	collectTextContents(result.RootNodes())
+	return textContents
+}
+
+func TestTextChunkNodes(t *testing.T) {
+	source := "<div>\n  <p>" + strings.Repeat("Some   text ", 20) + "</p>\n  <pre>\n" + strings.Repeat("keep   this ", 20) + "</pre>\n</div>"
+
+	for _, whitespaceMode := range []WhitespaceMode{WM_PRESERVE, WM_DROP, WM_COLLAPSE} {
+		var parse = func(textChunkSize int) *ParseResult {
+			options := ParseOptions{WhitespaceMode: whitespaceMode}
+			options.LexerOptions.TextChunkSize = textChunkSize
+			var responseWriter http.ResponseWriter = httptest.NewRecorder()
+			result, err := parseTemplateResult(context.Background(), strings.NewReader(source), "test.tmph.html", options, &responseWriter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result
+		}
+
+		expected := getJoinedTextContents(parse(0))
+		for _, textChunkSize := range []int{1, 5, 16} {
+			result := parse(textChunkSize)
+			if textContents := getJoinedTextContents(result); !reflect.DeepEqual(textContents, expected) {
+				t.Errorf("whitespace mode %d, chunk size %d: expected text\n%q\ngot\n%q", whitespaceMode, textChunkSize, expected, textContents)
+			}
+			if textNodeCount := len(getTextContents(result)); textNodeCount <= len(expected) {
+				t.Errorf("whitespace mode %d, chunk size %d: expected the text to be split into chunks, got %d text nodes", whitespaceMode, textChunkSize, textNodeCount)
+			}
+		}
+	}
+}
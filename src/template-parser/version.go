@@ -0,0 +1,26 @@
+package main
+
+// The version of the template parser. This should be bumped whenever the parsed output changes for the same input,
+// since it is used to invalidate cached parse results.
+const PARSER_VERSION = "0.2.0"
+
+// The version of the protocol clients use to talk to the parser. This should be bumped whenever a change to the
+// handshake, endpoints or response formats would break existing clients.
+// Starts at 2 since tree responses already differ from what clients which predate the handshake expect: their root
+// entries include diagnostic records.
+const PROTOCOL_VERSION = 2
+
+// Describes a running parser so clients can check that they're compatible with it. This is written to stdout as a single
+// JSON line once the parser is ready for requests, and is also served from /version.
+type ServerInfo struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	ParserVersion   string `json:"parserVersion"`
+	// The transport the parser is serving requests over: "tcp", "unix" or "stdio"
+	Transport string `json:"transport"`
+	// Where to send requests: the URL origin for tcp, or the socket path for unix; empty for stdio
+	Address string `json:"address,omitempty"`
+	// The output formats supported by the parse endpoint
+	Formats []string `json:"formats"`
+	// Optional features which are enabled, ie "memory-cache" or "disk-cache"
+	Features []string `json:"features"`
+}
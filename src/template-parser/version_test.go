@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Runs the serve command with stdin and stdout swapped for pipes. Returns a reader for what it writes to stdout, a
+// writer for its stdin, and a channel which is closed once the command returns.
+func startServeCommand(t *testing.T, args []string) (*bufio.Reader, io.WriteCloser, <-chan struct{}) {
+	previousPolicy, previousCache, previousDiskCache, previousLimits := templatePathPolicy, templateParseCache, templateDiskCache, templateParseLimits
+	previousStdin, previousStdout := os.Stdin, os.Stdout
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin, os.Stdout = stdinReader, stdoutWriter
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(args)
+	}()
+
+	t.Cleanup(func() {
+		stdinWriter.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("timed out waiting for the server to shut down")
+		}
+		os.Stdin, os.Stdout = previousStdin, previousStdout
+		stdinReader.Close()
+		stdoutReader.Close()
+		stdoutWriter.Close()
+		templatePathPolicy, templateParseCache, templateDiskCache, templateParseLimits = previousPolicy, previousCache, previousDiskCache, previousLimits
+	})
+
+	return bufio.NewReader(stdoutReader), stdinWriter, done
+}
+
+// Reads the handshake, which is the first line the server writes to stdout
+func readHandshake(t *testing.T, stdout *bufio.Reader) ServerInfo {
+	handshakeLine, err := stdout.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info ServerInfo
+	if err := json.Unmarshal(handshakeLine, &info); err != nil {
+		t.Fatalf("expected the handshake to be a single line of JSON, got %q: %v", handshakeLine, err)
+	}
+	return info
+}
+
+func TestStdioHandshakeAndVersion(t *testing.T) {
+	stdout, stdin, done := startServeCommand(t, []string{"-transport", "stdio", "-cache-memory-limit", "1000", "-idle-timeout", "1h"})
+
+	info := readHandshake(t, stdout)
+	expectedInfo := ServerInfo{
+		ProtocolVersion: PROTOCOL_VERSION,
+		ParserVersion:   PARSER_VERSION,
+		Transport:       "stdio",
+		Formats:         []string{"tree", "events"},
+		Features:        []string{"parse-batch", "watch", "diff", "shutdown", "metrics", "memory-cache", "idle-timeout"},
+	}
+	if !reflect.DeepEqual(info, expectedInfo) {
+		t.Errorf("expected the handshake\n%+v\ngot\n%+v", expectedInfo, info)
+	}
+	if info.ProtocolVersion != 2 {
+		t.Errorf("expected protocol version 2, got %d", info.ProtocolVersion)
+	}
+
+	// The version method returns the same info as the handshake
+	if _, err := io.WriteString(stdin, `{"jsonrpc":"2.0","id":1,"method":"version"}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	responseLine, err := stdout.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Result ServerInfo `json:"result"`
+		Error  *RPCError  `json:"error"`
+	}
+	if err := json.Unmarshal(responseLine, &response); err != nil || response.Error != nil {
+		t.Fatalf("expected a successful response, got %q: %v", responseLine, err)
+	}
+	if !reflect.DeepEqual(response.Result, info) {
+		t.Errorf("expected the version to match the handshake\n%+v\ngot\n%+v", info, response.Result)
+	}
+
+	// Closing stdin shuts the server down
+	stdin.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server to shut down once stdin closed")
+	}
+}
+
+func TestTCPHandshakeAndVersion(t *testing.T) {
+	stdout, _, done := startServeCommand(t, []string{"-transport", "tcp", "-cache-memory-limit", "0", "-exit-on-stdin-close"})
+
+	info := readHandshake(t, stdout)
+	if info.Transport != "tcp" || info.Address == "" {
+		t.Fatalf("expected the handshake to have the address to send requests to, got %+v", info)
+	}
+	expectedFeatures := []string{"parse-batch", "watch", "diff", "shutdown", "metrics", "exit-on-stdin-close"}
+	if !reflect.DeepEqual(info.Features, expectedFeatures) {
+		t.Errorf("expected features %v, got %v", expectedFeatures, info.Features)
+	}
+
+	response, err := http.Get(info.Address + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versionInfo ServerInfo
+	err = json.NewDecoder(response.Body).Decode(&versionInfo)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("expected /version to be JSON, got %s", contentType)
+	}
+	if !reflect.DeepEqual(versionInfo, info) {
+		t.Errorf("expected /version to match the handshake\n%+v\ngot\n%+v", info, versionInfo)
+	}
+
+	response, err = http.Post(info.Address+"/shutdown", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server to shut down")
+	}
+}
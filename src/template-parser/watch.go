@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const DEFAULT_WATCH_POLL_INTERVAL = 250 * time.Millisecond
+
+// A changed template is only parsed once it has gone this long without changing again, so a burst of saves only
+// produces a single event
+const DEFAULT_WATCH_DEBOUNCE = 100 * time.Millisecond
+
+// A comment is sent on idle watch streams this often so proxies and clients don't time out the connection
+const WATCH_KEEP_ALIVE_INTERVAL = 30 * time.Second
+
+type WatchOptions struct {
+	// How often the watched directory is scanned for changes
+	PollInterval time.Duration
+	Debounce     time.Duration
+	// Whether change events should include an edit script from the template's previous parse result
+	Diff bool
+}
+
+const (
+	WE_READY  = "ready"
+	WE_CHANGE = "change"
+	WE_DELETE = "delete"
+	WE_ERROR  = "error" // watching failed; this is always the last event
+)
+
+// An event sent when watched templates change
+type WatchEvent struct {
+	Event string `json:"-"`
+	// Set for change and delete events
+	*BatchResult
+	// The paths of all watched templates; only set for the ready event
+	Paths []string `json:"paths,omitempty"`
+	// The edits from the template's last successfully parsed result to the new one; only set for change events if diffs
+	// were requested, and omitted if nothing changed
+	Edits []NodeEdit `json:"edits,omitempty"`
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// Polls the templates in a batch for changes based on their modification times and sizes
+type templateWatcher struct {
+	batch *ParseBatch
+	files map[string]watchedFile
+	// When each template with changes which haven't been reported yet was last seen changing
+	pendingChanges map[string]time.Time
+}
+
+func newTemplateWatcher(batch *ParseBatch) (*templateWatcher, error) {
+	watcher := &templateWatcher{
+		batch:          batch,
+		files:          make(map[string]watchedFile),
+		pendingChanges: make(map[string]time.Time),
+	}
+
+	// Take an initial snapshot so only changes from this point on are reported
+	if err := watcher.scan(time.Now()); err != nil {
+		return nil, err
+	}
+	watcher.pendingChanges = make(map[string]time.Time)
+
+	return watcher, nil
+}
+
+// Scans the watched templates and records any which were created, modified or deleted since the last scan
+func (w *templateWatcher) scan(now time.Time) error {
+	templateFilePaths, err := w.batch.ResolvePaths()
+	if err != nil {
+		return err
+	}
+
+	existingFiles := make(map[string]bool, len(templateFilePaths))
+
+	for _, templateFilePath := range templateFilePaths {
+		fileInfo, err := os.Stat(templateFilePath)
+		if err != nil {
+			// The file was deleted after it was found; it will be reported as deleted below
+			continue
+		}
+		existingFiles[templateFilePath] = true
+
+		file := watchedFile{modTime: fileInfo.ModTime(), size: fileInfo.Size()}
+		if previousFile, ok := w.files[templateFilePath]; !ok || !previousFile.modTime.Equal(file.modTime) || previousFile.size != file.size {
+			w.files[templateFilePath] = file
+			w.pendingChanges[templateFilePath] = now
+		}
+	}
+
+	for templateFilePath := range w.files {
+		if !existingFiles[templateFilePath] {
+			delete(w.files, templateFilePath)
+			w.pendingChanges[templateFilePath] = now
+		}
+	}
+
+	return nil
+}
+
+// Gets the templates whose changes have settled for at least the debounce duration, in path order.
+// A template which was deleted and then recreated within the debounce duration is reported as changed.
+func (w *templateWatcher) takeSettledChanges(now time.Time, debounce time.Duration) []string {
+	var settledPaths []string
+	for templateFilePath, lastChangeTime := range w.pendingChanges {
+		if now.Sub(lastChangeTime) >= debounce {
+			settledPaths = append(settledPaths, templateFilePath)
+			delete(w.pendingChanges, templateFilePath)
+		}
+	}
+	sort.Strings(settledPaths)
+	return settledPaths
+}
+
+// Watches the templates in a batch until the context is cancelled, calling onEvent with a ready event once watching
+// has started and then with the freshly parsed template whenever a template changes.
+// Returns an error if the batch's templates can't be found or onEvent returns an error.
+func watchTemplates(ctx context.Context, batch *ParseBatch, options ParseOptions, watchOptions WatchOptions, onEvent func(event *WatchEvent) error) error {
+	watcher, err := newTemplateWatcher(batch)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(watcher.files))
+	for templateFilePath := range watcher.files {
+		paths = append(paths, templateFilePath)
+	}
+	sort.Strings(paths)
+
+	// The last successfully parsed result of each template, which changes are diffed against
+	var previousResults map[string]*ParseResult
+	var parseTemplateForDiff = func(templateFilePath string) *BatchResult {
+		return parseBatchTemplateWith(templateFilePath, func(responseWriter *http.ResponseWriter) error {
+			// Checked again right before parsing so the file which is read is the one that was checked
+			resolvedFilePath, err := templatePathPolicy.CheckFile(templateFilePath)
+			if err != nil {
+				return err
+			}
+			parseResult, err := parseTemplateFileResult(ctx, templateFilePath, resolvedFilePath, options, responseWriter)
+			if err == nil {
+				previousResults[templateFilePath] = parseResult
+			}
+			return err
+		})
+	}
+
+	if watchOptions.Diff {
+		previousResults = make(map[string]*ParseResult, len(paths))
+		for _, templateFilePath := range paths {
+			parseTemplateForDiff(templateFilePath)
+		}
+	}
+
+	if err := onEvent(&WatchEvent{Event: WE_READY, Paths: paths}); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(watchOptions.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := watcher.scan(now); err != nil {
+				return err
+			}
+
+			for _, templateFilePath := range watcher.takeSettledChanges(now, watchOptions.Debounce) {
+				var event *WatchEvent
+				if _, exists := watcher.files[templateFilePath]; !exists {
+					event = &WatchEvent{Event: WE_DELETE, BatchResult: &BatchResult{Path: templateFilePath}}
+					delete(previousResults, templateFilePath)
+				} else if watchOptions.Diff {
+					previousResult := previousResults[templateFilePath]
+					event = &WatchEvent{Event: WE_CHANGE, BatchResult: parseTemplateForDiff(templateFilePath)}
+					if event.Error == "" {
+						// A template without a previous result, ie a new one, is diffed against an empty one, so its edits insert all of its nodes
+						event.Edits = diffParseResults(previousResult, previousResults[templateFilePath])
+					}
+				} else {
+					event = &WatchEvent{Event: WE_CHANGE, BatchResult: parseBatchTemplate(ctx, templateFilePath, options)}
+				}
+
+				if err := onEvent(event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Watches the templates in a batch and streams changes to the response as server-sent events until the client disconnects
+func writeTemplateWatchEvents(request *http.Request, batch *ParseBatch, options ParseOptions, watchOptions WatchOptions, responseWriter *http.ResponseWriter) error {
+	stream := &responseStream{
+		responseWriter:     *responseWriter,
+		responseController: http.NewResponseController(*responseWriter),
+	}
+
+	stream.SetContentType("text/event-stream")
+	(*responseWriter).Header().Set("Cache-Control", "no-cache")
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	events := make(chan *WatchEvent)
+	watchErr := make(chan error, 1)
+
+	go func() {
+		watchErr <- watchTemplates(ctx, batch, options, watchOptions, func(event *WatchEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	keepAliveTicker := time.NewTicker(WATCH_KEEP_ALIVE_INTERVAL)
+	defer keepAliveTicker.Stop()
+
+	for {
+		select {
+		case err := <-watchErr:
+			if request.Context().Err() != nil {
+				// The client disconnected, which is how watching normally ends
+				return nil
+			}
+			if err != nil && stream.hasFlushed {
+				// Send the error as the last event since the response's status has already been sent
+				stream.buf.WriteString("event: " + WE_ERROR + "\ndata: ")
+				if stream.BufferJSON(&ErrorResponse{Error: newErrorResponseDetail(err)}) == nil {
+					stream.buf.WriteString("\n\n")
+					stream.Flush()
+				}
+			}
+			return err
+		case <-keepAliveTicker.C:
+			stream.buf.WriteString(": keep-alive\n\n")
+		case event := <-events:
+			stream.buf.WriteString("event: " + event.Event + "\ndata: ")
+			if err := stream.BufferJSON(event); err != nil {
+				return err
+			}
+			stream.buf.WriteString("\n\n")
+		}
+
+		if err := stream.Flush(); err != nil {
+			return err
+		}
+	}
+}
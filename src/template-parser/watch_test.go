@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeWatchedTemplate(t *testing.T, filePath string, source string) {
+	if err := os.WriteFile(filePath, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Starts watching a directory, returning a channel of the watch events and a function which stops watching and
+// returns the error watching ended with
+func startWatchingTemplates(t *testing.T, dir string, watchOptions WatchOptions) (<-chan *WatchEvent, func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan *WatchEvent)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- watchTemplates(ctx, &ParseBatch{Dir: dir}, ParseOptions{OutputFormat: OF_TREE, Limits: DEFAULT_PARSE_LIMITS}, watchOptions, func(event *WatchEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	var stopWatching = func() error {
+		cancel()
+		select {
+		case err := <-watchErr:
+			// Put the error back so stopping again returns it too
+			watchErr <- err
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for watching to stop")
+			return nil
+		}
+	}
+	t.Cleanup(func() { stopWatching() })
+	return events, stopWatching
+}
+
+// Waits for the next watch event
+func readWatchEvent(t *testing.T, events <-chan *WatchEvent) *WatchEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a watch event")
+		return nil
+	}
+}
+
+func TestWatchTemplates(t *testing.T) {
+	dir := t.TempDir()
+	aPath, bPath, cPath := filepath.Join(dir, "a.tmph.html"), filepath.Join(dir, "b.tmph.html"), filepath.Join(dir, "c.tmph.html")
+	writeWatchedTemplate(t, aPath, "<p>a</p>")
+	writeWatchedTemplate(t, bPath, "<p>b</p>")
+
+	events, stopWatching := startWatchingTemplates(t, dir, WatchOptions{PollInterval: 10 * time.Millisecond})
+
+	event := readWatchEvent(t, events)
+	if event.Event != WE_READY || !reflect.DeepEqual(event.Paths, []string{aPath, bPath}) {
+		t.Fatalf("expected a %s event with every watched template, got %s with %v", WE_READY, event.Event, event.Paths)
+	}
+
+	// The sizes change along with the content so the change is seen even if the modification time doesn't
+	writeWatchedTemplate(t, aPath, "<p>a changed</p>")
+	event = readWatchEvent(t, events)
+	if event.Event != WE_CHANGE || event.Path != aPath || !strings.Contains(string(event.Nodes), `"a changed"`) {
+		t.Fatalf("expected a %s event with the new content of %s, got %s for %s: %s", WE_CHANGE, aPath, event.Event, event.Path, event.Nodes)
+	}
+
+	writeWatchedTemplate(t, cPath, "<p>c</p>")
+	event = readWatchEvent(t, events)
+	if event.Event != WE_CHANGE || event.Path != cPath || !strings.Contains(string(event.Nodes), `"c"`) {
+		t.Fatalf("expected a %s event for the new template %s, got %s for %s: %s", WE_CHANGE, cPath, event.Event, event.Path, event.Nodes)
+	}
+
+	if err := os.Remove(bPath); err != nil {
+		t.Fatal(err)
+	}
+	event = readWatchEvent(t, events)
+	if event.Event != WE_DELETE || event.Path != bPath || event.Nodes != nil {
+		t.Fatalf("expected a %s event without nodes for %s, got %s for %s: %s", WE_DELETE, bPath, event.Event, event.Path, event.Nodes)
+	}
+
+	// Cancelling is how watching normally ends, so it isn't an error
+	if err := stopWatching(); err != nil {
+		t.Errorf("expected watching to stop without an error, got: %v", err)
+	}
+}
+
+func TestWatchTemplatesDiff(t *testing.T) {
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "a.tmph.html")
+	writeWatchedTemplate(t, templatePath, "<ul><li>1</li></ul>")
+
+	events, _ := startWatchingTemplates(t, dir, WatchOptions{PollInterval: 10 * time.Millisecond, Diff: true})
+	if event := readWatchEvent(t, events); event.Event != WE_READY {
+		t.Fatalf("expected a %s event, got %s", WE_READY, event.Event)
+	}
+
+	writeWatchedTemplate(t, templatePath, "<ul><li>1</li><li>2</li></ul>")
+	event := readWatchEvent(t, events)
+	if event.Event != WE_CHANGE || len(event.Edits) != 1 || event.Edits[0].Op != "insert" || event.Edits[0].Node == nil || event.Edits[0].Node.TagName != "li" {
+		t.Fatalf("expected a %s event with an edit inserting the new <li>, got %s with %+v", WE_CHANGE, event.Event, event.Edits)
+	}
+}
+
+func TestTemplateWatcherDebounce(t *testing.T) {
+	dir := t.TempDir()
+	templatePath := filepath.Join(dir, "a.tmph.html")
+	writeWatchedTemplate(t, templatePath, "<p>a</p>")
+
+	watcher, err := newTemplateWatcher(&ParseBatch{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	debounce := 100 * time.Millisecond
+	start := time.Now()
+	var scanAt = func(offset time.Duration) {
+		if err := watcher.scan(start.Add(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing changed since the initial snapshot
+	scanAt(0)
+	if settledPaths := watcher.takeSettledChanges(start.Add(time.Hour), debounce); len(settledPaths) != 0 {
+		t.Fatalf("expected no changes right after watching started, got %v", settledPaths)
+	}
+
+	// Each change restarts the debounce, so a burst of saves is only reported once it has settled
+	writeWatchedTemplate(t, templatePath, "<p>ab</p>")
+	scanAt(0)
+	writeWatchedTemplate(t, templatePath, "<p>abc</p>")
+	scanAt(60 * time.Millisecond)
+	if settledPaths := watcher.takeSettledChanges(start.Add(150*time.Millisecond), debounce); len(settledPaths) != 0 {
+		t.Errorf("expected the change not to be reported before it settled, got %v", settledPaths)
+	}
+	if settledPaths := watcher.takeSettledChanges(start.Add(160*time.Millisecond), debounce); !reflect.DeepEqual(settledPaths, []string{templatePath}) {
+		t.Errorf("expected the change to be reported once it settled, got %v", settledPaths)
+	}
+	if settledPaths := watcher.takeSettledChanges(start.Add(time.Hour), debounce); len(settledPaths) != 0 {
+		t.Errorf("expected the change to only be reported once, got %v", settledPaths)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strings"
+)
+
+type WhitespaceMode int
+
+const (
+	WM_PRESERVE WhitespaceMode = iota // keep all text content exactly as it was written
+	WM_DROP                           // drop whitespace-only text nodes between block elements
+	WM_COLLAPSE                       // drop whitespace-only text nodes between block elements and collapse other whitespace runs into a single space
+)
+
+var blockElementTagNames = map[string]bool{
+	"address":    true,
+	"article":    true,
+	"aside":      true,
+	"base":       true,
+	"blockquote": true,
+	"body":       true,
+	"caption":    true,
+	"col":        true,
+	"colgroup":   true,
+	"dd":         true,
+	"details":    true,
+	"dialog":     true,
+	"dir":        true,
+	"div":        true,
+	"dl":         true,
+	"dt":         true,
+	"fieldset":   true,
+	"figcaption": true,
+	"figure":     true,
+	"footer":     true,
+	"form":       true,
+	"frame":      true,
+	"frameset":   true,
+	"h1":         true,
+	"h2":         true,
+	"h3":         true,
+	"h4":         true,
+	"h5":         true,
+	"h6":         true,
+	"head":       true,
+	"header":     true,
+	"hgroup":     true,
+	"hr":         true,
+	"html":       true,
+	"legend":     true,
+	"li":         true,
+	"link":       true,
+	"main":       true,
+	"menu":       true,
+	"meta":       true,
+	"nav":        true,
+	"noscript":   true,
+	"ol":         true,
+	"optgroup":   true,
+	"option":     true,
+	"p":          true,
+	"pre":        true,
+	"script":     true,
+	"search":     true,
+	"section":    true,
+	"style":      true,
+	"summary":    true,
+	"table":      true,
+	"tbody":      true,
+	"td":         true,
+	"template":   true,
+	"tfoot":      true,
+	"th":         true,
+	"thead":      true,
+	"title":      true,
+	"tr":         true,
+	"ul":         true,
+}
+
+// Whitespace between block elements doesn't affect how a page is rendered
+func isBlockElementTagName(tagName string) bool {
+	isBlockElement, _ := lookupLowerCaseName(blockElementTagNames, tagName)
+	return isBlockElement
+}
+
+var whitespaceSensitiveTagNames = map[string]bool{
+	"pre":      true,
+	"listing":  true,
+	"textarea": true,
+}
+
+// Whether text content inside of this node must be left untouched; this is the case for
+// <pre> and <textarea> elements, raw text elements like <script>, and #md blocks
+func isWhitespaceSensitiveNode(node *Node) bool {
+	if node.Namespace != NS_HTML {
+		return false
+	}
+
+	if isWhitespaceSensitiveTagName, _ := lookupLowerCaseName(whitespaceSensitiveTagNames, node.TagName); isWhitespaceSensitiveTagName ||
+		isRawTextContentElementTagName(node.TagName) ||
+		isEscapableRawTextContentElementTagName(node.TagName) ||
+		isPlaintextElementTagName(node.TagName) {
+		return true
+	}
+
+	for _, attribute := range node.Attributes {
+		if attribute.Name == "#md" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isInsideWhitespaceSensitiveNode(parent *Node) bool {
+	for node := parent; node != nil; node = node.Parent {
+		if isWhitespaceSensitiveNode(node) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWhitespaceOnly(text string) bool {
+	for _, char := range text {
+		if !isWhiteSpace(char) {
+			return false
+		}
+	}
+	return true
+}
+
+// A sibling is a block boundary if it is a block element, or if there is no sibling and the text is at
+// the start or end of a block parent or the root of the template
+func isBlockBoundary(sibling *Node, parent *Node) bool {
+	if sibling == nil {
+		return parent == nil || isBlockElementTagName(parent.TagName)
+	}
+	return sibling.TagName != "" && isBlockElementTagName(sibling.TagName)
+}
+
+// Collapses each run of whitespace characters in the text into a single space, like a browser would when rendering it
+func collapseWhitespace(text string) string {
+	var builder strings.Builder
+	builder.Grow(len(text))
+
+	isInWhitespaceRun := false
+	for _, char := range text {
+		if isWhiteSpace(char) {
+			if !isInWhitespaceRun {
+				builder.WriteRune(' ')
+				isInWhitespaceRun = true
+			}
+		} else {
+			builder.WriteRune(char)
+			isInWhitespaceRun = false
+		}
+	}
+
+	return builder.String()
+}
+
+// Applies the whitespace mode to a text node once its surrounding siblings are known; a nil nextSibling means the text
+// is at the end of its parent. Returns false if the text node should be dropped.
+func applyWhitespaceMode(mode WhitespaceMode, textNode *Node, parent *Node, previousSibling *Node, nextSibling *Node) bool {
+	if mode == WM_PRESERVE || isInsideWhitespaceSensitiveNode(parent) {
+		return true
+	}
+
+	if isWhitespaceOnly(textNode.TextContent) && isBlockBoundary(previousSibling, parent) && isBlockBoundary(nextSibling, parent) {
+		return false
+	}
+
+	if mode == WM_COLLAPSE {
+		textNode.TextContent = collapseWhitespace(textNode.TextContent)
+	}
+
+	return true
+}
+
+// Per the HTML spec, a newline immediately following a <pre> or <textarea> opening tag is ignored. #md blocks are
+// compiled from their markdown source rather than rendered as the element, so their text is left untouched.
+func stripLeadingNewline(textNode *Node, parent *Node) {
+	if parent == nil || parent.Namespace != NS_HTML || len(parent.Children) > 0 || !strings.HasPrefix(textNode.TextContent, "\n") {
+		return
+	}
+
+	for _, attribute := range parent.Attributes {
+		if attribute.Name == "#md" {
+			return
+		}
+	}
+
+	switch strings.ToLower(parent.TagName) {
+	case "pre", "listing", "textarea":
+		textNode.TextContent = textNode.TextContent[1:]
+		textNode.Line++
+		textNode.Col = 1
+	}
+}
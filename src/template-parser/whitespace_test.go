@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Gets the content of every text node in a parse result in document order
+func getTextContents(result *ParseResult) []string {
+	textContents := []string{}
+	var collectTextContents func(nodes []*Node)
+	collectTextContents = func(nodes []*Node) {
+		for _, node := range nodes {
+			if node.TagName == "" {
+				textContents = append(textContents, node.TextContent)
+			}
+			collectTextContents(node.Children)
+		}
+	}
+	collectTextContents(result.RootNodes())
+	return textContents
+}
+
+func TestWhitespaceModes(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		source   string
+		preserve []string
+		drop     []string
+		collapse []string
+	}{
+		{
+			name:     "newline after <pre> is ignored",
+			source:   "<pre>\n  keep</pre>",
+			preserve: []string{"  keep"},
+			drop:     []string{"  keep"},
+			collapse: []string{"  keep"},
+		},
+		{
+			name:     "only the first newline after <textarea> is ignored",
+			source:   "<textarea>\n\nx</textarea>",
+			preserve: []string{"\nx"},
+			drop:     []string{"\nx"},
+			collapse: []string{"\nx"},
+		},
+		{
+			name:     "newline which isn't right after <pre> is kept",
+			source:   "<pre><b>a</b>\nb</pre>",
+			preserve: []string{"a", "\nb"},
+			drop:     []string{"a", "\nb"},
+			collapse: []string{"a", "\nb"},
+		},
+		{
+			name:     "newline after a comment at the start of <pre> is kept",
+			source:   "<pre><!-- c -->\nfoo</pre>",
+			preserve: []string{"\nfoo"},
+			drop:     []string{"\nfoo"},
+			collapse: []string{"\nfoo"},
+		},
+		{
+			name:     "newline after <pre> with attributes is ignored",
+			source:   "<pre class=\"a\">\n<!-- c -->foo</pre>",
+			preserve: []string{"foo"},
+			drop:     []string{"foo"},
+			collapse: []string{"foo"},
+		},
+		{
+			name:     "whitespace between block elements",
+			source:   "<div>a</div>\n  <p>b</p>",
+			preserve: []string{"a", "\n  ", "b"},
+			drop:     []string{"a", "b"},
+			collapse: []string{"a", "b"},
+		},
+		{
+			name:     "whitespace between inline elements",
+			source:   "<span>a</span>\n  <b>b</b>",
+			preserve: []string{"a", "\n  ", "b"},
+			drop:     []string{"a", "\n  ", "b"},
+			collapse: []string{"a", " ", "b"},
+		},
+		{
+			name:     "whitespace between a block boundary and an inline element",
+			source:   "<div>\n  <span>a</span>\n</div>",
+			preserve: []string{"\n  ", "a", "\n"},
+			drop:     []string{"\n  ", "a", "\n"},
+			collapse: []string{" ", "a", " "},
+		},
+		{
+			name:     "whitespace at the start and end of a block parent",
+			source:   "<ul>\n  <li>a</li>\n</ul>",
+			preserve: []string{"\n  ", "a", "\n"},
+			drop:     []string{"a"},
+			collapse: []string{"a"},
+		},
+		{
+			name:     "whitespace at the root of the template",
+			source:   "\n<div>a</div>\n",
+			preserve: []string{"\n", "a", "\n"},
+			drop:     []string{"a"},
+			collapse: []string{"a"},
+		},
+		{
+			name:     "whitespace inside of text",
+			source:   "<p>a   b\n c</p>",
+			preserve: []string{"a   b\n c"},
+			drop:     []string{"a   b\n c"},
+			collapse: []string{"a b c"},
+		},
+		{
+			name:     "<pre> is exempt",
+			source:   "<div>\n<pre>  a\n\n  b  </pre>\n</div>",
+			preserve: []string{"\n", "  a\n\n  b  ", "\n"},
+			drop:     []string{"  a\n\n  b  "},
+			collapse: []string{"  a\n\n  b  "},
+		},
+		{
+			name:     "whitespace-only text inside of <pre> is kept",
+			source:   "<div><pre>\n\n</pre></div>",
+			preserve: []string{"\n"},
+			drop:     []string{"\n"},
+			collapse: []string{"\n"},
+		},
+		{
+			name:     "<textarea> is exempt",
+			source:   "<textarea>a   b</textarea>",
+			preserve: []string{"a   b"},
+			drop:     []string{"a   b"},
+			collapse: []string{"a   b"},
+		},
+		{
+			name:     "raw text elements are exempt",
+			source:   "<script>\n  let a  =  1;\n</script>",
+			preserve: []string{"\n  let a  =  1;\n"},
+			drop:     []string{"\n  let a  =  1;\n"},
+			collapse: []string{"\n  let a  =  1;\n"},
+		},
+		{
+			name:     "#md blocks are exempt",
+			source:   "<div #md>\n  # Title\n\n  Some   text\n</div>",
+			preserve: []string{"\n  # Title\n\n  Some   text\n"},
+			drop:     []string{"\n  # Title\n\n  Some   text\n"},
+			collapse: []string{"\n  # Title\n\n  Some   text\n"},
+		},
+		{
+			name:     "newline after a <pre> #md block is kept",
+			source:   "<pre #md>\n# Title</pre>",
+			preserve: []string{"\n# Title"},
+			drop:     []string{"\n# Title"},
+			collapse: []string{"\n# Title"},
+		},
+		{
+			name:     "elements inside of #md blocks are exempt",
+			source:   "<div #md>\n<p>  a  </p>\n</div>",
+			preserve: []string{"\n", "  a  ", "\n"},
+			drop:     []string{"\n", "  a  ", "\n"},
+			collapse: []string{"\n", "  a  ", "\n"},
+		},
+	} {
+		for mode, expectedTextContents := range map[WhitespaceMode][]string{
+			WM_PRESERVE: testCase.preserve,
+			WM_DROP:     testCase.drop,
+			WM_COLLAPSE: testCase.collapse,
+		} {
+			responseBuffer := &bufferedResponseWriter{}
+			var responseWriter http.ResponseWriter = responseBuffer
+			options := ParseOptions{OutputFormat: OF_TREE, WhitespaceMode: mode, Limits: DEFAULT_PARSE_LIMITS}
+			result, err := parseTemplateResult(context.Background(), strings.NewReader(testCase.source), "whitespace.tmph.html", options, &responseWriter)
+			if err != nil {
+				t.Errorf("%s (mode %d): %v", testCase.name, mode, err)
+				continue
+			}
+
+			if textContents := getTextContents(result); !reflect.DeepEqual(textContents, expectedTextContents) {
+				t.Errorf("%s (mode %d): expected text %q, got %q", testCase.name, mode, expectedTextContents, textContents)
+			}
+		}
+	}
+}